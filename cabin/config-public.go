@@ -319,6 +319,24 @@ func prepPublicHubConfig() error {
 	return nil
 }
 
+// PierTransports returns all configured transports of the Hub, including local
+// transports, which are not announced.
+func PierTransports() []string {
+	return publicCfgOptionTransports()
+}
+
+// announcedTransports returns the given transports without local transports.
+func announcedTransports(definitions []string) []string {
+	announced := make([]string, 0, len(definitions))
+	for _, definition := range definitions {
+		if t, err := hub.ParseTransport(definition); err == nil && t.IsLocal() {
+			continue
+		}
+		announced = append(announced, definition)
+	}
+	return announced
+}
+
 func getPublicHubInfo() *hub.Announcement {
 	// get configuration
 	info := &hub.Announcement{
@@ -328,7 +346,7 @@ func getPublicHubInfo() *hub.Announcement {
 		ContactService: publicCfgOptionContactService(),
 		Hosters:        publicCfgOptionHosters(),
 		Datacenter:     publicCfgOptionDatacenter(),
-		Transports:     publicCfgOptionTransports(),
+		Transports:     announcedTransports(publicCfgOptionTransports()),
 		Entry:          publicCfgOptionEntry(),
 		Exit:           publicCfgOptionExit(),
 		Flags:          []string{},
@@ -112,10 +112,20 @@ func createBootstrapFile(filename string) error {
 	if len(publicIdentity.Hub.Info.Transports) == 0 {
 		return errors.New("public identity has no transports available")
 	}
-	// parse first transport
-	t, err := hub.ParseTransport(publicIdentity.Hub.Info.Transports[0])
-	if err != nil {
-		return fmt.Errorf("failed to parse transport of public identity: %w", err)
+	// parse first transport without option, as the option is used for the Hub ID
+	var t *hub.Transport
+	for _, definition := range publicIdentity.Hub.Info.Transports {
+		parsed, err := hub.ParseTransport(definition)
+		if err != nil {
+			return fmt.Errorf("failed to parse transport of public identity: %w", err)
+		}
+		if parsed.Option == "" {
+			t = parsed
+			break
+		}
+	}
+	if t == nil {
+		return errors.New("public identity has no transport without option available")
 	}
 	// add IP address
 	switch {
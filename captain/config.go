@@ -1,13 +1,16 @@
 package captain
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/safing/portbase/config"
 	"github.com/safing/portmaster/profile"
 	"github.com/safing/portmaster/profile/endpoints"
 	"github.com/safing/spn/conf"
 	"github.com/safing/spn/navigator"
+	"github.com/safing/spn/terminal"
 )
 
 var (
@@ -39,6 +42,36 @@ var (
 	cfgOptionTrustNodeNodes      config.StringArrayOption
 	cfgOptionTrustNodeNodesOrder = 150
 
+	// Multipath ships.
+	cfgOptionMultipathKey     = "spn/multipath"
+	cfgOptionMultipath        config.BoolOption
+	cfgOptionMultipathDefault = false
+	cfgOptionMultipathOrder   = 151
+
+	// Compression of expansion terminals.
+	cfgOptionCompressionKey     = "spn/compression"
+	cfgOptionCompression        config.BoolOption
+	cfgOptionCompressionDefault = false
+	cfgOptionCompressionOrder   = 152
+
+	// Cover traffic on the home hub lane.
+	cfgOptionCoverTrafficKey     = "spn/coverTraffic"
+	cfgOptionCoverTraffic        config.IntOption
+	cfgOptionCoverTrafficDefault = int64(terminal.DefaultCoverTrafficRate / 1024)
+	cfgOptionCoverTrafficOrder   = 153
+
+	// Keepalive of expansion terminals.
+	cfgOptionKeepaliveIntervalKey     = "spn/keepaliveInterval"
+	cfgOptionKeepaliveInterval        config.IntOption
+	cfgOptionKeepaliveIntervalDefault = int64(0)
+	cfgOptionKeepaliveIntervalOrder   = 154
+
+	// Re-keying of cranes and expansion terminals.
+	cfgOptionRekeyIntervalKey     = "spn/rekeyInterval"
+	cfgOptionRekeyInterval        config.IntOption
+	cfgOptionRekeyIntervalDefault = int64(terminal.DefaultRekeyInterval / time.Minute)
+	cfgOptionRekeyIntervalOrder   = 155
+
 	// Special Access Code.
 	cfgOptionSpecialAccessCodeKey     = "spn/specialAccessCode"
 	cfgOptionSpecialAccessCodeDefault = "none"
@@ -51,6 +84,24 @@ var (
 	cfgOptionBindToAdvertisedDefault = false
 	cfgOptionBindToAdvertisedOrder   = 161
 
+	// TLS certificate for piers using TLS.
+	cfgOptionTLSCertFileKey     = "spn/publicHub/tlsCertFile"
+	cfgOptionTLSCertFile        config.StringOption
+	cfgOptionTLSCertFileDefault = ""
+	cfgOptionTLSCertFileOrder   = 162
+
+	// TLS key for piers using TLS.
+	cfgOptionTLSKeyFileKey     = "spn/publicHub/tlsKeyFile"
+	cfgOptionTLSKeyFile        config.StringOption
+	cfgOptionTLSKeyFileDefault = ""
+	cfgOptionTLSKeyFileOrder   = 163
+
+	// Session rate limit policies per granted permission.
+	cfgOptionRateLimitPoliciesKey     = "spn/publicHub/rateLimitPolicies"
+	cfgOptionRateLimitPolicies        config.StringOption
+	cfgOptionRateLimitPoliciesDefault = ""
+	cfgOptionRateLimitPoliciesOrder   = 164
+
 	// Config options for use.
 	cfgOptionRoutingAlgorithm config.StringOption
 )
@@ -153,6 +204,107 @@ This setting mainly exists for when you need to simulate your presence in anothe
 	}
 	cfgOptionTrustNodeNodes = config.Concurrent.GetAsStringArray(CfgOptionTrustNodeNodesKey, []string{})
 
+	err = config.Register(&config.Option{
+		Name:            "Multipath Connections",
+		Key:             cfgOptionMultipathKey,
+		Description:     "Connect to other nodes using multiple transports and IP versions at the same time. Data is spread over all paths and connections survive the loss of a single path. Requires the other node to support multipath connections.",
+		OptType:         config.OptTypeBool,
+		ExpertiseLevel:  config.ExpertiseLevelExpert,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionMultipathDefault,
+		RequiresRestart: true,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionMultipathOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionMultipath = config.Concurrent.GetAsBool(cfgOptionMultipathKey, cfgOptionMultipathDefault)
+
+	err = config.Register(&config.Option{
+		Name:            "Compress Traffic",
+		Key:             cfgOptionCompressionKey,
+		Description:     "Compress the traffic of connections routed through the SPN. This reduces bandwidth usage on metered links for text-heavy traffic, at the cost of some CPU time. Already compressed or encrypted traffic does not benefit. Warning: Compression may leak secrets of unencrypted connections that also carry data controlled by an attacker, such as cookies in plain HTTP (see CRIME and BREACH). Requires the other nodes to support compression.",
+		OptType:         config.OptTypeBool,
+		ExpertiseLevel:  config.ExpertiseLevelExpert,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionCompressionDefault,
+		RequiresRestart: true,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionCompressionOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionCompression = config.Concurrent.GetAsBool(cfgOptionCompressionKey, cfgOptionCompressionDefault)
+
+	err = config.Register(&config.Option{
+		Name:            "Cover Traffic",
+		Key:             cfgOptionCoverTrafficKey,
+		Description:     "Send cover traffic to your Home Node in order to make it harder to correlate your connections by their traffic patterns. Your traffic is filled up with cover traffic to the configured rate in KB/s. Only applies when using the Privacy Focused routing algorithm. Set to 0 to disable.",
+		OptType:         config.OptTypeInt,
+		ExpertiseLevel:  config.ExpertiseLevelExpert,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionCoverTrafficDefault,
+		RequiresRestart: true,
+		ValidationRegex: `^(12[0-8]|1[01][0-9]|[1-9]?[0-9])$`,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionCoverTrafficOrder,
+			config.UnitAnnotation:         "KB/s",
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionCoverTraffic = config.Concurrent.GetAsInt(cfgOptionCoverTrafficKey, cfgOptionCoverTrafficDefault)
+
+	err = config.Register(&config.Option{
+		Name:            "Keepalive Interval",
+		Key:             cfgOptionKeepaliveIntervalKey,
+		Description:     "Probe the connections through the SPN for liveness after the configured amount of seconds without traffic, in order to detect broken connections early, eg. when Nodes are behind NAT. Set to 0 to disable.",
+		OptType:         config.OptTypeInt,
+		ExpertiseLevel:  config.ExpertiseLevelExpert,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionKeepaliveIntervalDefault,
+		RequiresRestart: true,
+		ValidationRegex: `^(0|[5-9]|[1-9][0-9]{1,2}|[1-2][0-9]{3}|3[0-5][0-9]{2}|3600)$`,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionKeepaliveIntervalOrder,
+			config.UnitAnnotation:         "seconds",
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionKeepaliveInterval = config.Concurrent.GetAsInt(cfgOptionKeepaliveIntervalKey, cfgOptionKeepaliveIntervalDefault)
+
+	err = config.Register(&config.Option{
+		Name:            "Re-Key Interval",
+		Key:             cfgOptionRekeyIntervalKey,
+		Description:     "Switch to new encryption keys on connections to and through the SPN after the configured amount of minutes, so that a compromised key only exposes a limited amount of traffic. Keys are also switched after every GiB of traffic. Set to 0 to only switch keys based on traffic.",
+		OptType:         config.OptTypeInt,
+		ExpertiseLevel:  config.ExpertiseLevelExpert,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionRekeyIntervalDefault,
+		RequiresRestart: true,
+		ValidationRegex: `^(0|[1-9][0-9]{0,3})$`,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionRekeyIntervalOrder,
+			config.UnitAnnotation:         "minutes",
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionRekeyInterval = config.Concurrent.GetAsInt(cfgOptionRekeyIntervalKey, cfgOptionRekeyIntervalDefault)
+
 	err = config.Register(&config.Option{
 		Name:         "Special Access Code",
 		Key:          cfgOptionSpecialAccessCodeKey,
@@ -187,6 +339,64 @@ This setting mainly exists for when you need to simulate your presence in anothe
 			return err
 		}
 		cfgOptionBindToAdvertised = config.GetAsBool(cfgOptionBindToAdvertisedKey, cfgOptionBindToAdvertisedDefault)
+
+		err = config.Register(&config.Option{
+			Name:            "TLS Certificate File",
+			Key:             cfgOptionTLSCertFileKey,
+			Description:     "Path to a PEM encoded certificate (chain) for transports using TLS. If not set, a self-signed certificate derived from the Hub identity is used, which clients pin to the Hub ID. A certificate issued for a domain is required for transports that define a domain.",
+			OptType:         config.OptTypeString,
+			ExpertiseLevel:  config.ExpertiseLevelExpert,
+			DefaultValue:    cfgOptionTLSCertFileDefault,
+			RequiresRestart: true,
+			Annotations: config.Annotations{
+				config.DisplayOrderAnnotation: cfgOptionTLSCertFileOrder,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		cfgOptionTLSCertFile = config.GetAsString(cfgOptionTLSCertFileKey, cfgOptionTLSCertFileDefault)
+
+		err = config.Register(&config.Option{
+			Name:            "TLS Key File",
+			Key:             cfgOptionTLSKeyFileKey,
+			Description:     "Path to the PEM encoded private key of the TLS certificate.",
+			OptType:         config.OptTypeString,
+			ExpertiseLevel:  config.ExpertiseLevelExpert,
+			DefaultValue:    cfgOptionTLSKeyFileDefault,
+			RequiresRestart: true,
+			Annotations: config.Annotations{
+				config.DisplayOrderAnnotation: cfgOptionTLSKeyFileOrder,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		cfgOptionTLSKeyFile = config.GetAsString(cfgOptionTLSKeyFileKey, cfgOptionTLSKeyFileDefault)
+
+		err = config.Register(&config.Option{
+			Name:           "Session Rate Limit Policies",
+			Key:            cfgOptionRateLimitPoliciesKey,
+			Description:    `Rate limit policies for terminal sessions as JSON, keyed by the permissions granted to the session. Permissions are "none", "mayExpand", "mayConnect", "isHubOwner", "isHubAdvisor" and "isCraneController" and may be combined with "+". The policy with the most matching permissions is used. Unset values use the defaults. Example: {"mayConnect+mayExpand": {"minOps": 500, "maxOpsPerSecond": 10}}`,
+			OptType:        config.OptTypeString,
+			ExpertiseLevel: config.ExpertiseLevelExpert,
+			DefaultValue:   cfgOptionRateLimitPoliciesDefault,
+			Annotations: config.Annotations{
+				config.DisplayOrderAnnotation: cfgOptionRateLimitPoliciesOrder,
+			},
+			ValidationFunc: func(value interface{}) error {
+				policies, ok := value.(string)
+				if !ok || policies == "" {
+					return nil
+				}
+				_, err := terminal.ParseRateLimitPolicies([]byte(policies))
+				return err
+			},
+		})
+		if err != nil {
+			return err
+		}
+		cfgOptionRateLimitPolicies = config.GetAsString(cfgOptionRateLimitPoliciesKey, cfgOptionRateLimitPoliciesDefault)
 	}
 
 	// Config options for use.
@@ -251,3 +461,19 @@ func GetDNSExitHubPolicy() (endpoints.Endpoints, error) {
 	dnsExitHubPolicy = policy
 	return dnsExitHubPolicy, nil
 }
+
+// applyRateLimitPolicies applies the configured session rate limit policies.
+func applyRateLimitPolicies(_ context.Context, _ interface{}) error {
+	configured := cfgOptionRateLimitPolicies()
+	if configured == "" {
+		terminal.SetRateLimitPolicies(nil)
+		return nil
+	}
+
+	policies, err := terminal.ParseRateLimitPolicies([]byte(configured))
+	if err != nil {
+		return err
+	}
+	terminal.SetRateLimitPolicies(policies)
+	return nil
+}
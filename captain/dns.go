@@ -0,0 +1,34 @@
+package captain
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+
+	"github.com/safing/portmaster/profile/endpoints"
+	"github.com/safing/spn/crew"
+	"github.com/safing/spn/navigator"
+)
+
+// QueryDNS resolves the given DNS query through the SPN, at an exit Hub that
+// matches the DNS exit policy.
+func QueryDNS(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	if !ClientReady() {
+		return nil, crew.ErrSPNNotReady
+	}
+
+	policy, err := GetDNSExitHubPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dns exit policy: %w", err)
+	}
+
+	opts := &navigator.Options{
+		Destination: &navigator.DestinationHubOptions{},
+	}
+	if len(policy) > 0 {
+		opts.Destination.HubPolicies = []endpoints.Endpoints{policy}
+	}
+
+	return crew.QueryDNS(ctx, query, opts)
+}
@@ -14,6 +14,9 @@ import (
 	"github.com/safing/spn/terminal"
 )
 
+// maxMultipathPaths defines how many paths are used for multipath ships.
+const maxMultipathPaths = 3
+
 // EstablishCrane establishes a crane to another Hub.
 func EstablishCrane(callerCtx context.Context, dst *hub.Hub) (*docks.Crane, error) {
 	if conf.PublicHub() && dst.ID == publicIdentity.ID {
@@ -23,7 +26,13 @@ func EstablishCrane(callerCtx context.Context, dst *hub.Hub) (*docks.Crane, erro
 		return nil, fmt.Errorf("route to %s already exists", dst.ID)
 	}
 
-	ship, err := ships.Launch(callerCtx, dst, nil, nil)
+	var ship ships.Ship
+	var err error
+	if cfgOptionMultipath() && dst.HasFlag(hub.FlagBonding) {
+		ship, err = ships.LaunchBonded(callerCtx, dst, maxMultipathPaths)
+	} else {
+		ship, err = ships.Launch(callerCtx, dst, nil, nil)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to launch ship: %w", err)
 	}
@@ -21,6 +21,7 @@ import (
 	"github.com/safing/spn/patrol"
 	"github.com/safing/spn/ships"
 	_ "github.com/safing/spn/sluice"
+	"github.com/safing/spn/terminal"
 )
 
 const controlledFailureExitCode = 24
@@ -97,6 +98,9 @@ func start() error {
 		return fmt.Errorf("failed to get random bytes for masking: %w", err)
 	}
 	ships.EnableMasking(maskingBytes)
+	terminal.EnableCompression(cfgOptionCompression())
+	terminal.SetKeepaliveInterval(time.Duration(cfgOptionKeepaliveInterval()) * time.Second)
+	terminal.SetRekeyPolicy(time.Duration(cfgOptionRekeyInterval())*time.Minute, terminal.DefaultRekeyBytes)
 
 	// Initialize intel.
 	if err := registerIntelUpdateHook(); err != nil {
@@ -128,6 +132,18 @@ func start() error {
 		if err := prepPublicIdentityMgmt(); err != nil {
 			return err
 		}
+		// Apply and watch session rate limit policies.
+		if err := applyRateLimitPolicies(module.Ctx, nil); err != nil {
+			log.Warningf("spn/captain: failed to apply session rate limit policies: %s", err)
+		}
+		if err := module.RegisterEventHook(
+			"config",
+			config.ChangeEvent,
+			"apply session rate limit policies",
+			applyRateLimitPolicies,
+		); err != nil {
+			return err
+		}
 		// Set ID to display on http info page.
 		ships.DisplayHubID = publicIdentity.ID
 		// Start listeners.
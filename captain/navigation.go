@@ -170,7 +170,7 @@ func connectToHomeHub(ctx context.Context, dst *hub.Hub) error {
 	}
 
 	// Create communication terminal.
-	homeTerminal, initData, tErr := docks.NewLocalCraneTerminal(crane, nil, terminal.DefaultHomeHubTerminalOpts())
+	homeTerminal, initData, tErr := docks.NewLocalCraneTerminal(crane, nil, getHomeHubTerminalOpts())
 	if tErr != nil {
 		return tErr.Wrap("failed to create home terminal")
 	}
@@ -210,6 +210,16 @@ func connectToHomeHub(ctx context.Context, dst *hub.Hub) error {
 	return nil
 }
 
+// getHomeHubTerminalOpts returns the terminal options for the home hub
+// terminal. Cover traffic is added for the privacy focused routing profile.
+func getHomeHubTerminalOpts() *terminal.TerminalOpts {
+	opts := terminal.DefaultHomeHubTerminalOpts()
+	if cfgOptionRoutingAlgorithm() == navigator.RoutingProfileTripleHopID {
+		opts.CoverTrafficRate = uint32(cfgOptionCoverTraffic()) * 1024
+	}
+	return opts
+}
+
 func optimizeNetwork(ctx context.Context, task *modules.Task) error {
 	if publicIdentity == nil {
 		return nil
@@ -2,6 +2,7 @@ package captain
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 
@@ -9,23 +10,35 @@ import (
 	"github.com/safing/portmaster/intel"
 	"github.com/safing/portmaster/network/netutils"
 	"github.com/safing/portmaster/profile/endpoints"
+	"github.com/safing/spn/cabin"
 	"github.com/safing/spn/docks"
 	"github.com/safing/spn/hub"
 	"github.com/safing/spn/ships"
 )
 
+// maxPendingDockings defines how many ships may be checked for being part of
+// a bonded ship at the same time. Further ships are sunk until slots are free.
+const maxPendingDockings = 100
+
 var (
 	dockingRequests = make(chan ships.Ship, 100)
+	pendingDockings = make(chan struct{}, maxPendingDockings)
 	piers           []ships.Pier
 )
 
 func startPiers() error {
 	// Get and check transports.
-	transports := publicIdentity.Hub.Info.Transports
+	// Use the configured transports, as local transports are not announced.
+	transports := cabin.PierTransports()
 	if len(transports) == 0 {
 		return errors.New("no transports defined")
 	}
 
+	// Set certificate for piers using TLS.
+	if err := setPierCertificate(); err != nil {
+		return err
+	}
+
 	piers = make([]ships.Pier, 0, len(transports))
 	for _, t := range transports {
 		// Parse transport.
@@ -50,6 +63,29 @@ func startPiers() error {
 	return nil
 }
 
+func setPierCertificate() error {
+	// Use configured certificate, if set.
+	certFile := cfgOptionTLSCertFile()
+	keyFile := cfgOptionTLSKeyFile()
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		ships.SetPierCertificate(&cert)
+		log.Infof("spn/captain: using configured tls certificate %s", certFile)
+		return nil
+	}
+
+	// Otherwise, derive certificate from identity.
+	cert, err := ships.CertificateFromSignet(publicIdentity.Signet)
+	if err != nil {
+		return fmt.Errorf("failed to create tls certificate from identity: %w", err)
+	}
+	ships.SetPierCertificate(cert)
+	return nil
+}
+
 func stopPiers() {
 	for _, pier := range piers {
 		pier.Abolish()
@@ -84,14 +120,34 @@ func dockingRequestHandler(ctx context.Context) error {
 
 			if err := checkDockingPermission(ctx, ship); err != nil {
 				log.Warningf("spn/captain: denied ship from %s to dock at pier %s: %s", ship.RemoteAddr(), ship.Transport().String(), err)
-			} else {
-				handleDockingRequest(ship)
+				continue
 			}
+
+			// Get a slot for the docking procedure.
+			select {
+			case pendingDockings <- struct{}{}:
+			default:
+				log.Warningf("spn/captain: denied ship from %s to dock at pier %s: too many pending dockings", ship.RemoteAddr(), ship.Transport().String())
+				ship.Sink()
+				continue
+			}
+
+			dockingShip := ship
+			module.StartWorker("handle docking request", func(_ context.Context) error {
+				handleDockingRequest(dockingShip)
+				return nil
+			})
 		}
 	}
 }
 
 func checkDockingPermission(ctx context.Context, ship ships.Ship) error {
+	// Local transports are only reachable from the same host and have no
+	// remote IP to check the entry policy against.
+	if ship.Transport().IsLocal() {
+		return nil
+	}
+
 	remoteIP, remotePort, err := netutils.IPPortFromAddr(ship.RemoteAddr())
 	if err != nil {
 		return fmt.Errorf("failed to parse remote IP: %w", err)
@@ -115,6 +171,19 @@ func checkDockingPermission(ctx context.Context, ship ships.Ship) error {
 }
 
 func handleDockingRequest(ship ships.Ship) {
+	// Check if the ship is part of a bonded ship.
+	// Release the docking slot afterwards.
+	ship, err := ships.DockBonded(ship, publicIdentity)
+	<-pendingDockings
+	switch {
+	case err != nil:
+		log.Warningf("spn/captain: failed to dock ship: %s", err)
+		return
+	case ship == nil:
+		// Ship was added to an existing bonded ship.
+		return
+	}
+
 	log.Infof("spn/captain: pemitting %s to dock", ship)
 
 	crane, err := docks.NewCrane(ship, nil, publicIdentity)
@@ -191,7 +191,7 @@ func maintainPublicStatus(ctx context.Context, task *modules.Task) error {
 	}
 
 	// Set flags.
-	var flags []string
+	flags := []string{hub.FlagResumable, hub.FlagTerminalV2, hub.FlagExitResolve, hub.FlagExitDNS, hub.FlagBonding}
 	if !patrol.HTTPSConnectivityConfirmed() {
 		flags = append(flags, hub.FlagNetError)
 	}
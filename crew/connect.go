@@ -50,6 +50,13 @@ type Tunnel struct {
 	route       *navigator.Route
 	failedTries int
 	stickied    bool
+
+	// pooled is the pooled terminal the tunnel is counted on.
+	pooled *pooledTerminal
+
+	// proxied signifies that the tunnel was requested by a proxy and that its
+	// connection info is not managed by the Portmaster.
+	proxied bool
 }
 
 func (t *Tunnel) connectWorker(ctx context.Context) (err error) {
@@ -92,6 +99,7 @@ func (t *Tunnel) connectWorker(ctx context.Context) (err error) {
 	// Connect via established tunnel.
 	_, tErr := NewConnectOp(t)
 	if tErr != nil {
+		t.releasePooled()
 		tErr = tErr.Wrap("failed to initialize tunnel")
 		reportConnectError(tErr)
 
@@ -144,7 +152,17 @@ func (t *Tunnel) establish(ctx context.Context) (err error) {
 	default:
 		log.Tracer(ctx).Tracef("spn/crew: using stickied %s", sticksTo.Pin.Hub)
 
-		// Check if the stickied Hub has an active terminal.
+		// Check if the stickied Hub has a pooled or active terminal.
+		// The stickied Hub was already checked against the destination options
+		// of the tunnel, including the required flags, by getStickiedHub.
+		if pooled := pool.acquire(sticksTo.Pin); pooled != nil {
+			t.dstPin = sticksTo.Pin
+			t.dstTerminal = pooled.terminal
+			t.route = sticksTo.Route
+			t.stickied = true
+			t.pooled = pooled
+			return nil
+		}
 		dstTerminal := sticksTo.Pin.GetActiveTerminal()
 		if dstTerminal != nil {
 			t.dstPin = sticksTo.Pin
@@ -184,6 +202,22 @@ func (t *Tunnel) establish(ctx context.Context) (err error) {
 		return fmt.Errorf("no routes to %s", t.connInfo.Entity.IP)
 	}
 
+	// Use a pooled terminal to any of the possible exit Hubs, if available.
+	for _, route := range routes.All {
+		if len(route.Path) < 2 {
+			continue
+		}
+		dstPin := route.Path[len(route.Path)-1].Pin()
+		if pooled := pool.acquire(dstPin); pooled != nil {
+			log.Tracer(ctx).Tracef("spn/crew: using pooled terminal to %s", dstPin.Hub)
+			t.dstPin = dstPin
+			t.dstTerminal = pooled.terminal
+			t.route = route
+			t.pooled = pooled
+			return nil
+		}
+	}
+
 	// Try routes until one succeeds.
 	log.Tracer(ctx).Trace("spn/crew: establishing route...")
 	var dstPin *navigator.Pin
@@ -200,6 +234,11 @@ func (t *Tunnel) establish(ctx context.Context) (err error) {
 		t.route = route
 		t.failedTries = tries
 
+		// Add terminal to the pool for use by other tunnels.
+		if len(route.Path) >= 2 {
+			t.pooled = pool.add(dstPin, route, dstTerminal)
+		}
+
 		// Push changes to Pins and return.
 		navigator.Main.PushPinChanges()
 		return nil
@@ -257,6 +296,13 @@ func establishRoute(route *navigator.Route) (dstPin *navigator.Pin, dstTerminal
 	for i, hop := range route.Path[1:] {
 		// Check if we already have a connection to the Hub.
 		activeTerminal := hop.Pin().GetActiveTerminal()
+
+		// Expand another terminal to the exit Hub, if the active one is full.
+		if activeTerminal != nil && i == len(route.Path)-2 &&
+			pool.isFull(hop.Pin(), activeTerminal) {
+			activeTerminal = nil
+		}
+
 		if activeTerminal != nil {
 			// Ping terminal if not recently checked.
 			if activeTerminal.NeedsReachableCheck(1 * time.Minute) {
@@ -0,0 +1,288 @@
+package crew
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+
+	"github.com/safing/portbase/config"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+	"github.com/safing/spn/hub"
+	"github.com/safing/spn/navigator"
+)
+
+const (
+	// dnsCacheMaxTTL defines the maximum duration responses are cached.
+	dnsCacheMaxTTL = time.Hour
+
+	// dnsCacheMaxEntries defines how many responses a cache holds.
+	dnsCacheMaxEntries = 10000
+)
+
+var (
+	// exitDNSCache caches responses on the exit Hub.
+	// It is shared by all clients, so it must not reveal when a response was
+	// cached, as this would tell clients when others queried a domain.
+	exitDNSCache = newDNSCache(false)
+
+	// clientDNSCache caches responses on the client.
+	clientDNSCache = newDNSCache(true)
+)
+
+// dnsCache caches DNS responses until their TTL expires.
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[string]*dnsCacheEntry
+
+	// reduceTTLs defines whether the TTLs of cached responses are reduced by
+	// the time they have been cached. Otherwise the original TTLs are returned.
+	reduceTTLs bool
+}
+
+type dnsCacheEntry struct {
+	response *dns.Msg
+	cached   time.Time
+	expires  time.Time
+}
+
+func newDNSCache(reduceTTLs bool) *dnsCache {
+	return &dnsCache{
+		entries:    make(map[string]*dnsCacheEntry),
+		reduceTTLs: reduceTTLs,
+	}
+}
+
+// dnsCacheKey returns the cache key of the given query.
+func dnsCacheKey(query *dns.Msg) string {
+	if len(query.Question) != 1 {
+		return ""
+	}
+	q := query.Question[0]
+
+	// Responses differ if DNSSEC records are requested.
+	var dnssec bool
+	if opt := query.IsEdns0(); opt != nil {
+		dnssec = opt.Do()
+	}
+
+	return fmt.Sprintf("%s/%d/%d/%t/%t", strings.ToLower(q.Name), q.Qtype, q.Qclass, query.CheckingDisabled, dnssec)
+}
+
+// get returns a copy of the cached response to the given query, or nil if
+// there is none. If the cache reduces TTLs, the response holds the remaining
+// TTLs.
+func (c *dnsCache) get(query *dns.Msg) *dns.Msg {
+	key := dnsCacheKey(query)
+	if key == "" {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	// Copy response and reduce TTLs by the time it was cached.
+	response := entry.response.Copy()
+	response.Id = query.Id
+	if !c.reduceTTLs {
+		return response
+	}
+	elapsed := uint32(now.Sub(entry.cached) / time.Second)
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+
+	return response
+}
+
+// put caches the given response to the given query, if it is cacheable.
+func (c *dnsCache) put(query, response *dns.Msg) {
+	key := dnsCacheKey(query)
+	if key == "" || response.Truncated {
+		return
+	}
+
+	// Only cache successful and non-existing domain responses.
+	// Use the lowest TTL of the response, which for non-existing domains is
+	// that of the SOA record.
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return
+	}
+	ttl := dnsCacheMaxTTL
+	var hasTTL bool
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			hasTTL = true
+			if rrTTL := time.Duration(rr.Header().Ttl) * time.Second; rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+	}
+	if !hasTTL || ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Make space, if needed.
+	now := time.Now()
+	if len(c.entries) >= dnsCacheMaxEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Remove arbitrary entries if all are still valid.
+		for k := range c.entries {
+			if len(c.entries) < dnsCacheMaxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = &dnsCacheEntry{
+		response: response.Copy(),
+		cached:   now,
+		expires:  now.Add(ttl),
+	}
+}
+
+var (
+	dnsClientOp     *DNSOp
+	dnsClientTunnel *Tunnel
+	dnsClientOpLock sync.Mutex
+)
+
+// QueryDNS resolves the given DNS query through the SPN, at an exit Hub that
+// matches the given options. If no routing profile is set in the options, the
+// globally configured routing algorithm is used.
+// All queries share a single DNS operation, which is recreated when its exit
+// Hub does not match the options anymore.
+func QueryDNS(ctx context.Context, query *dns.Msg, opts *navigator.Options) (*dns.Msg, error) {
+	if len(query.Question) != 1 {
+		return nil, errors.New("query must have exactly one question")
+	}
+
+	// Check cache.
+	if cached := clientDNSCache.get(query); cached != nil {
+		return cached, nil
+	}
+
+	// Get DNS operation and query.
+	op, err := getDNSOp(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+	response, tErr := op.Query(ctx, query)
+	if tErr != nil {
+		return nil, tErr
+	}
+
+	clientDNSCache.put(query, response)
+	return response, nil
+}
+
+// getDNSOp returns the active DNS operation or starts a new one.
+func getDNSOp(ctx context.Context, opts *navigator.Options) (*DNSOp, error) {
+	dnsClientOpLock.Lock()
+	defer dnsClientOpLock.Unlock()
+
+	// Prepare options.
+	if opts == nil {
+		opts = &navigator.Options{}
+	} else {
+		opts = opts.Copy()
+	}
+	if opts.Destination == nil {
+		opts.Destination = &navigator.DestinationHubOptions{}
+	}
+	if opts.RoutingProfile == "" {
+		opts.RoutingProfile = config.GetAsString(profile.CfgOptionRoutingAlgorithmKey, navigator.DefaultRoutingProfileID)()
+	}
+	// Only use exit Hubs that support the DNS operation.
+	opts.Destination.RequireFlags = append(slices.Clip(opts.Destination.RequireFlags), hub.FlagExitDNS)
+
+	// Reuse the active operation, if its exit Hub still matches.
+	if dnsClientOp != nil && !dnsClientOp.Stopped() {
+		matcher := opts.Destination.Matcher(navigator.Main.GetIntel())
+		dnsClientTunnel.dstPin.Lock()
+		matches := matcher(dnsClientTunnel.dstPin)
+		dnsClientTunnel.dstPin.Unlock()
+		if matches {
+			return dnsClientOp, nil
+		}
+		dnsClientOp.Stop(dnsClientOp, nil)
+	}
+	if dnsClientTunnel != nil {
+		dnsClientTunnel.releasePooled()
+	}
+	dnsClientOp = nil
+	dnsClientTunnel = nil
+
+	// Check the status of the Home Hub.
+	home, homeTerminal := navigator.Main.GetHome()
+	if home == nil || homeTerminal == nil || homeTerminal.IsBeingAbandoned() {
+		return nil, ErrSPNNotReady
+	}
+
+	// Establish route to an exit Hub near the Home Hub.
+	t := &Tunnel{
+		connInfo: &network.Connection{
+			Entity: (&intel.Entity{
+				Protocol: uint8(packet.UDP),
+				Port:     53,
+			}).Init(0),
+			TunnelOpts: opts,
+		},
+	}
+	if err := t.establish(ctx); err != nil {
+		return nil, fmt.Errorf("failed to establish route: %w", err)
+	}
+
+	// Start DNS operation.
+	op, tErr := NewDNSOp(t.dstTerminal)
+	if tErr != nil {
+		t.releasePooled()
+		return nil, tErr.Wrap("failed to start dns operation")
+	}
+	dnsClientOp = op
+	dnsClientTunnel = t
+
+	log.Infof("spn/crew: started dns operation via %s", t.dstPin.Hub)
+	return op, nil
+}
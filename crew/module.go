@@ -16,12 +16,15 @@ func init() {
 func start() error {
 	module.NewTask("sticky cleaner", cleanStickyHubs).
 		Repeat(10 * time.Minute)
+	module.NewTask("connection pool cleaner", cleanConnectionPool).
+		Repeat(1 * time.Minute)
 
 	return registerMetrics()
 }
 
 func stop() error {
 	clearStickyHubs()
+	pool.clear()
 	terminal.StopScheduler()
 
 	return nil
@@ -63,14 +63,23 @@ func (op *ConnectOp) Ctx() context.Context {
 }
 
 // ConnectRequest holds all the information necessary for a connect operation.
+// If no IP is set, the exit Hub resolves the Domain.
 type ConnectRequest struct {
-	Domain              string            `json:"d,omitempty"`
-	IP                  net.IP            `json:"ip,omitempty"`
-	UsePriorityDataMsgs bool              `json:"pr,omitempty"`
-	AlwaysHighPriority  bool              `json:"hp,omitempty"`
-	Protocol            packet.IPProtocol `json:"p,omitempty"`
-	Port                uint16            `json:"po,omitempty"`
-	QueueSize           uint32            `json:"qs,omitempty"`
+	Domain              string               `json:"d,omitempty"`
+	IP                  net.IP               `json:"ip,omitempty"`
+	UsePriorityDataMsgs bool                 `json:"pr,omitempty"`
+	AlwaysHighPriority  bool                 `json:"hp,omitempty"`
+	Protocol            packet.IPProtocol    `json:"p,omitempty"`
+	Port                uint16               `json:"po,omitempty"`
+	QueueSize           uint32               `json:"qs,omitempty"`
+	WeightClass         terminal.WeightClass `json:"wc,omitempty"`
+
+	// Compress requests compressing the data of the connection, if the
+	// terminal compresses data. Compressed sizes may leak secrets of
+	// connections that mix them with data controlled by an attacker, as
+	// exploited by CRIME and BREACH, so this is only set when the user
+	// explicitly enabled compression.
+	Compress bool `json:"z,omitempty"`
 }
 
 // DialNetwork returns the address of the connect request.
@@ -100,6 +109,9 @@ func (r *ConnectRequest) Address() string {
 }
 
 func (r *ConnectRequest) String() string {
+	if len(r.IP) == 0 {
+		return fmt.Sprintf("%s (%s port %d)", r.Domain, r.Protocol, r.Port)
+	}
 	if r.Domain != "" {
 		return fmt.Sprintf("%s (%s %s)", r.Domain, r.Protocol, r.Address())
 	}
@@ -127,7 +139,9 @@ func NewConnectOp(tunnel *Tunnel) (*ConnectOp, *terminal.Error) {
 		Port:                tunnel.connInfo.Entity.Port,
 		UsePriorityDataMsgs: terminal.UsePriorityDataMsgs,
 		AlwaysHighPriority:  tunnel.connInfo.Process().IsSystemResolver(),
+		Compress:            terminal.CompressionEnabled(),
 	}
+	request.WeightClass = connectWeightClass(request)
 
 	// Set defaults.
 	if request.QueueSize == 0 {
@@ -144,6 +158,8 @@ func NewConnectOp(tunnel *Tunnel) (*ConnectOp, *terminal.Error) {
 		tunnel:      tunnel,
 	}
 	op.ctx, op.cancelCtx = context.WithCancel(module.Ctx)
+	op.SetWeightClass(request.WeightClass)
+	op.SetCompression(request.Compress)
 	op.dfq = terminal.NewDuplexFlowQueue(op.Ctx(), request.QueueSize, op.submitUpstream)
 
 	// Prepare init msg.
@@ -154,7 +170,7 @@ func NewConnectOp(tunnel *Tunnel) (*ConnectOp, *terminal.Error) {
 
 	// Initialize.
 	tErr := op.t.StartOperation(op, container.New(data), 5*time.Second)
-	if err != nil {
+	if tErr != nil {
 		return nil, tErr
 	}
 
@@ -169,6 +185,21 @@ func NewConnectOp(tunnel *Tunnel) (*ConnectOp, *terminal.Error) {
 	return op, nil
 }
 
+// connectWeightClass returns the weight class for the given connect request.
+// DNS and remote shells are interactive, everything else is bulk.
+func connectWeightClass(request *ConnectRequest) terminal.WeightClass {
+	switch {
+	case request.AlwaysHighPriority:
+		return terminal.WeightClassInteractive
+	case request.Protocol == packet.UDP && request.Port == 53:
+		return terminal.WeightClassInteractive
+	case request.Protocol == packet.TCP && (request.Port == 22 || request.Port == 53 || request.Port == 853):
+		return terminal.WeightClassInteractive
+	default:
+		return terminal.WeightClassBulk
+	}
+}
+
 func startConnectOp(t terminal.Terminal, opID uint32, data *container.Container) (terminal.Operation, *terminal.Error) {
 	// Check if we are running a public hub.
 	if !conf.PublicHub() {
@@ -182,15 +213,9 @@ func startConnectOp(t terminal.Terminal, opID uint32, data *container.Container)
 		connectOpCntError.Inc() // More like a protocol/system error than a bad request.
 		return nil, terminal.ErrMalformedData.With("failed to parse connect request: %w", err)
 	}
-	if request.QueueSize == 0 || request.QueueSize > terminal.MaxQueueSize {
+	if tErr := checkConnectRequest(request); tErr != nil {
 		connectOpCntError.Inc() // More like a protocol/system error than a bad request.
-		return nil, terminal.ErrInvalidOptions.With("invalid queue size of %d", request.QueueSize)
-	}
-
-	// Check if IP seems valid.
-	if len(request.IP) != net.IPv4len && len(request.IP) != net.IPv6len {
-		connectOpCntError.Inc() // More like a protocol/system error than a bad request.
-		return nil, terminal.ErrInvalidOptions.With("ip address is not valid")
+		return nil, tErr
 	}
 
 	// Create and initialize operation.
@@ -201,6 +226,8 @@ func startConnectOp(t terminal.Terminal, opID uint32, data *container.Container)
 	}
 	op.InitOperationBase(t, opID)
 	op.ctx, op.cancelCtx = context.WithCancel(t.Ctx())
+	op.SetWeightClass(request.WeightClass)
+	op.SetCompression(request.Compress)
 	op.dfq = terminal.NewDuplexFlowQueue(op.Ctx(), request.QueueSize, op.submitUpstream)
 
 	// Start worker to complete setting up the connection.
@@ -209,6 +236,23 @@ func startConnectOp(t terminal.Terminal, opID uint32, data *container.Container)
 	return op, nil
 }
 
+// checkConnectRequest checks if the connect request seems valid.
+func checkConnectRequest(request *ConnectRequest) *terminal.Error {
+	if request.QueueSize == 0 || request.QueueSize > terminal.MaxQueueSize {
+		return terminal.ErrInvalidOptions.With("invalid queue size of %d", request.QueueSize)
+	}
+
+	// Check if IP seems valid.
+	switch {
+	case len(request.IP) == 0 && request.Domain != "":
+		// The domain is resolved by the exit Hub.
+	case len(request.IP) != net.IPv4len && len(request.IP) != net.IPv6len:
+		return terminal.ErrInvalidOptions.With("ip address is not valid")
+	}
+
+	return nil
+}
+
 func (op *ConnectOp) handleSetup(_ context.Context) error {
 	// Get terminal session for rate limiting.
 	var session *terminal.Session
@@ -251,6 +295,21 @@ func (op *ConnectOp) setup(session *terminal.Session) {
 		return
 	}
 
+	// Resolve the domain, if requested.
+	if len(op.request.IP) == 0 {
+		if tErr := op.resolveDestination(); tErr != nil {
+			if tErr.Is(terminal.ErrPermissionDenied) {
+				session.ReportSuspiciousActivity(terminal.SusFactorQuiteUnusual)
+				connectOpCntBadRequest.Inc()
+			} else {
+				session.ReportSuspiciousActivity(terminal.SusFactorWeirdButOK)
+				connectOpCntFailed.Inc()
+			}
+			op.Stop(op, tErr)
+			return
+		}
+	}
+
 	// Check if connection target is in global scope.
 	ipScope := netutils.GetIPScope(op.request.IP)
 	if ipScope != netutils.Global {
@@ -319,6 +378,46 @@ func (op *ConnectOp) setup(session *terminal.Session) {
 	log.Infof("spn/crew: connected op %s#%d to %s", op.t.FmtID(), op.ID(), op.request)
 }
 
+// resolveDestination resolves the domain of the request and uses the first
+// resolved IP that is in global scope and permitted by the exit policy.
+func (op *ConnectOp) resolveDestination() *terminal.Error {
+	// Only resolve for the IP versions this Hub can connect to.
+	lookupNet := "ip"
+	switch {
+	case conf.HubHasIPv4() && !conf.HubHasIPv6():
+		lookupNet = "ip4"
+	case conf.HubHasIPv6() && !conf.HubHasIPv4():
+		lookupNet = "ip6"
+	}
+
+	ctx, cancel := context.WithTimeout(op.Ctx(), 5*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, lookupNet, op.request.Domain)
+	if err != nil {
+		return terminal.ErrConnectionError.With("failed to resolve %s: %w", op.request.Domain, err)
+	}
+
+	// Use the first permitted IP.
+	var policyErr *terminal.Error
+	for _, ip := range ips {
+		if netutils.GetIPScope(ip) != netutils.Global {
+			continue
+		}
+		op.request.IP = ip
+		if tErr := checkExitPolicy(op.request); tErr != nil {
+			policyErr = tErr
+			continue
+		}
+		return nil
+	}
+
+	op.request.IP = nil
+	if policyErr != nil {
+		return policyErr
+	}
+	return terminal.ErrPermissionDenied.With("%s did not resolve to any global IP", op.request.Domain)
+}
+
 func (op *ConnectOp) submitUpstream(msg *terminal.Msg, timeout time.Duration) {
 	err := op.Send(msg, timeout)
 	if err != nil {
@@ -544,8 +643,11 @@ func (op *ConnectOp) HandleStop(err *terminal.Error) (errorToSend *terminal.Erro
 
 	// Special client-side handling.
 	if op.entry {
+		// Release the pooled terminal for use by other tunnels.
+		op.tunnel.releasePooled()
+
 		// Mark the connection as failed if there was an error and no data was sent to the app yet.
-		if err.IsError() && op.outgoingTraffic.Load() == 0 {
+		if err.IsError() && op.outgoingTraffic.Load() == 0 && !op.tunnel.proxied {
 			// Set connection to failed and save it to propagate the update.
 			c := op.tunnel.connInfo
 			func() {
@@ -113,3 +113,85 @@ func TestConnectOp(t *testing.T) {
 		time.Sleep(500 * time.Millisecond)
 	}
 }
+
+func TestCheckConnectRequest(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name    string
+		request *ConnectRequest
+		valid   bool
+	}{
+		{
+			name:    "ipv4",
+			request: &ConnectRequest{IP: net.IPv4(194, 232, 104, 142).To4(), QueueSize: testQueueSize},
+			valid:   true,
+		},
+		{
+			name:    "ipv6",
+			request: &ConnectRequest{IP: net.ParseIP("2001:db8::1"), QueueSize: testQueueSize},
+			valid:   true,
+		},
+		{
+			name:    "resolve at exit",
+			request: &ConnectRequest{Domain: "orf.at.", QueueSize: testQueueSize},
+			valid:   true,
+		},
+		{
+			name:    "no destination",
+			request: &ConnectRequest{QueueSize: testQueueSize},
+		},
+		{
+			name:    "invalid ip",
+			request: &ConnectRequest{IP: net.IP{1, 2, 3}, Domain: "orf.at.", QueueSize: testQueueSize},
+		},
+		{
+			name:    "no queue size",
+			request: &ConnectRequest{Domain: "orf.at."},
+		},
+	} {
+		tErr := checkConnectRequest(test.request)
+		if test.valid && tErr != nil {
+			t.Errorf("%s: request should be valid: %s", test.name, tErr)
+		}
+		if !test.valid && tErr == nil {
+			t.Errorf("%s: request should be invalid", test.name)
+		}
+	}
+}
+
+func TestProxyTunnelOptionsResolveAtExit(t *testing.T) {
+	t.Parallel()
+
+	oldExit := &navigator.Pin{
+		Hub: &hub.Hub{
+			Info:   &hub.Announcement{},
+			Status: &hub.Status{},
+		},
+		State: navigator.StateSummaryRegard | navigator.StateTrusted,
+	}
+	newExit := &navigator.Pin{
+		Hub: &hub.Hub{
+			Info:   &hub.Announcement{},
+			Status: &hub.Status{Flags: []string{hub.FlagExitResolve}},
+		},
+		State: navigator.StateSummaryRegard | navigator.StateTrusted,
+	}
+
+	// Destinations with an IP may exit anywhere.
+	withIP := (&intel.Entity{IP: net.IPv4(194, 232, 104, 142)}).Init(0)
+	matcher := proxyTunnelOptions(withIP, navigator.DefaultRoutingProfileID).Destination.Matcher(nil)
+	if !matcher(oldExit) || !matcher(newExit) {
+		t.Error("destination with IP should be able to exit at any Hub")
+	}
+
+	// Domain-only destinations need an exit that resolves them.
+	domainOnly := (&intel.Entity{Domain: "orf.at."}).Init(0)
+	matcher = proxyTunnelOptions(domainOnly, navigator.DefaultRoutingProfileID).Destination.Matcher(nil)
+	if matcher(oldExit) {
+		t.Error("domain-only destination should not exit at a Hub without exit resolving")
+	}
+	if !matcher(newExit) {
+		t.Error("domain-only destination should be able to exit at a Hub with exit resolving")
+	}
+}
@@ -0,0 +1,492 @@
+package crew
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/spn/conf"
+	"github.com/safing/spn/terminal"
+)
+
+/*
+
+DNS Operation:
+
+The DNS operation carries DNS messages to the resolver of an exit Hub. A single
+operation is kept open and used for all queries, so that resolving through the
+SPN does not require a full connect operation per query.
+
+Every data message of the operation holds a batch of DNS messages:
+
+- Batch: [repeated]
+	- Query ID [varint]: ID of the query within the operation
+	- DNS Message [bytes; varint length prefix]: packed DNS message
+
+Queries that are waiting to be sent are batched together and the exit Hub
+batches the responses that are ready. Both sides cache responses.
+
+*/
+
+const (
+	// DNSOpType is the type ID of the DNS operation.
+	DNSOpType = "dns"
+
+	dnsOpStartTimeout = 10 * time.Second
+	dnsOpSendTimeout  = 10 * time.Second
+	dnsQueryTimeout   = 5 * time.Second
+
+	// dnsMaxBatchSize defines how many DNS messages are sent in one message.
+	dnsMaxBatchSize = 16
+
+	// dnsMaxPendingQueries defines how many queries may be pending per
+	// operation on the exit Hub.
+	dnsMaxPendingQueries = 256
+
+	// dnsMaxConcurrentQueries defines how many queries are resolved
+	// concurrently per operation on the exit Hub.
+	dnsMaxConcurrentQueries = 16
+)
+
+func init() {
+	terminal.RegisterOpType(terminal.OperationFactory{
+		Type:     DNSOpType,
+		Requires: terminal.MayConnect,
+		Start:    startDNSOp,
+	})
+}
+
+// dnsBatchEntry is a DNS message of a batch.
+type dnsBatchEntry struct {
+	id  uint64
+	msg *dns.Msg
+}
+
+// packDNSBatch packs the given DNS messages into a batch.
+func packDNSBatch(entries []*dnsBatchEntry) ([]byte, *terminal.Error) {
+	c := container.New()
+	for _, entry := range entries {
+		packed, err := entry.msg.Pack()
+		if err != nil {
+			return nil, terminal.ErrInternalError.With("failed to pack dns message: %w", err)
+		}
+		c.AppendNumber(entry.id)
+		c.AppendAsBlock(packed)
+	}
+	return c.CompileData(), nil
+}
+
+// unpackDNSBatch unpacks the DNS messages of the given batch.
+func unpackDNSBatch(data *container.Container) ([]*dnsBatchEntry, *terminal.Error) {
+	var entries []*dnsBatchEntry
+	for data.HoldsData() {
+		id, err := data.GetNextN64()
+		if err != nil {
+			return nil, terminal.ErrMalformedData.With("failed to get dns query id: %w", err)
+		}
+		packed, err := data.GetNextBlock()
+		if err != nil {
+			return nil, terminal.ErrMalformedData.With("failed to get dns message: %w", err)
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(packed); err != nil {
+			return nil, terminal.ErrMalformedData.With("failed to unpack dns message: %w", err)
+		}
+		entries = append(entries, &dnsBatchEntry{id: id, msg: msg})
+	}
+	return entries, nil
+}
+
+// DNSOp is used to resolve DNS queries at an exit Hub.
+type DNSOp struct {
+	terminal.OperationBase
+
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+
+	// Client side.
+	queries    chan *dnsBatchEntry
+	nextID     atomic.Uint64
+	pending    map[uint64]chan *dns.Msg
+	pendingErr *terminal.Error
+	lock       sync.Mutex
+
+	// Exit side.
+	upstreams      []string
+	responses      chan *dnsBatchEntry
+	pendingQueries atomic.Int32
+	concurrency    chan struct{}
+}
+
+// Type returns the type ID.
+func (op *DNSOp) Type() string {
+	return DNSOpType
+}
+
+// NewDNSOp starts a new DNS operation.
+func NewDNSOp(t terminal.Terminal) (*DNSOp, *terminal.Error) {
+	op := &DNSOp{
+		queries: make(chan *dnsBatchEntry, dnsMaxPendingQueries),
+		pending: make(map[uint64]chan *dns.Msg),
+	}
+	op.ctx, op.cancelCtx = context.WithCancel(module.Ctx)
+	op.SetWeightClass(terminal.WeightClassInteractive)
+
+	tErr := t.StartOperation(op, nil, dnsOpStartTimeout)
+	if tErr != nil {
+		op.cancelCtx()
+		return nil, tErr
+	}
+
+	module.StartWorker("dns op query sender", func(_ context.Context) error {
+		op.batchSender(op.queries)
+		return nil
+	})
+
+	return op, nil
+}
+
+// Query resolves the given DNS query at the exit Hub.
+func (op *DNSOp) Query(ctx context.Context, query *dns.Msg) (*dns.Msg, *terminal.Error) {
+	// Register query.
+	id := op.nextID.Add(1)
+	response := make(chan *dns.Msg, 1)
+	op.lock.Lock()
+	if op.pendingErr != nil {
+		op.lock.Unlock()
+		return nil, op.pendingErr
+	}
+	op.pending[id] = response
+	op.lock.Unlock()
+	defer func() {
+		op.lock.Lock()
+		defer op.lock.Unlock()
+		delete(op.pending, id)
+	}()
+
+	// Queue query for sending.
+	select {
+	case op.queries <- &dnsBatchEntry{id: id, msg: query}:
+	case <-ctx.Done():
+		return nil, terminal.ErrCanceled
+	case <-op.ctx.Done():
+		return nil, op.stopError()
+	}
+
+	// Wait for response.
+	select {
+	case r := <-response:
+		r.Id = query.Id
+		return r, nil
+	case <-ctx.Done():
+		return nil, terminal.ErrCanceled
+	case <-op.ctx.Done():
+		return nil, op.stopError()
+	}
+}
+
+func (op *DNSOp) stopError() *terminal.Error {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+
+	if op.pendingErr != nil {
+		return op.pendingErr
+	}
+	return terminal.ErrStopping
+}
+
+// batchSender sends the DNS messages from the given queue in batches.
+func (op *DNSOp) batchSender(queue chan *dnsBatchEntry) {
+	for {
+		// Wait for the first message.
+		var batch []*dnsBatchEntry
+		select {
+		case entry := <-queue:
+			batch = append(batch, entry)
+		case <-op.ctx.Done():
+			return
+		}
+
+		// Add all other waiting messages.
+	batching:
+		for len(batch) < dnsMaxBatchSize {
+			select {
+			case entry := <-queue:
+				batch = append(batch, entry)
+			default:
+				break batching
+			}
+		}
+
+		// Send batch.
+		data, tErr := packDNSBatch(batch)
+		if tErr == nil {
+			msg := op.NewMsg(data)
+			msg.Unit.MakeHighPriority()
+			tErr = op.Send(msg, dnsOpSendTimeout)
+			if tErr != nil {
+				msg.Finish()
+			}
+		}
+		if tErr != nil {
+			op.Stop(op, tErr.Wrap("failed to send dns batch"))
+			return
+		}
+	}
+}
+
+// Deliver delivers a message to the operation.
+func (op *DNSOp) Deliver(msg *terminal.Msg) *terminal.Error {
+	defer msg.Finish()
+
+	entries, tErr := unpackDNSBatch(msg.Data)
+	if tErr != nil {
+		return tErr
+	}
+
+	// Handle queries on the exit Hub.
+	if op.responses != nil {
+		for _, entry := range entries {
+			op.handleQuery(entry)
+		}
+		return nil
+	}
+
+	// Hand responses to the waiting queries on the client.
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	for _, entry := range entries {
+		if response, ok := op.pending[entry.id]; ok {
+			select {
+			case response <- entry.msg:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func startDNSOp(t terminal.Terminal, opID uint32, _ *container.Container) (terminal.Operation, *terminal.Error) {
+	// Check if we are running a public hub that allows connecting.
+	if !conf.PublicHub() || !connectingEnabled() {
+		return nil, terminal.ErrPermissionDenied.With("resolving is only allowed on public hubs that allow connecting")
+	}
+
+	// Rate limit operation start, as queries are cheap afterwards.
+	if sessionTerm, ok := t.(terminal.SessionTerminal); ok {
+		if tErr := sessionTerm.GetSession().RateLimit(); tErr != nil {
+			return nil, tErr
+		}
+	}
+
+	// Only use resolvers that the exit policy permits.
+	upstreams, tErr := permittedDNSUpstreams()
+	if tErr != nil {
+		return nil, tErr
+	}
+
+	op := &DNSOp{
+		upstreams:   upstreams,
+		responses:   make(chan *dnsBatchEntry, dnsMaxPendingQueries),
+		concurrency: make(chan struct{}, dnsMaxConcurrentQueries),
+	}
+	op.InitOperationBase(t, opID)
+	op.ctx, op.cancelCtx = context.WithCancel(t.Ctx())
+	op.SetWeightClass(terminal.WeightClassInteractive)
+
+	module.StartWorker("dns op response sender", func(_ context.Context) error {
+		op.batchSender(op.responses)
+		return nil
+	})
+
+	return op, nil
+}
+
+// handleQuery resolves the given query on the exit Hub and queues the
+// response for sending.
+func (op *DNSOp) handleQuery(entry *dnsBatchEntry) {
+	// Refuse queries over the limit.
+	if op.pendingQueries.Add(1) > dnsMaxPendingQueries {
+		op.pendingQueries.Add(-1)
+		op.queueResponse(entry.id, dnsErrorResponse(entry.msg, dns.RcodeRefused))
+		return
+	}
+
+	module.StartWorker("dns op resolver", func(_ context.Context) error {
+		defer op.pendingQueries.Add(-1)
+
+		// Limit concurrency.
+		select {
+		case op.concurrency <- struct{}{}:
+			defer func() {
+				<-op.concurrency
+			}()
+		case <-op.ctx.Done():
+			return nil
+		}
+
+		op.queueResponse(entry.id, resolveAtExit(op.ctx, op.upstreams, entry.msg))
+		return nil
+	})
+}
+
+func (op *DNSOp) queueResponse(id uint64, response *dns.Msg) {
+	select {
+	case op.responses <- &dnsBatchEntry{id: id, msg: response}:
+	case <-op.ctx.Done():
+	}
+}
+
+// HandleStop gives the operation the ability to cleanly shut down.
+// The returned error is the error to send to the other side.
+// Should never be called directly. Call Stop() instead.
+func (op *DNSOp) HandleStop(err *terminal.Error) (errorToSend *terminal.Error) {
+	if op.pending != nil {
+		op.lock.Lock()
+		op.pendingErr = terminal.ErrStopping
+		if err.IsError() {
+			op.pendingErr = err
+		}
+		op.lock.Unlock()
+	}
+
+	op.cancelCtx()
+	return err
+}
+
+// resolveAtExit resolves the given query with the given resolvers of the exit
+// Hub. It always returns a response.
+func resolveAtExit(ctx context.Context, upstreams []string, query *dns.Msg) *dns.Msg {
+	// Only permit standard queries for a single question.
+	if query.Response || query.Opcode != dns.OpcodeQuery || len(query.Question) != 1 {
+		return dnsErrorResponse(query, dns.RcodeFormatError)
+	}
+	q := query.Question[0]
+	switch {
+	case q.Qclass != dns.ClassINET:
+		return dnsErrorResponse(query, dns.RcodeNotImplemented)
+	case q.Qtype == dns.TypeANY || q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR:
+		return dnsErrorResponse(query, dns.RcodeRefused)
+	}
+
+	// Check cache.
+	if cached := exitDNSCache.get(query); cached != nil {
+		return cached
+	}
+
+	// Resolve with the upstream resolvers.
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+	response, err := exchangeDNSUpstream(ctx, upstreams, query)
+	if err != nil {
+		log.Debugf("spn/crew: failed to resolve %s %s at exit: %s", q.Name, dns.TypeToString[q.Qtype], err)
+		return dnsErrorResponse(query, dns.RcodeServerFailure)
+	}
+	exitDNSCache.put(query, response)
+
+	return response
+}
+
+var (
+	dnsUpstreams     []string
+	dnsUpstreamsOnce sync.Once
+)
+
+// getDNSUpstreams returns the system resolvers of the Hub.
+func getDNSUpstreams() []string {
+	dnsUpstreamsOnce.Do(func() {
+		cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			log.Warningf("spn/crew: failed to read system resolvers, using localhost: %s", err)
+			dnsUpstreams = []string{"127.0.0.1:53"}
+			return
+		}
+		for _, server := range cfg.Servers {
+			dnsUpstreams = append(dnsUpstreams, net.JoinHostPort(server, cfg.Port))
+		}
+	})
+
+	return dnsUpstreams
+}
+
+// permittedDNSUpstreams returns the system resolvers of the Hub that the exit
+// policy permits to connect to via UDP on their port.
+func permittedDNSUpstreams() ([]string, *terminal.Error) {
+	var (
+		permitted []string
+		lastErr   *terminal.Error
+	)
+	for _, upstream := range getDNSUpstreams() {
+		host, portString, err := net.SplitHostPort(upstream)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+
+		if tErr := checkExitPolicy(&ConnectRequest{
+			IP:       ip,
+			Protocol: packet.UDP,
+			Port:     uint16(port),
+		}); tErr != nil {
+			lastErr = tErr
+			continue
+		}
+		permitted = append(permitted, upstream)
+	}
+
+	switch {
+	case len(permitted) > 0:
+		return permitted, nil
+	case lastErr != nil:
+		return nil, lastErr
+	default:
+		return nil, terminal.ErrInternalError.With("no usable resolvers configured")
+	}
+}
+
+// exchangeDNSUpstream sends the query to the given resolvers.
+func exchangeDNSUpstream(ctx context.Context, upstreams []string, query *dns.Msg) (response *dns.Msg, err error) {
+	// Use a separate query, so that the ID cannot be chosen by the client.
+	upstreamQuery := query.Copy()
+	upstreamQuery.Id = dns.Id()
+	upstreamQuery.RecursionDesired = true
+
+	for _, upstream := range upstreams {
+		response, _, err = (&dns.Client{}).ExchangeContext(ctx, upstreamQuery, upstream)
+		if err == nil && response.Truncated {
+			response, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, upstreamQuery, upstream)
+		}
+		if err == nil {
+			response.Id = query.Id
+			return response, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no resolvers configured")
+	}
+	return nil, err
+}
+
+// dnsErrorResponse returns an empty response to the given query with the
+// given response code.
+func dnsErrorResponse(query *dns.Msg, rcode int) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetRcode(query, rcode)
+	return response
+}
@@ -0,0 +1,182 @@
+package crew
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/safing/spn/cabin"
+	"github.com/safing/spn/terminal"
+)
+
+func TestDNSOp(t *testing.T) {
+	t.Parallel()
+
+	// Create test terminal pair.
+	a, b, err := terminal.NewSimpleTestTerminalPair(0, 0,
+		&terminal.TerminalOpts{
+			FlowControl:     terminal.FlowControlDFQ,
+			FlowControlSize: testQueueSize,
+			Padding:         testPadding,
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed to create test terminal pair: %s", err)
+	}
+
+	// Set up exit.
+	b.GrantPermission(terminal.MayConnect)
+	identity, err := cabin.CreateIdentity(module.Ctx, "test")
+	if err != nil {
+		t.Fatalf("failed to create identity: %s", err)
+	}
+	EnableConnecting(identity.Hub)
+
+	// Prepare cached responses on the exit, so that no network is needed.
+	names := []string{"a.example.com.", "b.example.com.", "c.example.com."}
+	for i, name := range names {
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		response := new(dns.Msg)
+		response.SetReply(query)
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, byte(i+1)),
+		})
+		exitDNSCache.put(query, response)
+	}
+
+	// Start DNS operation.
+	op, tErr := NewDNSOp(a)
+	if tErr != nil {
+		t.Fatalf("failed to start dns op: %s", tErr)
+	}
+	defer op.Stop(op, nil)
+
+	// Query in parallel, so that queries are batched.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errs := make(chan error, len(names)+1)
+	for i, name := range names {
+		go func(i int, name string) {
+			query := new(dns.Msg)
+			query.SetQuestion(name, dns.TypeA)
+			response, tErr := op.Query(ctx, query)
+			switch {
+			case tErr != nil:
+				errs <- tErr
+			case response.Id != query.Id:
+				errs <- fmt.Errorf("response to %s has id %d instead of %d", name, response.Id, query.Id)
+			case len(response.Answer) != 1:
+				errs <- fmt.Errorf("response to %s has %d answers", name, len(response.Answer))
+			case !response.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, byte(i+1))):
+				errs <- fmt.Errorf("response to %s has wrong answer %s", name, response.Answer[0])
+			default:
+				errs <- nil
+			}
+		}(i, name)
+	}
+
+	// Dangerous queries are refused.
+	go func() {
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeANY)
+		response, tErr := op.Query(ctx, query)
+		switch {
+		case tErr != nil:
+			errs <- tErr
+		case response.Rcode != dns.RcodeRefused:
+			errs <- fmt.Errorf("ANY query should be refused, got %s", dns.RcodeToString[response.Rcode])
+		default:
+			errs <- nil
+		}
+	}()
+
+	for i := 0; i < len(names)+1; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	t.Parallel()
+
+	c := newDNSCache(true)
+	query := new(dns.Msg)
+	query.SetQuestion("Example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+
+	// Failed responses are not cached.
+	failed := new(dns.Msg)
+	failed.SetRcode(query, dns.RcodeServerFailure)
+	c.put(query, failed)
+	if c.get(query) != nil {
+		t.Error("failed response should not be cached")
+	}
+
+	// Successful responses are cached case-insensitively.
+	c.put(query, response)
+	other := new(dns.Msg)
+	other.SetQuestion("example.com.", dns.TypeA)
+	cached := c.get(other)
+	if cached == nil {
+		t.Fatal("response should be cached")
+	}
+	if cached.Id != other.Id {
+		t.Errorf("cached response should have id %d, got %d", other.Id, cached.Id)
+	}
+
+	// TTLs are reduced by the time the response was cached.
+	c.entries[dnsCacheKey(query)].cached = time.Now().Add(-30 * time.Second)
+	if ttl := c.get(query).Answer[0].Header().Ttl; ttl != 30 {
+		t.Errorf("cached response should have a TTL of 30, got %d", ttl)
+	}
+
+	// Other types are not served.
+	other.SetQuestion("example.com.", dns.TypeAAAA)
+	if c.get(other) != nil {
+		t.Error("response for other type should not be served")
+	}
+
+	// Expired responses are not served.
+	c.entries[dnsCacheKey(query)].expires = time.Now().Add(-time.Second)
+	if c.get(query) != nil {
+		t.Error("expired response should not be served")
+	}
+}
+
+func TestExitDNSCacheKeepsTTLs(t *testing.T) {
+	t.Parallel()
+
+	c := newDNSCache(false)
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	c.put(query, response)
+
+	// The original TTL must be returned, so that clients cannot learn when
+	// the response was cached.
+	c.entries[dnsCacheKey(query)].cached = time.Now().Add(-30 * time.Second)
+	cached := c.get(query)
+	if cached == nil {
+		t.Fatal("response should be cached")
+	}
+	if ttl := cached.Answer[0].Header().Ttl; ttl != 60 {
+		t.Errorf("cached response should have the original TTL of 60, got %d", ttl)
+	}
+}
@@ -23,6 +23,14 @@ func EnableConnecting(my *hub.Hub) {
 	connectingHub = my
 }
 
+// connectingEnabled returns whether connecting from this Hub is enabled.
+func connectingEnabled() bool {
+	connectingHubLock.Lock()
+	defer connectingHubLock.Unlock()
+
+	return connectingHub != nil
+}
+
 func checkExitPolicy(request *ConnectRequest) *terminal.Error {
 	connectingHubLock.Lock()
 	defer connectingHubLock.Unlock()
@@ -0,0 +1,336 @@
+package crew
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portbase/modules"
+	"github.com/safing/spn/navigator"
+	"github.com/safing/spn/terminal"
+)
+
+// Connection Pool:
+// Tunnels to the same exit Hub share expansion terminals. The pool tracks how
+// many tunnels use each terminal, so that new tunnels can skip route
+// establishment and use a terminal with free capacity right away. When the
+// terminals of an exit Hub fill up, an additional terminal is expanded in the
+// background, so that bursts of connections (eg. page loads) do not wait for
+// it. If a new tunnel still finds the active terminal of the exit Hub full,
+// another terminal is expanded for it. Pre-warmed terminals are abandoned again
+// when they become idle.
+
+const (
+	// poolMaxTunnelsPerTerminal defines how many tunnels may share a terminal.
+	poolMaxTunnelsPerTerminal = 32
+
+	// poolMaxTerminalsPerHub defines how many terminals the pool holds per exit Hub.
+	poolMaxTerminalsPerHub = 4
+
+	// poolPrewarmThreshold defines the number of tunnels at which a terminal
+	// is considered to be busy. When all terminals of an exit Hub are busy,
+	// another one is pre-warmed.
+	poolPrewarmThreshold = poolMaxTunnelsPerTerminal * 3 / 4
+
+	// poolIdleTimeout defines after which duration without tunnels a terminal
+	// is removed from the pool.
+	poolIdleTimeout = 5 * time.Minute
+)
+
+var pool = newConnectionPool()
+
+type connectionPool struct {
+	lock sync.Mutex
+	hubs map[string]*poolHub
+}
+
+type poolHub struct {
+	pin        *navigator.Pin
+	route      *navigator.Route
+	terminals  []*pooledTerminal
+	prewarming bool
+}
+
+type pooledTerminal struct {
+	terminal  terminal.Terminal
+	tunnels   int
+	idleSince time.Time
+	prewarmed bool
+}
+
+func newConnectionPool() *connectionPool {
+	return &connectionPool{
+		hubs: make(map[string]*poolHub),
+	}
+}
+
+// isAbandoned returns whether the terminal is shutting down.
+func (pt *pooledTerminal) isAbandoned() bool {
+	return pt.terminal.Ctx().Err() != nil
+}
+
+// acquire returns the least used terminal to the given exit Hub and counts a
+// tunnel on it. It returns nil if there is no terminal with free capacity.
+func (p *connectionPool) acquire(pin *navigator.Pin) *pooledTerminal {
+	if pin.GetState().Has(navigator.StateFailing) {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ph, ok := p.hubs[pin.Hub.ID]
+	if !ok || ph.pin != pin {
+		return nil
+	}
+
+	// Find the least used terminal and remove abandoned ones.
+	var selected *pooledTerminal
+	busy := true
+	active := ph.terminals[:0]
+	for _, pt := range ph.terminals {
+		if pt.isAbandoned() {
+			continue
+		}
+		active = append(active, pt)
+
+		if pt.tunnels < poolPrewarmThreshold {
+			busy = false
+		}
+		if pt.tunnels < poolMaxTunnelsPerTerminal &&
+			(selected == nil || pt.tunnels < selected.tunnels) {
+			selected = pt
+		}
+	}
+	ph.terminals = active
+
+	// Pre-warm another terminal if all are busy.
+	if busy && !ph.prewarming &&
+		len(ph.terminals) < poolMaxTerminalsPerHub &&
+		ph.route != nil && len(ph.route.Path) >= 2 {
+		ph.prewarming = true
+		module.StartWorker("connection pool prewarmer", func(ctx context.Context) error {
+			p.prewarm(ph)
+			return nil
+		})
+	}
+
+	if selected == nil {
+		return nil
+	}
+	selected.tunnels++
+	return selected
+}
+
+// add adds the given terminal to the pool, if not yet present, and counts a
+// tunnel on it. It returns nil and does not count the tunnel, if the terminal
+// is full or the pool of the exit Hub has no space for another terminal.
+func (p *connectionPool) add(pin *navigator.Pin, route *navigator.Route, t terminal.Terminal) *pooledTerminal {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// Check if there is space for another terminal.
+	if ph, ok := p.hubs[pin.Hub.ID]; ok && ph.pin == pin &&
+		ph.get(t) == nil && len(ph.terminals) >= poolMaxTerminalsPerHub {
+		return nil
+	}
+
+	pt := p.insert(pin, route, t)
+	if pt.tunnels >= poolMaxTunnelsPerTerminal {
+		return nil
+	}
+	pt.tunnels++
+	return pt
+}
+
+// isFull returns whether the given terminal is in the pool and has no free
+// capacity for another tunnel.
+func (p *connectionPool) isFull(pin *navigator.Pin, t terminal.Terminal) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ph, ok := p.hubs[pin.Hub.ID]
+	if !ok || ph.pin != pin {
+		return false
+	}
+	pt := ph.get(t)
+	return pt != nil && pt.tunnels >= poolMaxTunnelsPerTerminal
+}
+
+// get returns the pool entry of the given terminal, if present.
+// The pool must be locked.
+func (ph *poolHub) get(t terminal.Terminal) *pooledTerminal {
+	for _, pt := range ph.terminals {
+		if pt.terminal == t {
+			return pt
+		}
+	}
+	return nil
+}
+
+// insert adds the given terminal to the pool, if not yet present.
+// The pool must be locked.
+func (p *connectionPool) insert(pin *navigator.Pin, route *navigator.Route, t terminal.Terminal) *pooledTerminal {
+	// Get or reset pool of the exit Hub.
+	ph, ok := p.hubs[pin.Hub.ID]
+	if !ok || ph.pin != pin {
+		ph = &poolHub{
+			pin: pin,
+		}
+		p.hubs[pin.Hub.ID] = ph
+	}
+	ph.route = route
+
+	// Return existing entry.
+	if pt := ph.get(t); pt != nil {
+		return pt
+	}
+
+	pt := &pooledTerminal{
+		terminal:  t,
+		idleSince: time.Now(),
+	}
+	ph.terminals = append(ph.terminals, pt)
+	return pt
+}
+
+// release removes a tunnel from the count of the given pooled terminal.
+func (p *connectionPool) release(pt *pooledTerminal) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pt.tunnels--
+	if pt.tunnels <= 0 {
+		pt.tunnels = 0
+		pt.idleSince = time.Now()
+	}
+}
+
+// prewarm expands to the exit Hub of the given pool via the same route in
+// order to have another terminal ready for new tunnels.
+func (p *connectionPool) prewarm(ph *poolHub) {
+	defer func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		ph.prewarming = false
+	}()
+
+	// Get terminal to the previous hop.
+	p.lock.Lock()
+	pin := ph.pin
+	route := ph.route
+	p.lock.Unlock()
+	previousHop := route.Path[len(route.Path)-2].Pin()
+	home, homeTerminal := navigator.Main.GetHome()
+	if home == nil || homeTerminal == nil || homeTerminal.IsBeingAbandoned() {
+		return
+	}
+	var previousTerminal terminal.Terminal
+	if previousHop == home {
+		previousTerminal = homeTerminal
+	} else if activeTerminal := previousHop.GetActiveTerminal(); activeTerminal != nil {
+		previousTerminal = activeTerminal
+	} else {
+		// The route is not established anymore.
+		return
+	}
+
+	// Expand to exit Hub.
+	connectLock.Lock()
+	expansion, authOp, tErr := expand(previousTerminal, previousHop, pin)
+	connectLock.Unlock()
+	if tErr != nil {
+		log.Warningf("spn/crew: failed to pre-warm terminal to %s: %s", pin.Hub, tErr)
+		return
+	}
+
+	// Wait for authOp result.
+	select {
+	case tErr = <-authOp.Result:
+		if !tErr.Is(terminal.ErrExplicitAck) {
+			expansion.Abandon(nil)
+			log.Warningf("spn/crew: failed to auth pre-warmed terminal to %s: %s", pin.Hub, tErr)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		expansion.Abandon(nil)
+		log.Warningf("spn/crew: auth of pre-warmed terminal to %s timed out", pin.Hub)
+		return
+	}
+	expansion.MarkReachable()
+
+	// Add to pool.
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.hubs[pin.Hub.ID] != ph {
+		// The pool of the exit Hub was reset in the meantime.
+		expansion.Abandon(nil)
+		return
+	}
+	pt := p.insert(pin, route, expansion)
+	pt.prewarmed = true
+	log.Infof("spn/crew: pre-warmed terminal to %s via %s", pin.Hub, route)
+}
+
+// clean removes idle and abandoned terminals from the pool and returns the
+// pre-warmed terminals that should be abandoned.
+func (p *connectionPool) clean() (abandon []terminal.Terminal) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for hubID, ph := range p.hubs {
+		active := ph.terminals[:0]
+		for _, pt := range ph.terminals {
+			switch {
+			case pt.isAbandoned():
+				// Remove.
+			case pt.tunnels == 0 && time.Since(pt.idleSince) > poolIdleTimeout:
+				// Abandon pre-warmed terminals, unless they are used as the
+				// active terminal of the Pin by now. Other terminals are managed
+				// by the Pin and the idle timeout of the terminal itself.
+				if pt.prewarmed {
+					if activeTerminal := ph.pin.GetActiveTerminal(); activeTerminal == nil ||
+						terminal.Terminal(activeTerminal) != pt.terminal {
+						abandon = append(abandon, pt.terminal)
+					}
+				}
+			default:
+				active = append(active, pt)
+			}
+		}
+		ph.terminals = active
+
+		if len(ph.terminals) == 0 && !ph.prewarming {
+			delete(p.hubs, hubID)
+		}
+	}
+
+	return abandon
+}
+
+// clear removes all terminals from the pool.
+func (p *connectionPool) clear() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for hubID := range p.hubs {
+		delete(p.hubs, hubID)
+	}
+}
+
+func cleanConnectionPool(ctx context.Context, task *modules.Task) error {
+	for _, t := range pool.clean() {
+		t.Abandon(nil)
+	}
+
+	return nil
+}
+
+// releasePooled releases the pooled terminal of the tunnel, if it has one.
+func (t *Tunnel) releasePooled() {
+	if t.pooled != nil {
+		pool.release(t.pooled)
+		t.pooled = nil
+	}
+}
@@ -0,0 +1,91 @@
+package crew
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safing/spn/hub"
+	"github.com/safing/spn/navigator"
+	"github.com/safing/spn/terminal"
+)
+
+func TestConnectionPool(t *testing.T) {
+	t.Parallel()
+
+	// Create test terminals.
+	a, _, err := terminal.NewSimpleTestTerminalPair(0, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to create test terminal pair: %s", err)
+	}
+	b, _, err := terminal.NewSimpleTestTerminalPair(0, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to create test terminal pair: %s", err)
+	}
+
+	p := newConnectionPool()
+	pin := &navigator.Pin{Hub: &hub.Hub{ID: "test"}}
+
+	// Nothing to acquire in an empty pool.
+	if p.acquire(pin) != nil {
+		t.Fatal("empty pool should not return a terminal")
+	}
+
+	// Adding a terminal counts the tunnel that established it.
+	first := p.add(pin, nil, a)
+	if first.tunnels != 1 {
+		t.Fatalf("added terminal should have 1 tunnel, has %d", first.tunnels)
+	}
+	if p.add(pin, nil, a) != first {
+		t.Fatal("adding the same terminal should return the existing entry")
+	}
+	p.release(first)
+	second := p.add(pin, nil, b)
+
+	// Tunnels are balanced between terminals until they are full.
+	for i := 2; i < 2*poolMaxTunnelsPerTerminal; i++ {
+		if p.acquire(pin) == nil {
+			t.Fatalf("acquire %d should succeed", i)
+		}
+		if diff := first.tunnels - second.tunnels; diff < -1 || diff > 1 {
+			t.Fatalf("tunnels should be balanced, have %d and %d", first.tunnels, second.tunnels)
+		}
+	}
+	if p.acquire(pin) != nil {
+		t.Fatal("full pool should not return a terminal")
+	}
+
+	// Full terminals do not take more tunnels when added again.
+	if !p.isFull(pin, a) {
+		t.Fatal("terminal should be full")
+	}
+	if p.add(pin, nil, a) != nil {
+		t.Fatal("adding a full terminal should not count a tunnel")
+	}
+	if first.tunnels != poolMaxTunnelsPerTerminal {
+		t.Fatalf("full terminal should have %d tunnels, has %d", poolMaxTunnelsPerTerminal, first.tunnels)
+	}
+
+	// Released terminals become idle and are removed after the idle timeout.
+	for first.tunnels > 0 {
+		p.release(first)
+	}
+	if p.acquire(pin) != first {
+		t.Fatal("released terminal should be acquired again")
+	}
+	p.release(first)
+	first.idleSince = time.Now().Add(-poolIdleTimeout - time.Second)
+	if abandon := p.clean(); len(abandon) != 0 {
+		t.Fatal("only pre-warmed terminals should be abandoned")
+	}
+	if len(p.hubs[pin.Hub.ID].terminals) != 1 {
+		t.Fatal("idle terminal should be removed")
+	}
+
+	// Abandoned terminals are removed.
+	b.Abandon(nil)
+	<-b.Ctx().Done()
+	p.clean()
+	if _, ok := p.hubs[pin.Hub.ID]; ok {
+		t.Fatal("pool of exit hub without terminals should be removed")
+	}
+}
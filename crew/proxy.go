@@ -0,0 +1,149 @@
+package crew
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/safing/portbase/config"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/netutils"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+	"github.com/safing/spn/hub"
+	"github.com/safing/spn/navigator"
+)
+
+var (
+	// ErrProxyRequestInvalid is returned when a proxy request is invalid.
+	ErrProxyRequestInvalid = errors.New("invalid proxy request")
+
+	// ErrProxyDestinationNotAllowed is returned when a proxy request targets a
+	// destination that may not be reached through the SPN.
+	ErrProxyDestinationNotAllowed = errors.New("destination not allowed")
+
+	// ErrSPNNotReady is returned when the SPN is not ready for tunneling.
+	ErrSPNNotReady = errors.New("SPN not ready for tunneling")
+)
+
+// ConnectProxy connects the given connection through the SPN to the
+// destination of the given connect request. It is used by ingress listeners
+// that do not have a network connection from the Portmaster, like the SOCKS5
+// proxy of the sluice.
+// Only the Domain, IP, Protocol and Port of the request are used. If no IP is
+// set, the domain is resolved by the exit Hub, so that the answer matches the
+// exit location and local resolvers never see the query.
+// The given routing profile is used to find a route. If it is empty, the
+// globally configured routing algorithm is used.
+// ConnectProxy returns when the tunnel is established or failed. On success,
+// the tunnel takes over the connection.
+func ConnectProxy(ctx context.Context, request *ConnectRequest, conn net.Conn, routingProfile string) error {
+	// Check request.
+	switch {
+	case request.Protocol != packet.TCP && request.Protocol != packet.UDP:
+		return fmt.Errorf("%w: protocol %s is not supported", ErrProxyRequestInvalid, request.Protocol)
+	case request.Port == 0:
+		return fmt.Errorf("%w: port missing", ErrProxyRequestInvalid)
+	case request.IP == nil && request.Domain == "":
+		return fmt.Errorf("%w: destination missing", ErrProxyRequestInvalid)
+	}
+
+	// Only global destinations may be reached through the SPN.
+	// The exit Hub checks resolved IPs itself.
+	if request.IP != nil && netutils.GetIPScope(request.IP) != netutils.Global {
+		return fmt.Errorf("%w: %s is not a global IP", ErrProxyDestinationNotAllowed, request.IP)
+	}
+
+	// Create the connection info of the tunnel.
+	entity := (&intel.Entity{
+		Protocol: uint8(request.Protocol),
+		Port:     request.Port,
+		Domain:   request.Domain,
+		IP:       request.IP,
+	}).Init(0)
+	if entity.Domain != "" && !strings.HasSuffix(entity.Domain, ".") {
+		entity.Domain += "."
+	}
+	t := &Tunnel{
+		connInfo: &network.Connection{
+			Entity:     entity,
+			TunnelOpts: proxyTunnelOptions(entity, routingProfile),
+		},
+		conn:    conn,
+		proxied: true,
+	}
+
+	return t.connectProxy(ctx)
+}
+
+// proxyTunnelOptions returns the tunnel options for proxied connections.
+// As it is unknown whether proxied connections are encrypted, they may only
+// exit at trusted Hubs. Destinations without an IP may only exit at Hubs that
+// resolve domains for connect requests.
+func proxyTunnelOptions(destination *intel.Entity, routingProfile string) *navigator.Options {
+	if routingProfile == "" {
+		routingProfile = config.GetAsString(profile.CfgOptionRoutingAlgorithmKey, navigator.DefaultRoutingProfileID)()
+	}
+
+	opts := &navigator.Options{
+		Destination: &navigator.DestinationHubOptions{
+			Regard:             navigator.StateTrusted,
+			CheckHubPolicyWith: destination,
+		},
+		RoutingProfile: routingProfile,
+	}
+	if destination.IP == nil {
+		opts.Destination.RequireFlags = []string{hub.FlagExitResolve}
+	}
+
+	return opts
+}
+
+func (t *Tunnel) connectProxy(ctx context.Context) error {
+	// Get tracing logger.
+	ctx, tracer := log.AddTracer(ctx)
+	defer tracer.Submit()
+
+	// Save start time.
+	started := time.Now()
+
+	// Check the status of the Home Hub.
+	home, homeTerminal := navigator.Main.GetHome()
+	if home == nil || homeTerminal == nil || homeTerminal.IsBeingAbandoned() {
+		return ErrSPNNotReady
+	}
+
+	// Create path through the SPN.
+	if err := t.establish(ctx); err != nil {
+		tracer.Warningf("spn/crew: failed to establish route for proxied %s: %s", proxyDestination(t.connInfo.Entity), err)
+		return fmt.Errorf("failed to establish route: %w", err)
+	}
+
+	// Connect via established tunnel.
+	if _, tErr := NewConnectOp(t); tErr != nil {
+		t.releasePooled()
+		tErr = tErr.Wrap("failed to initialize tunnel")
+		reportConnectError(tErr)
+		return tErr
+	}
+
+	// Report time taken to find, build and check route and send connect request.
+	connectOpTTCRDurationHistogram.UpdateDuration(started)
+
+	tracer.Infof("spn/crew: connected proxied %s via %s", proxyDestination(t.connInfo.Entity), t.dstPin.Hub)
+	return nil
+}
+
+// proxyDestination returns the destination of a proxied connection for
+// logging.
+func proxyDestination(entity *intel.Entity) string {
+	if entity.IP == nil {
+		return entity.Domain
+	}
+	return entity.IP.String()
+}
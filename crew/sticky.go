@@ -65,15 +65,18 @@ func getStickiedHub(conn *network.Connection) (sticksTo *stickyHub) {
 	defer stickyLock.Unlock()
 
 	// Check if IP is sticky.
-	sticksTo = stickyIPs[makeStickyIPKey(conn)] // byte comparison
-	if sticksTo != nil && !sticksTo.isExpired() {
-		sticksTo.LastSeen = time.Now()
+	// The IP is missing if the domain is resolved by the exit Hub.
+	if conn.Entity.IP != nil {
+		sticksTo = stickyIPs[makeStickyIPKey(conn)] // byte comparison
+		if sticksTo != nil && !sticksTo.isExpired() {
+			sticksTo.LastSeen = time.Now()
+		}
 	}
 
 	// If the IP did not stick and we have a domain, check if that sticks.
 	if sticksTo == nil && conn.Entity.Domain != "" {
-		sticksTo, ok := stickyDomains[makeStickyDomainKey(conn)]
-		if ok && !sticksTo.isExpired() {
+		sticksTo = stickyDomains[makeStickyDomainKey(conn)]
+		if sticksTo != nil && !sticksTo.isExpired() {
 			sticksTo.LastSeen = time.Now()
 		}
 	}
@@ -114,14 +117,16 @@ func (t *Tunnel) stickDestinationToHub() {
 	stickyLock.Lock()
 	defer stickyLock.Unlock()
 
-	// Stick to IP.
-	ipKey := makeStickyIPKey(t.connInfo)
-	stickyIPs[ipKey] = &stickyHub{
-		Pin:      t.dstPin,
-		Route:    t.route,
-		LastSeen: time.Now(),
+	// Stick to IP, if present.
+	if t.connInfo.Entity.IP != nil {
+		ipKey := makeStickyIPKey(t.connInfo)
+		stickyIPs[ipKey] = &stickyHub{
+			Pin:      t.dstPin,
+			Route:    t.route,
+			LastSeen: time.Now(),
+		}
+		log.Infof("spn/crew: sticking %s to %s", ipKey, t.dstPin.Hub)
 	}
-	log.Infof("spn/crew: sticking %s to %s", ipKey, t.dstPin.Hub)
 
 	// Stick to Domain, if present.
 	if t.connInfo.Entity.Domain != "" {
@@ -140,6 +145,9 @@ func (t *Tunnel) avoidDestinationHub() {
 	defer stickyLock.Unlock()
 
 	// Stick to Hub/IP Pair.
+	if t.connInfo.Entity.IP == nil {
+		return
+	}
 	ipKey := makeStickyIPKey(t.connInfo)
 	stickyIPs[ipKey] = &stickyHub{
 		Pin:      t.dstPin,
@@ -0,0 +1,61 @@
+package crew
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/spn/hub"
+	"github.com/safing/spn/navigator"
+)
+
+func TestStickiedHubMatchesDestination(t *testing.T) { //nolint:paralleltest // Test changes the sticky hubs.
+	defer clearStickyHubs()
+
+	oldExit := &navigator.Pin{
+		Hub: &hub.Hub{
+			ID:     "old-exit",
+			Info:   &hub.Announcement{},
+			Status: &hub.Status{},
+		},
+		State: navigator.StateSummaryRegard | navigator.StateTrusted,
+	}
+	newExit := &navigator.Pin{
+		Hub: &hub.Hub{
+			ID:     "new-exit",
+			Info:   &hub.Announcement{},
+			Status: &hub.Status{Flags: []string{hub.FlagExitResolve}},
+		},
+		State: navigator.StateSummaryRegard | navigator.StateTrusted,
+	}
+
+	// Create a domain-only proxied connection.
+	domainOnly := (&intel.Entity{Domain: "orf.at."}).Init(0)
+	conn := &network.Connection{
+		Entity:     domainOnly,
+		TunnelOpts: proxyTunnelOptions(domainOnly, navigator.DefaultRoutingProfileID),
+	}
+
+	// A stickied Hub that does not resolve at the exit must not be used.
+	stickyLock.Lock()
+	stickyDomains[makeStickyDomainKey(conn)] = &stickyHub{
+		Pin:      oldExit,
+		LastSeen: time.Now(),
+	}
+	stickyLock.Unlock()
+	if sticksTo := getStickiedHub(conn); sticksTo != nil {
+		t.Errorf("domain-only connection should not stick to %s", sticksTo.Pin.Hub.ID)
+	}
+
+	// A stickied Hub that resolves at the exit is used.
+	stickyLock.Lock()
+	stickyDomains[makeStickyDomainKey(conn)] = &stickyHub{
+		Pin:      newExit,
+		LastSeen: time.Now(),
+	}
+	stickyLock.Unlock()
+	if sticksTo := getStickiedHub(conn); sticksTo == nil || sticksTo.Pin != newExit {
+		t.Error("domain-only connection should stick to the exit that resolves it")
+	}
+}
@@ -0,0 +1,252 @@
+package docks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/safing/portbase/api"
+	"github.com/safing/spn/terminal"
+)
+
+const (
+	apiPathForSessions          = "spn/sessions"
+	apiPathForRateLimitPolicies = "spn/sessions/policies"
+	apiPathForTraces            = "spn/cranes/traces"
+	apiPathForTraceStart        = `spn/cranes/{crane:[0-9a-f]{6}}/trace/start`
+	apiPathForTraceStop         = `spn/cranes/{crane:[0-9a-f]{6}}/trace/stop`
+	apiPathForTraceExport       = `spn/cranes/{crane:[0-9a-f]{6}}/trace/export`
+)
+
+func registerAPIEndpoints() error {
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:        apiPathForSessions,
+		Read:        api.PermitAdmin,
+		BelongsTo:   module,
+		StructFunc:  handleSessions,
+		Name:        "Get Session Stats",
+		Description: "Returns the rate limiting counters and suspicion scores of all crane terminal sessions.",
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:        apiPathForRateLimitPolicies,
+		Read:        api.PermitAdmin,
+		BelongsTo:   module,
+		StructFunc:  handleRateLimitPolicies,
+		Name:        "Get Session Rate Limit Policies",
+		Description: "Returns the default and the configured per-permission session rate limit policies.",
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:        apiPathForTraces,
+		Read:        api.PermitAdmin,
+		BelongsTo:   module,
+		StructFunc:  handleTraces,
+		Name:        "Get Crane Traces",
+		Description: "Returns the trace status of all cranes.",
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:        apiPathForTraceStart,
+		Write:       api.PermitAdmin,
+		BelongsTo:   module,
+		ActionFunc:  handleTraceStart,
+		Name:        "Start Crane Trace",
+		Description: "Starts recording the message headers of all terminals of a crane. The amount of kept records can be set with the \"size\" parameter.",
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:        apiPathForTraceStop,
+		Write:       api.PermitAdmin,
+		BelongsTo:   module,
+		ActionFunc:  handleTraceStop,
+		Name:        "Stop Crane Trace",
+		Description: "Stops recording the message headers of a crane. The trace is kept for export.",
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:        apiPathForTraceExport,
+		Read:        api.PermitAdmin,
+		ReadMethod:  http.MethodGet,
+		BelongsTo:   module,
+		DataFunc:    handleTraceExport,
+		Name:        "Export Crane Trace",
+		Description: "Exports the recorded message headers of a crane as JSON lines or, with the \"format\" parameter set to \"pcapng\", as pcapng.",
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SessionInfo holds the session stats of a crane terminal.
+type SessionInfo struct {
+	Crane    string
+	Terminal string
+	*terminal.SessionStats
+}
+
+func handleSessions(ar *api.Request) (i interface{}, err error) {
+	return GetSessionInfos(), nil
+}
+
+// GetSessionInfos returns the session stats of all crane terminals that have a
+// session.
+func GetSessionInfos() []*SessionInfo {
+	var infos []*SessionInfo
+	for _, crane := range getAllCranes() {
+		craneName := crane.String()
+		for _, t := range crane.allTerms() {
+			craneTerm, ok := t.(*CraneTerminal)
+			if !ok {
+				continue
+			}
+			session := craneTerm.CurrentSession()
+			if session == nil {
+				continue
+			}
+
+			infos = append(infos, &SessionInfo{
+				Crane:        craneName,
+				Terminal:     craneTerm.FmtID(),
+				SessionStats: session.Stats(),
+			})
+		}
+	}
+
+	// Sort by suspicion score, then by operation count.
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].SuspicionScore != infos[j].SuspicionScore {
+			return infos[i].SuspicionScore > infos[j].SuspicionScore
+		}
+		return infos[i].OpCount > infos[j].OpCount
+	})
+
+	return infos
+}
+
+func handleRateLimitPolicies(ar *api.Request) (i interface{}, err error) {
+	return struct {
+		Default     *terminal.RateLimitPolicy
+		Permissions map[terminal.Permission]*terminal.RateLimitPolicy
+	}{
+		Default:     terminal.DefaultRateLimitPolicy(),
+		Permissions: terminal.GetRateLimitPolicies(),
+	}, nil
+}
+
+// TraceInfo holds the trace status of a crane.
+type TraceInfo struct {
+	Crane   string
+	ID      string
+	Active  bool
+	Started int64
+	Size    int
+	Records int
+}
+
+func handleTraces(ar *api.Request) (i interface{}, err error) {
+	infos := make([]*TraceInfo, 0)
+	for _, crane := range getAllCranes() {
+		info := &TraceInfo{
+			Crane: crane.String(),
+			ID:    crane.ID,
+		}
+		if tracer := crane.Tracer(); tracer != nil {
+			info.Active = tracer.Active()
+			info.Started = tracer.Started().Unix()
+			info.Size = tracer.Size()
+			info.Records = len(tracer.Records())
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos, nil
+}
+
+func getCraneForAPI(ar *api.Request) (*Crane, error) {
+	cranesLock.RLock()
+	defer cranesLock.RUnlock()
+
+	crane, ok := allCranes[ar.URLVars["crane"]]
+	if !ok {
+		return nil, errors.New("crane not found")
+	}
+	return crane, nil
+}
+
+func handleTraceStart(ar *api.Request) (msg string, err error) {
+	crane, err := getCraneForAPI(ar)
+	if err != nil {
+		return "", err
+	}
+
+	size := terminal.DefaultTraceSize
+	if sizeParam := ar.URL.Query().Get("size"); sizeParam != "" {
+		size, err = strconv.Atoi(sizeParam)
+		if err != nil {
+			return "", fmt.Errorf("invalid size: %w", err)
+		}
+	}
+
+	tracer := crane.StartTracing(size)
+	return fmt.Sprintf("started tracing %s with %d records", crane, tracer.Size()), nil
+}
+
+func handleTraceStop(ar *api.Request) (msg string, err error) {
+	crane, err := getCraneForAPI(ar)
+	if err != nil {
+		return "", err
+	}
+
+	crane.StopTracing()
+	return fmt.Sprintf("stopped tracing %s", crane), nil
+}
+
+func handleTraceExport(ar *api.Request) (data []byte, err error) {
+	crane, err := getCraneForAPI(ar)
+	if err != nil {
+		return nil, err
+	}
+	tracer := crane.Tracer()
+	if tracer == nil {
+		return nil, errors.New("crane is not being traced")
+	}
+
+	buf := &bytes.Buffer{}
+	switch format := ar.URL.Query().Get("format"); format {
+	case "", "jsonl":
+		ar.ResponseHeader.Set("Content-Type", "application/jsonl")
+		err = tracer.WriteJSONL(buf)
+	case "pcapng":
+		ar.ResponseHeader.Set("Content-Type", "application/x-pcapng")
+		ar.ResponseHeader.Set(
+			"Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"crane-%s.pcapng\"", crane.ID),
+		)
+		err = tracer.WritePcapng(buf)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -20,6 +20,9 @@ func NewLocalCraneControllerTerminal(
 	// Remove unnecessary options from the crane controller.
 	initMsg.Padding = 0
 
+	// Use the highest terminal version supported by the connected Hub.
+	initMsg.UpgradeVersion(crane.ConnectedHub)
+
 	// Create Terminal Base.
 	t, initData, err := terminal.NewLocalBaseTerminal(
 		crane.ctx,
@@ -79,6 +82,9 @@ func initCraneController(
 	// Grant crane controller permission.
 	t.GrantPermission(terminal.IsCraneController)
 
+	// Trace messages if enabled.
+	t.SetTracer(crane.tracer.Load())
+
 	// Start workers.
 	t.StartWorkers(module, "crane controller terminal")
 
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tevino/abool"
@@ -79,14 +80,38 @@ type Crane struct {
 
 	// jession is the jess session used for encryption.
 	jession *jess.Session
-	// jessionLock locks jession.
+	// recvJession is the jess session used for decryption.
+	// It only differs from jession while re-keying.
+	recvJession *jess.Session
+	// jessionLock locks jession, recvJession and the re-keying state.
 	jessionLock sync.Mutex
+	// rekeyRecvNext holds the prepared session for receiving, while waiting
+	// for the reply to a rekey segment.
+	rekeyRecvNext *jess.Session
+	// rekeyEpoch holds how often the crane was resumed, in order to ignore
+	// resent rekey segments.
+	rekeyEpoch uint64
+	// rekeyBytes holds the amount of encrypted and decrypted bytes since the
+	// last re-key.
+	rekeyBytes atomic.Uint64
+	// rekeys holds how often the crane switched to new encryption sessions.
+	rekeys atomic.Uint32
+	// rekeySegments holds rekey segments waiting to be loaded.
+	rekeySegments chan *craneRekey
 
 	// Controller is the Crane's Controller Terminal.
 	Controller *CraneControllerTerminal
 
 	// ship represents the underlying physical connection.
 	ship ships.Ship
+	// shipLock locks ship, as it may be replaced when resuming the crane.
+	shipLock sync.RWMutex
+	// shipHandedOver indicates that the ship was handed over to another crane
+	// for resuming it and must not be sunk.
+	shipHandedOver *abool.AtomicBool
+	// resumption holds the state for resuming the crane on a new ship.
+	// It is only set if the crane is resumable.
+	resumption *craneResumption
 	// unloading moves containers from the ship to the crane.
 	unloading chan *container.Container
 	// loading moves containers from the crane to the ship.
@@ -105,6 +130,10 @@ type Crane struct {
 
 	// targetLoadSize defines the optimal loading size.
 	targetLoadSize int
+
+	// tracer records the message headers of all terminals, if tracing was
+	// started.
+	tracer atomic.Pointer[terminal.Tracer]
 }
 
 // NewCrane returns a new crane.
@@ -119,6 +148,8 @@ func NewCrane(ship ships.Ship, connectedHub *hub.Hub, id *cabin.Identity) (*Cran
 		stopped:       abool.NewBool(false),
 		authenticated: abool.NewBool(false),
 
+		shipHandedOver: abool.NewBool(false),
+
 		ConnectedHub: connectedHub,
 		NetState:     newNetworkOptimizationState(),
 		identity:     id,
@@ -128,6 +159,7 @@ func NewCrane(ship ships.Ship, connectedHub *hub.Hub, id *cabin.Identity) (*Cran
 		loading:        make(chan *container.Container, 100),
 		terminalMsgs:   make(chan *terminal.Msg, 100),
 		controllerMsgs: make(chan *terminal.Msg, 100),
+		rekeySegments:  make(chan *craneRekey, 1),
 
 		terminals: make(map[uint32]terminal.Terminal),
 	}
@@ -160,12 +192,20 @@ func NewCrane(ship ships.Ship, connectedHub *hub.Hub, id *cabin.Identity) (*Cran
 
 // IsMine returns whether the crane was started on this side.
 func (crane *Crane) IsMine() bool {
-	return crane.ship.IsMine()
+	return crane.getShip().IsMine()
 }
 
 // Public returns whether the crane has been published.
 func (crane *Crane) Public() bool {
-	return crane.ship.Public()
+	return crane.getShip().Public()
+}
+
+// getShip returns the current ship of the crane.
+func (crane *Crane) getShip() ships.Ship {
+	crane.shipLock.RLock()
+	defer crane.shipLock.RUnlock()
+
+	return crane.ship
 }
 
 // IsStopping returns whether the crane is stopping.
@@ -241,8 +281,9 @@ func (crane *Crane) Publish() error {
 	}
 
 	// Mark crane as public.
-	maskedID := crane.ship.MaskAddress(crane.ship.RemoteAddr())
-	crane.ship.MarkPublic()
+	ship := crane.getShip()
+	maskedID := ship.MaskAddress(ship.RemoteAddr())
+	ship.MarkPublic()
 
 	// Assign crane to make it available to others.
 	AssignCrane(crane.ConnectedHub.ID, crane)
@@ -253,17 +294,17 @@ func (crane *Crane) Publish() error {
 
 // LocalAddr returns ship's local address.
 func (crane *Crane) LocalAddr() net.Addr {
-	return crane.ship.LocalAddr()
+	return crane.getShip().LocalAddr()
 }
 
 // RemoteAddr returns ship's local address.
 func (crane *Crane) RemoteAddr() net.Addr {
-	return crane.ship.RemoteAddr()
+	return crane.getShip().RemoteAddr()
 }
 
 // Transport returns ship's transport.
 func (crane *Crane) Transport() *hub.Transport {
-	return crane.ship.Transport()
+	return crane.getShip().Transport()
 }
 
 func (crane *Crane) getNextTerminalID() uint32 {
@@ -383,15 +424,17 @@ func (crane *Crane) Send(msg *terminal.Msg, timeout time.Duration) *terminal.Err
 }
 
 func (crane *Crane) encrypt(shipment *container.Container) (encrypted *container.Container, err error) {
+	crane.jessionLock.Lock()
+	defer crane.jessionLock.Unlock()
+
 	// Skip if encryption is not enabled.
 	if crane.jession == nil {
 		return shipment, nil
 	}
 
-	crane.jessionLock.Lock()
-	defer crane.jessionLock.Unlock()
-
-	letter, err := crane.jession.Close(shipment.CompileData())
+	data := shipment.CompileData()
+	crane.rekeyBytes.Add(uint64(len(data)))
+	letter, err := crane.jession.Close(data)
 	if err != nil {
 		return nil, err
 	}
@@ -405,23 +448,24 @@ func (crane *Crane) encrypt(shipment *container.Container) (encrypted *container
 }
 
 func (crane *Crane) decrypt(shipment *container.Container) (decrypted *container.Container, err error) {
+	crane.jessionLock.Lock()
+	defer crane.jessionLock.Unlock()
+
 	// Skip if encryption is not enabled.
-	if crane.jession == nil {
+	if crane.recvJession == nil {
 		return shipment, nil
 	}
 
-	crane.jessionLock.Lock()
-	defer crane.jessionLock.Unlock()
-
 	letter, err := jess.LetterFromWire(shipment)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse letter: %w", err)
 	}
 
-	decryptedData, err := crane.jession.Open(letter)
+	decryptedData, err := crane.recvJession.Open(letter)
 	if err != nil {
 		return nil, err
 	}
+	crane.rekeyBytes.Add(uint64(len(decryptedData)))
 
 	return container.New(decryptedData), nil
 }
@@ -431,72 +475,113 @@ func (crane *Crane) unloader(workerCtx context.Context) error {
 	defer crane.Stop(terminal.ErrUnknownError.With("unloader died"))
 
 	for {
-		// Get first couple bytes to get the packet length.
-		// 2 bytes are enough to encode 65535.
-		// On the other hand, packets can be only 2 bytes small.
-		lenBuf := make([]byte, 2)
-		err := crane.unloadUntilFull(lenBuf)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				crane.Stop(terminal.ErrStopping.With("connection closed"))
-			} else {
-				crane.Stop(terminal.ErrInternalError.With("failed to unload: %w", err))
+		// Unload next shipment.
+		ship := crane.getShip()
+		shipment, tErr := crane.unloadShipment(ship)
+		if tErr != nil {
+			// Continue with the new ship, if the crane could be resumed.
+			if crane.resume(ship, tErr) {
+				continue
 			}
+			crane.Stop(tErr)
 			return nil
 		}
 
-		// Unpack length.
-		containerLen, n, err := varint.Unpack64(lenBuf)
-		if err != nil {
-			crane.Stop(terminal.ErrMalformedData.With("failed to get container length: %w", err))
-			return nil
-		}
-		switch {
-		case containerLen <= 0:
-			crane.Stop(terminal.ErrMalformedData.With("received empty container with length %d", containerLen))
-			return nil
-		case containerLen > maxUnloadSize:
-			crane.Stop(terminal.ErrMalformedData.With("received oversized container with length %d", containerLen))
+		// Submit to handler.
+		select {
+		case <-crane.ctx.Done():
+			crane.Stop(nil)
 			return nil
+		case crane.unloading <- shipment:
 		}
+	}
+}
 
-		// Build shipment.
-		var shipmentBuf []byte
-		leftovers := len(lenBuf) - n
+// unloadShipment unloads a single shipment from the given ship.
+func (crane *Crane) unloadShipment(ship ships.Ship) (*container.Container, *terminal.Error) {
+	// Get first couple bytes to get the packet length.
+	// 2 bytes are enough to encode 65535.
+	// On the other hand, packets can be only 2 bytes small.
+	lenBuf := make([]byte, 2)
+	err := crane.unloadUntilFull(ship, lenBuf)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, terminal.ErrStopping.With("connection closed")
+		}
+		return nil, terminal.ErrInternalError.With("failed to unload: %w", err)
+	}
 
-		if leftovers == int(containerLen) {
-			// We already have all the shipment data.
-			shipmentBuf = lenBuf[n:]
-		} else {
-			// Create a shipment buffer, copy leftovers and read the rest from the connection.
-			shipmentBuf = make([]byte, containerLen)
-			if leftovers > 0 {
-				copy(shipmentBuf, lenBuf[n:])
-			}
+	// Unpack length.
+	containerLen, n, err := varint.Unpack64(lenBuf)
+	if err != nil {
+		return nil, terminal.ErrMalformedData.With("failed to get container length: %w", err)
+	}
+	switch {
+	case containerLen <= 0:
+		return nil, terminal.ErrMalformedData.With("received empty container with length %d", containerLen)
+	case containerLen > maxUnloadSize:
+		return nil, terminal.ErrMalformedData.With("received oversized container with length %d", containerLen)
+	}
 
-			// Read remaining shipment.
-			err = crane.unloadUntilFull(shipmentBuf[leftovers:])
-			if err != nil {
-				crane.Stop(terminal.ErrInternalError.With("failed to unload: %w", err))
-				return nil
-			}
+	// Build shipment.
+	var shipmentBuf []byte
+	leftovers := len(lenBuf) - n
+
+	if leftovers == int(containerLen) {
+		// We already have all the shipment data.
+		shipmentBuf = lenBuf[n:]
+	} else {
+		// Create a shipment buffer, copy leftovers and read the rest from the connection.
+		shipmentBuf = make([]byte, containerLen)
+		if leftovers > 0 {
+			copy(shipmentBuf, lenBuf[n:])
 		}
 
-		// Submit to handler.
-		select {
-		case <-crane.ctx.Done():
-			crane.Stop(nil)
-			return nil
-		case crane.unloading <- container.New(shipmentBuf):
+		// Read remaining shipment.
+		err = crane.unloadUntilFull(ship, shipmentBuf[leftovers:])
+		if err != nil {
+			return nil, terminal.ErrInternalError.With("failed to unload: %w", err)
 		}
 	}
+
+	return container.New(shipmentBuf), nil
 }
 
-func (crane *Crane) unloadUntilFull(buf []byte) error {
+// unloadInitMsg unloads a single message from the given ship during the
+// crane init procedure.
+func (crane *Crane) unloadInitMsg(callerCtx context.Context, ship ships.Ship, waitingFor string) (*container.Container, *terminal.Error) {
+	type unloadResult struct {
+		msg *container.Container
+		err *terminal.Error
+	}
+
+	// Unload in a separate worker in order to be able to time out.
+	// The ship is sunk by the caller if the crane init fails, which will also
+	// end the worker.
+	result := make(chan unloadResult, 1)
+	module.StartWorker("crane init unloader", func(_ context.Context) error {
+		msg, tErr := crane.unloadShipment(ship)
+		result <- unloadResult{msg: msg, err: tErr}
+		return nil
+	})
+
+	select {
+	case r := <-result:
+		return r.msg, r.err
+	case <-time.After(30 * time.Second):
+		return nil, terminal.ErrTimeout.With("waiting for %s", waitingFor)
+	case <-crane.ctx.Done():
+		return nil, terminal.ErrShipSunk.With("waiting for %s", waitingFor)
+	case <-callerCtx.Done():
+		return nil, terminal.ErrCanceled.With("waiting for %s", waitingFor)
+	}
+}
+
+func (crane *Crane) unloadUntilFull(ship ships.Ship, buf []byte) error {
 	var bytesRead int
 	for {
 		// Get shipment from ship.
-		n, err := crane.ship.UnloadTo(buf[bytesRead:])
+		n, err := ship.UnloadTo(buf[bytesRead:])
 		if err != nil {
 			return err
 		}
@@ -531,6 +616,12 @@ handling:
 			return nil
 
 		case shipment := <-crane.unloading:
+			// A nil shipment is sent by the unloader in order to make sure that
+			// all previous shipments have been handled.
+			if shipment == nil {
+				continue handling
+			}
+
 			// log.Debugf("spn/crane %s: before decrypt: %v ... %v", crane.ID, c.CompileData()[:10], c.CompileData()[c.Length()-10:])
 
 			// Decrypt shipment.
@@ -540,6 +631,11 @@ handling:
 				return nil
 			}
 
+			// Count handled shipments for resuming.
+			if crane.resumption != nil {
+				crane.resumption.unloaded.Add(1)
+			}
+
 			// Process all segments/containers of the shipment.
 			for shipment.HoldsData() {
 				if partialShipment != nil {
@@ -599,7 +695,16 @@ handling:
 
 				switch terminalMsgType {
 				case terminal.MsgTypeInit:
-					crane.establishTerminal(terminalID, segment)
+					// The crane controller is initialized with the start message, so
+					// init segments for it are used to switch encryption sessions.
+					if terminalID == 0 {
+						if tErr := crane.handleRekey(segment); tErr != nil {
+							crane.Stop(tErr.Wrap("failed to handle rekey"))
+							return nil
+						}
+					} else {
+						crane.establishTerminal(terminalID, segment)
+					}
 
 				case terminal.MsgTypeData, terminal.MsgTypePriorityData:
 					// Get terminal and let it further handle the message.
@@ -663,6 +768,7 @@ func (crane *Crane) loader(workerCtx context.Context) (err error) {
 
 	// Make sure any received message is finished
 	var msg, firstMsg *terminal.Msg
+	var rekey *craneRekey
 	defer msg.Finish()
 	defer firstMsg.Finish()
 
@@ -687,6 +793,11 @@ func (crane *Crane) loader(workerCtx context.Context) (err error) {
 				select {
 				case msg = <-crane.controllerMsgs:
 				case msg = <-crane.terminalMsgs:
+				case rekey = <-crane.rekeySegments:
+					// Load the rekey segment immediately, as the session is switched
+					// after loading it.
+					shipment.AppendContainer(rekey.segment)
+					break fillingShipment
 				case <-loadNow():
 					break fillingShipment
 				case <-crane.ctx.Done():
@@ -762,12 +873,19 @@ func (crane *Crane) loader(workerCtx context.Context) (err error) {
 				shipment, partialShipment = partialShipment, nil
 
 				// If shipment is not big enough to send immediately, wait for more data.
-				if shipment.Length() < crane.targetLoadSize {
+				// A rekey segment must be loaded completely before switching sessions.
+				if shipment.Length() < crane.targetLoadSize && rekey == nil {
 					loadingTimer = time.NewTimer(loadingMaxWaitDuration)
 					break sendingShipment
 				}
 
 			} else {
+				// Switch to the new session, if a rekey segment was loaded.
+				if rekey != nil {
+					crane.switchSendSession(rekey)
+					rekey = nil
+				}
+
 				// Continue loading with new shipment.
 				shipment = container.New()
 				break sendingShipment
@@ -811,6 +929,16 @@ func (crane *Crane) load(c *container.Container) error {
 		}
 	}
 
+	// Keep shipment for resending, if the crane is resumable.
+	if crane.resumption != nil {
+		return crane.loadResumable(c)
+	}
+
+	return crane.loadShipment(crane.getShip(), c)
+}
+
+// loadShipment encrypts the shipment and loads it onto the given ship.
+func (crane *Crane) loadShipment(ship ships.Ship, c *container.Container) error {
 	// Encrypt shipment.
 	c, err := crane.encrypt(c)
 	if err != nil {
@@ -826,7 +954,7 @@ func (crane *Crane) load(c *container.Container) error {
 	crane.NetState.ReportTraffic(uint64(len(readyToSend)), false)
 
 	// Load onto ship.
-	err = crane.ship.Load(readyToSend)
+	err = ship.Load(readyToSend)
 	if err != nil {
 		return fmt.Errorf("failed to load ship: %w", err)
 	}
@@ -851,6 +979,7 @@ func (crane *Crane) Stop(err *terminal.Error) {
 
 	// Unregister crane.
 	unregisterCrane(crane)
+	unregisterResumableCrane(crane)
 
 	// Stop all terminals.
 	for _, t := range crane.allTerms() {
@@ -873,8 +1002,10 @@ func (crane *Crane) Stop(err *terminal.Error) {
 		time.Sleep(waitStep)
 	}
 
-	// Close connection.
-	crane.ship.Sink()
+	// Close connection, unless it was handed over to a resumed crane.
+	if !crane.shipHandedOver.IsSet() {
+		crane.getShip().Sink()
+	}
 
 	// Cancel crane context.
 	crane.cancelCtx()
@@ -896,14 +1027,15 @@ func (crane *Crane) allTerms() []terminal.Terminal {
 }
 
 func (crane *Crane) String() string {
-	remoteAddr := crane.ship.RemoteAddr()
+	ship := crane.getShip()
+	remoteAddr := ship.RemoteAddr()
 	switch {
 	case remoteAddr == nil:
 		return fmt.Sprintf("crane %s", crane.ID)
-	case crane.ship.IsMine():
-		return fmt.Sprintf("crane %s to %s", crane.ID, crane.ship.MaskAddress(crane.ship.RemoteAddr()))
+	case ship.IsMine():
+		return fmt.Sprintf("crane %s to %s", crane.ID, ship.MaskAddress(remoteAddr))
 	default:
-		return fmt.Sprintf("crane %s from %s", crane.ID, crane.ship.MaskAddress(crane.ship.RemoteAddr()))
+		return fmt.Sprintf("crane %s from %s", crane.ID, ship.MaskAddress(remoteAddr))
 	}
 }
 
@@ -11,6 +11,7 @@ import (
 	"github.com/safing/portbase/info"
 	"github.com/safing/portbase/log"
 	"github.com/safing/spn/conf"
+	"github.com/safing/spn/hub"
 	"github.com/safing/spn/terminal"
 )
 
@@ -21,7 +22,10 @@ used by init procedures
 
 - Data [bytes block]
 	- MsgType [varint]
-	- Data [bytes; only when MsgType is Verify or Start*]
+	- Data [bytes; only when MsgType is Verify, Start* or Resume]
+
+The decrypted data of StartResumable is prefixed with the session ticket
+[bytes block]. See crane_resume.go for the Resume message.
 
 Crane Init Response Format:
 
@@ -42,6 +46,8 @@ const (
 	CraneMsgTypeVerify           = 3
 	CraneMsgTypeStartEncrypted   = 4
 	CraneMsgTypeStartUnencrypted = 5
+	CraneMsgTypeStartResumable   = 6
+	CraneMsgTypeResume           = 7
 )
 
 // Start starts the crane.
@@ -139,6 +145,7 @@ func (crane *Crane) startLocal(callerCtx context.Context) *terminal.Error {
 		if err != nil {
 			return terminal.ErrInternalError.With("failed to create encryption session: %w", err)
 		}
+		crane.recvJession = crane.jession
 	}
 
 	// Create crane controller.
@@ -151,6 +158,20 @@ func (crane *Crane) startLocal(callerCtx context.Context) *terminal.Error {
 	if crane.ship.IsSecure() {
 		initData.PrependNumber(CraneMsgTypeStartUnencrypted)
 	} else {
+		// Make crane resumable, if the Hub supports it.
+		startMsgType := CraneMsgTypeStartEncrypted
+		if crane.ConnectedHub.HasFlag(hub.FlagResumable) {
+			resumption, err := newCraneResumption(nil)
+			if err != nil {
+				return terminal.ErrInternalError.With("failed to set up resumption: %w", err)
+			}
+			crane.setResumption(resumption)
+
+			// Prefix the controller initializer with the session ticket.
+			initData.PrependAsBlock(resumption.ticket)
+			startMsgType = CraneMsgTypeStartResumable
+		}
+
 		// Encrypt controller initializer.
 		letter, err := crane.jession.Close(initData.CompileData())
 		if err != nil {
@@ -160,7 +181,7 @@ func (crane *Crane) startLocal(callerCtx context.Context) *terminal.Error {
 		if err != nil {
 			return terminal.ErrInternalError.With("failed to pack initial packet: %w", err)
 		}
-		initData.PrependNumber(CraneMsgTypeStartEncrypted)
+		initData.PrependNumber(uint64(startMsgType))
 	}
 
 	// Send start message.
@@ -173,6 +194,7 @@ func (crane *Crane) startLocal(callerCtx context.Context) *terminal.Error {
 	// Start remaining workers.
 	module.StartWorker("crane loader", crane.loader)
 	module.StartWorker("crane handler", crane.handler)
+	crane.startRekeying()
 
 	return nil
 }
@@ -180,21 +202,14 @@ func (crane *Crane) startLocal(callerCtx context.Context) *terminal.Error {
 func (crane *Crane) startRemote(callerCtx context.Context) *terminal.Error {
 	var initMsg *container.Container
 
-	module.StartWorker("crane unloader", crane.unloader)
-
+	// The unloader is only started after the init procedure, as the ship might
+	// be handed over to another crane for resuming it.
 handling:
 	for {
 		// Wait for request.
-		var request *container.Container
-		select {
-		case request = <-crane.unloading:
-
-		case <-time.After(30 * time.Second):
-			return terminal.ErrTimeout.With("waiting for crane init msg")
-		case <-crane.ctx.Done():
-			return terminal.ErrShipSunk.With("waiting for crane init msg")
-		case <-callerCtx.Done():
-			return terminal.ErrCanceled.With("waiting for crane init msg")
+		request, tErr := crane.unloadInitMsg(callerCtx, crane.ship, "crane init msg")
+		if tErr != nil {
+			return tErr
 		}
 
 		msgType, err := request.GetNextN8()
@@ -238,7 +253,7 @@ handling:
 			log.Debugf("spn/docks: %s initiated unencrypted channel", crane)
 			break handling
 
-		case CraneMsgTypeStartEncrypted:
+		case CraneMsgTypeStartEncrypted, CraneMsgTypeStartResumable:
 			if crane.identity == nil {
 				return terminal.ErrIncorrectUsage.With("cannot start incoming crane without designated identity")
 			}
@@ -252,15 +267,34 @@ handling:
 			if err != nil {
 				return terminal.ErrInternalError.With("failed to create encryption session: %w", err)
 			}
+			crane.recvJession = crane.jession
 			initMsgData, err := crane.jession.Open(letter)
 			if err != nil {
 				return terminal.ErrIntegrity.With("failed to decrypt initial packet: %w", err)
 			}
 			initMsg = container.New(initMsgData)
 
+			// Make crane resumable, if requested.
+			if msgType == CraneMsgTypeStartResumable {
+				ticket, err := initMsg.GetNextBlock()
+				if err != nil {
+					return terminal.ErrMalformedData.With("failed to get session ticket: %w", err)
+				}
+				resumption, err := newCraneResumption(ticket)
+				if err != nil {
+					return terminal.ErrMalformedData.With("invalid session ticket: %w", err)
+				}
+				crane.setResumption(resumption)
+				registerResumableCrane(crane)
+			}
+
 			// Start crane with initMsg.
 			log.Debugf("spn/docks: %s initiated encrypted channel", crane)
 			break handling
+
+		case CraneMsgTypeResume:
+			// Resume is a terminating request.
+			return crane.handleCraneResume(request)
 		}
 	}
 
@@ -270,6 +304,7 @@ handling:
 	}
 
 	// Start remaining workers.
+	module.StartWorker("crane unloader", crane.unloader)
 	module.StartWorker("crane loader", crane.loader)
 	module.StartWorker("crane handler", crane.handler)
 
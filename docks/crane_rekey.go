@@ -0,0 +1,261 @@
+package docks
+
+import (
+	"context"
+	"time"
+
+	"github.com/safing/jess"
+	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/formats/varint"
+	"github.com/safing/portbase/log"
+	"github.com/safing/spn/terminal"
+)
+
+/*
+Crane Re-Keying:
+
+Encrypted cranes whose controllers agreed on terminal.CapabilityRekey
+periodically switch to new jess wire sessions, as requested by the re-key
+options of the local crane controller. Like with terminals (see
+terminal/rekey.go), every new session exchanges a new ephemeral key of the
+local crane with the exchange key currently announced by the connected Hub, so
+forward secrecy is bounded by the lifetime of the Hub's exchange keys.
+
+Re-keying is always initiated by the local crane. Every direction switches
+sessions independently with a rekey segment. This is an init message for the
+crane controller, which is otherwise never sent, as the crane controller is
+initialized with the start message of the crane:
+
+- Epoch [varint]: how often the crane was resumed
+- Handshake [bytes; only when initiating]: first letter of the new session
+
+The sender switches to the new session after loading the shipment that
+completes the rekey segment. The receiver switches to the new session after
+handling the rekey segment.
+
+1. The local crane creates a new session, sends the rekey segment with the
+   first letter of the new session and then switches to the new session for
+   sending.
+2. The remote crane creates its new session from the received letter and
+   switches to it for receiving. It then sends an empty rekey segment and
+   switches to the new session for sending.
+3. The local crane switches to the new session for receiving.
+
+When the crane is resumed, both sides switch to the session of the resumption,
+which aborts unfinished re-keys. Rekey segments that are resent with the
+resumption are ignored, as they have a previous epoch.
+
+*/
+
+// craneRekeyCheckInterval defines how often the re-key options are checked.
+// It is only changed for testing.
+var craneRekeyCheckInterval = 10 * time.Second
+
+// craneRekey is a rekey segment waiting to be loaded.
+type craneRekey struct {
+	segment *container.Container
+	next    *jess.Session
+	epoch   uint64
+}
+
+// Rekeys returns how often the crane switched to new encryption sessions.
+func (crane *Crane) Rekeys() uint32 {
+	return crane.rekeys.Load()
+}
+
+// startRekeying starts re-keying, if the crane is encrypted and re-keying was
+// requested. Must only be called on local cranes.
+func (crane *Crane) startRekeying() {
+	if crane.jession == nil ||
+		(crane.opts.RekeyInterval == 0 && crane.opts.RekeyBytes == 0) {
+		return
+	}
+
+	module.StartWorker("crane re-keying", crane.rekeyWorker)
+}
+
+func (crane *Crane) rekeyWorker(_ context.Context) error {
+	ticker := time.NewTicker(craneRekeyCheckInterval)
+	defer ticker.Stop()
+
+	lastRekey := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-crane.ctx.Done():
+			return nil
+		}
+
+		// Check if re-keying was agreed on and is due.
+		if !crane.Controller.HasCapability(terminal.CapabilityRekey) {
+			continue
+		}
+		switch {
+		case crane.opts.RekeyInterval > 0 && time.Since(lastRekey) >= crane.opts.RekeyInterval:
+		case crane.opts.RekeyBytes > 0 && crane.rekeyBytes.Load() >= crane.opts.RekeyBytes:
+		default:
+			continue
+		}
+
+		tErr := crane.rekey()
+		switch {
+		case tErr == nil:
+			lastRekey = time.Now()
+		case tErr.Is(terminal.ErrStopping):
+			return nil
+		case tErr.Is(terminal.ErrHubNotReady):
+			// Retry with the next check, as the Hub might announce new
+			// exchange keys with its next status update.
+			log.Warningf("spn/docks: %s failed to re-key: %s", crane, tErr)
+		default:
+			crane.Stop(tErr.Wrap("failed to re-key"))
+			return nil
+		}
+	}
+}
+
+// rekey starts switching to a new encryption session, which uses the exchange
+// key currently announced by the connected Hub.
+// It is a no-op if the previous re-key has not yet finished.
+// Must only be called on local cranes.
+func (crane *Crane) rekey() *terminal.Error {
+	// Select a public key of the Hub.
+	signet := crane.ConnectedHub.SelectSignet()
+	if signet == nil {
+		return terminal.ErrHubNotReady.With("failed to select signet")
+	}
+
+	// Create the new session and its first letter.
+	env := jess.NewUnconfiguredEnvelope()
+	env.SuiteID = jess.SuiteWireV1
+	env.Recipients = []*jess.Signet{signet}
+	next, err := env.WireCorrespondence(nil)
+	if err != nil {
+		return terminal.ErrInternalError.With("failed to create encryption session: %w", err)
+	}
+	handshake, err := next.Close(nil)
+	if err != nil {
+		return terminal.ErrIntegrity.With("failed to create handshake: %w", err)
+	}
+	handshakeData, err := handshake.ToWire()
+	if err != nil {
+		return terminal.ErrInternalError.With("failed to pack handshake: %w", err)
+	}
+
+	// Prepare switching sessions.
+	crane.jessionLock.Lock()
+	if crane.rekeyRecvNext != nil {
+		crane.jessionLock.Unlock()
+		return nil
+	}
+	crane.rekeyRecvNext = next
+	epoch := crane.rekeyEpoch
+	crane.jessionLock.Unlock()
+
+	crane.rekeyBytes.Store(0)
+	select {
+	case crane.rekeySegments <- newCraneRekey(next, epoch, handshakeData):
+		return nil
+	case <-crane.ctx.Done():
+		return terminal.ErrStopping
+	}
+}
+
+// newCraneRekey creates a rekey segment, which switches to the given session.
+func newCraneRekey(next *jess.Session, epoch uint64, handshake *container.Container) *craneRekey {
+	segment := container.New(varint.Pack64(epoch))
+	if handshake != nil {
+		segment.AppendContainer(handshake)
+	}
+	terminal.MakeMsg(segment, 0, terminal.MsgTypeInit)
+
+	return &craneRekey{
+		segment: segment,
+		next:    next,
+		epoch:   epoch,
+	}
+}
+
+// handleRekey handles a rekey segment.
+// Must only be called by the handler, as the session for receiving is switched
+// before the next shipment is decrypted.
+func (crane *Crane) handleRekey(segment *container.Container) *terminal.Error {
+	epoch, err := segment.GetNextN64()
+	if err != nil {
+		return terminal.ErrMalformedData.With("failed to get rekey epoch: %w", err)
+	}
+
+	crane.jessionLock.Lock()
+	defer crane.jessionLock.Unlock()
+
+	if crane.jession == nil {
+		return terminal.ErrIncorrectUsage.With("received rekey on unencrypted crane")
+	}
+
+	// Ignore rekey segments that were resent when resuming the crane.
+	if epoch != crane.rekeyEpoch {
+		return nil
+	}
+
+	// Handle the reply of the remote crane.
+	// The local crane only sends a rekey segment, if re-keying was agreed on.
+	if !segment.HoldsData() {
+		if crane.rekeyRecvNext == nil {
+			return terminal.ErrIncorrectUsage.With("received unexpected rekey reply")
+		}
+		crane.recvJession = crane.rekeyRecvNext
+		crane.rekeyRecvNext = nil
+		crane.rekeys.Add(1)
+		return nil
+	}
+
+	// Otherwise, the local crane initiated a re-key.
+	switch {
+	case crane.identity == nil:
+		return terminal.ErrIncorrectUsage.With("received rekey on local crane")
+	case !crane.Controller.HasCapability(terminal.CapabilityRekey):
+		return terminal.ErrIncorrectUsage.With("received rekey without agreed re-keying")
+	}
+
+	// Create new session from the handshake.
+	handshake, err := jess.LetterFromWire(segment)
+	if err != nil {
+		return terminal.ErrMalformedData.With("failed to parse rekey handshake: %w", err)
+	}
+	next, err := handshake.WireCorrespondence(crane.identity)
+	if err != nil {
+		return terminal.ErrIntegrity.With("failed to initialize new session: %w", err)
+	}
+	if _, err := next.Open(handshake); err != nil {
+		return terminal.ErrIntegrity.With("failed to open rekey handshake: %w", err)
+	}
+	crane.recvJession = next
+
+	// Reply with an empty rekey segment.
+	// The handler must not block, but only one re-key may be in progress.
+	select {
+	case crane.rekeySegments <- newCraneRekey(next, epoch, nil):
+		return nil
+	default:
+		return terminal.ErrIncorrectUsage.With("received rekey while re-keying")
+	}
+}
+
+// switchSendSession switches to the session of the given rekey segment for
+// sending. Must only be called by the loader after the rekey segment was
+// loaded.
+func (crane *Crane) switchSendSession(rekey *craneRekey) {
+	crane.jessionLock.Lock()
+	defer crane.jessionLock.Unlock()
+
+	// Ignore rekey segments from before the crane was resumed.
+	if rekey.epoch != crane.rekeyEpoch {
+		return
+	}
+	crane.jession = rekey.next
+
+	// The re-key is finished, if the session for receiving was already switched.
+	if crane.rekeyRecvNext == nil {
+		crane.rekeys.Add(1)
+	}
+}
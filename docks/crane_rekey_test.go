@@ -0,0 +1,89 @@
+package docks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/safing/spn/cabin"
+	"github.com/safing/spn/hub"
+	"github.com/safing/spn/ships"
+	"github.com/safing/spn/terminal"
+)
+
+func TestCraneRekey(t *testing.T) {
+	t.Parallel()
+
+	// Create identity with support for terminal capabilities.
+	identity, err := cabin.CreateIdentity(module.Ctx, "test")
+	if err != nil {
+		t.Fatalf("failed to create identity: %s", err)
+	}
+	_, err = identity.MaintainStatus(nil, nil, []string{hub.FlagTerminalV2}, false)
+	if err != nil {
+		t.Fatalf("failed to update identity: %s", err)
+	}
+
+	// Build ship and cranes.
+	ship := ships.NewTestShip(false, 100)
+	crane1, err := NewCrane(ship, identity.Hub, nil)
+	if err != nil {
+		t.Fatalf("failed to create crane1: %s", err)
+	}
+	crane2, err := NewCrane(ship.Reverse(), nil, identity)
+	if err != nil {
+		t.Fatalf("failed to create crane2: %s", err)
+	}
+	crane2Started := make(chan error)
+	go func() {
+		crane2Started <- crane2.Start(module.Ctx)
+	}()
+	err = crane1.Start(module.Ctx)
+	if err != nil {
+		t.Fatalf("failed to start crane1: %s", err)
+	}
+	err = <-crane2Started
+	if err != nil {
+		t.Fatalf("failed to start crane2: %s", err)
+	}
+	defer crane1.Stop(nil)
+
+	// Re-key continuously while traffic is flowing in both directions.
+	ctx, cancel := context.WithCancel(module.Ctx)
+	rekeyDone := make(chan struct{})
+	go func() {
+		defer close(rekeyDone)
+		for {
+			select {
+			case <-time.After(5 * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
+			if tErr := crane1.rekey(); tErr != nil {
+				t.Errorf("failed to re-key: %s", tErr)
+				return
+			}
+		}
+	}()
+	op, tErr := terminal.NewCounterOp(crane1.Controller, terminal.CounterOpts{
+		ClientCountTo: 1000,
+		ServerCountTo: 1000,
+		Wait:          time.Millisecond,
+	})
+	if tErr != nil {
+		t.Fatalf("failed to run counter op: %s", tErr)
+	}
+	op.Wait()
+	cancel()
+	<-rekeyDone
+
+	if op.Error != nil {
+		t.Fatalf("counter op failed: %s", op.Error)
+	}
+	assert.Greater(t, crane1.Rekeys(), uint32(1), "crane1 should have re-keyed")
+	assert.Greater(t, crane2.Rekeys(), uint32(1), "crane2 should have re-keyed")
+	assert.False(t, crane1.Stopped(), "crane1 should not be stopped")
+	assert.False(t, crane2.Stopped(), "crane2 should not be stopped")
+}
@@ -0,0 +1,649 @@
+package docks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/jess"
+	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portbase/rng"
+	"github.com/safing/spn/hub"
+	"github.com/safing/spn/ships"
+	"github.com/safing/spn/terminal"
+)
+
+/*
+Crane Resumption:
+
+When the ship of a crane breaks, eg. because the IP address of the client
+changed, the crane is resumed on a new ship, keeping all its terminals.
+
+1. If the Hub has the resumable flag, the client prefixes the encrypted start
+   message with a random session ticket (StartResumable).
+2. Both sides keep the shipments they loaded last in a resend buffer and count
+   the shipments they handled.
+3. When the ship breaks, the client launches a new ship to the Hub and sends a
+   Resume message, encrypted with a new session:
+   - Session Ticket [bytes block]
+   - Handled Shipments [varint]
+4. The Hub finds the crane by the session ticket, checks the count of handled
+   shipments and hands over the new ship. It then replies with its own count
+   of handled shipments and a new session ticket, encrypted with the new
+   session:
+   - Handled Shipments [varint]
+   - New Session Ticket [bytes block]
+5. Both sides resend the shipments the other side did not handle and continue
+   with the new ship, the new encryption session and the new session ticket.
+   As the ticket is rotated on every resumption, a captured Resume message
+   cannot be replayed.
+
+If the other side missed more shipments than are in the resend buffer, or no
+new ship is available in time, the crane is stopped.
+*/
+
+const (
+	// resumeTicketSize defines the size of the session ticket.
+	resumeTicketSize = 32
+
+	// maxResumeDuration defines how long a crane waits for a new ship before
+	// it is stopped.
+	maxResumeDuration = 2 * time.Minute
+
+	// resumeRetryDelay defines how long to wait between attempts to launch a
+	// new ship.
+	resumeRetryDelay = 5 * time.Second
+
+	// resumeHandOverTimeout defines how long to wait for a crane to accept a
+	// new ship.
+	resumeHandOverTimeout = 10 * time.Second
+
+	// maxResendBufferSize defines how many bytes of loaded shipments are kept
+	// for resending.
+	maxResendBufferSize = 256 * 1024
+)
+
+// launchResumeShip launches a new ship for resuming a crane.
+// It may be replaced for testing.
+var launchResumeShip = func(ctx context.Context, h *hub.Hub) (ships.Ship, error) {
+	return ships.Launch(ctx, h, nil, nil)
+}
+
+var (
+	resumableCranes     = make(map[string]*Crane) // ID = Session Ticket
+	resumableCranesLock sync.Mutex
+)
+
+// craneResumption holds the state needed for resuming a crane.
+type craneResumption struct {
+	// ticket is the session ticket used to identify the crane.
+	// It is protected by resumableCranesLock, as it is rotated on resumption.
+	ticket []byte
+
+	// loadLock locks loading shipments and replacing the ship.
+	loadLock sync.Mutex
+	// resendBuffer holds the last loaded shipments for resending.
+	resendBuffer [][]byte
+	// resendBufferSize holds the total size of the shipments in resendBuffer.
+	resendBufferSize int
+	// loaded holds the amount of loaded shipments.
+	loaded uint64
+
+	// loadedMirror and oldestKeptMirror mirror loaded and the count of the
+	// oldest kept shipment, so that resume requests can be checked without
+	// waiting for the loadLock, which is held while loading to a broken ship.
+	loadedMirror     atomic.Uint64
+	oldestKeptMirror atomic.Uint64
+
+	// unloaded holds the amount of handled shipments.
+	unloaded atomic.Uint64
+
+	// replaced is closed when the ship was replaced or resuming failed.
+	// It is protected by the crane's shipLock.
+	replaced chan struct{}
+
+	// replacements is used to hand over new ships to a remote crane.
+	replacements chan *craneReplacement
+}
+
+// craneReplacement holds a new ship with its encryption session.
+type craneReplacement struct {
+	ship         ships.Ship
+	jession      *jess.Session
+	peerUnloaded uint64
+}
+
+func newCraneResumption(ticket []byte) (*craneResumption, error) {
+	// Create new ticket, if none is given.
+	if ticket == nil {
+		var err error
+		ticket, err = rng.Bytes(resumeTicketSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session ticket: %w", err)
+		}
+	}
+	if len(ticket) != resumeTicketSize {
+		return nil, fmt.Errorf("session ticket has invalid size of %d", len(ticket))
+	}
+
+	return &craneResumption{
+		ticket:       ticket,
+		replaced:     make(chan struct{}),
+		replacements: make(chan *craneReplacement),
+	}, nil
+}
+
+func (crane *Crane) setResumption(r *craneResumption) {
+	crane.shipLock.Lock()
+	defer crane.shipLock.Unlock()
+
+	crane.resumption = r
+}
+
+func (crane *Crane) getResumption() *craneResumption {
+	crane.shipLock.RLock()
+	defer crane.shipLock.RUnlock()
+
+	return crane.resumption
+}
+
+func registerResumableCrane(crane *Crane) {
+	resumableCranesLock.Lock()
+	defer resumableCranesLock.Unlock()
+
+	resumableCranes[string(crane.resumption.ticket)] = crane
+}
+
+func unregisterResumableCrane(crane *Crane) {
+	r := crane.getResumption()
+	if r == nil {
+		return
+	}
+
+	resumableCranesLock.Lock()
+	defer resumableCranesLock.Unlock()
+
+	if resumableCranes[string(r.ticket)] == crane {
+		delete(resumableCranes, string(r.ticket))
+	}
+}
+
+func getResumableCrane(ticket []byte) *Crane {
+	resumableCranesLock.Lock()
+	defer resumableCranesLock.Unlock()
+
+	return resumableCranes[string(ticket)]
+}
+
+// addResumableTicket additionally registers the crane with the given ticket.
+func addResumableTicket(crane *Crane, ticket []byte) {
+	resumableCranesLock.Lock()
+	defer resumableCranesLock.Unlock()
+
+	resumableCranes[string(ticket)] = crane
+}
+
+// removeResumableTicket removes the given ticket of the crane.
+func removeResumableTicket(crane *Crane, ticket []byte) {
+	resumableCranesLock.Lock()
+	defer resumableCranesLock.Unlock()
+
+	if resumableCranes[string(ticket)] == crane {
+		delete(resumableCranes, string(ticket))
+	}
+}
+
+// getTicket returns the current session ticket.
+func (r *craneResumption) getTicket() []byte {
+	resumableCranesLock.Lock()
+	defer resumableCranesLock.Unlock()
+
+	return r.ticket
+}
+
+// rotateTicket replaces the session ticket with the given one and removes the
+// old ticket of the crane from the resumable cranes.
+func (r *craneResumption) rotateTicket(crane *Crane, newTicket []byte) {
+	resumableCranesLock.Lock()
+	defer resumableCranesLock.Unlock()
+
+	if resumableCranes[string(r.ticket)] == crane {
+		delete(resumableCranes, string(r.ticket))
+	}
+	r.ticket = newTicket
+}
+
+// loadResumable loads the shipment and keeps it for resending.
+func (crane *Crane) loadResumable(c *container.Container) error {
+	r := crane.resumption
+
+	r.loadLock.Lock()
+	shipment := c.CompileData()
+	r.keep(shipment)
+	ship := crane.getShip()
+	err := crane.loadShipment(ship, container.New(shipment))
+	r.loadLock.Unlock()
+
+	// The shipment is resent when the crane is resumed on a new ship.
+	if err != nil && crane.awaitResumption(r, ship) {
+		return nil
+	}
+	return err
+}
+
+// keep adds a copy of the shipment to the resend buffer.
+// The loadLock must be held.
+func (r *craneResumption) keep(shipment []byte) {
+	kept := make([]byte, len(shipment))
+	copy(kept, shipment)
+	r.resendBuffer = append(r.resendBuffer, kept)
+	r.resendBufferSize += len(kept)
+	r.loaded++
+
+	// Remove oldest shipments if the buffer is full.
+	for r.resendBufferSize > maxResendBufferSize && len(r.resendBuffer) > 1 {
+		r.resendBufferSize -= len(r.resendBuffer[0])
+		r.resendBuffer[0] = nil
+		r.resendBuffer = r.resendBuffer[1:]
+	}
+
+	r.loadedMirror.Store(r.loaded)
+	r.oldestKeptMirror.Store(r.loaded - uint64(len(r.resendBuffer)))
+}
+
+// awaitResumption waits for the failed ship to be replaced by the unloader.
+// It returns whether the crane was resumed on a new ship.
+func (crane *Crane) awaitResumption(r *craneResumption, failedShip ships.Ship) (resumed bool) {
+	crane.shipLock.RLock()
+	currentShip := crane.ship
+	replaced := r.replaced
+	crane.shipLock.RUnlock()
+
+	// Check if the ship was already replaced.
+	if currentShip != failedShip {
+		return true
+	}
+
+	// Sink the failed ship, so that the unloader notices and resumes the crane.
+	failedShip.Sink()
+
+	select {
+	case <-replaced:
+		return crane.getShip() != failedShip
+	case <-crane.ctx.Done():
+		return false
+	}
+}
+
+// resume attempts to resume the crane on a new ship after the given ship failed.
+// It must only be called by the unloader.
+func (crane *Crane) resume(failedShip ships.Ship, shipErr *terminal.Error) (resumed bool) {
+	r := crane.getResumption()
+	if r == nil || crane.stopped.IsSet() {
+		return false
+	}
+	log.Warningf("spn/docks: %s lost its ship, attempting to resume: %s", crane, shipErr)
+	failedShip.Sink()
+
+	// Make sure the handler has handled all unloaded shipments.
+	select {
+	case crane.unloading <- nil:
+	case <-crane.ctx.Done():
+		return false
+	}
+
+	// Get and switch to a new ship.
+	var tErr *terminal.Error
+	if crane.IsMine() {
+		tErr = crane.resumeLocal(r)
+	} else {
+		tErr = crane.resumeRemote(r)
+	}
+	if tErr != nil {
+		log.Warningf("spn/docks: %s failed to resume: %s", crane, tErr)
+
+		// Release everyone waiting for a new ship.
+		crane.shipLock.Lock()
+		close(r.replaced)
+		r.replaced = make(chan struct{})
+		crane.shipLock.Unlock()
+
+		return false
+	}
+
+	log.Infof("spn/docks: %s resumed on new ship", crane)
+	return true
+}
+
+// resumeLocal launches a new ship to the connected Hub and resumes the crane on it.
+func (crane *Crane) resumeLocal(r *craneResumption) *terminal.Error {
+	if crane.ConnectedHub == nil {
+		return terminal.ErrIncorrectUsage.With("cannot resume crane without connected hub")
+	}
+
+	ctx, cancel := context.WithTimeout(crane.ctx, maxResumeDuration)
+	defer cancel()
+
+	for {
+		// Launch new ship and request resumption.
+		ship, err := launchResumeShip(ctx, crane.ConnectedHub)
+		if err == nil {
+			jession, peerUnloaded, newTicket, tErr := crane.requestResumption(ctx, r, ship)
+			if tErr == nil {
+				tErr = crane.replaceShip(r, ship, jession, peerUnloaded)
+				if tErr != nil {
+					ship.Sink()
+					return tErr
+				}
+				r.rotateTicket(crane, newTicket)
+				return nil
+			}
+			ship.Sink()
+
+			// Stop trying if the Hub refused to resume the crane.
+			if tErr.Is(terminal.ErrStopping) {
+				return tErr.Wrap("hub refused to resume")
+			}
+			log.Debugf("spn/docks: %s failed to request resumption: %s", crane, tErr)
+		} else {
+			log.Debugf("spn/docks: %s failed to launch new ship: %s", crane, err)
+		}
+
+		// Wait before trying again.
+		select {
+		case <-time.After(resumeRetryDelay):
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return terminal.ErrTimeout.With("no new ship available")
+			}
+			return terminal.ErrCanceled
+		}
+	}
+}
+
+// requestResumption sends a resume request on the given ship and returns the
+// new encryption session, the amount of shipments the Hub handled and the new
+// session ticket.
+func (crane *Crane) requestResumption(
+	ctx context.Context,
+	r *craneResumption,
+	ship ships.Ship,
+) (jession *jess.Session, peerUnloaded uint64, newTicket []byte, tErr *terminal.Error) {
+	// Select a public key of the Hub.
+	signet := crane.ConnectedHub.SelectSignet()
+	if signet == nil {
+		return nil, 0, nil, terminal.ErrHubNotReady.With("failed to select signet")
+	}
+
+	// Create new encryption session.
+	env := jess.NewUnconfiguredEnvelope()
+	env.SuiteID = jess.SuiteWireV1
+	env.Recipients = []*jess.Signet{signet}
+	jession, err := env.WireCorrespondence(nil)
+	if err != nil {
+		return nil, 0, nil, terminal.ErrInternalError.With("failed to create encryption session: %w", err)
+	}
+
+	// Build and send resume request.
+	request := container.New()
+	request.AppendAsBlock(r.getTicket())
+	request.AppendNumber(r.unloaded.Load())
+	letter, err := jession.Close(request.CompileData())
+	if err != nil {
+		return nil, 0, nil, terminal.ErrInternalError.With("failed to encrypt resume request: %w", err)
+	}
+	msg, err := letter.ToWire()
+	if err != nil {
+		return nil, 0, nil, terminal.ErrInternalError.With("failed to pack resume request: %w", err)
+	}
+	msg.PrependNumber(CraneMsgTypeResume)
+	msg.PrependLength()
+	err = ship.Load(msg.CompileData())
+	if err != nil {
+		return nil, 0, nil, terminal.ErrShipSunk.With("failed to send resume request: %w", err)
+	}
+
+	// Wait for reply.
+	reply, tErr := crane.unloadInitMsg(ctx, ship, "resume reply")
+	if tErr != nil {
+		return nil, 0, nil, tErr
+	}
+
+	// Decrypt and parse reply.
+	letter, err = jess.LetterFromWire(reply)
+	if err != nil {
+		return nil, 0, nil, terminal.ErrMalformedData.With("failed to unpack resume reply: %w", err)
+	}
+	replyData, err := jession.Open(letter)
+	if err != nil {
+		return nil, 0, nil, terminal.ErrIntegrity.With("failed to decrypt resume reply: %w", err)
+	}
+	replyC := container.New(replyData)
+	peerUnloaded, err = replyC.GetNextN64()
+	if err != nil {
+		return nil, 0, nil, terminal.ErrMalformedData.With("failed to parse resume reply: %w", err)
+	}
+	newTicket, err = replyC.GetNextBlock()
+	if err != nil {
+		return nil, 0, nil, terminal.ErrMalformedData.With("failed to get new session ticket: %w", err)
+	}
+	if len(newTicket) != resumeTicketSize {
+		return nil, 0, nil, terminal.ErrMalformedData.With("new session ticket has invalid size of %d", len(newTicket))
+	}
+
+	return jession, peerUnloaded, newTicket, nil
+}
+
+// resumeRemote waits for a new ship to be handed over and resumes the crane on it.
+func (crane *Crane) resumeRemote(r *craneResumption) *terminal.Error {
+	timeout := time.NewTimer(maxResumeDuration)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case replacement := <-r.replacements:
+			tErr := crane.acceptResumption(r, replacement)
+			if tErr == nil {
+				return nil
+			}
+			replacement.ship.Sink()
+			log.Debugf("spn/docks: %s failed to accept resumption: %s", crane, tErr)
+
+		case <-timeout.C:
+			return terminal.ErrTimeout.With("waiting for new ship")
+		case <-crane.ctx.Done():
+			return terminal.ErrStopping
+		}
+	}
+}
+
+// acceptResumption replies to a resume request and resumes the crane on the new ship.
+func (crane *Crane) acceptResumption(r *craneResumption, replacement *craneReplacement) (tErr *terminal.Error) {
+	// Create new session ticket and register it already, as the client may
+	// use it as soon as it received the reply.
+	newTicket, err := rng.Bytes(resumeTicketSize)
+	if err != nil {
+		return terminal.ErrInternalError.With("failed to create session ticket: %w", err)
+	}
+	addResumableTicket(crane, newTicket)
+	defer func() {
+		if tErr != nil {
+			removeResumableTicket(crane, newTicket)
+		}
+	}()
+
+	// Build and send reply.
+	reply := container.New()
+	reply.AppendNumber(r.unloaded.Load())
+	reply.AppendAsBlock(newTicket)
+	letter, err := replacement.jession.Close(reply.CompileData())
+	if err != nil {
+		return terminal.ErrInternalError.With("failed to encrypt resume reply: %w", err)
+	}
+	msg, err := letter.ToWire()
+	if err != nil {
+		return terminal.ErrInternalError.With("failed to pack resume reply: %w", err)
+	}
+	msg.PrependLength()
+	err = replacement.ship.Load(msg.CompileData())
+	if err != nil {
+		return terminal.ErrShipSunk.With("failed to send resume reply: %w", err)
+	}
+
+	tErr = crane.replaceShip(r, replacement.ship, replacement.jession, replacement.peerUnloaded)
+	if tErr != nil {
+		return tErr
+	}
+
+	// Invalidate the old session ticket.
+	r.rotateTicket(crane, newTicket)
+	return nil
+}
+
+// replaceShip switches the crane to the new ship and encryption session and
+// resends all shipments the other side did not handle yet.
+func (crane *Crane) replaceShip(
+	r *craneResumption,
+	ship ships.Ship,
+	jession *jess.Session,
+	peerUnloaded uint64,
+) *terminal.Error {
+	r.loadLock.Lock()
+	defer r.loadLock.Unlock()
+
+	// Check if all shipments the other side is missing are still available.
+	oldestKept := r.loaded - uint64(len(r.resendBuffer))
+	if tErr := checkPeerUnloaded(peerUnloaded, r.loaded, oldestKept); tErr != nil {
+		return tErr
+	}
+
+	// Switch to new encryption session and ship.
+	// Unfinished re-keys are aborted, as the new session replaces them.
+	crane.jessionLock.Lock()
+	crane.jession = jession
+	crane.recvJession = jession
+	crane.rekeyRecvNext = nil
+	crane.rekeyEpoch++
+	crane.jessionLock.Unlock()
+
+	crane.shipLock.Lock()
+	if crane.ship.Public() {
+		ship.MarkPublic()
+	}
+	crane.ship = ship
+	close(r.replaced)
+	r.replaced = make(chan struct{})
+	crane.shipLock.Unlock()
+
+	// Resend shipments the other side is missing.
+	for _, shipment := range r.resendBuffer[peerUnloaded-oldestKept:] {
+		resend := make([]byte, len(shipment))
+		copy(resend, shipment)
+		err := crane.loadShipment(ship, container.New(resend))
+		if err != nil {
+			return terminal.ErrShipSunk.With("failed to resend shipment: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// checkPeerUnloaded checks if all shipments the other side is missing are
+// still available for resending.
+func checkPeerUnloaded(peerUnloaded, loaded, oldestKept uint64) *terminal.Error {
+	switch {
+	case peerUnloaded > loaded:
+		return terminal.ErrIntegrity.With("peer handled %d shipments, but only %d were loaded", peerUnloaded, loaded)
+	case peerUnloaded < oldestKept:
+		return terminal.ErrInternalError.With("peer is missing shipments that are not kept anymore")
+	}
+	return nil
+}
+
+// handleCraneResume handles a resume request by handing over the ship to the
+// crane identified by the session ticket.
+func (crane *Crane) handleCraneResume(request *container.Container) *terminal.Error {
+	if crane.identity == nil {
+		return terminal.ErrIncorrectUsage.With("cannot resume crane without designated identity")
+	}
+
+	// Set up new encryption session.
+	letter, err := jess.LetterFromWire(container.New(request.CompileData()))
+	if err != nil {
+		return terminal.ErrMalformedData.With("failed to unpack resume request: %w", err)
+	}
+	jession, err := letter.WireCorrespondence(crane.identity)
+	if err != nil {
+		return terminal.ErrInternalError.With("failed to create encryption session: %w", err)
+	}
+	requestData, err := jession.Open(letter)
+	if err != nil {
+		return terminal.ErrIntegrity.With("failed to decrypt resume request: %w", err)
+	}
+
+	// Parse request.
+	requestC := container.New(requestData)
+	ticket, err := requestC.GetNextBlock()
+	if err != nil {
+		return terminal.ErrMalformedData.With("failed to get session ticket: %w", err)
+	}
+	peerUnloaded, err := requestC.GetNextN64()
+	if err != nil {
+		return terminal.ErrMalformedData.With("failed to get handled shipments: %w", err)
+	}
+
+	// Find crane to resume.
+	resumedCrane := getResumableCrane(ticket)
+	if resumedCrane == nil {
+		return terminal.ErrPermissionDenied.With("unknown session ticket")
+	}
+
+	// Hand over ship.
+	tErr := resumedCrane.handOver(&craneReplacement{
+		ship:         crane.ship,
+		jession:      jession,
+		peerUnloaded: peerUnloaded,
+	})
+	if tErr != nil {
+		return tErr.Wrap("failed to hand over ship to %s", resumedCrane)
+	}
+	crane.shipHandedOver.Set()
+
+	return terminal.ErrStopping.With("handed over ship to %s", resumedCrane)
+}
+
+// handOver hands over a new ship to the crane.
+func (crane *Crane) handOver(replacement *craneReplacement) *terminal.Error {
+	r := crane.getResumption()
+	if r == nil {
+		return terminal.ErrIncorrectUsage.With("crane is not resumable")
+	}
+
+	// Check the replacement before sinking the current ship, so that invalid
+	// resume requests cannot disrupt the crane.
+	tErr := checkPeerUnloaded(
+		replacement.peerUnloaded,
+		r.loadedMirror.Load(),
+		r.oldestKeptMirror.Load(),
+	)
+	if tErr != nil {
+		return tErr
+	}
+
+	// Sink the current ship, as the other side has moved on to a new one.
+	// This makes the unloader wait for the new ship.
+	crane.getShip().Sink()
+
+	select {
+	case r.replacements <- replacement:
+		return nil
+	case <-time.After(resumeHandOverTimeout):
+		return terminal.ErrTimeout.With("waiting for crane to accept new ship")
+	case <-crane.ctx.Done():
+		return terminal.ErrStopping
+	}
+}
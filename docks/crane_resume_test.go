@@ -0,0 +1,145 @@
+package docks
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/safing/spn/cabin"
+	"github.com/safing/spn/hub"
+	"github.com/safing/spn/ships"
+	"github.com/safing/spn/terminal"
+)
+
+func TestCraneResumption(t *testing.T) { //nolint:paralleltest // Test replaces launchResumeShip.
+	// Create resumable identity.
+	identity, err := cabin.CreateIdentity(module.Ctx, "test")
+	if err != nil {
+		t.Fatalf("failed to create identity: %s", err)
+	}
+	_, err = identity.MaintainStatus(nil, nil, []string{hub.FlagResumable, hub.FlagTerminalV2}, false)
+	if err != nil {
+		t.Fatalf("failed to update identity: %s", err)
+	}
+
+	// Dock new ships at a new crane, which hands them over to the resumed crane.
+	launchResumeShip = func(ctx context.Context, h *hub.Hub) (ships.Ship, error) {
+		newShip := ships.NewTestShip(false, 100)
+		go func() {
+			dockingCrane, err := NewCrane(newShip.Reverse(), nil, identity)
+			if err != nil {
+				t.Errorf("failed to create docking crane: %s", err)
+				return
+			}
+			_ = dockingCrane.Start(module.Ctx)
+		}()
+		return newShip, nil
+	}
+
+	// Build ship and cranes.
+	ship := ships.NewTestShip(false, 100)
+	crane1, err := NewCrane(ship, identity.Hub, nil)
+	if err != nil {
+		t.Fatalf("failed to create crane1: %s", err)
+	}
+	crane2, err := NewCrane(ship.Reverse(), nil, identity)
+	if err != nil {
+		t.Fatalf("failed to create crane2: %s", err)
+	}
+	crane2Started := make(chan error)
+	go func() {
+		crane2Started <- crane2.Start(module.Ctx)
+	}()
+	err = crane1.Start(module.Ctx)
+	if err != nil {
+		t.Fatalf("failed to start crane1: %s", err)
+	}
+	err = <-crane2Started
+	if err != nil {
+		t.Fatalf("failed to start crane2: %s", err)
+	}
+	defer crane1.Stop(nil)
+	assert.NotNil(t, crane1.getResumption(), "crane1 should be resumable")
+	assert.NotNil(t, crane2.getResumption(), "crane2 should be resumable")
+	oldTicket := crane1.getResumption().getTicket()
+
+	// Create terminal for receiving.
+	st := &StreamingTerminal{
+		test:  t,
+		id:    8,
+		crane: crane2,
+		recv:  make(chan *terminal.Msg),
+	}
+	crane2.setTerminal(st)
+
+	// Send data and break the ship in the middle, while re-keying.
+	count := 3000
+	go func() {
+		for i := 1; i <= count; i++ {
+			if i == count/2 {
+				if tErr := crane1.rekey(); tErr != nil {
+					t.Errorf("failed to re-key: %s", tErr)
+				}
+				ship.Sink()
+			}
+
+			msg := terminal.NewMsg([]byte(strconv.Itoa(i)))
+			msg.FlowID = st.id
+			tErr := crane1.Send(msg, 1*time.Second)
+			if tErr != nil {
+				msg.Finish()
+				t.Errorf("failed to send msg %d: %s", i, tErr)
+				return
+			}
+		}
+	}()
+
+	// Check that all data arrives in order.
+	for i := 1; i <= count; i++ {
+		select {
+		case msg := <-st.recv:
+			assert.Equal(t, strconv.Itoa(i), string(msg.Data.CompileData()), "data mismatched")
+		case <-time.After(30 * time.Second):
+			t.Fatalf("timed out waiting for msg %d", i)
+		}
+	}
+
+	assert.NotEqual(t, ship, crane1.getShip(), "crane1 should use a new ship")
+	assert.False(t, crane1.Stopped(), "crane1 should not be stopped")
+	assert.False(t, crane2.Stopped(), "crane2 should not be stopped")
+
+	// The session ticket must be rotated, so that the resume request cannot be replayed.
+	newTicket := crane1.getResumption().getTicket()
+	assert.NotEqual(t, oldTicket, newTicket, "ticket should be rotated")
+	assert.Equal(t, newTicket, crane2.getResumption().getTicket(), "tickets should match")
+	assert.Nil(t, getResumableCrane(oldTicket), "old ticket should be invalid")
+	assert.Equal(t, crane2, getResumableCrane(newTicket), "new ticket should be valid")
+
+	// An invalid replacement must not disrupt the crane.
+	tErr := crane2.handOver(&craneReplacement{
+		ship:         ships.NewTestShip(false, 100),
+		peerUnloaded: math.MaxUint64,
+	})
+	assert.Error(t, tErr, "invalid replacement should be refused")
+
+	// Re-keying must work after resuming.
+	if tErr := crane1.rekey(); tErr != nil {
+		t.Fatalf("failed to re-key: %s", tErr)
+	}
+	msg := terminal.NewMsg([]byte("after"))
+	msg.FlowID = st.id
+	if tErr := crane1.Send(msg, 1*time.Second); tErr != nil {
+		msg.Finish()
+		t.Fatalf("failed to send msg: %s", tErr)
+	}
+	select {
+	case msg := <-st.recv:
+		assert.Equal(t, "after", string(msg.Data.CompileData()), "data mismatched")
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for msg after refused replacement")
+	}
+}
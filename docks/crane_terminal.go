@@ -24,6 +24,9 @@ func NewLocalCraneTerminal(
 	remoteHub *hub.Hub,
 	initMsg *terminal.TerminalOpts,
 ) (*CraneTerminal, *container.Container, *terminal.Error) {
+	// Use the highest terminal version supported by the connected Hub.
+	initMsg.UpgradeVersion(crane.ConnectedHub)
+
 	// Create Terminal Base.
 	t, initData, err := terminal.NewLocalBaseTerminal(
 		crane.ctx,
@@ -73,6 +76,9 @@ func initCraneTerminal(
 	}
 	t.SetTerminalExtension(ct)
 
+	// Trace messages if enabled.
+	t.SetTracer(crane.tracer.Load())
+
 	// Start workers.
 	t.StartWorkers(module, "crane terminal")
 
@@ -82,8 +88,9 @@ func initCraneTerminal(
 // GrantPermission grants the given permissions.
 // Additionally, it will mark the crane as authenticated, if not public.
 func (t *CraneTerminal) GrantPermission(grant terminal.Permission) {
-	// Forward granted permission to base terminal.
+	// Forward granted permission to base terminal and session.
 	t.TerminalBase.GrantPermission(grant)
+	t.GetSession().GrantPermission(grant)
 
 	// Mark crane as authenticated if not public or already authenticated.
 	if !t.crane.Public() && !t.crane.Authenticated() {
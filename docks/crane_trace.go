@@ -0,0 +1,45 @@
+package docks
+
+import (
+	"github.com/safing/spn/terminal"
+)
+
+// tracedTerminal is a terminal that supports message tracing.
+type tracedTerminal interface {
+	SetTracer(tracer *terminal.Tracer)
+}
+
+// StartTracing starts recording the message headers of all terminals of the
+// crane into a new tracer that keeps the given amount of records.
+// Any previous trace is discarded.
+func (crane *Crane) StartTracing(size int) *terminal.Tracer {
+	tracer := terminal.NewTracer(size)
+	if previous := crane.tracer.Swap(tracer); previous != nil {
+		previous.Stop()
+	}
+	crane.setTracerOnTerminals(tracer)
+
+	return tracer
+}
+
+// StopTracing stops recording message headers. The trace is kept until
+// tracing is started again.
+func (crane *Crane) StopTracing() {
+	if tracer := crane.tracer.Load(); tracer != nil {
+		tracer.Stop()
+	}
+	crane.setTracerOnTerminals(nil)
+}
+
+// Tracer returns the current tracer of the crane, if tracing was started.
+func (crane *Crane) Tracer() *terminal.Tracer {
+	return crane.tracer.Load()
+}
+
+func (crane *Crane) setTracerOnTerminals(tracer *terminal.Tracer) {
+	for _, t := range crane.allTerms() {
+		if tt, ok := t.(tracedTerminal); ok {
+			tt.SetTracer(tracer)
+		}
+	}
+}
@@ -22,7 +22,11 @@ var (
 )
 
 func init() {
-	module = modules.Register("docks", nil, start, stopAllCranes, "terminal", "cabin", "access")
+	module = modules.Register("docks", prep, start, stopAllCranes, "terminal", "cabin", "access")
+}
+
+func prep() error {
+	return registerAPIEndpoints()
 }
 
 func start() error {
@@ -92,11 +96,11 @@ func GetAssignedCrane(hubID string) *Crane {
 }
 
 func getAllCranes() map[string]*Crane {
-	copiedCranes := make(map[string]*Crane, len(allCranes))
-
 	cranesLock.RLock()
 	defer cranesLock.RUnlock()
 
+	copiedCranes := make(map[string]*Crane, len(allCranes))
+
 	for id, crane := range allCranes {
 		copiedCranes[id] = crane
 	}
@@ -105,11 +109,11 @@ func getAllCranes() map[string]*Crane {
 
 // GetAllAssignedCranes returns a copy of the map of all assigned cranes.
 func GetAllAssignedCranes() map[string]*Crane {
-	copiedCranes := make(map[string]*Crane, len(assignedCranes))
-
 	cranesLock.RLock()
 	defer cranesLock.RUnlock()
 
+	copiedCranes := make(map[string]*Crane, len(assignedCranes))
+
 	for destination, crane := range assignedCranes {
 		copiedCranes[destination] = crane
 	}
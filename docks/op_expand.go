@@ -173,6 +173,19 @@ func expand(t terminal.Terminal, opID uint32, data *container.Container) (termin
 		op.relayTerminal.deliverProxy = op.relayTerminal.flowControl.Deliver
 		op.relayTerminal.recvProxy = op.relayTerminal.flowControl.Receive
 		op.relayTerminal.sendProxy = op.submitForwardFlowControl
+	case terminal.FlowControlCFQ:
+		// The terminal options were checked to require terminal version 2 and
+		// CapabilityCFQ, so both sides support the CFQ.
+		// Operation
+		op.flowControl = terminal.NewCongestionFlowQueue(op.ctx, opts.FlowControlSize, op.submitBackwardUpstream)
+		op.deliverProxy = op.flowControl.Deliver
+		op.recvProxy = op.flowControl.Receive
+		op.sendProxy = op.submitBackwardFlowControl
+		// Relay Terminal
+		op.relayTerminal.flowControl = terminal.NewCongestionFlowQueue(op.ctx, opts.FlowControlSize, op.submitForwardUpstream)
+		op.relayTerminal.deliverProxy = op.relayTerminal.flowControl.Deliver
+		op.relayTerminal.recvProxy = op.relayTerminal.flowControl.Receive
+		op.relayTerminal.sendProxy = op.submitForwardFlowControl
 	case terminal.FlowControlNone:
 		// Operation
 		deliverToOp := make(chan *terminal.Msg, opts.FlowControlSize)
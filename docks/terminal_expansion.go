@@ -8,6 +8,7 @@ import (
 	"github.com/tevino/abool"
 
 	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/log"
 	"github.com/safing/spn/hub"
 	"github.com/safing/spn/terminal"
 )
@@ -44,6 +45,15 @@ func ExpandTo(from terminal.Terminal, routeTo string, encryptFor *hub.Hub) (*Exp
 	// Create options and bare expansion terminal.
 	opts := terminal.DefaultExpansionTerminalOpts()
 	opts.Encrypt = encryptFor != nil
+	opts.UpgradeVersion(encryptFor)
+	// The relaying Hub must support the congestion flow queue too.
+	if opts.FlowControl == terminal.FlowControlCFQ {
+		if fromCaps, ok := from.(interface {
+			HasCapability(c terminal.Capability) bool
+		}); !ok || !fromCaps.HasCapability(terminal.CapabilityCFQ) {
+			opts.FlowControl = terminal.FlowControlDFQ
+		}
+	}
 	expansion := &ExpansionTerminal{
 		changeNotifyFuncReady: abool.New(),
 	}
@@ -66,6 +76,9 @@ func ExpandTo(from terminal.Terminal, routeTo string, encryptFor *hub.Hub) (*Exp
 	expansion.TerminalBase = base
 	base.SetTerminalExtension(expansion)
 	base.SetTimeout(defaultTerminalIdleTimeout)
+	base.OnDeadPeer(func() {
+		log.Warningf("spn/docks: %s to %s stopped responding", expansion.FmtID(), routeTo)
+	})
 
 	// Second, start the actual relay operation.
 
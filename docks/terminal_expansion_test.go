@@ -37,6 +37,10 @@ func TestExpansion(t *testing.T) {
 					flowControl:     terminal.FlowControlDFQ,
 					flowControlSize: defaultTestQueueSize,
 				},
+				{
+					flowControl:     terminal.FlowControlCFQ,
+					flowControlSize: defaultTestQueueSize,
+				},
 			} {
 				// Run tests with combined options.
 				testExpansion(
@@ -25,6 +25,21 @@ const (
 
 	// FlagAllowUnencrypted signifies that the Hub is available to handle unencrypted connections.
 	FlagAllowUnencrypted = "allow-unencrypted"
+
+	// FlagResumable signifies that the Hub supports resuming cranes on a new ship.
+	FlagResumable = "resumable"
+
+	// FlagTerminalV2 signifies that the Hub supports terminal version 2.
+	FlagTerminalV2 = "terminal-v2"
+
+	// FlagExitResolve signifies that the Hub resolves domains of connect requests without an IP address.
+	FlagExitResolve = "exit-resolve"
+
+	// FlagExitDNS signifies that the Hub resolves DNS queries via the DNS operation.
+	FlagExitDNS = "exit-dns"
+
+	// FlagBonding signifies that the Hub supports bonding multiple ships into one.
+	FlagBonding = "bonding"
 )
 
 // Status is the message type used to update changing Hub Information. Changes are made automatically.
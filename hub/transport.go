@@ -16,10 +16,20 @@ import (
 // "smtp:587",
 // "imap:143",
 // "http:80",
+// "quic:443",
 // "http://example.com:80/example", // HTTP (based): use full path for request
 // "https:443",
 // "ws:80",
 // "wss://example.com:443/spn",
+// "tcp:17#obfs=prefix+pad", // Obfuscation layers are defined in the fragment.
+// "unix:///run/spn/hub.sock", // Local: unix domain socket path.
+// "pipe://hub-a", // Local: named in-process pipe.
+
+// ErrLocalTransport is returned when a local transport is announced.
+// Local transports may only be used from local configuration, as they would
+// otherwise allow other Hubs to make clients connect to arbitrary local
+// sockets and pipes.
+var ErrLocalTransport = errors.New("local transports may not be announced")
 
 // Transport represents a "endpoint" that others can connect to. This allows for use of different protocols, ports and infrastructure integration.
 type Transport struct {
@@ -31,11 +41,14 @@ type Transport struct {
 }
 
 // ParseTransports returns a list of parsed transports and errors from parsing
-// the given definitions.
+// the given announced definitions. Local transports are rejected.
 func ParseTransports(definitions []string) (transports []*Transport, errs []error) {
 	transports = make([]*Transport, 0, len(definitions))
 	for _, definition := range definitions {
 		parsed, err := ParseTransport(definition)
+		if err == nil && parsed.IsLocal() {
+			err = ErrLocalTransport
+		}
 		if err != nil {
 			errs = append(errs, fmt.Errorf(
 				"unknown or invalid transport %q: %w", definition, err,
@@ -69,6 +82,20 @@ func ParseTransport(definition string) (*Transport, error) {
 		Option:   u.Fragment,
 	}
 
+	// Local transports are addressed by a path or name instead of a port.
+	if t.IsLocal() {
+		if t.Path == "/" {
+			t.Path = ""
+		}
+		switch {
+		case t.Protocol == "unix" && t.Path == "":
+			return nil, errors.New("missing socket path")
+		case t.Protocol == "pipe" && t.Domain == "":
+			return nil, errors.New("missing pipe name")
+		}
+		return t, nil
+	}
+
 	// parse port
 	portData := u.Port()
 	if portData == "" {
@@ -104,9 +131,19 @@ func ParseTransport(definition string) (*Transport, error) {
 	return t, nil
 }
 
+// IsLocal returns whether the transport is only reachable from the same host
+// or process and does not use a port.
+func (t *Transport) IsLocal() bool {
+	return t.Protocol == "unix" || t.Protocol == "pipe"
+}
+
 // String returns the definition form of the transport.
 func (t *Transport) String() string {
 	switch {
+	case t.IsLocal() && t.Option != "":
+		return fmt.Sprintf("%s://%s%s#%s", t.Protocol, t.Domain, t.Path, t.Option)
+	case t.IsLocal():
+		return fmt.Sprintf("%s://%s%s", t.Protocol, t.Domain, t.Path)
 	case t.Option != "":
 		return fmt.Sprintf("%s://%s:%d%s#%s", t.Protocol, t.Domain, t.Port, t.Path, t.Option)
 	case t.Domain != "":
@@ -116,6 +153,17 @@ func (t *Transport) String() string {
 	}
 }
 
+// Obfuscation returns the obfuscation layers defined in the transport option.
+// The option has the format "obfs=<layer>+<layer>". Returns nil if no
+// obfuscation is defined.
+func (t *Transport) Obfuscation() []string {
+	layers, ok := strings.CutPrefix(t.Option, "obfs=")
+	if !ok || layers == "" {
+		return nil
+	}
+	return strings.Split(layers, "+")
+}
+
 // SortTransports sorts the transports to emphasize certain protocols, but
 // otherwise leaves the order intact.
 func SortTransports(ts []*Transport) {
@@ -68,6 +68,17 @@ func TestTransportParsing(t *testing.T) {
 		Port:     443,
 	}, parseT(t, "https:443"), "should match")
 
+	assert.Equal(t, &Transport{
+		Protocol: "quic",
+		Port:     443,
+	}, parseT(t, "quic:443"), "should match")
+
+	assert.Equal(t, &Transport{
+		Protocol: "quic",
+		Domain:   "example.com",
+		Port:     443,
+	}, parseT(t, "quic://example.com:443"), "should match")
+
 	assert.Equal(t, &Transport{
 		Protocol: "ws",
 		Port:     80,
@@ -125,6 +136,10 @@ func TestTransportParsing(t *testing.T) {
 		parseT(t, "http://example.com:80").String(), "should match")
 	assert.Equal(t, "https:443",
 		parseT(t, "https:443").String(), "should match")
+	assert.Equal(t, "quic:443",
+		parseT(t, "quic:443").String(), "should match")
+	assert.Equal(t, "quic://example.com:443",
+		parseT(t, "quic://example.com:443").String(), "should match")
 	assert.Equal(t, "ws:80",
 		parseT(t, "ws:80").String(), "should match")
 	assert.Equal(t, "wss://example.com:443/spn",
@@ -138,10 +153,64 @@ func TestTransportParsing(t *testing.T) {
 	assert.Equal(t, "http://example.com:80/test?key=value",
 		parseT(t, "http://example.com:80/test?key=value").String(), "should match")
 
+	// test obfuscation option
+
+	assert.Equal(t, &Transport{
+		Protocol: "tcp",
+		Port:     17,
+		Option:   "obfs=prefix+pad",
+	}, parseT(t, "tcp:17#obfs=prefix+pad"), "should match")
+	assert.Equal(t, "tcp://:17#obfs=prefix+pad",
+		parseT(t, "tcp:17#obfs=prefix+pad").String(), "should match")
+	assert.Equal(t, []string{"prefix", "pad"},
+		parseT(t, "tcp:17#obfs=prefix+pad").Obfuscation(), "should match")
+	assert.Equal(t, []string{"prefix"},
+		parseT(t, "tcp:17#obfs=prefix").Obfuscation(), "should match")
+	assert.Nil(t, parseT(t, "tcp:17").Obfuscation(), "should be nil")
+	assert.Nil(t, parseT(t, "tcp:17#Zwuk9L5bSwap2JHgWituh493jKFmASUWjgMCvXyBMESEDJ").Obfuscation(), "should be nil")
+
+	// test local transports
+
+	assert.Equal(t, &Transport{
+		Protocol: "unix",
+		Path:     "/run/spn/hub.sock",
+	}, parseT(t, "unix:///run/spn/hub.sock"), "should match")
+	assert.Equal(t, "unix:///run/spn/hub.sock",
+		parseT(t, "unix:///run/spn/hub.sock").String(), "should match")
+	assert.Equal(t, &Transport{
+		Protocol: "pipe",
+		Domain:   "hub-a",
+	}, parseT(t, "pipe://hub-a"), "should match")
+	assert.Equal(t, "pipe://hub-a",
+		parseT(t, "pipe://hub-a").String(), "should match")
+	assert.Equal(t, "pipe://hub-a#obfs=pad",
+		parseT(t, "pipe://hub-a#obfs=pad").String(), "should match")
+
 	// test invalid
 
 	assert.NotEqual(t, parseTError("spn"), nil, "should fail")
 	assert.NotEqual(t, parseTError("spn:"), nil, "should fail")
 	assert.NotEqual(t, parseTError("spn:0"), nil, "should fail")
 	assert.NotEqual(t, parseTError("spn:65536"), nil, "should fail")
+	assert.NotEqual(t, parseTError("unix://"), nil, "should fail")
+	assert.NotEqual(t, parseTError("pipe:hub-a"), nil, "should fail")
+}
+
+func TestAnnouncedTransports(t *testing.T) {
+	t.Parallel()
+
+	// Local transports may not be announced.
+	transports, errs := ParseTransports([]string{"unix:///run/spn/hub.sock", "tcp:17", "pipe://hub-a"})
+	assert.Len(t, transports, 1, "only the tcp transport should be parsed")
+	assert.Equal(t, "tcp:17", transports[0].String(), "should match")
+	assert.Len(t, errs, 2, "local transports should fail")
+	for _, err := range errs {
+		assert.ErrorIs(t, err, ErrLocalTransport, "should match")
+	}
+
+	// Announcements with only local transports are invalid.
+	a := &Announcement{
+		Transports: []string{"unix:///run/spn/hub.sock"},
+	}
+	assert.ErrorIs(t, a.prepare(true), ErrMissingTransports, "should fail")
 }
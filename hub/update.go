@@ -115,7 +115,7 @@ func OpenHubMsg(hub *Hub, data []byte, mapName string, tofu bool) (msg []byte, s
 		if hub.ID != seal.ID {
 			return nil, hub, known, fmt.Errorf("ID mismatch with hub msg ID %s and hub ID %s", seal.ID, hub.ID)
 		}
-		if !verifyHubID(seal.ID, hub.PublicKey.Scheme, hub.PublicKey.Key) {
+		if !VerifyHubID(seal.ID, hub.PublicKey.Scheme, hub.PublicKey.Key) {
 			return nil, hub, known, fmt.Errorf("ID integrity of %s violated with existing key", seal.ID)
 		}
 	} else {
@@ -138,7 +138,7 @@ func OpenHubMsg(hub *Hub, data []byte, mapName string, tofu bool) (msg []byte, s
 		}
 
 		// check ID integrity
-		if !verifyHubID(seal.ID, seal.Scheme, pubkey.Value) {
+		if !VerifyHubID(seal.ID, seal.Scheme, pubkey.Value) {
 			return nil, nil, false, fmt.Errorf("ID integrity of %s violated with new key", seal.ID)
 		}
 
@@ -507,7 +507,8 @@ func createHubID(scheme string, pubkey []byte) string {
 	return lhash.Digest(lhash.BLAKE2b_256, c.CompileData()).Base58()
 }
 
-func verifyHubID(id string, scheme string, pubkey []byte) (ok bool) {
+// VerifyHubID checks if the given Hub ID matches the given scheme and public key.
+func VerifyHubID(id string, scheme string, pubkey []byte) (ok bool) {
 	// load labeled hash from ID
 	labeledHash, err := lhash.FromBase58(id)
 	if err != nil {
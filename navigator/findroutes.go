@@ -20,6 +20,8 @@ const (
 )
 
 // FindRoutes finds possible routes to the given IP, with the given options.
+// If no IP is given, eg. because the destination is resolved by the exit Hub,
+// routes to Hubs near the Home Hub are found.
 func (m *Map) FindRoutes(ip net.IP, opts *Options) (*Routes, error) {
 	m.Lock()
 	defer m.Unlock()
@@ -38,9 +40,12 @@ func (m *Map) FindRoutes(ip net.IP, opts *Options) (*Routes, error) {
 	var locationV4, locationV6 *geoip.Location
 	var err error
 	// Save whether the given IP address is a IPv4 or IPv6 address.
-	if v4 := ip.To4(); v4 != nil {
+	switch {
+	case ip == nil:
+		locationV4, locationV6 = m.home.LocationV4, m.home.LocationV6
+	case ip.To4() != nil:
 		locationV4, err = geoip.GetLocation(ip)
-	} else {
+	default:
 		locationV6, err = geoip.GetLocation(ip)
 	}
 	if err != nil {
@@ -71,6 +71,10 @@ type HubOptions struct {
 	// If the list is empty, all owners are allowed.
 	RequireVerifiedOwners []string
 
+	// RequireFlags holds status flags that Hubs must have in order to be taken
+	// into account for the operation.
+	RequireFlags []string
+
 	// CheckHubPolicyWith provides an entity that must match the Hubs entry or exit
 	// policy (depending on type) in order to be taken into account for the operation.
 	CheckHubPolicyWith *intel.Entity
@@ -104,6 +108,7 @@ func (o HubOptions) Copy() HubOptions {
 		NoDefaults:            o.NoDefaults,
 		HubPolicies:           o.HubPolicies,
 		RequireVerifiedOwners: o.RequireVerifiedOwners,
+		RequireFlags:          o.RequireFlags,
 		CheckHubPolicyWith:    o.CheckHubPolicyWith,
 	}
 }
@@ -268,6 +273,13 @@ func (o *HubOptions) Matcher(hubType HubType, hubIntel *hub.Intel) PinMatcher {
 			}
 		}
 
+		// Check required flags.
+		for _, flag := range o.RequireFlags {
+			if !pin.Hub.HasFlag(flag) {
+				return false
+			}
+		}
+
 		// Check policies.
 	policyCheck:
 		for _, policy := range hubPolicies {
@@ -0,0 +1,47 @@
+package ships
+
+import (
+	"github.com/safing/portbase/api"
+)
+
+const (
+	apiPathForTransportHealth      = "spn/ships/transports"
+	apiPathForTransportHealthReset = "spn/ships/transports/reset"
+)
+
+func registerAPIEndpoints() error {
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:        apiPathForTransportHealth,
+		Read:        api.PermitUser,
+		BelongsTo:   module,
+		StructFunc:  handleTransportHealth,
+		Name:        "Get Transport Health",
+		Description: "Returns the launch history and blacklist status of the transports of all known Hubs.",
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:        apiPathForTransportHealthReset,
+		Write:       api.PermitAdmin,
+		BelongsTo:   module,
+		ActionFunc:  handleTransportHealthReset,
+		Name:        "Reset Transport Health",
+		Description: "Resets the launch history of all transports and lifts all blacklistings.",
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func handleTransportHealth(ar *api.Request) (i interface{}, err error) {
+	return GetTransportHealth(), nil
+}
+
+func handleTransportHealthReset(ar *api.Request) (msg string, err error) {
+	if err := ResetTransportHealth(ar.Context()); err != nil {
+		return "", err
+	}
+	return "transport health reset", nil
+}
@@ -0,0 +1,976 @@
+package ships
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/jess"
+	"github.com/safing/portbase/log"
+	"github.com/safing/spn/hub"
+)
+
+/*
+Bonded Ships:
+
+A bonded ship stripes the crane byte stream over multiple ships (paths) to
+the same Hub, eg. using different transports or IP versions. If a path dies,
+the data that was not yet acknowledged is resent over the remaining paths.
+
+Every path starts with a header, which is sent by the launching side:
+
+	Magic (4 bytes) | Bond ID (16 bytes) | Version (1 byte) | Join Type (1 byte)
+
+The magic starts with 0xFFFF, which the crane would read as a message length
+exceeding its maximum, so that it cannot collide with regular ships.
+
+The first path creates the bond and carries the bond secret after the header,
+sealed to the current exchange key of the Hub, so that it is never sent in the
+clear, even on transports without TLS. Additional paths must prove that they know the secret: The docking side sends
+a random challenge, which the launching side answers with an HMAC-SHA256 of
+the bond ID and the challenge, keyed with the secret. Every path is confirmed
+by the docking side with a single byte before any frames are exchanged.
+
+	Create: -> Header | Length (2 bytes) | Sealed Secret    <- Accepted (1 byte)
+	Join:   -> Header <- Challenge (32 bytes) -> Proof (32 bytes) <- Accepted (1 byte)
+
+After the header, frames are exchanged on all paths:
+
+	Data: Type (1 byte) | Sequence (8 bytes) | Length (2 bytes) | Data
+	Ack:  Type (1 byte) | Next Expected Sequence (8 bytes)
+
+Data frames are reordered by their sequence number on the receiving side.
+Acks are cumulative.
+
+Unacknowledged and reordered data is limited to bondMaxBufferSize. If the peer
+stops acknowledging data, the path that carried the oldest unacknowledged frame
+is dropped. Because of this, the reorder buffer of a well-behaved peer never
+exceeds the limit by more than a frame and a path that does is dropped.
+*/
+
+// BondedShip is a ship that bonds multiple ships to the same Hub.
+type BondedShip struct {
+	id     []byte
+	secret []byte
+	mine   bool
+
+	// sealedSecret is the secret sealed to the exchange key of the Hub.
+	// It is only set on launched ships.
+	sealedSecret []byte
+
+	// dstHub and ctx are used to replace failed paths of launched ships.
+	dstHub    *hub.Hub
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+
+	paths     []*bondPath
+	pathsLock sync.Mutex
+	nextPath  int
+
+	// Sending.
+	sendLock    sync.Mutex
+	nextSendSeq uint64
+	unacked     []*bondFrame
+	unackedSize int
+
+	// Receiving.
+	frames      chan *bondFrame
+	reorder     map[uint64][]byte
+	reorderSize int
+	delivered   []byte
+	recvLock    sync.Mutex
+	nextRecvSeq uint64
+	recvNotAck  int
+
+	public  *abool.AtomicBool
+	sinking *abool.AtomicBool
+}
+
+type bondPath struct {
+	ship      Ship
+	dead      *abool.AtomicBool
+	writeLock sync.Mutex
+}
+
+type bondFrame struct {
+	seq  uint64
+	data []byte
+
+	// path is the path the frame was last sent or received on.
+	path *bondPath
+}
+
+const (
+	bondIDSize     = 16
+	bondSecretSize = sha256.Size
+	bondVersion    = 3
+	bondHeaderSize = 4 + bondIDSize + 1 + 1
+
+	bondJoinTypeCreate = 1
+	bondJoinTypeJoin   = 2
+	bondAccepted       = 0xAC
+
+	bondMaxSealedSecretSize = 4096
+
+	bondFrameTypeData    = 1
+	bondFrameTypeAck     = 2
+	bondDataHeaderSize   = 1 + 8 + 2
+	bondAckFrameSize     = 1 + 8
+	bondMaxSegmentSize   = 0xFFFF
+	bondAckInterval      = 16
+	bondAckDelay         = 100 * time.Millisecond
+	bondDockingTimeout   = 30 * time.Second
+	bondPathReplaceDelay = 5 * time.Second
+	bondMaxBufferSize    = 16 * 1024 * 1024
+)
+
+var bondMagic = []byte{0xFF, 0xFF, 'B', 'D'}
+
+var (
+	dockedBonds     = make(map[string]*BondedShip)
+	dockedBondsLock sync.Mutex
+)
+
+func newBondedShip(id, secret []byte, mine bool) *BondedShip {
+	ctx, cancelCtx := context.WithCancel(module.Ctx)
+	b := &BondedShip{
+		id:        id,
+		secret:    secret,
+		mine:      mine,
+		ctx:       ctx,
+		cancelCtx: cancelCtx,
+		frames:    make(chan *bondFrame, 100),
+		reorder:   make(map[uint64][]byte),
+		public:    abool.New(),
+		sinking:   abool.New(),
+	}
+
+	module.StartWorker("bonded ship acker", b.ackWorker)
+	return b
+}
+
+// LaunchBonded launches ships to the given Hub using up to maxPaths different
+// combinations of transports and IPs and bonds them into a single ship.
+// If only a single path can be launched, it is returned as a regular ship.
+func LaunchBonded(ctx context.Context, h *hub.Hub, maxPaths int) (Ship, error) {
+	// The bond secret is sealed to the exchange key of the Hub.
+	// Launch a regular ship if the Hub has none.
+	signet := h.SelectSignet()
+	if signet == nil {
+		return Launch(ctx, h, nil, nil)
+	}
+
+	transports, ips, err := getLaunchOptions(h, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Launch paths.
+	var launched []Ship
+	var firstErr error
+	for _, ip := range ips {
+		for _, tr := range sortTransportsByHealth(h.ID, transports, ip) {
+			if len(launched) >= maxPaths {
+				break
+			}
+
+			ship, err := connectTo(ctx, h, tr, ip)
+			switch {
+			case err == nil:
+				launched = append(launched, ship)
+			case ctx.Err() != nil:
+				for _, ship := range launched {
+					ship.Sink()
+				}
+				return nil, ctx.Err()
+			case firstErr == nil:
+				firstErr = err
+			}
+		}
+	}
+
+	// Check how many paths we have.
+	switch len(launched) {
+	case 0:
+		return nil, firstErr
+	case 1:
+		return launched[0], nil
+	}
+
+	// Create bonded ship.
+	id := make([]byte, bondIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to create bond ID: %w", err)
+	}
+	secret := make([]byte, bondSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to create bond secret: %w", err)
+	}
+	sealedSecret, err := sealBondSecret(secret, signet)
+	if err != nil {
+		for _, ship := range launched {
+			ship.Sink()
+		}
+		return nil, err
+	}
+	b := newBondedShip(id, secret, true)
+	b.sealedSecret = sealedSecret
+	b.dstHub = h
+	for i, ship := range launched {
+		// The first path creates the bond, the others join it.
+		if err := b.addLaunchedPath(ship, i == 0); err != nil {
+			for _, notAdded := range launched[i+1:] {
+				notAdded.Sink()
+			}
+			b.Sink()
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+func (b *BondedShip) addLaunchedPath(ship Ship, create bool) error {
+	// Sink the ship if the docking procedure does not finish in time.
+	timer := time.AfterFunc(bondDockingTimeout, ship.Sink)
+	defer timer.Stop()
+
+	if err := b.launchPath(ship, create); err != nil {
+		ship.Sink()
+		return err
+	}
+
+	b.addPath(ship)
+	return nil
+}
+
+func (b *BondedShip) launchPath(ship Ship, create bool) error {
+	// Send header, including the sealed secret when creating the bond.
+	header := make([]byte, 0, bondHeaderSize+2+len(b.sealedSecret))
+	header = append(header, bondMagic...)
+	header = append(header, b.id...)
+	header = append(header, bondVersion)
+	if create {
+		header = append(header, bondJoinTypeCreate)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(b.sealedSecret)))
+		header = append(header, b.sealedSecret...)
+	} else {
+		header = append(header, bondJoinTypeJoin)
+	}
+	if err := ship.Load(header); err != nil {
+		return fmt.Errorf("failed to send bond header: %w", err)
+	}
+
+	// Answer challenge when joining.
+	if !create {
+		challenge := make([]byte, bondSecretSize)
+		if err := unloadFull(ship, challenge); err != nil {
+			return fmt.Errorf("failed to receive bond challenge: %w", err)
+		}
+		if err := ship.Load(b.joinProof(challenge)); err != nil {
+			return fmt.Errorf("failed to send bond proof: %w", err)
+		}
+	}
+
+	// Wait for the path to be accepted.
+	accepted := make([]byte, 1)
+	if err := unloadFull(ship, accepted); err != nil {
+		return fmt.Errorf("failed to receive bond acceptance: %w", err)
+	}
+	if accepted[0] != bondAccepted {
+		return errors.New("bond path was not accepted")
+	}
+
+	return nil
+}
+
+// sealBondSecret seals the bond secret to the given exchange key of the Hub.
+func sealBondSecret(secret []byte, signet *jess.Signet) ([]byte, error) {
+	env := jess.NewUnconfiguredEnvelope()
+	env.SuiteID = jess.SuiteWireV1
+	env.Recipients = []*jess.Signet{signet}
+	s, err := env.WireCorrespondence(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bond secret session: %w", err)
+	}
+	letter, err := s.Close(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal bond secret: %w", err)
+	}
+	c, err := letter.ToWire()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack bond secret: %w", err)
+	}
+	if c.Length() > bondMaxSealedSecretSize {
+		return nil, fmt.Errorf("sealed bond secret too big: %d bytes", c.Length())
+	}
+	return c.CompileData(), nil
+}
+
+// openBondSecret opens a bond secret that was sealed to an exchange key
+// supplied by the given trust store.
+func openBondSecret(sealedSecret []byte, keys jess.TrustStore) ([]byte, error) {
+	letter, err := jess.LetterFromWireData(sealedSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sealed bond secret: %w", err)
+	}
+	s, err := letter.WireCorrespondence(keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bond secret session: %w", err)
+	}
+	secret, err := s.Open(letter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bond secret: %w", err)
+	}
+	if len(secret) != bondSecretSize {
+		return nil, fmt.Errorf("invalid bond secret size %d", len(secret))
+	}
+	return secret, nil
+}
+
+// joinProof returns the proof of knowing the bond secret for the given
+// challenge.
+func (b *BondedShip) joinProof(challenge []byte) []byte {
+	mac := hmac.New(sha256.New, b.secret)
+	_, _ = mac.Write(b.id)
+	_, _ = mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+func (b *BondedShip) addPath(ship Ship) {
+	path := &bondPath{
+		ship: ship,
+		dead: abool.New(),
+	}
+	if b.public.IsSet() {
+		ship.MarkPublic()
+	}
+
+	b.pathsLock.Lock()
+	b.paths = append(b.paths, path)
+	b.pathsLock.Unlock()
+
+	module.StartWorker("bonded ship path reader", func(_ context.Context) error {
+		b.pathReader(path)
+		return nil
+	})
+}
+
+// peekableShip is a ship that supports reading data ahead without consuming it.
+type peekableShip interface {
+	peek(n int, timeout time.Duration) ([]byte, error)
+}
+
+// peek reads the next n bytes from the ship without consuming them.
+func (ship *ShipBase) peek(n int, timeout time.Duration) ([]byte, error) {
+	// Only peek into new data.
+	if ship.initial != nil {
+		return nil, errors.New("ship has unconsumed initial data")
+	}
+
+	_ = ship.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() {
+		_ = ship.conn.SetReadDeadline(time.Time{})
+	}()
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(ship.conn, buf); err != nil {
+		return nil, err
+	}
+	ship.initial = buf
+	return buf, nil
+}
+
+// DockBonded checks if a docked ship is a path of a bonded ship.
+// If it is not, the ship is returned unchanged. If it is the first path of a
+// bond, a new bonded ship is returned. If it is an additional path of a bond,
+// it is added to the bonded ship after checking its proof of the bond secret
+// and nil is returned.
+// The given trust store must supply the private exchange keys of the Hub in
+// order to open the bond secret.
+func DockBonded(ship Ship, keys jess.TrustStore) (Ship, error) {
+	peekable, ok := ship.(peekableShip)
+	if !ok {
+		return ship, nil
+	}
+
+	// Check for magic.
+	start, err := peekable.peek(len(bondMagic), bondDockingTimeout)
+	if err != nil {
+		ship.Sink()
+		return nil, fmt.Errorf("failed to read from ship: %w", err)
+	}
+	if !bytes.Equal(start, bondMagic) {
+		return ship, nil
+	}
+
+	// Read full header.
+	header := make([]byte, bondHeaderSize)
+	if err := unloadFull(ship, header); err != nil {
+		ship.Sink()
+		return nil, fmt.Errorf("failed to read bond header: %w", err)
+	}
+	if header[bondHeaderSize-2] != bondVersion {
+		ship.Sink()
+		return nil, fmt.Errorf("unsupported bond version %d", header[bondHeaderSize-2])
+	}
+	id := header[len(bondMagic) : len(bondMagic)+bondIDSize]
+
+	// Sink the ship if the docking procedure does not finish in time.
+	timer := time.AfterFunc(bondDockingTimeout, ship.Sink)
+	defer timer.Stop()
+
+	var b *BondedShip
+	created := header[bondHeaderSize-1] == bondJoinTypeCreate
+	switch header[bondHeaderSize-1] {
+	case bondJoinTypeCreate:
+		b, err = dockNewBond(ship, id, keys)
+	case bondJoinTypeJoin:
+		b, err = dockBondPath(ship, id)
+	default:
+		err = fmt.Errorf("unknown bond join type %d", header[bondHeaderSize-1])
+	}
+	if err != nil {
+		ship.Sink()
+		return nil, err
+	}
+
+	// Confirm path before any frames are exchanged.
+	if err := ship.Load([]byte{bondAccepted}); err != nil {
+		ship.Sink()
+		if created {
+			b.Sink()
+		}
+		return nil, fmt.Errorf("failed to send bond acceptance: %w", err)
+	}
+
+	// Return new bonds, add paths to existing bonds.
+	b.addPath(ship)
+	if created {
+		return b, nil
+	}
+	log.Debugf("spn/ships: added %s to %s", ship, b)
+	return nil, nil
+}
+
+// dockNewBond reads the sealed bond secret from the ship and registers a new
+// bond.
+func dockNewBond(ship Ship, id []byte, keys jess.TrustStore) (*BondedShip, error) {
+	length := make([]byte, 2)
+	if err := unloadFull(ship, length); err != nil {
+		return nil, fmt.Errorf("failed to read bond secret length: %w", err)
+	}
+	sealedSecret := make([]byte, binary.BigEndian.Uint16(length))
+	if len(sealedSecret) > bondMaxSealedSecretSize {
+		return nil, fmt.Errorf("sealed bond secret too big: %d bytes", len(sealedSecret))
+	}
+	if err := unloadFull(ship, sealedSecret); err != nil {
+		return nil, fmt.Errorf("failed to read bond secret: %w", err)
+	}
+	secret, err := openBondSecret(sealedSecret, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	dockedBondsLock.Lock()
+	defer dockedBondsLock.Unlock()
+
+	if _, ok := dockedBonds[hex.EncodeToString(id)]; ok {
+		return nil, errors.New("bond already exists")
+	}
+	b := newBondedShip(id, secret, false)
+	dockedBonds[hex.EncodeToString(id)] = b
+	return b, nil
+}
+
+// dockBondPath challenges the ship to prove that it knows the secret of the
+// existing bond and returns the bond.
+func dockBondPath(ship Ship, id []byte) (*BondedShip, error) {
+	// Send challenge.
+	challenge := make([]byte, bondSecretSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("failed to create bond challenge: %w", err)
+	}
+	if err := ship.Load(challenge); err != nil {
+		return nil, fmt.Errorf("failed to send bond challenge: %w", err)
+	}
+
+	// Read and check proof.
+	proof := make([]byte, bondSecretSize)
+	if err := unloadFull(ship, proof); err != nil {
+		return nil, fmt.Errorf("failed to read bond proof: %w", err)
+	}
+	dockedBondsLock.Lock()
+	b, ok := dockedBonds[hex.EncodeToString(id)]
+	dockedBondsLock.Unlock()
+	if !ok || b.sinking.IsSet() || !hmac.Equal(proof, b.joinProof(challenge)) {
+		return nil, errors.New("invalid bond proof")
+	}
+
+	return b, nil
+}
+
+func (b *BondedShip) pathReader(path *bondPath) {
+	defer b.pathFailed(path)
+
+	header := make([]byte, bondDataHeaderSize)
+	for {
+		// Read frame type.
+		if err := unloadFull(path.ship, header[:1]); err != nil {
+			return
+		}
+
+		switch header[0] {
+		case bondFrameTypeData:
+			if err := unloadFull(path.ship, header[1:]); err != nil {
+				return
+			}
+			frame := &bondFrame{
+				seq:  binary.BigEndian.Uint64(header[1:9]),
+				data: make([]byte, binary.BigEndian.Uint16(header[9:11])),
+				path: path,
+			}
+			if err := unloadFull(path.ship, frame.data); err != nil {
+				return
+			}
+
+			select {
+			case b.frames <- frame:
+			case <-b.ctx.Done():
+				return
+			}
+
+		case bondFrameTypeAck:
+			if err := unloadFull(path.ship, header[1:9]); err != nil {
+				return
+			}
+			b.handleAck(binary.BigEndian.Uint64(header[1:9]))
+
+		default:
+			log.Warningf("spn/ships: %s received unknown frame type %d on %s", b, header[0], path.ship)
+			return
+		}
+	}
+}
+
+func (b *BondedShip) pathFailed(path *bondPath) {
+	if !path.dead.SetToIf(false, true) {
+		return
+	}
+	path.ship.Sink()
+
+	// Sink bonded ship if no paths are left.
+	if b.alivePaths() == 0 {
+		b.Sink()
+		return
+	}
+	if b.sinking.IsSet() {
+		return
+	}
+	log.Infof("spn/ships: %s lost path %s", b, path.ship)
+
+	// Resend unacknowledged data over the remaining paths.
+	b.sendLock.Lock()
+	unacked := make([]*bondFrame, len(b.unacked))
+	copy(unacked, b.unacked)
+	b.sendLock.Unlock()
+	for _, frame := range unacked {
+		resentOn, err := b.sendFrame(frame.wire(frame.seq))
+		if err != nil {
+			return
+		}
+		b.sendLock.Lock()
+		frame.path = resentOn
+		b.sendLock.Unlock()
+	}
+
+	// Attempt to replace the path of launched ships.
+	if b.mine && b.dstHub != nil {
+		transport := path.ship.Transport()
+		ip := addrIP(path.ship.RemoteAddr())
+		module.StartWorker("replace bonded ship path", func(_ context.Context) error {
+			select {
+			case <-time.After(bondPathReplaceDelay):
+			case <-b.ctx.Done():
+				return nil
+			}
+			ship, err := connectTo(b.ctx, b.dstHub, transport, ip)
+			if err != nil {
+				log.Debugf("spn/ships: failed to replace path of %s: %s", b, err)
+				return nil
+			}
+			if err := b.addLaunchedPath(ship, false); err != nil {
+				log.Debugf("spn/ships: failed to replace path of %s: %s", b, err)
+			}
+			return nil
+		})
+	}
+}
+
+func (b *BondedShip) alivePaths() (alive int) {
+	b.pathsLock.Lock()
+	defer b.pathsLock.Unlock()
+
+	for _, path := range b.paths {
+		if path.dead.IsNotSet() {
+			alive++
+		}
+	}
+	return alive
+}
+
+// nextAlivePath returns the next alive path in a round-robin fashion.
+func (b *BondedShip) nextAlivePath() *bondPath {
+	b.pathsLock.Lock()
+	defer b.pathsLock.Unlock()
+
+	for i := 0; i < len(b.paths); i++ {
+		b.nextPath = (b.nextPath + 1) % len(b.paths)
+		if path := b.paths[b.nextPath]; path.dead.IsNotSet() {
+			return path
+		}
+	}
+	return nil
+}
+
+// primaryPath returns the first alive path, or the first path if none is alive.
+func (b *BondedShip) primaryPath() *bondPath {
+	b.pathsLock.Lock()
+	defer b.pathsLock.Unlock()
+
+	for _, path := range b.paths {
+		if path.dead.IsNotSet() {
+			return path
+		}
+	}
+	return b.paths[0]
+}
+
+// sendFrame sends the given frame data over the next alive path and returns
+// the path it was sent on.
+func (b *BondedShip) sendFrame(data []byte) (*bondPath, error) {
+	for {
+		path := b.nextAlivePath()
+		if path == nil {
+			return nil, ErrSunk
+		}
+
+		path.writeLock.Lock()
+		err := path.ship.Load(data)
+		path.writeLock.Unlock()
+		if err == nil {
+			return path, nil
+		}
+
+		b.pathFailed(path)
+	}
+}
+
+// size returns the size the frame is accounted with in the buffers.
+// The header is included so that empty frames are limited too.
+func (frame *bondFrame) size() int {
+	return bondDataHeaderSize + len(frame.data)
+}
+
+func (frame *bondFrame) wire(seq uint64) []byte {
+	data := make([]byte, bondDataHeaderSize+len(frame.data))
+	data[0] = bondFrameTypeData
+	binary.BigEndian.PutUint64(data[1:9], seq)
+	binary.BigEndian.PutUint16(data[9:11], uint16(len(frame.data)))
+	copy(data[bondDataHeaderSize:], frame.data)
+	return data
+}
+
+func (b *BondedShip) handleAck(nextExpected uint64) {
+	b.sendLock.Lock()
+	defer b.sendLock.Unlock()
+
+	// Remove all acknowledged frames.
+	var i int
+	for i < len(b.unacked) && b.unacked[i].seq < nextExpected {
+		b.unackedSize -= b.unacked[i].size()
+		i++
+	}
+	b.unacked = b.unacked[i:]
+}
+
+func (b *BondedShip) sendAck() {
+	b.recvLock.Lock()
+	if b.recvNotAck == 0 {
+		b.recvLock.Unlock()
+		return
+	}
+	b.recvNotAck = 0
+	data := make([]byte, bondAckFrameSize)
+	data[0] = bondFrameTypeAck
+	binary.BigEndian.PutUint64(data[1:], b.nextRecvSeq)
+	b.recvLock.Unlock()
+
+	_, _ = b.sendFrame(data)
+}
+
+func (b *BondedShip) ackWorker(_ context.Context) error {
+	ticker := time.NewTicker(bondAckDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.sendAck()
+		case <-b.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// String returns a human readable informational summary about the ship.
+func (b *BondedShip) String() string {
+	if b.mine {
+		return fmt.Sprintf("<BondedShip to %s with %d paths>", b.MaskAddress(b.RemoteAddr()), b.alivePaths())
+	}
+	return fmt.Sprintf("<BondedShip from %s with %d paths>", b.MaskAddress(b.RemoteAddr()), b.alivePaths())
+}
+
+// Transport returns the transport of the primary path.
+func (b *BondedShip) Transport() *hub.Transport {
+	return b.primaryPath().ship.Transport()
+}
+
+// IsMine returns whether the ship was launched from here.
+func (b *BondedShip) IsMine() bool {
+	return b.mine
+}
+
+// IsSecure returns whether the ship provides transport security.
+func (b *BondedShip) IsSecure() bool {
+	return false
+}
+
+// Public returns whether the ship is marked as public.
+func (b *BondedShip) Public() bool {
+	return b.public.IsSet()
+}
+
+// MarkPublic marks the ship and all its paths as public.
+func (b *BondedShip) MarkPublic() {
+	b.public.Set()
+
+	b.pathsLock.Lock()
+	defer b.pathsLock.Unlock()
+	for _, path := range b.paths {
+		path.ship.MarkPublic()
+	}
+}
+
+// LoadSize returns the recommended data size that should be handed to Load().
+func (b *BondedShip) LoadSize() int {
+	return b.primaryPath().ship.LoadSize() - bondDataHeaderSize
+}
+
+// Load loads data into the ship - ie. sends the data via the paths.
+// Returns ErrSunk if the ship has already sunk earlier.
+func (b *BondedShip) Load(data []byte) error {
+	// Empty load is used as a signal to cease operation.
+	if len(data) == 0 {
+		b.Sink()
+		return nil
+	}
+	if b.sinking.IsSet() {
+		return ErrSunk
+	}
+
+	for len(data) > 0 {
+		// Get data for this frame.
+		segment := data
+		if len(segment) > bondMaxSegmentSize {
+			segment = segment[:bondMaxSegmentSize]
+		}
+		data = data[len(segment):]
+
+		// Create frame and save until acknowledged.
+		frame := &bondFrame{
+			data: make([]byte, len(segment)),
+		}
+		copy(frame.data, segment)
+		b.sendLock.Lock()
+		frame.seq = b.nextSendSeq
+		b.nextSendSeq++
+		b.unacked = append(b.unacked, frame)
+		b.unackedSize += frame.size()
+		b.sendLock.Unlock()
+
+		// Send.
+		path, err := b.sendFrame(frame.wire(frame.seq))
+		if err != nil {
+			return err
+		}
+
+		// Drop the path of the oldest unacknowledged frame if the peer stopped
+		// acknowledging data.
+		var stalled *bondPath
+		b.sendLock.Lock()
+		frame.path = path
+		if b.unackedSize > bondMaxBufferSize && len(b.unacked) > 0 {
+			stalled = b.unacked[0].path
+		}
+		b.sendLock.Unlock()
+		if stalled != nil && stalled.dead.IsNotSet() {
+			log.Warningf("spn/ships: %s exceeded unacknowledged data limit, dropping %s", b, stalled.ship)
+			b.pathFailed(stalled)
+		}
+	}
+
+	return nil
+}
+
+// UnloadTo unloads data from the ship - ie. receives data from the paths in
+// order - puts it into the buf. It returns the amount of data written and an
+// optional error.
+// Returns ErrSunk if the ship has already sunk earlier.
+func (b *BondedShip) UnloadTo(buf []byte) (n int, err error) {
+	for len(b.delivered) == 0 {
+		select {
+		case frame := <-b.frames:
+			b.receive(frame)
+		case <-b.ctx.Done():
+			return 0, ErrSunk
+		}
+	}
+
+	n = copy(buf, b.delivered)
+	b.delivered = b.delivered[n:]
+	return n, nil
+}
+
+func (b *BondedShip) receive(frame *bondFrame) {
+	var exceeded bool
+	b.recvLock.Lock()
+	defer func() {
+		ackNow := b.recvNotAck >= bondAckInterval
+		b.recvLock.Unlock()
+		if ackNow {
+			b.sendAck()
+		}
+		if exceeded {
+			log.Warningf("spn/ships: %s exceeded reorder limit, dropping %s", b, frame.path.ship)
+			b.pathFailed(frame.path)
+		}
+	}()
+
+	// Ignore duplicates.
+	if frame.seq < b.nextRecvSeq {
+		return
+	}
+	if _, ok := b.reorder[frame.seq]; ok {
+		return
+	}
+
+	// A well-behaved peer stays within the limit, as it drops paths when
+	// too much data is unacknowledged. Allow for one frame of overshoot.
+	if b.reorderSize+frame.size() > bondMaxBufferSize+bondDataHeaderSize+bondMaxSegmentSize {
+		exceeded = true
+		return
+	}
+	b.reorder[frame.seq] = frame.data
+	b.reorderSize += frame.size()
+
+	// Deliver all frames that are in order.
+	for {
+		data, ok := b.reorder[b.nextRecvSeq]
+		if !ok {
+			return
+		}
+		b.delivered = append(b.delivered, data...)
+		b.reorderSize -= bondDataHeaderSize + len(data)
+		delete(b.reorder, b.nextRecvSeq)
+		b.nextRecvSeq++
+		b.recvNotAck++
+	}
+}
+
+// LocalAddr returns the local address of the primary path.
+func (b *BondedShip) LocalAddr() net.Addr {
+	return b.primaryPath().ship.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the primary path.
+func (b *BondedShip) RemoteAddr() net.Addr {
+	return b.primaryPath().ship.RemoteAddr()
+}
+
+// Sink closes all paths and cleans up any related resources.
+func (b *BondedShip) Sink() {
+	if !b.sinking.SetToIf(false, true) {
+		return
+	}
+	b.cancelCtx()
+
+	// Sink all paths.
+	b.pathsLock.Lock()
+	for _, path := range b.paths {
+		path.dead.Set()
+		path.ship.Sink()
+	}
+	b.pathsLock.Unlock()
+
+	// Remove from docked bonds.
+	if !b.mine {
+		dockedBondsLock.Lock()
+		delete(dockedBonds, hex.EncodeToString(b.id))
+		dockedBondsLock.Unlock()
+	}
+}
+
+// MaskAddress masks the address, if enabled.
+func (b *BondedShip) MaskAddress(addr net.Addr) string {
+	return b.primaryPath().ship.MaskAddress(addr)
+}
+
+// MaskIP masks an IP, if enabled.
+func (b *BondedShip) MaskIP(ip net.IP) string {
+	return b.primaryPath().ship.MaskIP(ip)
+}
+
+// Mask masks a value.
+func (b *BondedShip) Mask(value []byte) string {
+	return b.primaryPath().ship.Mask(value)
+}
+
+// unloadFull unloads from the ship until buf is full.
+func unloadFull(ship Ship, buf []byte) error {
+	var read int
+	for read < len(buf) {
+		n, err := ship.UnloadTo(buf[read:])
+		if err != nil {
+			return err
+		}
+		read += n
+	}
+	return nil
+}
+
+// addrIP returns the IP of the given address, if available.
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	case *net.IPAddr:
+		return v.IP
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,212 @@
+package ships
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/safing/jess"
+	"github.com/safing/spn/hub"
+)
+
+func TestBondedShip(t *testing.T) {
+	t.Parallel()
+
+	// Establish two piers for the same Hub.
+	dockingRequests := make(chan Ship, 10)
+	testHub := &hub.Hub{
+		ID: "Zwuk9L5bSwap2JHgWituh493jKFmASUWjgMCvXyBMESEDJ",
+		Info: &hub.Announcement{
+			IPv4: localhost,
+		},
+	}
+	keys := createTestExchKey(t, testHub)
+	for i := 0; i < 2; i++ {
+		transport := &hub.Transport{
+			Protocol: "tcp",
+			Port:     getTestPort(),
+		}
+		pier, err := EstablishPier(transport, dockingRequests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pier.Abolish()
+		testHub.Info.Transports = append(testHub.Info.Transports, fmt.Sprintf("tcp:%d", transport.Port))
+	}
+
+	// Dock both paths while launching.
+	docked := make(chan Ship, 2)
+	dockErrs := make(chan error, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			ship, err := DockBonded(<-dockingRequests, keys)
+			if err != nil {
+				dockErrs <- err
+				continue
+			}
+			if ship != nil {
+				docked <- ship
+			}
+		}
+		close(dockErrs)
+	}()
+
+	// Launch bonded ship.
+	ship, err := LaunchBonded(context.Background(), testHub, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bondedShip, ok := ship.(*BondedShip)
+	if !ok {
+		t.Fatalf("expected bonded ship, got %s", ship)
+	}
+	defer bondedShip.Sink()
+	for err := range dockErrs {
+		t.Fatal(err)
+	}
+	var srvShip Ship
+	select {
+	case srvShip = <-docked:
+	default:
+		t.Fatal("no bonded ship docked")
+	}
+	defer srvShip.Sink()
+	assert.Equal(t, 2, bondedShip.alivePaths(), "client should have two paths")
+	assert.Equal(t, 2, srvShip.(*BondedShip).alivePaths(), "server should have two paths") //nolint:forcetypeassert
+
+	exchange := func() {
+		t.Helper()
+
+		for i := 0; i < 10; i++ {
+			err = ship.Load(testData)
+			if err != nil {
+				t.Fatalf("%s failed: %s", ship, err)
+			}
+			buf := getTestBuf()
+			err = unloadFull(srvShip, buf)
+			if err != nil {
+				t.Fatalf("%s failed: %s", srvShip, err)
+			}
+			assert.Equal(t, testData, buf, "should match")
+
+			err = srvShip.Load(testData)
+			if err != nil {
+				t.Fatalf("%s failed: %s", srvShip, err)
+			}
+			buf = getTestBuf()
+			err = unloadFull(ship, buf)
+			if err != nil {
+				t.Fatalf("%s failed: %s", ship, err)
+			}
+			assert.Equal(t, testData, buf, "should match")
+		}
+	}
+
+	// Exchange data over both paths.
+	exchange()
+
+	// Joining the bond without knowing the secret must fail.
+	intruder := newBondedShip(bondedShip.id, make([]byte, bondSecretSize), true)
+	defer intruder.Sink()
+	transport, err := hub.ParseTransport(testHub.Info.Transports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	intruderShip, err := connectTo(context.Background(), testHub, transport, localhost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = DockBonded(<-dockingRequests, keys)
+	}()
+	assert.Error(t, intruder.addLaunchedPath(intruderShip, false), "join without secret should fail")
+	assert.Equal(t, 2, srvShip.(*BondedShip).alivePaths(), "server should still have two paths") //nolint:forcetypeassert
+
+	// Kill a path and check that data still arrives.
+	bondedShip.paths[0].ship.Sink()
+	exchange()
+}
+
+// createTestExchKey adds an exchange key to the given Hub and returns a trust
+// store that supplies its private key.
+func createTestExchKey(t *testing.T, h *hub.Hub) jess.TrustStore {
+	t.Helper()
+
+	signet, err := jess.GenerateSignet("ECDH-X25519", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signet.ID = "test"
+	rcpt, err := signet.AsRecipient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rcpt.StoreKey(); err != nil {
+		t.Fatal(err)
+	}
+	h.Status = &hub.Status{
+		Keys: map[string]*hub.Key{
+			signet.ID: {
+				Scheme:  rcpt.Scheme,
+				Key:     rcpt.Key,
+				Expires: time.Now().Add(time.Hour).Unix(),
+			},
+		},
+	}
+
+	keys := jess.NewMemTrustStore()
+	if err := keys.StoreSignet(signet); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestBondBufferLimits(t *testing.T) {
+	t.Parallel()
+
+	// Create bonded ship with two paths, of which the remote ends only drain
+	// data without acknowledging it.
+	b := newBondedShip(make([]byte, bondIDSize), make([]byte, bondSecretSize), false)
+	defer b.Sink()
+	for i := 0; i < 2; i++ {
+		ship := NewTestShip(false, 100)
+		remote := ship.Reverse()
+		go func() {
+			buf := make([]byte, bondMaxSegmentSize)
+			for {
+				if _, err := remote.UnloadTo(buf); err != nil {
+					return
+				}
+			}
+		}()
+		b.addPath(ship)
+	}
+
+	// Frames far ahead of the expected sequence may only fill the reorder
+	// buffer up to the limit, before the path they arrived on is dropped.
+	frameData := make([]byte, bondMaxSegmentSize)
+	for seq := uint64(1); b.paths[1].dead.IsNotSet(); seq++ {
+		if seq > 2*bondMaxBufferSize/bondMaxSegmentSize {
+			t.Fatal("path should have been dropped")
+		}
+		b.receive(&bondFrame{seq: seq, data: frameData, path: b.paths[1]})
+	}
+	assert.LessOrEqual(t, b.reorderSize, bondMaxBufferSize+bondDataHeaderSize+bondMaxSegmentSize)
+	assert.Equal(t, 1, b.alivePaths(), "one path should be left")
+
+	// Unacknowledged data may only grow up to the limit, before the path that
+	// carried the oldest unacknowledged data is dropped.
+	for i := 0; b.alivePaths() > 0; i++ {
+		if i > 2*bondMaxBufferSize/bondMaxSegmentSize {
+			t.Fatal("path should have been dropped")
+		}
+		if err := b.Load(frameData); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, 0, b.alivePaths(), "all paths should be dropped")
+	assert.True(t, b.sinking.IsSet(), "bonded ship should be sunk")
+}
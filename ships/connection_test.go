@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"path/filepath"
 	"sync"
 	"testing"
 
@@ -30,6 +31,18 @@ func getTestBuf() []byte {
 func TestConnections(t *testing.T) {
 	t.Parallel()
 
+	// Set up pier certificate and matching Hub for transports using TLS.
+	signet, _, err := hub.CreateHubSignet("Ed25519", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := CertificateFromSignet(signet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetPierCertificate(cert)
+	testHub := &hub.Hub{ID: signet.ID}
+
 	registryLock.Lock()
 	t.Cleanup(func() {
 		registryLock.Unlock()
@@ -49,6 +62,14 @@ func TestConnections(t *testing.T) {
 				Protocol: protocol,
 				Port:     getTestPort(),
 			}
+			switch protocol {
+			case "unix":
+				transport.Port = 0
+				transport.Path = filepath.Join(t.TempDir(), "spn.sock")
+			case "pipe":
+				transport.Port = 0
+				transport.Domain = "test"
+			}
 
 			// create listener
 			pier, err := builder.EstablishPier(transport, dockingRequests)
@@ -57,7 +78,7 @@ func TestConnections(t *testing.T) {
 			}
 
 			// connect to listener
-			ship, err := builder.LaunchShip(ctx, transport, localhost)
+			ship, err := builder.LaunchShip(ctx, testHub, transport, localhost)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -129,3 +150,54 @@ func TestConnections(t *testing.T) {
 		})
 	}
 }
+
+func TestLaunchPipe(t *testing.T) { //nolint:paralleltest // TestConnections locks the registry.
+	// Establish pier on pipe.
+	transport, err := hub.ParseTransport("pipe://launch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dockingRequests := make(chan Ship, 1)
+	pier, err := EstablishPier(transport, dockingRequests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pier.Abolish()
+
+	// Announced local transports must not be launched to.
+	testHub := &hub.Hub{
+		ID: "Zwuk9L5bSwap2JHgWituh493jKFmASUWjgMCvXyBMESEDJ",
+		Info: &hub.Announcement{
+			IPv4:       localhost,
+			Transports: []string{"pipe://launch-test"},
+		},
+	}
+	_, err = Launch(context.Background(), testHub, nil, nil)
+	assert.ErrorIs(t, err, hub.ErrMissingTransports, "should fail")
+
+	// Launch ship via the regular launch procedure with the configured transport.
+	ship, err := Launch(context.Background(), testHub, transport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ship.Sink()
+	srvShip := <-dockingRequests
+	defer srvShip.Sink()
+
+	// Exchange data.
+	err = ship.Load(testData)
+	if err != nil {
+		t.Fatalf("%s failed: %s", ship, err)
+	}
+	buf := getTestBuf()
+	err = unloadFull(srvShip, buf)
+	if err != nil {
+		t.Fatalf("%s failed: %s", srvShip, err)
+	}
+	assert.Equal(t, testData, buf, "should match")
+
+	// Launching to an abolished pipe must fail.
+	pier.Abolish()
+	_, err = Launch(context.Background(), testHub, transport, nil)
+	assert.ErrorIs(t, err, ErrPipeNotFound, "should fail")
+}
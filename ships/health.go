@@ -0,0 +1,357 @@
+package ships
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/safing/portbase/database"
+	"github.com/safing/portbase/database/query"
+	"github.com/safing/portbase/database/record"
+	"github.com/safing/portbase/log"
+	"github.com/safing/spn/hub"
+)
+
+/*
+Transport Health:
+
+The outcome of every ship launch is recorded per Hub, transport and IP version.
+When launching a ship without a specific transport, the transports are sorted
+by their health: Transports that failed repeatedly are temporarily blacklisted
+and only tried after all others. The remaining transports are sorted by their
+success rate and latency, but otherwise keep the order of SortTransports.
+
+The records are persisted in the cache database, so that they survive restarts.
+*/
+
+const (
+	// transportBlacklistThreshold defines after how many consecutive failures a
+	// transport is blacklisted.
+	transportBlacklistThreshold = 3
+
+	// transportBlacklistBaseDuration defines how long a transport is
+	// blacklisted at first. The duration doubles with every further failure.
+	transportBlacklistBaseDuration = 10 * time.Minute
+
+	// transportBlacklistMaxDuration defines the maximum blacklist duration.
+	transportBlacklistMaxDuration = 6 * time.Hour
+
+	// transportHealthTTL defines how long a health record is kept after the
+	// last launch.
+	transportHealthTTL = 30 * 24 * time.Hour
+)
+
+var (
+	healthDB = database.NewInterface(&database.Options{
+		Local:    true,
+		Internal: true,
+	})
+
+	transportHealth     = make(map[string]*HubTransportHealth) // ID = Hub ID
+	transportHealthLock sync.Mutex
+)
+
+// HubTransportHealth holds the transport health of a Hub.
+type HubTransportHealth struct {
+	record.Base
+	sync.Mutex
+
+	// HubID is the ID of the Hub.
+	HubID string
+	// Transports holds the health per transport and IP version.
+	Transports map[string]*TransportHealth
+}
+
+// TransportHealth holds the launch history of a transport.
+type TransportHealth struct {
+	// Successes holds the amount of successful launches.
+	Successes int
+	// Failures holds the amount of failed launches.
+	Failures int
+	// ConsecutiveFailures holds the amount of failed launches since the last success.
+	ConsecutiveFailures int
+	// Latency holds the moving average of the launch duration.
+	Latency time.Duration
+	// LastSuccess holds the time of the last successful launch.
+	LastSuccess time.Time
+	// LastFailure holds the time of the last failed launch.
+	LastFailure time.Time
+	// BlacklistedUntil holds the time until the transport is blacklisted.
+	BlacklistedUntil time.Time
+}
+
+// loadTransportHealth loads all transport health records from the database.
+func loadTransportHealth() error {
+	iter, err := healthDB.Query(query.New(makeTransportHealthDBKey("")))
+	if err != nil {
+		return fmt.Errorf("failed to start query for transport health: %w", err)
+	}
+
+	transportHealthLock.Lock()
+	defer transportHealthLock.Unlock()
+
+	for r := range iter.Next {
+		hth, err := ensureHubTransportHealth(r)
+		if err != nil {
+			log.Warningf("spn/ships: could not parse transport health %q: %s", r.Key(), err)
+			continue
+		}
+		if _, ok := transportHealth[hth.HubID]; !ok {
+			transportHealth[hth.HubID] = hth
+		}
+	}
+	if iter.Err() != nil {
+		return fmt.Errorf("failed to (fully) load transport health: %w", iter.Err())
+	}
+
+	return nil
+}
+
+func makeTransportHealthDBKey(hubID string) string {
+	return fmt.Sprintf("cache:spn/transports/%s", hubID)
+}
+
+// makeTransportHealthKey returns the key of the transport within the health
+// records, which includes the IP version.
+func makeTransportHealthKey(transport *hub.Transport, ip net.IP) string {
+	if ip.To4() != nil {
+		return transport.String() + " IPv4"
+	}
+	return transport.String() + " IPv6"
+}
+
+// getHubTransportHealth returns the transport health of the given Hub.
+// It is loaded from the database or created, if needed.
+func getHubTransportHealth(hubID string) *HubTransportHealth {
+	transportHealthLock.Lock()
+	defer transportHealthLock.Unlock()
+
+	// Check cache.
+	hth, ok := transportHealth[hubID]
+	if ok {
+		return hth
+	}
+
+	// Load from database.
+	r, err := healthDB.Get(makeTransportHealthDBKey(hubID))
+	if err == nil {
+		hth, err = ensureHubTransportHealth(r)
+	}
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			log.Debugf("spn/ships: failed to load transport health of %s: %s", hubID, err)
+		}
+		hth = &HubTransportHealth{
+			HubID:      hubID,
+			Transports: make(map[string]*TransportHealth),
+		}
+		hth.SetKey(makeTransportHealthDBKey(hubID))
+	}
+
+	transportHealth[hubID] = hth
+	return hth
+}
+
+func ensureHubTransportHealth(r record.Record) (*HubTransportHealth, error) {
+	// unwrap
+	if r.IsWrapped() {
+		// only allocate a new struct, if we need it
+		newHTH := &HubTransportHealth{}
+		err := record.Unwrap(r, newHTH)
+		if err != nil {
+			return nil, err
+		}
+		if newHTH.Transports == nil {
+			newHTH.Transports = make(map[string]*TransportHealth)
+		}
+		return newHTH, nil
+	}
+
+	// or adjust type
+	newHTH, ok := r.(*HubTransportHealth)
+	if !ok {
+		return nil, fmt.Errorf("record not of type *HubTransportHealth, but %T", r)
+	}
+	return newHTH, nil
+}
+
+// getTransport returns the health of the given transport key.
+// The HubTransportHealth must be locked.
+func (hth *HubTransportHealth) getTransport(key string) *TransportHealth {
+	th, ok := hth.Transports[key]
+	if !ok {
+		th = &TransportHealth{}
+		hth.Transports[key] = th
+	}
+	return th
+}
+
+// save saves the transport health to the database.
+// The HubTransportHealth must not be locked, as the database locks it.
+func (hth *HubTransportHealth) save() {
+	hth.Lock()
+	hth.UpdateMeta()
+	hth.Meta().SetRelativateExpiry(int64(transportHealthTTL.Seconds()))
+	hth.Unlock()
+
+	err := healthDB.Put(hth)
+	if err != nil {
+		log.Debugf("spn/ships: failed to save transport health of %s: %s", hth.HubID, err)
+	}
+}
+
+// reportLaunchSuccess records a successful launch.
+func reportLaunchSuccess(h *hub.Hub, transport *hub.Transport, ip net.IP, latency time.Duration) {
+	hth := getHubTransportHealth(h.ID)
+	hth.Lock()
+	th := hth.getTransport(makeTransportHealthKey(transport, ip))
+	th.Successes++
+	th.ConsecutiveFailures = 0
+	th.LastSuccess = time.Now()
+	th.BlacklistedUntil = time.Time{}
+	if th.Latency == 0 {
+		th.Latency = latency
+	} else {
+		th.Latency = (th.Latency*3 + latency) / 4
+	}
+	hth.Unlock()
+
+	hth.save()
+}
+
+// reportLaunchFailure records a failed launch.
+func reportLaunchFailure(h *hub.Hub, transport *hub.Transport, ip net.IP) {
+	hth := getHubTransportHealth(h.ID)
+	hth.Lock()
+	th := hth.getTransport(makeTransportHealthKey(transport, ip))
+	th.Failures++
+	th.ConsecutiveFailures++
+	th.LastFailure = time.Now()
+
+	// Blacklist transport after consecutive failures.
+	if th.ConsecutiveFailures >= transportBlacklistThreshold {
+		blacklistDuration := transportBlacklistBaseDuration
+		for i := transportBlacklistThreshold; i < th.ConsecutiveFailures; i++ {
+			blacklistDuration *= 2
+			if blacklistDuration >= transportBlacklistMaxDuration {
+				blacklistDuration = transportBlacklistMaxDuration
+				break
+			}
+		}
+		th.BlacklistedUntil = th.LastFailure.Add(blacklistDuration)
+		log.Infof("spn/ships: blacklisted %s of %s for %s", transport, h, blacklistDuration)
+	}
+	hth.Unlock()
+
+	hth.save()
+}
+
+// sortTransportsByHealth returns the transports sorted by their health for
+// launching a ship to the given Hub and IP.
+func sortTransportsByHealth(hubID string, transports []*hub.Transport, ip net.IP) []*hub.Transport {
+	hth := getHubTransportHealth(hubID)
+	hth.Lock()
+	defer hth.Unlock()
+
+	// Nothing to sort if there is no history.
+	if len(hth.Transports) == 0 {
+		return transports
+	}
+
+	// Get health of transports.
+	healths := make(map[*hub.Transport]*TransportHealth, len(transports))
+	for _, t := range transports {
+		th, ok := hth.Transports[makeTransportHealthKey(t, ip)]
+		if ok {
+			healths[t] = th
+		}
+	}
+
+	// Sort copy of transports.
+	now := time.Now()
+	sorted := slices.Clone(transports)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := healths[sorted[i]], healths[sorted[j]]
+
+		// Try blacklisted transports last.
+		aBlacklisted := a != nil && now.Before(a.BlacklistedUntil)
+		bBlacklisted := b != nil && now.Before(b.BlacklistedUntil)
+		if aBlacklisted != bBlacklisted {
+			return bBlacklisted
+		}
+
+		// Prefer transports with a better score.
+		return a.score() > b.score()
+	})
+
+	return sorted
+}
+
+// score returns a score for sorting transports. Transports without history
+// have a neutral score.
+func (th *TransportHealth) score() float64 {
+	if th == nil || th.Successes+th.Failures == 0 {
+		return 0.5
+	}
+
+	// Base score on the success rate.
+	score := float64(th.Successes) / float64(th.Successes+th.Failures)
+
+	// Reduce score by up to a tenth for latency, maxing out at 5 seconds.
+	latencyPenalty := float64(th.Latency) / float64(5*time.Second)
+	if latencyPenalty > 1 {
+		latencyPenalty = 1
+	}
+	return score - latencyPenalty/10
+}
+
+// IsBlacklisted returns whether the transport is currently blacklisted.
+func (th *TransportHealth) IsBlacklisted() bool {
+	return time.Now().Before(th.BlacklistedUntil)
+}
+
+// GetTransportHealth returns a copy of the transport health of all Hubs.
+func GetTransportHealth() []*HubTransportHealth {
+	transportHealthLock.Lock()
+	defer transportHealthLock.Unlock()
+
+	all := make([]*HubTransportHealth, 0, len(transportHealth))
+	for _, hth := range transportHealth {
+		hth.Lock()
+		transports := make(map[string]*TransportHealth, len(hth.Transports))
+		for key, th := range hth.Transports {
+			copied := *th
+			transports[key] = &copied
+		}
+		all = append(all, &HubTransportHealth{
+			HubID:      hth.HubID,
+			Transports: transports,
+		})
+		hth.Unlock()
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].HubID < all[j].HubID
+	})
+	return all
+}
+
+// ResetTransportHealth resets the transport health of all Hubs.
+func ResetTransportHealth(ctx context.Context) error {
+	transportHealthLock.Lock()
+	defer transportHealthLock.Unlock()
+
+	transportHealth = make(map[string]*HubTransportHealth)
+	_, err := healthDB.Purge(ctx, query.New(makeTransportHealthDBKey("")))
+	if err != nil {
+		return fmt.Errorf("failed to delete transport health: %w", err)
+	}
+
+	return nil
+}
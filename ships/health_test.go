@@ -0,0 +1,102 @@
+package ships
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/safing/portbase/database"
+	_ "github.com/safing/portbase/database/storage/hashmap"
+	"github.com/safing/spn/hub"
+)
+
+func TestTransportHealth(t *testing.T) {
+	t.Parallel()
+
+	testHub := &hub.Hub{
+		ID: "Zwu5LkkELhAbJTLbnzs8GBN6YazqtpvRfh2CwpySwN6UAs",
+	}
+	transports, err := hub.ParseTransports([]string{"tcp:17", "http:80", "tcp:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted := func(ip net.IP) []string {
+		s := make([]string, 0, len(transports))
+		for _, t := range sortTransportsByHealth(testHub.ID, transports, ip) {
+			s = append(s, t.String())
+		}
+		return s
+	}
+	initial := sorted(localhost)
+
+	// Fail the first transport until it is blacklisted.
+	first := transports[0]
+	for i := 0; i < transportBlacklistThreshold; i++ {
+		reportLaunchFailure(testHub, first, localhost)
+	}
+	assert.Equal(t, first.String(), sorted(localhost)[len(transports)-1], "blacklisted transport should be tried last")
+
+	// Check blacklist duration.
+	hth := getHubTransportHealth(testHub.ID)
+	th := hth.Transports[makeTransportHealthKey(first, localhost)]
+	assert.True(t, th.IsBlacklisted(), "transport should be blacklisted")
+	assert.WithinDuration(t, time.Now().Add(transportBlacklistBaseDuration), th.BlacklistedUntil, time.Minute)
+	reportLaunchFailure(testHub, first, localhost)
+	assert.WithinDuration(t, time.Now().Add(2*transportBlacklistBaseDuration), th.BlacklistedUntil, time.Minute)
+
+	// The blacklist must only apply to the same IP version.
+	assert.Equal(t, initial, sorted(net.ParseIP("fd00::1")), "blacklist should only apply to the same IP version")
+
+	// A successful transport should be preferred over ones without history.
+	last := transports[len(transports)-1]
+	reportLaunchSuccess(testHub, last, localhost, 100*time.Millisecond)
+	assert.Equal(t, last.String(), sorted(localhost)[0], "successful transport should be tried first")
+
+	// A success lifts the blacklist, but the transport is still sorted by its
+	// bad success rate.
+	reportLaunchSuccess(testHub, first, localhost, 3*time.Second)
+	assert.False(t, th.IsBlacklisted(), "transport should not be blacklisted anymore")
+	assert.Equal(t, first.String(), sorted(localhost)[len(transports)-1], "unreliable transport should be tried last")
+}
+
+func TestTransportHealthPersistence(t *testing.T) { //nolint:paralleltest // Initializes the global database.
+	// Set up a cache database in memory.
+	require.NoError(t, database.InitializeWithPath(t.TempDir()))
+	_, err := database.Register(&database.Database{
+		Name:        "cache",
+		Description: "test cache",
+		StorageType: "hashmap",
+	})
+	require.NoError(t, err)
+
+	testHub := &hub.Hub{
+		ID: "Zwu5LkkELhAbJTLbnzs8GBN6YazqtpvRfh2CwpySwN6UAt",
+	}
+	transports, errs := hub.ParseTransports([]string{"tcp:17"})
+	require.Empty(t, errs)
+
+	// Reporting must save the health to the database without deadlocking.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reportLaunchFailure(testHub, transports[0], localhost)
+		reportLaunchSuccess(testHub, transports[0], localhost, 100*time.Millisecond)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reporting the launch result deadlocked")
+	}
+
+	r, err := healthDB.Get(makeTransportHealthDBKey(testHub.ID))
+	require.NoError(t, err)
+	hth, err := ensureHubTransportHealth(r)
+	require.NoError(t, err)
+	th := hth.Transports[makeTransportHealthKey(transports[0], localhost)]
+	require.NotNil(t, th, "transport health should be saved")
+	assert.Equal(t, 1, th.Successes)
+	assert.Equal(t, 1, th.Failures)
+}
@@ -3,6 +3,7 @@ package ships
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -31,6 +32,10 @@ func init() {
 		LaunchShip:    launchHTTPShip,
 		EstablishPier: establishHTTPPier,
 	})
+	Register("https", &Builder{
+		LaunchShip:    launchHTTPShip,
+		EstablishPier: establishHTTPPier,
+	})
 }
 
 /*
@@ -50,9 +55,12 @@ Response:
 		Connection: Upgrade
 		Upgrade: SPN
 
+The "https" protocol uses the same variants, but wrapped in TLS.
+See tls.go for how the certificate is verified.
+
 */
 
-func launchHTTPShip(ctx context.Context, transport *hub.Transport, ip net.IP) (Ship, error) {
+func launchHTTPShip(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP) (Ship, error) {
 	// Default to root path.
 	path := transport.Path
 	if path == "" {
@@ -86,6 +94,22 @@ func launchHTTPShip(ctx context.Context, transport *hub.Transport, ip net.IP) (S
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
 
+	// Wrap connection in TLS, if required.
+	if transport.Protocol == "https" {
+		tlsConfig, err := getShipTLSConfig(h, transport)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to establish tls: %w", err)
+		}
+		conn = tlsConn
+	}
+
 	// Send HTTP request.
 	err = request.Write(conn)
 	if err != nil {
@@ -125,7 +149,7 @@ func launchHTTPShip(ctx context.Context, transport *hub.Transport, ip net.IP) (S
 	}
 
 	// Init and return.
-	ship.calculateLoadSize(ip, nil, TCPHeaderMTUSize)
+	ship.calculateLoadSize(ip, nil, httpOverhead(transport)...)
 	ship.initBase()
 	return ship, nil
 }
@@ -175,7 +199,7 @@ func (pier *HTTPPier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				secure:    false,
 			},
 		}
-		ship.calculateLoadSize(nil, conn.RemoteAddr(), TCPHeaderMTUSize)
+		ship.calculateLoadSize(nil, conn.RemoteAddr(), httpOverhead(pier.transport)...)
 		ship.initBase()
 
 		// Submit new docking request.
@@ -209,9 +233,16 @@ func establishHTTPPier(transport *hub.Transport, dockingRequests chan Ship) (Pie
 	pier.initBase()
 
 	// Register handler.
-	err := addHTTPHandler(transport.Port, path, pier.ServeHTTP)
-	if err != nil {
-		return nil, fmt.Errorf("failed to add HTTP handler: %w", err)
+	if transport.Protocol == "https" {
+		err := addHTTPSHandler(transport.Port, path, pier.ServeHTTP, getPierTLSConfig())
+		if err != nil {
+			return nil, fmt.Errorf("failed to add HTTPS handler: %w", err)
+		}
+	} else {
+		err := addHTTPHandler(transport.Port, path, pier.ServeHTTP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add HTTP handler: %w", err)
+		}
 	}
 
 	return pier, nil
@@ -228,3 +259,11 @@ func (pier *HTTPPier) Abolish() {
 	// Instead, remove the HTTP handler and the shared server will shutdown itself when needed.
 	_ = removeHTTPHandler(pier.transport.Port, pier.transport.Path)
 }
+
+// httpOverhead returns the header sizes to subtract from the load size.
+func httpOverhead(transport *hub.Transport) []int {
+	if transport.Protocol == "https" {
+		return []int{TCPHeaderMTUSize, TLSHeaderMTUSize}
+	}
+	return []int{TCPHeaderMTUSize}
+}
@@ -2,6 +2,7 @@ package ships
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -14,7 +15,8 @@ import (
 )
 
 type sharedServer struct {
-	server *http.Server
+	server    *http.Server
+	tlsConfig *tls.Config
 
 	handlers     map[string]http.HandlerFunc
 	handlersLock sync.RWMutex
@@ -48,6 +50,20 @@ var (
 )
 
 func addHTTPHandler(port uint16, path string, handler http.HandlerFunc) error {
+	return addSharedHTTPHandler(port, path, handler, nil)
+}
+
+// addHTTPSHandler is like addHTTPHandler, but the shared server on the port
+// serves TLS using the given config. If the server already exists, its
+// existing TLS config is used.
+func addHTTPSHandler(port uint16, path string, handler http.HandlerFunc, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		return errors.New("missing tls config")
+	}
+	return addSharedHTTPHandler(port, path, handler, tlsConfig)
+}
+
+func addSharedHTTPHandler(port uint16, path string, handler http.HandlerFunc, tlsConfig *tls.Config) error {
 	// Check params.
 	if port == 0 {
 		return errors.New("cannot listen on port 0")
@@ -64,6 +80,11 @@ func addHTTPHandler(port uint16, path string, handler http.HandlerFunc) error {
 	// Get http server of the port.
 	shared, ok := sharedHTTPServers[port]
 	if ok {
+		// Check if TLS usage matches.
+		if (shared.tlsConfig == nil) != (tlsConfig == nil) {
+			return errors.New("port already used with a different tls setting")
+		}
+
 		// Set path to handler.
 		shared.handlersLock.Lock()
 		defer shared.handlersLock.Unlock()
@@ -81,7 +102,8 @@ func addHTTPHandler(port uint16, path string, handler http.HandlerFunc) error {
 
 	// Shared server does not exist - create one.
 	shared = &sharedServer{
-		handlers: make(map[string]http.HandlerFunc),
+		tlsConfig: tlsConfig,
+		handlers:  make(map[string]http.HandlerFunc),
 	}
 
 	// Add first handler.
@@ -105,7 +127,7 @@ func addHTTPHandler(port uint16, path string, handler http.HandlerFunc) error {
 	bindIPs := conf.GetBindIPs()
 	listeners := make([]net.Listener, 0, len(bindIPs))
 	for _, bindIP := range bindIPs {
-		listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+		tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{
 			IP:   bindIP,
 			Port: int(port),
 		})
@@ -113,8 +135,16 @@ func addHTTPHandler(port uint16, path string, handler http.HandlerFunc) error {
 			return fmt.Errorf("failed to listen: %w", err)
 		}
 
+		// Wrap listener with TLS, if configured.
+		var listener net.Listener = tcpListener
+		if tlsConfig != nil {
+			listener = tls.NewListener(tcpListener, tlsConfig)
+			log.Infof("spn/ships: https transport pier established on %s", listener.Addr())
+		} else {
+			log.Infof("spn/ships: http transport pier established on %s", listener.Addr())
+		}
+
 		listeners = append(listeners, listener)
-		log.Infof("spn/ships: http transport pier established on %s", listener.Addr())
 	}
 
 	// Add shared http server to list.
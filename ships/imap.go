@@ -0,0 +1,113 @@
+package ships
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/safing/spn/hub"
+)
+
+/*
+IMAP Handshake:
+
+	S: * OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] <name> ready
+	C: a1 CAPABILITY
+	S: * CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED
+	S: a1 OK CAPABILITY completed
+	C: a2 STARTTLS
+	S: a2 OK Begin TLS negotiation now
+
+The pier additionally answers NOOP and LOGOUT in order to behave like a real
+server when probed.
+*/
+
+const imapCapabilities = "IMAP4rev1 STARTTLS LOGINDISABLED"
+
+func imapShipHandshake(conn net.Conn, _ *hub.Transport) error {
+	// Receive greeting.
+	line, err := readMailLine(conn)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("unexpected greeting: %q", line)
+	}
+
+	// Query capabilities.
+	if err := writeMailLines(conn, "a1 CAPABILITY"); err != nil {
+		return err
+	}
+	if err := expectIMAPCompletion(conn, "a1"); err != nil {
+		return err
+	}
+
+	// Request TLS.
+	if err := writeMailLines(conn, "a2 STARTTLS"); err != nil {
+		return err
+	}
+	return expectIMAPCompletion(conn, "a2")
+}
+
+// expectIMAPCompletion reads untagged responses until the tagged completion
+// response and checks if it is OK.
+func expectIMAPCompletion(conn net.Conn, tag string) error {
+	for {
+		line, err := readMailLine(conn)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "* "):
+			continue
+		case strings.HasPrefix(line, tag+" OK"):
+			return nil
+		default:
+			return fmt.Errorf("unexpected response: %q", line)
+		}
+	}
+}
+
+func imapPierHandshake(conn net.Conn, transport *hub.Transport) error {
+	// Send greeting.
+	err := writeMailLines(conn, "* OK [CAPABILITY "+imapCapabilities+"] "+mailServerName(transport)+" ready")
+	if err != nil {
+		return err
+	}
+
+	// Handle commands until the client requests TLS.
+	for i := 0; i < mailMaxCommands; i++ {
+		line, err := readMailLine(conn)
+		if err != nil {
+			return err
+		}
+		tag, rest, _ := strings.Cut(line, " ")
+		command, _, _ := strings.Cut(rest, " ")
+
+		switch strings.ToUpper(command) {
+		case "CAPABILITY":
+			err = writeMailLines(conn,
+				"* CAPABILITY "+imapCapabilities,
+				tag+" OK CAPABILITY completed",
+			)
+		case "NOOP":
+			err = writeMailLines(conn, tag+" OK NOOP completed")
+		case "STARTTLS":
+			return writeMailLines(conn, tag+" OK Begin TLS negotiation now")
+		case "LOGOUT":
+			_ = writeMailLines(conn,
+				"* BYE Logging out",
+				tag+" OK LOGOUT completed",
+			)
+			return errors.New("client logged out")
+		default:
+			err = writeMailLines(conn, tag+" BAD Command unknown or not allowed before STARTTLS")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return errors.New("too many commands")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/safing/portbase/log"
 	"github.com/safing/portmaster/netenv"
@@ -12,6 +13,38 @@ import (
 
 // Launch launches a new ship to the given Hub.
 func Launch(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP) (Ship, error) {
+	transports, ips, err := getLaunchOptions(h, transport, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	// connect
+	var firstErr error
+	for _, ip := range ips {
+		for _, tr := range sortTransportsByHealth(h.ID, transports, ip) {
+			ship, err := connectTo(ctx, h, tr, ip)
+			if err == nil {
+				return ship, nil // return on success
+			}
+
+			// Check if context is canceled.
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			// Save first error.
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return nil, firstErr
+}
+
+// getLaunchOptions returns the transports and IPs that may be used to launch
+// a ship to the given Hub. If a transport or IP is given, only it is used.
+func getLaunchOptions(h *hub.Hub, transport *hub.Transport, ip net.IP) ([]*hub.Transport, []net.IP, error) {
 	var transports []*hub.Transport
 	var ips []net.IP
 
@@ -20,7 +53,7 @@ func Launch(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP
 		transports = []*hub.Transport{transport}
 	} else {
 		if h.Info == nil {
-			return nil, hub.ErrMissingInfo
+			return nil, nil, hub.ErrMissingInfo
 		}
 		transports = h.Info.ParsedTransports()
 		// If there are no transports, check if they were parsed.
@@ -31,7 +64,7 @@ func Launch(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP
 		}
 		// Fail if there are not transports.
 		if len(transports) == 0 {
-			return nil, hub.ErrMissingTransports
+			return nil, nil, hub.ErrMissingTransports
 		}
 	}
 
@@ -40,7 +73,7 @@ func Launch(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP
 		ips = []net.IP{ip}
 	} else {
 		if h.Info == nil {
-			return nil, hub.ErrMissingInfo
+			return nil, nil, hub.ErrMissingInfo
 		}
 		ips = make([]net.IP, 0, 3)
 		// If IPs have been verified, check if we can use a virtual network address.
@@ -71,32 +104,11 @@ func Launch(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP
 			}
 		}
 		if len(ips) == 0 {
-			return nil, hub.ErrMissingIPs
-		}
-	}
-
-	// connect
-	var firstErr error
-	for _, ip := range ips {
-		for _, tr := range transports {
-			ship, err := connectTo(ctx, h, tr, ip)
-			if err == nil {
-				return ship, nil // return on success
-			}
-
-			// Check if context is canceled.
-			if ctx.Err() != nil {
-				return nil, ctx.Err()
-			}
-
-			// Save first error.
-			if firstErr == nil {
-				firstErr = err
-			}
+			return nil, nil, hub.ErrMissingIPs
 		}
 	}
 
-	return nil, firstErr
+	return transports, ips, nil
 }
 
 func connectTo(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP) (Ship, error) {
@@ -105,10 +117,33 @@ func connectTo(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net
 		return nil, fmt.Errorf("protocol %s not supported", transport.Protocol)
 	}
 
-	ship, err := builder.LaunchShip(ctx, transport, ip)
+	if err := checkObfuscation(transport); err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	ship, err := builder.LaunchShip(ctx, h, transport, ip)
 	if err != nil {
+		// Record failure, if not caused by the context.
+		if ctx.Err() == nil {
+			reportLaunchFailure(h, transport, ip)
+		}
 		return nil, fmt.Errorf("failed to connect to %s using %s (%s): %w", h, transport, ip, err)
 	}
 
+	// Obfuscate ship, if configured.
+	if len(transport.Obfuscation()) > 0 {
+		obfsShip, ok := ship.(obfuscatableShip)
+		if !ok {
+			ship.Sink()
+			return nil, fmt.Errorf("protocol %s does not support obfuscation", transport.Protocol)
+		}
+		if err := obfsShip.obfuscate(); err != nil {
+			ship.Sink()
+			return nil, err
+		}
+	}
+
+	reportLaunchSuccess(h, transport, ip, time.Since(started))
 	return ship, nil
 }
@@ -0,0 +1,276 @@
+package ships
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/spn/conf"
+	"github.com/safing/spn/hub"
+)
+
+// MailShip is a ship that disguises itself as a mail protocol session.
+type MailShip struct {
+	ShipBase
+}
+
+// MailPier is a pier that disguises itself as a mail server.
+type MailPier struct {
+	PierBase
+
+	serverHandshake mailHandshake
+
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+}
+
+/*
+Mail Transports:
+
+The "smtp" and "imap" protocols perform a believable greeting exchange of the
+respective mail protocol up to the STARTTLS command. The connection is then
+upgraded to TLS, after which the crane byte stream follows.
+See tls.go for how the certificate is verified.
+*/
+
+// mailHandshake performs the plaintext part of a mail protocol session on
+// the given connection, up until the connection is ready to switch to TLS.
+type mailHandshake func(conn net.Conn, transport *hub.Transport) error
+
+const (
+	mailHandshakeTimeout = 30 * time.Second
+	mailMaxLineLength    = 512
+	mailMaxCommands      = 10
+)
+
+func init() {
+	Register("smtp", &Builder{
+		LaunchShip: func(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP) (Ship, error) {
+			return launchMailShip(ctx, h, transport, ip, smtpShipHandshake)
+		},
+		EstablishPier: func(transport *hub.Transport, dockingRequests chan Ship) (Pier, error) {
+			return establishMailPier(transport, dockingRequests, smtpPierHandshake)
+		},
+	})
+	Register("imap", &Builder{
+		LaunchShip: func(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP) (Ship, error) {
+			return launchMailShip(ctx, h, transport, ip, imapShipHandshake)
+		},
+		EstablishPier: func(transport *hub.Transport, dockingRequests chan Ship) (Pier, error) {
+			return establishMailPier(transport, dockingRequests, imapPierHandshake)
+		},
+	})
+}
+
+func launchMailShip(
+	ctx context.Context,
+	h *hub.Hub,
+	transport *hub.Transport,
+	ip net.IP,
+	handshake mailHandshake,
+) (Ship, error) {
+	// Get TLS config for verifying the pier.
+	tlsConfig, err := getShipTLSConfig(h, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create connection.
+	var dialNet string
+	if ip4 := ip.To4(); ip4 != nil {
+		dialNet = "tcp4"
+	} else {
+		dialNet = "tcp6"
+	}
+	dialer := &net.Dialer{
+		Timeout:       30 * time.Second,
+		LocalAddr:     conf.GetBindAddr(dialNet),
+		FallbackDelay: -1, // Disables Fast Fallback from IPv6 to IPv4.
+		KeepAlive:     -1, // Disable keep-alive.
+	}
+	conn, err := dialer.DialContext(ctx, dialNet, net.JoinHostPort(ip.String(), portToA(transport.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	// Perform mail protocol handshake.
+	_ = conn.SetDeadline(time.Now().Add(mailHandshakeTimeout))
+	err = handshake(conn, transport)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to perform %s handshake: %w", transport.Protocol, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// Upgrade to TLS.
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to establish tls: %w", err)
+	}
+
+	// Create ship.
+	ship := &MailShip{
+		ShipBase: ShipBase{
+			conn:      tlsConn,
+			transport: transport,
+			mine:      true,
+			secure:    false,
+		},
+	}
+
+	// Init and return.
+	ship.calculateLoadSize(ip, nil, TCPHeaderMTUSize, TLSHeaderMTUSize)
+	ship.initBase()
+	return ship, nil
+}
+
+func establishMailPier(transport *hub.Transport, dockingRequests chan Ship, handshake mailHandshake) (Pier, error) {
+	// Start listeners.
+	bindIPs := conf.GetBindIPs()
+	listeners := make([]net.Listener, 0, len(bindIPs))
+	for _, bindIP := range bindIPs {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+			IP:   bindIP,
+			Port: int(transport.Port),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen: %w", err)
+		}
+
+		listeners = append(listeners, listener)
+		log.Infof("spn/ships: %s transport pier established on %s", transport.Protocol, listener.Addr())
+	}
+
+	// Create new pier.
+	pierCtx, cancelCtx := context.WithCancel(module.Ctx)
+	pier := &MailPier{
+		PierBase: PierBase{
+			transport:       transport,
+			listeners:       listeners,
+			dockingRequests: dockingRequests,
+		},
+		serverHandshake: handshake,
+		ctx:             pierCtx,
+		cancelCtx:       cancelCtx,
+	}
+	pier.initBase()
+
+	// Start workers.
+	for _, listener := range pier.listeners {
+		serviceListener := listener
+		module.StartServiceWorker("accept mail docking requests", 0, func(ctx context.Context) error {
+			return pier.dockingWorker(ctx, serviceListener)
+		})
+	}
+
+	return pier, nil
+}
+
+func (pier *MailPier) dockingWorker(_ context.Context, listener net.Listener) error {
+	for {
+		// Block until something happens.
+		conn, err := listener.Accept()
+
+		// Check for errors.
+		switch {
+		case pier.ctx.Err() != nil:
+			return pier.ctx.Err()
+		case err != nil:
+			return err
+		}
+
+		// Perform the handshake in a separate worker in order to not block
+		// accepting other connections.
+		module.StartWorker("dock mail ship", func(_ context.Context) error {
+			pier.dockShip(conn)
+			return nil
+		})
+	}
+}
+
+func (pier *MailPier) dockShip(conn net.Conn) {
+	// Perform mail protocol handshake.
+	_ = conn.SetDeadline(time.Now().Add(mailHandshakeTimeout))
+	err := pier.serverHandshake(conn, pier.transport)
+	if err != nil {
+		log.Debugf("spn/ships: failed %s handshake with %s: %s", pier.transport.Protocol, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+
+	// Upgrade to TLS.
+	tlsConn := tls.Server(conn, getPierTLSConfig())
+	err = tlsConn.HandshakeContext(pier.ctx)
+	if err != nil {
+		log.Debugf("spn/ships: failed tls handshake with %s: %s", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// Create new ship.
+	ship := &MailShip{
+		ShipBase: ShipBase{
+			transport: pier.transport,
+			conn:      tlsConn,
+			mine:      false,
+			secure:    false,
+		},
+	}
+	ship.calculateLoadSize(nil, conn.RemoteAddr(), TCPHeaderMTUSize, TLSHeaderMTUSize)
+	ship.initBase()
+
+	// Submit new docking request.
+	select {
+	case pier.dockingRequests <- ship:
+	case <-pier.ctx.Done():
+		ship.Sink()
+	}
+}
+
+// Abolish closes the underlying listener and cleans up any related resources.
+func (pier *MailPier) Abolish() {
+	pier.cancelCtx()
+	pier.PierBase.Abolish()
+}
+
+// mailServerName returns the name the mail server uses to introduce itself.
+func mailServerName(transport *hub.Transport) string {
+	if transport.Domain != "" {
+		return transport.Domain
+	}
+	return "mail"
+}
+
+// writeMailLines writes the given lines, each terminated by CRLF.
+func writeMailLines(conn net.Conn, lines ...string) error {
+	_, err := io.WriteString(conn, strings.Join(lines, "\r\n")+"\r\n")
+	return err
+}
+
+// readMailLine reads a single line without the line ending.
+// It reads byte by byte in order to never consume data after the line, as
+// the connection is later handed to TLS.
+func readMailLine(conn net.Conn) (string, error) {
+	line := make([]byte, 0, 128)
+	b := make([]byte, 1)
+	for len(line) < mailMaxLineLength {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("line too long")
+}
@@ -1,6 +1,7 @@
 package ships
 
 import (
+	"github.com/safing/portbase/log"
 	"github.com/safing/portbase/modules"
 	"github.com/safing/spn/conf"
 )
@@ -16,5 +17,9 @@ func start() error {
 		initPageInput()
 	}
 
-	return nil
+	if err := loadTransportHealth(); err != nil {
+		log.Warningf("spn/ships: %s", err)
+	}
+
+	return registerAPIEndpoints()
 }
@@ -9,6 +9,10 @@ const (
 	IPv6HeaderMTUSize = 40   // Without options, as not common.
 	TCPHeaderMTUSize  = 60   // Maximum size with options.
 	UDPHeaderMTUSize  = 8    // Has no options.
+	QUICHeaderMTUSize = 60   // Short header with max connection ID, stream frame header and AEAD tag.
+	TLSHeaderMTUSize  = 22   // Record header, content type and AEAD tag.
+
+	WebSocketHeaderMTUSize = 14 // Maximum frame header with masking key.
 )
 
 func (ship *ShipBase) calculateLoadSize(ip net.IP, addr net.Addr, subtract ...int) {
@@ -36,7 +40,7 @@ func (ship *ShipBase) calculateLoadSize(ip net.IP, addr net.Addr, subtract ...in
 	}
 
 	// Subtract others.
-	for sub := range subtract {
+	for _, sub := range subtract {
 		ship.loadSize -= sub
 	}
 
@@ -0,0 +1,226 @@
+package ships
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/spn/hub"
+)
+
+/*
+Obfuscation Layers:
+
+Obfuscation layers wrap the underlying connection of a ship in order to hide
+static byte patterns and message sizes from simple deep packet inspection.
+They are configured in the transport option, eg. "tcp:17#obfs=prefix+pad". The
+first layer wraps the raw connection, every following layer wraps the
+previous one.
+
+All layers work independently per direction and without additional round
+trips, so that they do not change the behavior of the underlying protocol.
+
+- "prefix": Sends a random amount of random data in front of the stream.
+- "pad":    Frames every write and adds a random amount of random padding.
+
+The layers only change the shape of the traffic. They provide no
+confidentiality and no authentication and an observer that knows this protocol
+can identify it. The crane data itself is already encrypted, so it shows no
+static byte patterns. Security is provided by the crane.
+*/
+
+type obfuscationLayer func(conn net.Conn) net.Conn
+
+var obfuscationLayers = map[string]obfuscationLayer{
+	"prefix": newPrefixConn,
+	"pad":    newPaddingConn,
+}
+
+// checkObfuscation checks if all obfuscation layers of the transport are supported.
+func checkObfuscation(transport *hub.Transport) error {
+	for _, layer := range transport.Obfuscation() {
+		if _, ok := obfuscationLayers[layer]; !ok {
+			return fmt.Errorf("obfuscation layer %q not supported", layer)
+		}
+	}
+	return nil
+}
+
+// obfuscatableShip is a ship that supports obfuscation layers.
+type obfuscatableShip interface {
+	obfuscate() error
+}
+
+// obfuscate wraps the connection of the ship with the obfuscation layers
+// defined in the transport.
+func (ship *ShipBase) obfuscate() error {
+	for _, layer := range ship.transport.Obfuscation() {
+		newLayer, ok := obfuscationLayers[layer]
+		if !ok {
+			return fmt.Errorf("obfuscation layer %q not supported", layer)
+		}
+		ship.conn = newLayer(ship.conn)
+
+		// Account for the frame header.
+		if layer == "pad" {
+			ship.loadSize -= paddingHeaderSize
+		}
+	}
+	return nil
+}
+
+// obfuscateDocked applies obfuscation to a ship that docked at a pier.
+func (ship *ShipBase) obfuscateDocked() {
+	if ship.mine || len(ship.transport.Obfuscation()) == 0 {
+		return
+	}
+
+	if err := ship.obfuscate(); err != nil {
+		log.Warningf("spn/ships: failed to obfuscate %s: %s", ship, err)
+	}
+}
+
+// Prefix Layer.
+
+type prefixConn struct {
+	net.Conn
+
+	prefixSent     bool
+	prefixReceived bool
+}
+
+func newPrefixConn(conn net.Conn) net.Conn {
+	return &prefixConn{
+		Conn: conn,
+	}
+}
+
+// Write writes the data, sending the random prefix first.
+func (pc *prefixConn) Write(b []byte) (n int, err error) {
+	if !pc.prefixSent {
+		// Create prefix: one byte for the length, followed by random data.
+		prefixLength := make([]byte, 1)
+		if _, err := rand.Read(prefixLength); err != nil {
+			return 0, err
+		}
+		out := make([]byte, 1+int(prefixLength[0])+len(b))
+		if _, err := rand.Read(out[:1+int(prefixLength[0])]); err != nil {
+			return 0, err
+		}
+		out[0] = prefixLength[0]
+		copy(out[1+int(prefixLength[0]):], b)
+
+		if _, err := pc.Conn.Write(out); err != nil {
+			return 0, err
+		}
+		pc.prefixSent = true
+		return len(b), nil
+	}
+
+	return pc.Conn.Write(b)
+}
+
+// Read reads data, discarding the random prefix first.
+func (pc *prefixConn) Read(b []byte) (n int, err error) {
+	if !pc.prefixReceived {
+		prefixLength := make([]byte, 1)
+		if _, err := io.ReadFull(pc.Conn, prefixLength); err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(io.Discard, pc.Conn, int64(prefixLength[0])); err != nil {
+			return 0, err
+		}
+		pc.prefixReceived = true
+	}
+
+	return pc.Conn.Read(b)
+}
+
+// Padding Layer.
+
+const (
+	// paddingHeaderSize is the size of the frame header: two bytes for the
+	// data length and one byte for the padding length.
+	paddingHeaderSize   = 3
+	paddingMaxFrameData = 0xFFFF
+)
+
+type paddingConn struct {
+	net.Conn
+
+	dataLeft    int
+	paddingLeft int
+}
+
+func newPaddingConn(conn net.Conn) net.Conn {
+	return &paddingConn{
+		Conn: conn,
+	}
+}
+
+// Write writes the data in frames with random padding.
+func (pc *paddingConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		// Get data for this frame.
+		frameData := b
+		if len(frameData) > paddingMaxFrameData {
+			frameData = frameData[:paddingMaxFrameData]
+		}
+
+		// Get random padding length.
+		paddingLength := make([]byte, 1)
+		if _, err := rand.Read(paddingLength); err != nil {
+			return n, err
+		}
+
+		// Build frame.
+		frame := make([]byte, paddingHeaderSize+len(frameData)+int(paddingLength[0]))
+		binary.BigEndian.PutUint16(frame, uint16(len(frameData)))
+		frame[2] = paddingLength[0]
+		copy(frame[paddingHeaderSize:], frameData)
+		if _, err := rand.Read(frame[paddingHeaderSize+len(frameData):]); err != nil {
+			return n, err
+		}
+
+		// Send frame.
+		if _, err := pc.Conn.Write(frame); err != nil {
+			return n, err
+		}
+		n += len(frameData)
+		b = b[len(frameData):]
+	}
+
+	return n, nil
+}
+
+// Read reads data from the frames, discarding the padding.
+func (pc *paddingConn) Read(b []byte) (n int, err error) {
+	for pc.dataLeft == 0 {
+		// Discard the padding of the previous frame.
+		if pc.paddingLeft > 0 {
+			if _, err := io.CopyN(io.Discard, pc.Conn, int64(pc.paddingLeft)); err != nil {
+				return 0, err
+			}
+			pc.paddingLeft = 0
+		}
+
+		// Read the header of the next frame.
+		header := make([]byte, paddingHeaderSize)
+		if _, err := io.ReadFull(pc.Conn, header); err != nil {
+			return 0, err
+		}
+		pc.dataLeft = int(binary.BigEndian.Uint16(header))
+		pc.paddingLeft = int(header[2])
+	}
+
+	// Read data of the current frame.
+	if len(b) > pc.dataLeft {
+		b = b[:pc.dataLeft]
+	}
+	n, err = pc.Conn.Read(b)
+	pc.dataLeft -= n
+	return n, err
+}
@@ -0,0 +1,82 @@
+package ships
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/safing/spn/hub"
+)
+
+func TestObfuscation(t *testing.T) { //nolint:paralleltest // Test sets global state.
+	testHub := &hub.Hub{ID: "Zwuk9L5bSwap2JHgWituh493jKFmASUWjgMCvXyBMESEDJ"}
+
+	for _, option := range []string{
+		"obfs=prefix",
+		"obfs=pad",
+		"obfs=prefix+pad",
+	} {
+		transport := &hub.Transport{
+			Protocol: "tcp",
+			Port:     getTestPort(),
+			Option:   option,
+		}
+
+		// Establish pier and launch ship.
+		dockingRequests := make(chan Ship, 1)
+		pier, err := EstablishPier(transport, dockingRequests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ship, err := connectTo(context.Background(), testHub, transport, localhost)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Exchange data in both directions.
+		err = ship.Load(testData)
+		if err != nil {
+			t.Fatalf("%s failed: %s", ship, err)
+		}
+		srvShip := <-dockingRequests
+		for i := 0; i < 10; i++ {
+			buf := getTestBuf()
+			_, err = srvShip.UnloadTo(buf)
+			if err != nil {
+				t.Fatalf("%s failed: %s", srvShip, err)
+			}
+			assert.Equal(t, testData, buf, "should match with %s", option)
+
+			err = srvShip.Load(testData)
+			if err != nil {
+				t.Fatalf("%s failed: %s", srvShip, err)
+			}
+			buf = getTestBuf()
+			_, err = ship.UnloadTo(buf)
+			if err != nil {
+				t.Fatalf("%s failed: %s", ship, err)
+			}
+			assert.Equal(t, testData, buf, "should match with %s", option)
+
+			err = ship.Load(testData)
+			if err != nil {
+				t.Fatalf("%s failed: %s", ship, err)
+			}
+		}
+
+		ship.Sink()
+		srvShip.Sink()
+		pier.Abolish()
+	}
+
+	// Unknown layers must be rejected.
+	for _, option := range []string{"obfs=unknown", "obfs=xor"} {
+		_, err := EstablishPier(&hub.Transport{
+			Protocol: "tcp",
+			Port:     getTestPort(),
+			Option:   option,
+		}, make(chan Ship))
+		assert.Error(t, err, "unknown obfuscation layer should fail")
+	}
+}
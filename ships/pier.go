@@ -34,6 +34,9 @@ func EstablishPier(transport *hub.Transport, dockingRequests chan Ship) (Pier, e
 	if builder == nil {
 		return nil, fmt.Errorf("protocol %s not supported", transport.Protocol)
 	}
+	if err := checkObfuscation(transport); err != nil {
+		return nil, err
+	}
 
 	pier, err := builder.EstablishPier(transport, dockingRequests)
 	if err != nil {
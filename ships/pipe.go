@@ -0,0 +1,212 @@
+package ships
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/spn/hub"
+)
+
+// PipeShip is a ship that uses an in-process pipe.
+type PipeShip struct {
+	ShipBase
+}
+
+// PipePier is a pier that accepts ships on a named in-process pipe.
+type PipePier struct {
+	PierBase
+
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+}
+
+var (
+	pipePiers     = make(map[string]*PipePier) // ID = Pipe Name
+	pipePiersLock sync.Mutex
+
+	// ErrPipeNotFound is returned when launching a ship to a pipe that has no pier.
+	ErrPipeNotFound = errors.New("no pier established on pipe")
+)
+
+func init() {
+	Register("pipe", &Builder{
+		LaunchShip:    launchPipeShip,
+		EstablishPier: establishPipePier,
+	})
+}
+
+func launchPipeShip(ctx context.Context, _ *hub.Hub, transport *hub.Transport, _ net.IP) (Ship, error) {
+	// Get pier of pipe.
+	pipePiersLock.Lock()
+	pier, ok := pipePiers[transport.Domain]
+	pipePiersLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("failed to connect: %w", ErrPipeNotFound)
+	}
+
+	// Create connected ships.
+	launchConn, dockConn := newPipeConns()
+	ship := &PipeShip{
+		ShipBase: ShipBase{
+			conn:      launchConn,
+			transport: transport,
+			mine:      true,
+			secure:    false,
+		},
+	}
+	dockedShip := &PipeShip{
+		ShipBase: ShipBase{
+			conn:      dockConn,
+			transport: pier.transport,
+			mine:      false,
+			secure:    false,
+		},
+	}
+
+	// Pipes are not bound by an MTU, so use the default load size.
+	ship.initBase()
+	dockedShip.initBase()
+
+	// Submit docking request to the pier.
+	select {
+	case pier.dockingRequests <- dockedShip:
+		return ship, nil
+	case <-pier.ctx.Done():
+		ship.Sink()
+		dockedShip.Sink()
+		return nil, fmt.Errorf("failed to connect: %w", ErrPipeNotFound)
+	case <-ctx.Done():
+		ship.Sink()
+		dockedShip.Sink()
+		return nil, ctx.Err()
+	}
+}
+
+func establishPipePier(transport *hub.Transport, dockingRequests chan Ship) (Pier, error) {
+	pipePiersLock.Lock()
+	defer pipePiersLock.Unlock()
+
+	// Check if the pipe is already in use.
+	if _, ok := pipePiers[transport.Domain]; ok {
+		return nil, fmt.Errorf("pipe %q is already in use", transport.Domain)
+	}
+
+	// Create new pier.
+	pierCtx, cancelCtx := context.WithCancel(module.Ctx)
+	pier := &PipePier{
+		PierBase: PierBase{
+			transport:       transport,
+			dockingRequests: dockingRequests,
+		},
+		ctx:       pierCtx,
+		cancelCtx: cancelCtx,
+	}
+	pier.initBase()
+	pipePiers[transport.Domain] = pier
+
+	log.Infof("spn/ships: pipe transport pier established on %s", transport.Domain)
+	return pier, nil
+}
+
+// Abolish closes the underlying listener and cleans up any related resources.
+func (pier *PipePier) Abolish() {
+	pier.cancelCtx()
+	pier.PierBase.Abolish()
+
+	pipePiersLock.Lock()
+	defer pipePiersLock.Unlock()
+
+	if pipePiers[pier.transport.Domain] == pier {
+		delete(pipePiers, pier.transport.Domain)
+	}
+}
+
+const (
+	// pipeBufferSize defines how many writes are buffered per pipe direction.
+	pipeBufferSize = 1000
+
+	// pipeFlushTimeout defines how long buffered writes are flushed when the
+	// pipe is closed.
+	pipeFlushTimeout = 1 * time.Second
+)
+
+// pipeConn is a connection end of an in-process pipe. In contrast to net.Pipe,
+// writes are buffered, so that it behaves like a network connection.
+type pipeConn struct {
+	net.Conn
+
+	loading   chan []byte
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeConns() (net.Conn, net.Conn) {
+	a, b := net.Pipe()
+	return newPipeConn(a), newPipeConn(b)
+}
+
+func newPipeConn(conn net.Conn) *pipeConn {
+	pc := &pipeConn{
+		Conn:    conn,
+		loading: make(chan []byte, pipeBufferSize),
+		closing: make(chan struct{}),
+	}
+	module.StartWorker("pipe loader", pc.loader)
+	return pc
+}
+
+// Write buffers the given data for writing to the pipe.
+func (pc *pipeConn) Write(b []byte) (n int, err error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	select {
+	case pc.loading <- data:
+		return len(b), nil
+	case <-pc.closing:
+		return 0, net.ErrClosed
+	}
+}
+
+// Close flushes buffered data and closes the pipe.
+func (pc *pipeConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.closing)
+	})
+	return nil
+}
+
+func (pc *pipeConn) loader(_ context.Context) error {
+	defer func() {
+		_ = pc.Conn.Close()
+	}()
+
+	for {
+		select {
+		case data := <-pc.loading:
+			if _, err := pc.Conn.Write(data); err != nil {
+				pc.Close() //nolint:errcheck,gosec // Always returns nil.
+				return nil
+			}
+
+		case <-pc.closing:
+			// Flush remaining data.
+			_ = pc.Conn.SetWriteDeadline(time.Now().Add(pipeFlushTimeout))
+			for {
+				select {
+				case data := <-pc.loading:
+					if _, err := pc.Conn.Write(data); err != nil {
+						return nil
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
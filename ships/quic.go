@@ -0,0 +1,277 @@
+package ships
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/spn/conf"
+	"github.com/safing/spn/hub"
+)
+
+// QUICShip is a ship that uses QUIC.
+type QUICShip struct {
+	ShipBase
+}
+
+// QUICPier is a pier that uses QUIC.
+type QUICPier struct {
+	PierBase
+
+	quicListeners []*quic.Listener
+
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+}
+
+const (
+	// quicALPN is the application protocol negotiated via TLS.
+	quicALPN = "spn"
+
+	// quicDockingTimeout defines how long a pier waits for the first stream of
+	// a new QUIC connection.
+	quicDockingTimeout = 30 * time.Second
+)
+
+func init() {
+	Register("quic", &Builder{
+		LaunchShip:    launchQUICShip,
+		EstablishPier: establishQUICPier,
+	})
+}
+
+func getQUICConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: 10 * time.Second,
+		MaxIdleTimeout:       5 * time.Minute,
+		// Keep NAT mappings alive, as UDP mappings expire fast.
+		KeepAlivePeriod: 20 * time.Second,
+		// The crane uses a single stream per ship.
+		MaxIncomingStreams:    1,
+		MaxIncomingUniStreams: -1,
+	}
+}
+
+func launchQUICShip(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP) (Ship, error) {
+	// Get TLS config for verifying the pier.
+	tlsConfig, err := getShipTLSConfig(h, transport)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.NextProtos = []string{quicALPN}
+
+	var dialNet string
+	if ip4 := ip.To4(); ip4 != nil {
+		dialNet = "udp4"
+	} else {
+		dialNet = "udp6"
+	}
+
+	// Create local UDP socket.
+	var localAddr *net.UDPAddr
+	if bindAddr, ok := conf.GetBindAddr(dialNet).(*net.UDPAddr); ok {
+		localAddr = bindAddr
+	}
+	packetConn, err := net.ListenUDP(dialNet, localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local socket: %w", err)
+	}
+
+	// Connect to pier.
+	dialCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	qConn, err := quic.Dial(
+		dialCtx,
+		packetConn,
+		&net.UDPAddr{IP: ip, Port: int(transport.Port)},
+		tlsConfig,
+		getQUICConfig(),
+	)
+	if err != nil {
+		_ = packetConn.Close()
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	// Open stream for the crane.
+	stream, err := qConn.OpenStreamSync(dialCtx)
+	if err != nil {
+		_ = qConn.CloseWithError(0, "")
+		_ = packetConn.Close()
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	ship := &QUICShip{
+		ShipBase: ShipBase{
+			conn: &quicConn{
+				Stream:     stream,
+				conn:       qConn,
+				packetConn: packetConn,
+			},
+			transport: transport,
+			mine:      true,
+			secure:    false,
+		},
+	}
+
+	ship.calculateLoadSize(ip, nil, UDPHeaderMTUSize, QUICHeaderMTUSize)
+	ship.initBase()
+	return ship, nil
+}
+
+func establishQUICPier(transport *hub.Transport, dockingRequests chan Ship) (Pier, error) {
+	// Get TLS config.
+	tlsConfig := getPierTLSConfig()
+	tlsConfig.NextProtos = []string{quicALPN}
+
+	// Start listeners.
+	bindIPs := conf.GetBindIPs()
+	quicListeners := make([]*quic.Listener, 0, len(bindIPs))
+	for _, bindIP := range bindIPs {
+		listener, err := quic.ListenAddr(
+			net.JoinHostPort(bindIPToHost(bindIP), portToA(transport.Port)),
+			tlsConfig,
+			getQUICConfig(),
+		)
+		if err != nil {
+			for _, l := range quicListeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen: %w", err)
+		}
+
+		quicListeners = append(quicListeners, listener)
+		log.Infof("spn/ships: quic transport pier established on %s", listener.Addr())
+	}
+
+	// Create new pier.
+	pierCtx, cancelCtx := context.WithCancel(module.Ctx)
+	pier := &QUICPier{
+		PierBase: PierBase{
+			transport:       transport,
+			dockingRequests: dockingRequests,
+		},
+		quicListeners: quicListeners,
+		ctx:           pierCtx,
+		cancelCtx:     cancelCtx,
+	}
+	pier.initBase()
+
+	// Start workers.
+	for _, listener := range pier.quicListeners {
+		serviceListener := listener
+		module.StartServiceWorker("accept QUIC docking requests", 0, func(ctx context.Context) error {
+			return pier.dockingWorker(ctx, serviceListener)
+		})
+	}
+
+	return pier, nil
+}
+
+func (pier *QUICPier) dockingWorker(_ context.Context, listener *quic.Listener) error {
+	for {
+		// Block until something happens.
+		qConn, err := listener.Accept(pier.ctx)
+
+		// Check for errors.
+		switch {
+		case pier.ctx.Err() != nil:
+			return pier.ctx.Err()
+		case err != nil:
+			return err
+		}
+
+		// Wait for the stream in a separate worker in order to not block
+		// accepting other connections.
+		module.StartWorker("dock QUIC ship", func(_ context.Context) error {
+			pier.dockShip(qConn)
+			return nil
+		})
+	}
+}
+
+func (pier *QUICPier) dockShip(qConn quic.Connection) {
+	// Wait for the client to open the crane stream.
+	ctx, cancel := context.WithTimeout(pier.ctx, quicDockingTimeout)
+	defer cancel()
+	stream, err := qConn.AcceptStream(ctx)
+	if err != nil {
+		log.Debugf("spn/ships: failed to accept quic stream from %s: %s", qConn.RemoteAddr(), err)
+		_ = qConn.CloseWithError(0, "")
+		return
+	}
+
+	// Create new ship.
+	ship := &QUICShip{
+		ShipBase: ShipBase{
+			transport: pier.transport,
+			conn: &quicConn{
+				Stream: stream,
+				conn:   qConn,
+			},
+			mine:   false,
+			secure: false,
+		},
+	}
+	ship.calculateLoadSize(nil, qConn.RemoteAddr(), UDPHeaderMTUSize, QUICHeaderMTUSize)
+	ship.initBase()
+
+	// Submit new docking request.
+	select {
+	case pier.dockingRequests <- ship:
+	case <-pier.ctx.Done():
+		ship.Sink()
+	}
+}
+
+// Abolish closes the underlying listener and cleans up any related resources.
+func (pier *QUICPier) Abolish() {
+	pier.cancelCtx()
+	if pier.abolishing.SetToIf(false, true) {
+		for _, listener := range pier.quicListeners {
+			_ = listener.Close()
+		}
+	}
+}
+
+// quicConn wraps a QUIC connection and its single crane stream in order to
+// comply with the net.Conn interface.
+type quicConn struct {
+	quic.Stream
+
+	conn quic.Connection
+	// packetConn is the underlying socket, if it was created by us.
+	packetConn net.PacketConn
+}
+
+// LocalAddr returns the local network address.
+func (qc *quicConn) LocalAddr() net.Addr {
+	return qc.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (qc *quicConn) RemoteAddr() net.Addr {
+	return qc.conn.RemoteAddr()
+}
+
+// Close closes the stream, the QUIC connection and the underlying socket.
+func (qc *quicConn) Close() error {
+	qc.Stream.CancelRead(0)
+	_ = qc.Stream.Close()
+	err := qc.conn.CloseWithError(0, "")
+	if qc.packetConn != nil {
+		_ = qc.packetConn.Close()
+	}
+	return err
+}
+
+// bindIPToHost returns the host part for listening on the given bind IP.
+func bindIPToHost(bindIP net.IP) string {
+	if bindIP == nil {
+		return ""
+	}
+	return bindIP.String()
+}
@@ -106,6 +106,10 @@ func (ship *ShipBase) initBase() {
 	if ship.bufSize == 0 {
 		ship.bufSize = ship.loadSize
 	}
+
+	// Obfuscate docked ships.
+	// Launched ships are obfuscated after launching, as the Hub is needed.
+	ship.obfuscateDocked()
 }
 
 // String returns a human readable informational summary about the ship.
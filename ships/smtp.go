@@ -0,0 +1,117 @@
+package ships
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/safing/spn/hub"
+)
+
+/*
+SMTP Handshake:
+
+	S: 220 <name> ESMTP ready
+	C: EHLO [<client ip>]
+	S: 250-<name>
+	S: 250-PIPELINING
+	S: 250-8BITMIME
+	S: 250 STARTTLS
+	C: STARTTLS
+	S: 220 2.0.0 Ready to start TLS
+
+The pier additionally answers NOOP, RSET, HELO and QUIT in order to behave
+like a real server when probed.
+*/
+
+func smtpShipHandshake(conn net.Conn, _ *hub.Transport) error {
+	// Receive greeting.
+	if err := expectSMTPReply(conn, "220"); err != nil {
+		return err
+	}
+
+	// Introduce ourselves with the address literal, as most clients do.
+	clientName := "[127.0.0.1]"
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		if addr.IP.To4() != nil {
+			clientName = "[" + addr.IP.String() + "]"
+		} else {
+			clientName = "[IPv6:" + addr.IP.String() + "]"
+		}
+	}
+	if err := writeMailLines(conn, "EHLO "+clientName); err != nil {
+		return err
+	}
+	if err := expectSMTPReply(conn, "250"); err != nil {
+		return err
+	}
+
+	// Request TLS.
+	if err := writeMailLines(conn, "STARTTLS"); err != nil {
+		return err
+	}
+	return expectSMTPReply(conn, "220")
+}
+
+// expectSMTPReply reads a (multi-line) SMTP reply and checks its code.
+func expectSMTPReply(conn net.Conn, code string) error {
+	for {
+		line, err := readMailLine(conn)
+		if err != nil {
+			return err
+		}
+		if len(line) < 3 || line[:3] != code {
+			return fmt.Errorf("unexpected reply: %q", line)
+		}
+		// A dash after the code signifies that more lines follow.
+		if len(line) > 3 && line[3] == '-' {
+			continue
+		}
+		return nil
+	}
+}
+
+func smtpPierHandshake(conn net.Conn, transport *hub.Transport) error {
+	name := mailServerName(transport)
+
+	// Send greeting.
+	if err := writeMailLines(conn, "220 "+name+" ESMTP ready"); err != nil {
+		return err
+	}
+
+	// Handle commands until the client requests TLS.
+	for i := 0; i < mailMaxCommands; i++ {
+		line, err := readMailLine(conn)
+		if err != nil {
+			return err
+		}
+		command, _, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(command) {
+		case "EHLO":
+			err = writeMailLines(conn,
+				"250-"+name,
+				"250-PIPELINING",
+				"250-8BITMIME",
+				"250 STARTTLS",
+			)
+		case "HELO":
+			err = writeMailLines(conn, "250 "+name)
+		case "NOOP", "RSET":
+			err = writeMailLines(conn, "250 2.0.0 Ok")
+		case "STARTTLS":
+			return writeMailLines(conn, "220 2.0.0 Ready to start TLS")
+		case "QUIT":
+			_ = writeMailLines(conn, "221 2.0.0 Bye")
+			return errors.New("client quit")
+		default:
+			err = writeMailLines(conn, "530 5.7.0 Must issue a STARTTLS command first")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return errors.New("too many commands")
+}
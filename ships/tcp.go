@@ -31,7 +31,7 @@ func init() {
 	})
 }
 
-func launchTCPShip(ctx context.Context, transport *hub.Transport, ip net.IP) (Ship, error) {
+func launchTCPShip(ctx context.Context, _ *hub.Hub, transport *hub.Transport, ip net.IP) (Ship, error) {
 	var dialNet string
 	if ip4 := ip.To4(); ip4 != nil {
 		dialNet = "tcp4"
@@ -17,7 +17,9 @@ type TestShip struct {
 	forward   chan []byte
 	backward  chan []byte
 	unloadTmp []byte
-	sinking   *abool.AtomicBool
+	// sinking and sunk are shared by both ends of the simulated connection.
+	sinking *abool.AtomicBool
+	sunk    chan struct{}
 }
 
 // NewTestShip returns a new TestShip for simulation.
@@ -29,6 +31,7 @@ func NewTestShip(secure bool, loadSize int) *TestShip {
 		forward:  make(chan []byte, 100),
 		backward: make(chan []byte, 100),
 		sinking:  abool.NewBool(false),
+		sunk:     make(chan struct{}),
 	}
 }
 
@@ -72,7 +75,8 @@ func (ship *TestShip) Reverse() *TestShip {
 		loadSize: ship.loadSize,
 		forward:  ship.backward,
 		backward: ship.forward,
-		sinking:  abool.NewBool(false),
+		sinking:  ship.sinking,
+		sunk:     ship.sunk,
 	}
 }
 
@@ -94,9 +98,12 @@ func (ship *TestShip) Load(data []byte) error {
 	}
 
 	// Send all given data.
-	ship.forward <- data
-
-	return nil
+	select {
+	case ship.forward <- data:
+		return nil
+	case <-ship.sunk:
+		return ErrSunk
+	}
 }
 
 // UnloadTo unloads data from the ship - ie. receives data from the
@@ -121,10 +128,16 @@ func (ship *TestShip) UnloadTo(buf []byte) (n int, err error) {
 		return n, nil
 	}
 
-	// Receive data.
-	data := <-ship.backward
-	if len(data) == 0 {
-		return 0, ErrSunk
+	// Receive data, preferring data that was loaded before the ship sunk.
+	var data []byte
+	select {
+	case data = <-ship.backward:
+	default:
+		select {
+		case data = <-ship.backward:
+		case <-ship.sunk:
+			return 0, ErrSunk
+		}
 	}
 
 	// Copy data, possibly save remainder for later.
@@ -139,7 +152,7 @@ func (ship *TestShip) UnloadTo(buf []byte) (n int, err error) {
 // Sink closes the underlying connection and cleans up any related resources.
 func (ship *TestShip) Sink() {
 	if ship.sinking.SetToIf(false, true) {
-		close(ship.forward)
+		close(ship.sunk)
 	}
 }
 
@@ -149,6 +162,6 @@ func (ship *TestShip) LocalAddr() net.Addr              { return nil }
 func (ship *TestShip) RemoteAddr() net.Addr             { return nil }                  //nolint:golint
 func (ship *TestShip) Public() bool                     { return true }                 //nolint:golint
 func (ship *TestShip) MarkPublic()                      {}                              //nolint:golint
-func (ship *TestShip) MaskAddress(addr net.Addr) string { return addr.String() }        //nolint:golint
+func (ship *TestShip) MaskAddress(addr net.Addr) string { return "test" }               //nolint:golint
 func (ship *TestShip) MaskIP(ip net.IP) string          { return ip.String() }          //nolint:golint
 func (ship *TestShip) Mask(value []byte) string         { return base58.Encode(value) } //nolint:golint
@@ -0,0 +1,214 @@
+package ships
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/safing/jess"
+	"github.com/safing/spn/hub"
+)
+
+/*
+TLS Certificates:
+
+Piers that use TLS serve the certificate set via SetPierCertificate. Public
+Hubs either use a configured certificate or one derived from their identity
+key via CertificateFromSignet. If none is set, an ephemeral self-signed
+certificate is used.
+
+Ships verify the certificate in one of two ways:
+1. By default, the public key of the certificate is pinned to the Hub ID of
+   the destination Hub, which is derived from the Hub's identity key.
+2. If the Hub announced a transport with a domain, the certificate is instead
+   verified against the domain using the system roots. This is needed when a
+   CDN or reverse proxy terminates TLS, which cannot present the identity key.
+
+The second case is an exception to pinning and is limited to domains that the
+Hub itself announced in its signed announcement. It does not authenticate the
+Hub, but this is left to the crane: Ships using TLS never report to be secure,
+so cranes always encrypt end-to-end to the exchange key of the Hub, which is
+signed by its identity key. TLS only hides the SPN traffic from middleboxes in
+this case.
+*/
+
+var (
+	pierCert     *tls.Certificate
+	pierCertLock sync.Mutex
+)
+
+// SetPierCertificate sets the TLS certificate that piers present.
+func SetPierCertificate(cert *tls.Certificate) {
+	pierCertLock.Lock()
+	defer pierCertLock.Unlock()
+
+	pierCert = cert
+}
+
+func getPierCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	pierCertLock.Lock()
+	defer pierCertLock.Unlock()
+
+	// Create ephemeral certificate if none is set.
+	if pierCert == nil {
+		cert, err := generateSelfSignedCert("", nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ephemeral certificate: %w", err)
+		}
+		pierCert = cert
+	}
+
+	return pierCert, nil
+}
+
+// getPierTLSConfig returns the TLS config for piers.
+func getPierTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getPierCertificate,
+	}
+}
+
+// getShipTLSConfig returns the TLS config for ships, which verifies the pier
+// certificate for the given Hub and transport.
+func getShipTLSConfig(h *hub.Hub, transport *hub.Transport) (*tls.Config, error) {
+	// Verify using the system roots, if the Hub announced a domain.
+	if transport.Domain != "" && announcedTransport(h, transport) {
+		return &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: transport.Domain,
+		}, nil
+	}
+
+	// Otherwise, pin the certificate to the Hub ID.
+	if h == nil || h.ID == "" {
+		return nil, errors.New("cannot verify pier certificate without hub ID")
+	}
+	hubID := h.ID
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The default verification is replaced by the pinning below.
+		InsecureSkipVerify: true, //nolint:gosec
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPinnedCertificate(hubID, rawCerts)
+		},
+	}, nil
+}
+
+// announcedTransport returns whether the given transport is announced by the
+// given Hub.
+func announcedTransport(h *hub.Hub, transport *hub.Transport) bool {
+	if h == nil {
+		return false
+	}
+	info := h.GetInfo()
+	if info == nil {
+		return false
+	}
+
+	announced := info.ParsedTransports()
+	if len(announced) == 0 {
+		announced, _ = hub.ParseTransports(info.Transports)
+	}
+	for _, tr := range announced {
+		if *tr == *transport {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyPinnedCertificate(hubID string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("pier presented no certificate")
+	}
+
+	// Parse leaf certificate.
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse pier certificate: %w", err)
+	}
+
+	// Check if the public key matches the Hub ID.
+	pubKey, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("pier certificate has unsupported key type %T", cert.PublicKey)
+	}
+	signet := &jess.Signet{
+		Scheme: "Ed25519",
+		Public: true,
+	}
+	signet.SetLoadedKeys(pubKey, nil)
+	err = signet.StoreKey()
+	if err != nil {
+		return fmt.Errorf("failed to serialize pier certificate key: %w", err)
+	}
+	if !hub.VerifyHubID(hubID, signet.Scheme, signet.Key) {
+		return fmt.Errorf("pier certificate does not match hub %s", hubID)
+	}
+
+	return nil
+}
+
+// CertificateFromSignet returns a self-signed TLS certificate using the key of
+// the given Hub identity signet.
+func CertificateFromSignet(signet *jess.Signet) (*tls.Certificate, error) {
+	if signet.Scheme != "Ed25519" {
+		return nil, fmt.Errorf("unsupported signet scheme %q", signet.Scheme)
+	}
+
+	// Load key.
+	err := signet.LoadKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signet key: %w", err)
+	}
+	privKey, ok := signet.PrivateKey().(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signet has no private key")
+	}
+
+	return generateSelfSignedCert(signet.ID, privKey)
+}
+
+// generateSelfSignedCert generates a self-signed TLS certificate.
+// If no private key is given, a new one is generated.
+func generateSelfSignedCert(commonName string, privKey ed25519.PrivateKey) (*tls.Certificate, error) {
+	if privKey == nil {
+		var err error
+		_, privKey, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-24 * time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, privKey.Public(), privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  privKey,
+	}, nil
+}
@@ -0,0 +1,82 @@
+package ships
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/safing/spn/hub"
+)
+
+func TestPinnedCertificate(t *testing.T) {
+	t.Parallel()
+
+	signet, _, err := hub.CreateHubSignet("Ed25519", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSignet, _, err := hub.CreateHubSignet("Ed25519", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := CertificateFromSignet(signet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, verifyPinnedCertificate(signet.ID, cert.Certificate), "certificate should match hub")
+	assert.Error(t, verifyPinnedCertificate(otherSignet.ID, cert.Certificate), "certificate should not match other hub")
+	assert.Error(t, verifyPinnedCertificate(signet.ID, nil), "missing certificate should fail")
+
+	// Ephemeral certificates must not match.
+	ephemeralCert, err := generateSelfSignedCert("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, verifyPinnedCertificate(signet.ID, ephemeralCert.Certificate), "ephemeral certificate should not match hub")
+}
+
+func TestShipTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	signet, _, err := hub.CreateHubSignet("Ed25519", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	announced, err := hub.ParseTransport("wss://example.com:443/spn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAnnounced, err := hub.ParseTransport("wss://example.org:443/spn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &hub.Hub{
+		ID: signet.ID,
+		Info: &hub.Announcement{
+			Transports: []string{"wss://example.com:443/spn"},
+		},
+	}
+
+	// Announced domains are verified using the system roots.
+	tlsConfig, err := getShipTLSConfig(h, announced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "example.com", tlsConfig.ServerName, "should verify announced domain")
+	assert.False(t, tlsConfig.InsecureSkipVerify, "should use default verification for announced domain")
+
+	// Other domains are pinned to the Hub ID.
+	tlsConfig, err = getShipTLSConfig(h, notAnnounced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, tlsConfig.VerifyPeerCertificate, "should pin domain that was not announced")
+
+	cert, err := CertificateFromSignet(signet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, tlsConfig.VerifyPeerCertificate(cert.Certificate, nil), "certificate should match hub")
+}
@@ -0,0 +1,134 @@
+package ships
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/spn/hub"
+)
+
+// UnixShip is a ship that uses a unix domain socket.
+type UnixShip struct {
+	ShipBase
+}
+
+// UnixPier is a pier that uses a unix domain socket.
+type UnixPier struct {
+	PierBase
+
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+}
+
+func init() {
+	Register("unix", &Builder{
+		LaunchShip:    launchUnixShip,
+		EstablishPier: establishUnixPier,
+	})
+}
+
+func launchUnixShip(ctx context.Context, _ *hub.Hub, transport *hub.Transport, _ net.IP) (Ship, error) {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+	}
+	conn, err := dialer.DialContext(ctx, "unix", transport.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	ship := &UnixShip{
+		ShipBase: ShipBase{
+			conn:      conn,
+			transport: transport,
+			mine:      true,
+			secure:    false,
+		},
+	}
+
+	// Unix domain sockets are not bound by an MTU, so use the default load size.
+	ship.initBase()
+	return ship, nil
+}
+
+func establishUnixPier(transport *hub.Transport, dockingRequests chan Ship) (Pier, error) {
+	// Remove stale socket from a previous run.
+	if info, err := os.Stat(transport.Path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(transport.Path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to check socket path: %w", err)
+	}
+
+	// Start listener.
+	listener, err := net.Listen("unix", transport.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	log.Infof("spn/ships: unix transport pier established on %s", listener.Addr())
+
+	// Create new pier.
+	pierCtx, cancelCtx := context.WithCancel(module.Ctx)
+	pier := &UnixPier{
+		PierBase: PierBase{
+			transport:       transport,
+			listeners:       []net.Listener{listener},
+			dockingRequests: dockingRequests,
+		},
+		ctx:       pierCtx,
+		cancelCtx: cancelCtx,
+	}
+	pier.initBase()
+
+	// Start worker.
+	module.StartServiceWorker("accept unix docking requests", 0, func(ctx context.Context) error {
+		return pier.dockingWorker(ctx, listener)
+	})
+
+	return pier, nil
+}
+
+func (pier *UnixPier) dockingWorker(_ context.Context, listener net.Listener) error {
+	for {
+		// Block until something happens.
+		conn, err := listener.Accept()
+
+		// Check for errors.
+		switch {
+		case pier.ctx.Err() != nil:
+			return pier.ctx.Err()
+		case err != nil:
+			return err
+		}
+
+		// Create new ship.
+		ship := &UnixShip{
+			ShipBase: ShipBase{
+				transport: pier.transport,
+				conn:      conn,
+				mine:      false,
+				secure:    false,
+			},
+		}
+		ship.initBase()
+
+		// Submit new docking request.
+		select {
+		case pier.dockingRequests <- ship:
+		case <-pier.ctx.Done():
+			return pier.ctx.Err()
+		}
+	}
+}
+
+// Abolish closes the underlying listener and cleans up any related resources.
+func (pier *UnixPier) Abolish() {
+	pier.cancelCtx()
+	pier.PierBase.Abolish()
+}
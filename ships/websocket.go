@@ -0,0 +1,283 @@
+package ships
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/exp/slices"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/spn/conf"
+	"github.com/safing/spn/hub"
+)
+
+// WebSocketShip is a ship that uses WebSocket.
+type WebSocketShip struct {
+	ShipBase
+}
+
+// WebSocketPier is a pier that uses WebSocket.
+type WebSocketPier struct {
+	PierBase
+
+	upgrader *websocket.Upgrader
+}
+
+// webSocketSubprotocol is the WebSocket subprotocol used for negotiation.
+const webSocketSubprotocol = "spn"
+
+func init() {
+	Register("ws", &Builder{
+		LaunchShip:    launchWebSocketShip,
+		EstablishPier: establishWebSocketPier,
+	})
+	Register("wss", &Builder{
+		LaunchShip:    launchWebSocketShip,
+		EstablishPier: establishWebSocketPier,
+	})
+}
+
+/*
+WebSocket Transport:
+
+The ship sends a standard WebSocket upgrade request with the "spn"
+subprotocol. After the upgrade, every load is sent as a single binary message.
+Message boundaries carry no meaning - the messages are read as a byte stream.
+
+The "wss" variant wraps the connection in TLS. See tls.go for how the
+certificate is verified.
+*/
+
+func launchWebSocketShip(ctx context.Context, h *hub.Hub, transport *hub.Transport, ip net.IP) (Ship, error) {
+	// Build URL.
+	host := transport.Domain
+	if host == "" {
+		host = ip.String()
+	}
+	u := &url.URL{
+		Scheme: transport.Protocol,
+		Host:   net.JoinHostPort(host, portToA(transport.Port)),
+		Path:   transport.Path,
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	// Create dialer that always connects to the given IP.
+	var dialNet string
+	if ip4 := ip.To4(); ip4 != nil {
+		dialNet = "tcp4"
+	} else {
+		dialNet = "tcp6"
+	}
+	netDialer := &net.Dialer{
+		Timeout:       30 * time.Second,
+		LocalAddr:     conf.GetBindAddr(dialNet),
+		FallbackDelay: -1, // Disables Fast Fallback from IPv6 to IPv4.
+		KeepAlive:     -1, // Disable keep-alive.
+	}
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return netDialer.DialContext(ctx, dialNet, net.JoinHostPort(ip.String(), portToA(transport.Port)))
+		},
+		HandshakeTimeout: 30 * time.Second,
+		Subprotocols:     []string{webSocketSubprotocol},
+	}
+	if transport.Protocol == "wss" {
+		tlsConfig, err := getShipTLSConfig(h, transport)
+		if err != nil {
+			return nil, err
+		}
+		dialer.TLSClientConfig = tlsConfig
+	}
+
+	// Connect and upgrade.
+	wsConn, response, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		if response != nil {
+			return nil, fmt.Errorf("failed to connect: %w (%s)", err, response.Status)
+		}
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	_ = response.Body.Close()
+	if wsConn.Subprotocol() != webSocketSubprotocol {
+		_ = wsConn.Close()
+		return nil, fmt.Errorf("received unexpected subprotocol %q", wsConn.Subprotocol())
+	}
+
+	// Create ship.
+	ship := &WebSocketShip{
+		ShipBase: ShipBase{
+			conn:      newWebSocketConn(wsConn),
+			transport: transport,
+			mine:      true,
+			secure:    false,
+		},
+	}
+
+	// Init and return.
+	ship.calculateLoadSize(ip, nil, webSocketOverhead(transport)...)
+	ship.initBase()
+	return ship, nil
+}
+
+func (pier *WebSocketPier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Reply with info page if the request is not a matching upgrade request.
+	if !websocket.IsWebSocketUpgrade(r) ||
+		!slices.Contains(websocket.Subprotocols(r), webSocketSubprotocol) {
+		ServeInfoPage(w, r)
+		return
+	}
+
+	// Upgrade connection.
+	wsConn, err := pier.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader already replied with an error.
+		log.Warningf("ships: failed to upgrade websocket connection from %s: %s", r.RemoteAddr, err)
+		return
+	}
+
+	// Create new ship.
+	ship := &WebSocketShip{
+		ShipBase: ShipBase{
+			transport: pier.transport,
+			conn:      newWebSocketConn(wsConn),
+			mine:      false,
+			secure:    false,
+		},
+	}
+	ship.calculateLoadSize(nil, wsConn.RemoteAddr(), webSocketOverhead(pier.transport)...)
+	ship.initBase()
+
+	// Submit new docking request.
+	select {
+	case pier.dockingRequests <- ship:
+	case <-r.Context().Done():
+		ship.Sink()
+	}
+}
+
+func establishWebSocketPier(transport *hub.Transport, dockingRequests chan Ship) (Pier, error) {
+	// Default to root path.
+	path := transport.Path
+	if path == "" {
+		path = "/"
+	}
+
+	// Create pier.
+	pier := &WebSocketPier{
+		PierBase: PierBase{
+			transport:       transport,
+			dockingRequests: dockingRequests,
+		},
+		upgrader: &websocket.Upgrader{
+			HandshakeTimeout: 30 * time.Second,
+			Subprotocols:     []string{webSocketSubprotocol},
+			// Ships are not browsers, so the origin is irrelevant.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	pier.initBase()
+
+	// Register handler.
+	if transport.Protocol == "wss" {
+		err := addHTTPSHandler(transport.Port, path, pier.ServeHTTP, getPierTLSConfig())
+		if err != nil {
+			return nil, fmt.Errorf("failed to add HTTPS handler: %w", err)
+		}
+	} else {
+		err := addHTTPHandler(transport.Port, path, pier.ServeHTTP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add HTTP handler: %w", err)
+		}
+	}
+
+	return pier, nil
+}
+
+// Abolish closes the underlying listener and cleans up any related resources.
+func (pier *WebSocketPier) Abolish() {
+	// Only abolish once.
+	if !pier.abolishing.SetToIf(false, true) {
+		return
+	}
+
+	// Do not close the listener, as it is shared.
+	// Instead, remove the HTTP handler and the shared server will shutdown itself when needed.
+	_ = removeHTTPHandler(pier.transport.Port, pier.transport.Path)
+}
+
+// webSocketOverhead returns the header sizes to subtract from the load size.
+func webSocketOverhead(transport *hub.Transport) []int {
+	if transport.Protocol == "wss" {
+		return []int{TCPHeaderMTUSize, TLSHeaderMTUSize, WebSocketHeaderMTUSize}
+	}
+	return []int{TCPHeaderMTUSize, WebSocketHeaderMTUSize}
+}
+
+// webSocketConn wraps a WebSocket connection in order to comply with the
+// net.Conn interface.
+type webSocketConn struct {
+	*websocket.Conn
+
+	reader io.Reader
+}
+
+func newWebSocketConn(wsConn *websocket.Conn) *webSocketConn {
+	return &webSocketConn{
+		Conn: wsConn,
+	}
+}
+
+// Read reads data from the current binary message, continuing with the next
+// message when the current one has been read completely.
+func (wc *webSocketConn) Read(b []byte) (n int, err error) {
+	for {
+		// Get next message, if needed.
+		if wc.reader == nil {
+			messageType, reader, err := wc.Conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				return 0, errors.New("received non-binary websocket message")
+			}
+			wc.reader = reader
+		}
+
+		// Read from message.
+		n, err = wc.reader.Read(b)
+		if errors.Is(err, io.EOF) {
+			wc.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write writes the data as a single binary message.
+func (wc *webSocketConn) Write(b []byte) (n int, err error) {
+	err = wc.Conn.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetDeadline sets the read and write deadlines.
+func (wc *webSocketConn) SetDeadline(t time.Time) error {
+	if err := wc.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return wc.Conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,221 @@
+package sluice
+
+import (
+	"github.com/safing/portbase/config"
+	"github.com/safing/spn/navigator"
+)
+
+var (
+	// SOCKS5 proxy listener.
+	cfgOptionSOCKS5ListenKey     = "spn/socks5/listen"
+	cfgOptionSOCKS5Listen        config.StringOption
+	cfgOptionSOCKS5ListenDefault = ""
+	cfgOptionSOCKS5ListenOrder   = 170
+
+	// SOCKS5 proxy username.
+	cfgOptionSOCKS5UsernameKey     = "spn/socks5/username"
+	cfgOptionSOCKS5Username        config.StringOption
+	cfgOptionSOCKS5UsernameDefault = ""
+	cfgOptionSOCKS5UsernameOrder   = 171
+
+	// SOCKS5 proxy password.
+	cfgOptionSOCKS5PasswordKey     = "spn/socks5/password"
+	cfgOptionSOCKS5Password        config.StringOption
+	cfgOptionSOCKS5PasswordDefault = ""
+	cfgOptionSOCKS5PasswordOrder   = 172
+
+	// HTTP proxy listener.
+	cfgOptionHTTPProxyListenKey     = "spn/httpProxy/listen"
+	cfgOptionHTTPProxyListen        config.StringOption
+	cfgOptionHTTPProxyListenDefault = ""
+	cfgOptionHTTPProxyListenOrder   = 173
+
+	// HTTP proxy username.
+	cfgOptionHTTPProxyUsernameKey     = "spn/httpProxy/username"
+	cfgOptionHTTPProxyUsername        config.StringOption
+	cfgOptionHTTPProxyUsernameDefault = ""
+	cfgOptionHTTPProxyUsernameOrder   = 174
+
+	// HTTP proxy password.
+	cfgOptionHTTPProxyPasswordKey     = "spn/httpProxy/password"
+	cfgOptionHTTPProxyPassword        config.StringOption
+	cfgOptionHTTPProxyPasswordDefault = ""
+	cfgOptionHTTPProxyPasswordOrder   = 175
+
+	// Routing algorithm for proxied connections.
+	cfgOptionProxyRoutingAlgorithmKey     = "spn/proxyRoutingAlgorithm"
+	cfgOptionProxyRoutingAlgorithm        config.StringOption
+	cfgOptionProxyRoutingAlgorithmDefault = ""
+	cfgOptionProxyRoutingAlgorithmOrder   = 176
+)
+
+func prepConfig() error {
+	err := config.Register(&config.Option{
+		Name:            "SOCKS5 Proxy Listen Address",
+		Key:             cfgOptionSOCKS5ListenKey,
+		Description:     "Listen for SOCKS5 proxy requests on the given address, eg. \"127.0.0.1:1080\", in order to route applications through the SPN without the Portmaster's network interception. Without a username and password, only requests from this device are accepted. Leave empty to disable.",
+		OptType:         config.OptTypeString,
+		ExpertiseLevel:  config.ExpertiseLevelDeveloper,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionSOCKS5ListenDefault,
+		RequiresRestart: true,
+		ValidationRegex: `^(|[^\s]+:[0-9]{1,5})$`,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionSOCKS5ListenOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionSOCKS5Listen = config.Concurrent.GetAsString(cfgOptionSOCKS5ListenKey, cfgOptionSOCKS5ListenDefault)
+
+	err = config.Register(&config.Option{
+		Name:            "SOCKS5 Proxy Username",
+		Key:             cfgOptionSOCKS5UsernameKey,
+		Description:     "Require SOCKS5 proxy clients to authenticate with this username and the configured password.",
+		OptType:         config.OptTypeString,
+		ExpertiseLevel:  config.ExpertiseLevelDeveloper,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionSOCKS5UsernameDefault,
+		RequiresRestart: true,
+		ValidationRegex: `^.{0,255}$`,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionSOCKS5UsernameOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionSOCKS5Username = config.Concurrent.GetAsString(cfgOptionSOCKS5UsernameKey, cfgOptionSOCKS5UsernameDefault)
+
+	err = config.Register(&config.Option{
+		Name:            "SOCKS5 Proxy Password",
+		Key:             cfgOptionSOCKS5PasswordKey,
+		Description:     "Require SOCKS5 proxy clients to authenticate with the configured username and this password.",
+		Sensitive:       true,
+		OptType:         config.OptTypeString,
+		ExpertiseLevel:  config.ExpertiseLevelDeveloper,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionSOCKS5PasswordDefault,
+		RequiresRestart: true,
+		ValidationRegex: `^.{0,255}$`,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionSOCKS5PasswordOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionSOCKS5Password = config.Concurrent.GetAsString(cfgOptionSOCKS5PasswordKey, cfgOptionSOCKS5PasswordDefault)
+
+	err = config.Register(&config.Option{
+		Name:            "HTTP Proxy Listen Address",
+		Key:             cfgOptionHTTPProxyListenKey,
+		Description:     "Listen for HTTP proxy requests on the given address, eg. \"127.0.0.1:8080\", in order to route applications through the SPN without the Portmaster's network interception. CONNECT requests and plain HTTP requests are supported. Without a username and password, only requests from this device are accepted. Leave empty to disable.",
+		OptType:         config.OptTypeString,
+		ExpertiseLevel:  config.ExpertiseLevelDeveloper,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionHTTPProxyListenDefault,
+		RequiresRestart: true,
+		ValidationRegex: `^(|[^\s]+:[0-9]{1,5})$`,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionHTTPProxyListenOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionHTTPProxyListen = config.Concurrent.GetAsString(cfgOptionHTTPProxyListenKey, cfgOptionHTTPProxyListenDefault)
+
+	err = config.Register(&config.Option{
+		Name:            "HTTP Proxy Username",
+		Key:             cfgOptionHTTPProxyUsernameKey,
+		Description:     "Require HTTP proxy clients to authenticate with this username and the configured password.",
+		OptType:         config.OptTypeString,
+		ExpertiseLevel:  config.ExpertiseLevelDeveloper,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionHTTPProxyUsernameDefault,
+		RequiresRestart: true,
+		ValidationRegex: `^[^:]*$`,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionHTTPProxyUsernameOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionHTTPProxyUsername = config.Concurrent.GetAsString(cfgOptionHTTPProxyUsernameKey, cfgOptionHTTPProxyUsernameDefault)
+
+	err = config.Register(&config.Option{
+		Name:            "HTTP Proxy Password",
+		Key:             cfgOptionHTTPProxyPasswordKey,
+		Description:     "Require HTTP proxy clients to authenticate with the configured username and this password.",
+		Sensitive:       true,
+		OptType:         config.OptTypeString,
+		ExpertiseLevel:  config.ExpertiseLevelDeveloper,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    cfgOptionHTTPProxyPasswordDefault,
+		RequiresRestart: true,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionHTTPProxyPasswordOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionHTTPProxyPassword = config.Concurrent.GetAsString(cfgOptionHTTPProxyPasswordKey, cfgOptionHTTPProxyPasswordDefault)
+
+	err = config.Register(&config.Option{
+		Name:           "Proxy Routing Algorithm",
+		Key:            cfgOptionProxyRoutingAlgorithmKey,
+		Description:    "Select the routing algorithm for connections of the SOCKS5 and HTTP proxies.",
+		OptType:        config.OptTypeString,
+		ExpertiseLevel: config.ExpertiseLevelDeveloper,
+		ReleaseLevel:   config.ReleaseLevelExperimental,
+		DefaultValue:   cfgOptionProxyRoutingAlgorithmDefault,
+		Annotations: config.Annotations{
+			config.DisplayHintAnnotation:  config.DisplayHintOneOf,
+			config.DisplayOrderAnnotation: cfgOptionProxyRoutingAlgorithmOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+		PossibleValues: []config.PossibleValue{
+			{
+				Name:        "Global Setting",
+				Value:       "",
+				Description: "Use the globally configured routing algorithm.",
+			},
+			{
+				Name:        "Plain VPN Mode",
+				Value:       navigator.RoutingProfileHomeID,
+				Description: "Always connect to the destination directly from the Home Hub.",
+			},
+			{
+				Name:        "Speed Focused",
+				Value:       navigator.RoutingProfileSingleHopID,
+				Description: "Optimize routes with a minimum of one hop.",
+			},
+			{
+				Name:        "Balanced",
+				Value:       navigator.RoutingProfileDoubleHopID,
+				Description: "Optimize routes with a minimum of two hops.",
+			},
+			{
+				Name:        "Privacy Focused",
+				Value:       navigator.RoutingProfileTripleHopID,
+				Description: "Optimize routes with a minimum of three hops.",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionProxyRoutingAlgorithm = config.Concurrent.GetAsString(cfgOptionProxyRoutingAlgorithmKey, cfgOptionProxyRoutingAlgorithmDefault)
+
+	return nil
+}
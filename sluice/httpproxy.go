@@ -0,0 +1,266 @@
+package sluice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/spn/crew"
+)
+
+/*
+
+HTTP Proxy:
+
+The HTTP proxy routes connections of applications that are configured to use
+it, eg. via the HTTP_PROXY and HTTPS_PROXY environment variables, through the
+SPN, without requiring a network connection from the Portmaster.
+
+CONNECT requests are tunneled as is. Plain HTTP requests with an absolute URI
+are forwarded to the destination in origin form, after which the connection is
+closed by the destination.
+
+If a username and password are configured, clients must authenticate with them
+using basic proxy authentication, but may connect from anywhere. Otherwise,
+only clients from this device are accepted.
+
+*/
+
+const httpProxyHandshakeLimit = 30 * time.Second
+
+// httpProxyHopHeaders are removed from forwarded plain HTTP requests.
+var httpProxyHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// HTTPProxy handles HTTP proxy requests.
+type HTTPProxy struct {
+	username []byte
+	password []byte
+	connect  ProxyConnectFunc
+}
+
+// StartHTTPProxy starts an HTTP proxy listener at the given address.
+// If a username or password is given, clients must authenticate.
+func StartHTTPProxy(address, username, password string) {
+	p := &HTTPProxy{
+		username: []byte(username),
+		password: []byte(password),
+		connect:  connectProxy,
+	}
+	startProxyListener("http", address, p.handleConnection)
+}
+
+func (p *HTTPProxy) requiresAuth() bool {
+	return len(p.username) > 0 || len(p.password) > 0
+}
+
+func (p *HTTPProxy) handleConnection(ctx context.Context, conn net.Conn) {
+	// Close the connection if it is not taken over.
+	takenOver := false
+	defer func() {
+		if !takenOver {
+			_ = conn.Close()
+		}
+	}()
+
+	// Check if the client is permitted.
+	if !p.requiresAuth() && !isLocalClient(conn.RemoteAddr()) {
+		log.Warningf("spn/sluice: received external http proxy request from %s, ignoring", conn.RemoteAddr())
+		return
+	}
+
+	// Limit the time for the handshake.
+	_ = conn.SetDeadline(time.Now().Add(httpProxyHandshakeLimit))
+
+	// Read the request.
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		log.Debugf("spn/sluice: failed to read http proxy request from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	// Check authentication.
+	if p.requiresAuth() && !p.authenticated(req) {
+		_ = writeHTTPProxyResponse(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"SPN\"\r\n")
+		log.Debugf("spn/sluice: http proxy authentication of %s failed", conn.RemoteAddr())
+		return
+	}
+
+	// Handle the request.
+	if req.Method == http.MethodConnect {
+		takenOver = p.handleConnect(ctx, conn, reader, req)
+	} else {
+		takenOver = p.handlePlain(ctx, conn, reader, req)
+	}
+}
+
+// authenticated returns whether the request carries the configured
+// credentials.
+func (p *HTTPProxy) authenticated(req *http.Request) bool {
+	auth, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return false
+	}
+	username, password, ok := bytes.Cut(decoded, []byte(":"))
+	if !ok {
+		return false
+	}
+
+	usernameOK := subtle.ConstantTimeCompare(username, p.username) == 1
+	passwordOK := subtle.ConstantTimeCompare(password, p.password) == 1
+	return usernameOK && passwordOK
+}
+
+func (p *HTTPProxy) handleConnect(ctx context.Context, conn net.Conn, reader *bufio.Reader, req *http.Request) (takenOver bool) {
+	request, err := httpProxyConnectRequest(req.Host, "")
+	if err != nil {
+		_ = writeHTTPProxyResponse(conn, http.StatusBadRequest, "")
+		log.Debugf("spn/sluice: received invalid http proxy request from %s: %s", conn.RemoteAddr(), err)
+		return false
+	}
+
+	// Connect through the SPN.
+	// Data the client already sent is read from the buffer first.
+	pConn := newProxyConn(conn, reader)
+	if err := p.connect(ctx, request, pConn); err != nil {
+		_ = writeHTTPProxyResponse(conn, httpProxyStatusCode(err), "")
+		log.Infof("spn/sluice: failed to connect http proxy request from %s to %s: %s", conn.RemoteAddr(), req.Host, err)
+		return false
+	}
+
+	// Report success and hand over the connection to the tunnel.
+	// The tunnel closes the connection from now on.
+	_ = conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		_ = conn.Close()
+	}
+	pConn.release()
+
+	log.Tracef("spn/sluice: connected http proxy request from %s to %s", conn.RemoteAddr(), req.Host)
+	return true
+}
+
+func (p *HTTPProxy) handlePlain(ctx context.Context, conn net.Conn, reader *bufio.Reader, req *http.Request) (takenOver bool) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		_ = writeHTTPProxyResponse(conn, http.StatusBadRequest, "")
+		log.Debugf("spn/sluice: received http proxy request from %s without absolute http uri", conn.RemoteAddr())
+		return false
+	}
+	request, err := httpProxyConnectRequest(req.URL.Host, "80")
+	if err != nil {
+		_ = writeHTTPProxyResponse(conn, http.StatusBadRequest, "")
+		log.Debugf("spn/sluice: received invalid http proxy request from %s: %s", conn.RemoteAddr(), err)
+		return false
+	}
+
+	// Forward the request in origin form, followed by the unread body.
+	pConn := newProxyConn(conn, io.MultiReader(bytes.NewReader(httpProxyRequestHead(req)), reader))
+	if err := p.connect(ctx, request, pConn); err != nil {
+		_ = writeHTTPProxyResponse(conn, httpProxyStatusCode(err), "")
+		log.Infof("spn/sluice: failed to connect http proxy request from %s to %s: %s", conn.RemoteAddr(), req.URL.Host, err)
+		return false
+	}
+
+	// Hand over the connection to the tunnel.
+	// The tunnel closes the connection from now on.
+	_ = conn.SetDeadline(time.Time{})
+	pConn.release()
+
+	log.Tracef("spn/sluice: connected http proxy request from %s to %s", conn.RemoteAddr(), req.URL.Host)
+	return true
+}
+
+// httpProxyConnectRequest returns the connect request for the given host
+// with an optional port, which defaults to the given port.
+func httpProxyConnectRequest(hostport, defaultPort string) (*crew.ConnectRequest, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		if defaultPort == "" {
+			return nil, err
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+		port = defaultPort
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || portNum == 0 {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	if host == "" {
+		return nil, errors.New("missing host")
+	}
+
+	request := &crew.ConnectRequest{
+		Protocol: packet.TCP,
+		Port:     uint16(portNum),
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		request.IP = ip
+	} else {
+		request.Domain = host
+	}
+	return request, nil
+}
+
+// httpProxyRequestHead returns the head of the given request in origin form,
+// without hop-by-hop headers.
+func httpProxyRequestHead(req *http.Request) []byte {
+	header := req.Header.Clone()
+	for _, h := range httpProxyHopHeaders {
+		header.Del(h)
+	}
+	header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 {
+		header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+
+	buf := &bytes.Buffer{}
+	_, _ = fmt.Fprintf(buf, "%s %s %s\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Proto, req.Host)
+	_ = header.Write(buf)
+	_, _ = buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// httpProxyStatusCode returns the status code for the given connect error.
+func httpProxyStatusCode(err error) int {
+	switch {
+	case errors.Is(err, crew.ErrProxyRequestInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, crew.ErrProxyDestinationNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, crew.ErrSPNNotReady):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// writeHTTPProxyResponse writes a response without body and with the given
+// additional header lines.
+func writeHTTPProxyResponse(w io.Writer, code int, headers string) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), headers)
+	return err
+}
@@ -0,0 +1,137 @@
+package sluice
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/spn/crew"
+)
+
+func TestHTTPProxyConnect(t *testing.T) {
+	t.Parallel()
+
+	requests := make(chan *crew.ConnectRequest, 1)
+	received := make(chan string, 1)
+	p := &HTTPProxy{
+		username: []byte("user"),
+		password: []byte("pass"),
+		connect: func(ctx context.Context, request *crew.ConnectRequest, conn net.Conn) error {
+			requests <- request
+			go func() {
+				// Data from the tunnel must only arrive after the response.
+				_, _ = conn.Write([]byte("hello"))
+				// Data sent with the request must be forwarded.
+				buf := make([]byte, 5)
+				_, _ = io.ReadFull(conn, buf)
+				received <- string(buf)
+			}()
+			return nil
+		},
+	}
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go p.handleConnection(context.Background(), server)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	go func() {
+		_, _ = io.WriteString(client, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic "+auth+"\r\n\r\nearly")
+	}()
+	reader := bufio.NewReader(client)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []byte("hello"), readN(t, reader, 5))
+	assert.Equal(t, "early", <-received)
+
+	request := <-requests
+	assert.Equal(t, "example.com", request.Domain)
+	assert.Equal(t, packet.TCP, request.Protocol)
+	assert.Equal(t, uint16(443), request.Port)
+}
+
+func TestHTTPProxyPlain(t *testing.T) {
+	t.Parallel()
+
+	requests := make(chan *crew.ConnectRequest, 1)
+	forwarded := make(chan *http.Request, 1)
+	p := &HTTPProxy{
+		username: []byte("user"),
+		password: []byte("pass"),
+		connect: func(ctx context.Context, request *crew.ConnectRequest, conn net.Conn) error {
+			requests <- request
+			go func() {
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err == nil {
+					forwarded <- req
+				}
+				close(forwarded)
+			}()
+			return nil
+		},
+	}
+
+	// Authentication is required.
+	client, server := net.Pipe()
+	go p.handleConnection(context.Background(), server)
+	go func() {
+		_, _ = io.WriteString(client, "GET http://example.com/path?q=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	_ = client.Close()
+
+	// Plain requests are forwarded in origin form.
+	client, server = net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go p.handleConnection(context.Background(), server)
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	go func() {
+		_, _ = io.WriteString(client, "GET http://10.0.0.1:8080/path?q=1 HTTP/1.1\r\nHost: 10.0.0.1:8080\r\nProxy-Authorization: Basic "+auth+"\r\nProxy-Connection: keep-alive\r\nAccept: */*\r\n\r\n")
+	}()
+
+	request := <-requests
+	assert.Equal(t, net.IPv4(10, 0, 0, 1).To16(), request.IP.To16())
+	assert.Equal(t, uint16(8080), request.Port)
+
+	req, ok := <-forwarded
+	require.True(t, ok)
+	assert.Equal(t, "/path?q=1", req.RequestURI)
+	assert.Equal(t, "10.0.0.1:8080", req.Host)
+	assert.Equal(t, "*/*", req.Header.Get("Accept"))
+	assert.Empty(t, req.Header.Get("Proxy-Authorization"))
+	assert.Empty(t, req.Header.Get("Proxy-Connection"))
+	assert.True(t, req.Close)
+}
+
+func TestHTTPProxyConnectRequest(t *testing.T) {
+	t.Parallel()
+
+	request, err := httpProxyConnectRequest("[2001:db8::1]:443", "")
+	require.NoError(t, err)
+	assert.Equal(t, net.ParseIP("2001:db8::1"), request.IP)
+	assert.Equal(t, uint16(443), request.Port)
+
+	request, err = httpProxyConnectRequest("example.com", "80")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", request.Domain)
+	assert.Equal(t, uint16(80), request.Port)
+
+	_, err = httpProxyConnectRequest("example.com", "")
+	assert.Error(t, err, "port should be required")
+	_, err = httpProxyConnectRequest("example.com:0", "")
+	assert.Error(t, err, "port should be valid")
+}
@@ -17,7 +17,11 @@ var (
 )
 
 func init() {
-	module = modules.Register("sluice", nil, start, stop, "terminal")
+	module = modules.Register("sluice", prep, start, stop, "terminal", "crew")
+}
+
+func prep() error {
+	return prepConfig()
 }
 
 func start() error {
@@ -35,6 +39,13 @@ func start() error {
 		} else {
 			log.Warningf("spn/sluice: no IPv6 stack detected, disabling IPv6 SPN entry endpoints")
 		}
+
+		if address := cfgOptionSOCKS5Listen(); address != "" {
+			StartSOCKS5Proxy(address, cfgOptionSOCKS5Username(), cfgOptionSOCKS5Password())
+		}
+		if address := cfgOptionHTTPProxyListen(); address != "" {
+			StartHTTPProxy(address, cfgOptionHTTPProxyUsername(), cfgOptionHTTPProxyPassword())
+		}
 	}
 
 	return nil
@@ -42,5 +53,6 @@ func start() error {
 
 func stop() error {
 	stopAllSluices()
+	stopAllProxyListeners()
 	return nil
 }
@@ -0,0 +1,169 @@
+package sluice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/netenv"
+	"github.com/safing/spn/crew"
+)
+
+// ProxyConnectFunc connects a proxied connection through the SPN.
+type ProxyConnectFunc func(ctx context.Context, request *crew.ConnectRequest, conn net.Conn) error
+
+// connectProxy connects a proxied connection through the SPN with the
+// configured proxy routing algorithm.
+func connectProxy(ctx context.Context, request *crew.ConnectRequest, conn net.Conn) error {
+	return crew.ConnectProxy(ctx, request, conn, cfgOptionProxyRoutingAlgorithm())
+}
+
+// proxyListener accepts connections for a proxy and hands them to its
+// handler.
+type proxyListener struct {
+	name    string
+	address string
+	handler func(ctx context.Context, conn net.Conn)
+
+	lock     sync.Mutex
+	listener net.Listener
+	stopped  bool
+}
+
+var (
+	proxyListeners     []*proxyListener
+	proxyListenersLock sync.Mutex
+)
+
+// startProxyListener starts listening for proxy requests at the given address.
+func startProxyListener(name, address string, handler func(ctx context.Context, conn net.Conn)) {
+	pl := &proxyListener{
+		name:    name,
+		address: address,
+		handler: handler,
+	}
+
+	proxyListenersLock.Lock()
+	proxyListeners = append(proxyListeners, pl)
+	proxyListenersLock.Unlock()
+
+	// Start service worker.
+	module.StartServiceWorker(name+" proxy listener", 10*time.Second, pl.listenHandler)
+}
+
+func stopAllProxyListeners() {
+	proxyListenersLock.Lock()
+	defer proxyListenersLock.Unlock()
+
+	for _, pl := range proxyListeners {
+		pl.stop()
+	}
+	proxyListeners = nil
+}
+
+func (pl *proxyListener) stop() {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	pl.stopped = true
+	if pl.listener != nil {
+		_ = pl.listener.Close()
+	}
+}
+
+func (pl *proxyListener) listenHandler(_ context.Context) error {
+	// Start listening.
+	pl.lock.Lock()
+	if pl.stopped {
+		pl.lock.Unlock()
+		return nil
+	}
+	ln, err := net.Listen("tcp", pl.address)
+	if err != nil {
+		pl.lock.Unlock()
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	pl.listener = ln
+	pl.lock.Unlock()
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	// Handle new connections.
+	log.Infof("spn/sluice: started listening for %s proxy requests on %s", pl.name, ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if module.IsStopping() {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		module.StartWorker(pl.name+" proxy handler", func(ctx context.Context) error {
+			pl.handler(ctx, conn)
+			return nil
+		})
+	}
+}
+
+// isLocalClient returns whether the given address is on this device.
+func isLocalClient(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if tcpAddr.IP.IsLoopback() {
+		return true
+	}
+	local, err := netenv.IsMyIP(tcpAddr.IP)
+	if err != nil {
+		log.Warningf("spn/sluice: failed to check if proxy client %s is local: %s", tcpAddr.IP, err)
+		return false
+	}
+	return local
+}
+
+// proxyConn delays writing to the client until the proxy handshake is
+// complete, as the tunnel may already receive data before.
+// If a reader is set, data from the client is read from it instead.
+type proxyConn struct {
+	net.Conn
+
+	reader    io.Reader
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func newProxyConn(conn net.Conn, reader io.Reader) *proxyConn {
+	return &proxyConn{
+		Conn:   conn,
+		reader: reader,
+		ready:  make(chan struct{}),
+	}
+}
+
+// release permits writing to the client.
+func (c *proxyConn) release() {
+	c.readyOnce.Do(func() {
+		close(c.ready)
+	})
+}
+
+// Read reads data from the client.
+func (c *proxyConn) Read(b []byte) (n int, err error) {
+	if c.reader != nil {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// Write writes data to the client, once the handshake is complete.
+func (c *proxyConn) Write(b []byte) (n int, err error) {
+	<-c.ready
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,349 @@
+package sluice
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/spn/crew"
+)
+
+/*
+
+SOCKS5 Proxy:
+
+The SOCKS5 proxy (RFC 1928) routes connections of applications that are
+configured to use it through the SPN, without requiring a network connection
+from the Portmaster. The CONNECT and UDP ASSOCIATE commands are supported.
+
+If a username and password are configured, clients must authenticate with them
+(RFC 1929), but may connect from anywhere. Otherwise, only clients from this
+device are accepted.
+
+*/
+
+const (
+	socks5Version        = 5
+	socks5AuthVersion    = 1
+	socks5HandshakeLimit = 30 * time.Second
+
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xFF
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrTypeIPv4   = 0x01
+	socks5AddrTypeDomain = 0x03
+	socks5AddrTypeIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyNetworkUnreachable  = 0x03
+	socks5ReplyCmdNotSupported     = 0x07
+	socks5ReplyAddrTypeUnsupported = 0x08
+)
+
+// errSOCKS5AddrTypeUnsupported is returned when a request uses an unknown
+// address type.
+var errSOCKS5AddrTypeUnsupported = errors.New("unsupported address type")
+
+// SOCKS5Proxy handles SOCKS5 proxy requests.
+type SOCKS5Proxy struct {
+	username []byte
+	password []byte
+	connect  ProxyConnectFunc
+}
+
+// StartSOCKS5Proxy starts a SOCKS5 proxy listener at the given address.
+// If a username or password is given, clients must authenticate.
+func StartSOCKS5Proxy(address, username, password string) {
+	p := &SOCKS5Proxy{
+		username: []byte(username),
+		password: []byte(password),
+		connect:  connectProxy,
+	}
+	startProxyListener("socks5", address, p.handleConnection)
+}
+
+func (p *SOCKS5Proxy) requiresAuth() bool {
+	return len(p.username) > 0 || len(p.password) > 0
+}
+
+func (p *SOCKS5Proxy) handleConnection(ctx context.Context, conn net.Conn) {
+	// Close the connection if it is not taken over.
+	takenOver := false
+	defer func() {
+		if !takenOver {
+			_ = conn.Close()
+		}
+	}()
+
+	// Check if the client is permitted.
+	if !p.requiresAuth() && !isLocalClient(conn.RemoteAddr()) {
+		log.Warningf("spn/sluice: received external socks5 request from %s, ignoring", conn.RemoteAddr())
+		return
+	}
+
+	// Limit the time for the handshake.
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeLimit))
+
+	// Negotiate and check authentication.
+	if err := p.authenticate(conn); err != nil {
+		log.Debugf("spn/sluice: socks5 authentication of %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	// Read the request.
+	cmd, dst, err := readSOCKS5Request(conn)
+	if err != nil {
+		if errors.Is(err, errSOCKS5AddrTypeUnsupported) {
+			_ = writeSOCKS5Reply(conn, socks5ReplyAddrTypeUnsupported, nil)
+		}
+		log.Debugf("spn/sluice: failed to read socks5 request from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	switch cmd {
+	case socks5CmdConnect:
+		takenOver = p.handleConnect(ctx, conn, dst)
+	case socks5CmdUDPAssociate:
+		p.handleUDPAssociate(ctx, conn, dst)
+	default:
+		_ = writeSOCKS5Reply(conn, socks5ReplyCmdNotSupported, nil)
+		log.Debugf("spn/sluice: received unsupported socks5 command %d from %s", cmd, conn.RemoteAddr())
+	}
+}
+
+// authenticate negotiates the authentication method and checks the
+// credentials, if required.
+func (p *SOCKS5Proxy) authenticate(conn net.Conn) error {
+	// Read offered methods.
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	// Select method.
+	method := byte(socks5AuthNone)
+	if p.requiresAuth() {
+		method = socks5AuthUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		if m == method {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return errors.New("no acceptable authentication method offered")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5AuthNone {
+		return nil
+	}
+
+	// Check username and password.
+	username, password, err := readSOCKS5Credentials(conn)
+	if err != nil {
+		return err
+	}
+	usernameOK := subtle.ConstantTimeCompare(username, p.username) == 1
+	passwordOK := subtle.ConstantTimeCompare(password, p.password) == 1
+	if !usernameOK || !passwordOK {
+		_, _ = conn.Write([]byte{socks5AuthVersion, 0x01})
+		return errors.New("invalid credentials")
+	}
+	_, err = conn.Write([]byte{socks5AuthVersion, 0x00})
+	return err
+}
+
+func readSOCKS5Credentials(r io.Reader) (username, password []byte, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[0] != socks5AuthVersion {
+		return nil, nil, fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+	username = make([]byte, header[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return nil, nil, err
+	}
+
+	passwordLength := make([]byte, 1)
+	if _, err := io.ReadFull(r, passwordLength); err != nil {
+		return nil, nil, err
+	}
+	password = make([]byte, passwordLength[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return nil, nil, err
+	}
+
+	return username, password, nil
+}
+
+func (p *SOCKS5Proxy) handleConnect(ctx context.Context, conn net.Conn, dst *socks5Addr) (takenOver bool) {
+	// Connect through the SPN.
+	pConn := newProxyConn(conn, nil)
+	err := p.connect(ctx, &crew.ConnectRequest{
+		Domain:   dst.Domain,
+		IP:       dst.IP,
+		Protocol: packet.TCP,
+		Port:     dst.Port,
+	}, pConn)
+	if err != nil {
+		_ = writeSOCKS5Reply(conn, socks5ReplyCode(err), nil)
+		log.Infof("spn/sluice: failed to connect socks5 request from %s to %s: %s", conn.RemoteAddr(), dst, err)
+		return false
+	}
+
+	// Report success and hand over the connection to the tunnel.
+	// The tunnel closes the connection from now on.
+	_ = conn.SetDeadline(time.Time{})
+	if err := writeSOCKS5Reply(conn, socks5ReplySucceeded, nil); err != nil {
+		_ = conn.Close()
+	}
+	pConn.release()
+
+	log.Tracef("spn/sluice: connected socks5 request from %s to %s", conn.RemoteAddr(), dst)
+	return true
+}
+
+// socks5ReplyCode returns the reply code for the given connect error.
+func socks5ReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, crew.ErrProxyDestinationNotAllowed):
+		return socks5ReplyNotAllowed
+	case errors.Is(err, crew.ErrSPNNotReady):
+		return socks5ReplyNetworkUnreachable
+	default:
+		return socks5ReplyGeneralFailure
+	}
+}
+
+// readSOCKS5Request reads a request and returns its command and address.
+func readSOCKS5Request(r io.Reader) (cmd byte, dst *socks5Addr, err error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != socks5Version {
+		return 0, nil, fmt.Errorf("unsupported version %d", header[0])
+	}
+
+	dst, err = readSOCKS5Addr(r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[1], dst, nil
+}
+
+// writeSOCKS5Reply writes a reply with the given code and bound address.
+func writeSOCKS5Reply(w io.Writer, code byte, bound net.Addr) error {
+	bnd := &socks5Addr{IP: net.IPv4zero}
+	if udpAddr, ok := bound.(*net.UDPAddr); ok {
+		bnd = &socks5Addr{IP: udpAddr.IP, Port: uint16(udpAddr.Port)}
+	}
+
+	reply := append([]byte{socks5Version, code, 0x00}, bnd.pack()...)
+	_, err := w.Write(reply)
+	return err
+}
+
+// socks5Addr is an address as used in SOCKS5 messages.
+type socks5Addr struct {
+	IP     net.IP
+	Domain string
+	Port   uint16
+}
+
+// readSOCKS5Addr reads an address type, address and port.
+func readSOCKS5Addr(r io.Reader) (*socks5Addr, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return nil, err
+	}
+
+	a := &socks5Addr{}
+	switch addrType[0] {
+	case socks5AddrTypeIPv4:
+		a.IP = make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, a.IP); err != nil {
+			return nil, err
+		}
+	case socks5AddrTypeIPv6:
+		a.IP = make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, a.IP); err != nil {
+			return nil, err
+		}
+	case socks5AddrTypeDomain:
+		domainLength := make([]byte, 1)
+		if _, err := io.ReadFull(r, domainLength); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, domainLength[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return nil, err
+		}
+		a.Domain = string(domain)
+		// Some clients send IPs as domains.
+		if ip := net.ParseIP(a.Domain); ip != nil {
+			a.IP = ip
+			a.Domain = ""
+		}
+	default:
+		return nil, fmt.Errorf("%w %d", errSOCKS5AddrTypeUnsupported, addrType[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	a.Port = binary.BigEndian.Uint16(port)
+
+	return a, nil
+}
+
+// pack returns the address type, address and port.
+func (a *socks5Addr) pack() []byte {
+	var data []byte
+	switch {
+	case a.Domain != "":
+		data = append([]byte{socks5AddrTypeDomain, byte(len(a.Domain))}, a.Domain...)
+	case a.IP.To4() != nil:
+		data = append([]byte{socks5AddrTypeIPv4}, a.IP.To4()...)
+	default:
+		data = append([]byte{socks5AddrTypeIPv6}, a.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(data, a.Port)
+}
+
+func (a *socks5Addr) String() string {
+	if a.Domain != "" {
+		return net.JoinHostPort(a.Domain, strconv.Itoa(int(a.Port)))
+	}
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
+}
@@ -0,0 +1,124 @@
+package sluice
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/spn/crew"
+)
+
+func TestSOCKS5Connect(t *testing.T) {
+	t.Parallel()
+
+	requests := make(chan *crew.ConnectRequest, 1)
+	p := &SOCKS5Proxy{
+		username: []byte("user"),
+		password: []byte("pass"),
+		connect: func(ctx context.Context, request *crew.ConnectRequest, conn net.Conn) error {
+			requests <- request
+			// Data from the tunnel must only arrive after the reply.
+			go func() {
+				_, _ = conn.Write([]byte("hello"))
+			}()
+			return nil
+		},
+	}
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go p.handleConnection(context.Background(), server)
+
+	// Negotiate authentication.
+	_, err := client.Write([]byte{socks5Version, 2, socks5AuthNone, socks5AuthUserPass})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, socks5AuthUserPass}, readN(t, client, 2))
+	_, err = client.Write(append(append([]byte{socks5AuthVersion, 4}, "user"...), append([]byte{4}, "pass"...)...))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{socks5AuthVersion, 0x00}, readN(t, client, 2))
+
+	// Request connection.
+	dst := &socks5Addr{Domain: "example.com", Port: 443}
+	_, err = client.Write(append([]byte{socks5Version, socks5CmdConnect, 0}, dst.pack()...))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, socks5ReplySucceeded, 0, socks5AddrTypeIPv4, 0, 0, 0, 0, 0, 0}, readN(t, client, 10))
+	assert.Equal(t, []byte("hello"), readN(t, client, 5))
+
+	request := <-requests
+	assert.Equal(t, "example.com", request.Domain)
+	assert.Equal(t, packet.TCP, request.Protocol)
+	assert.Equal(t, uint16(443), request.Port)
+}
+
+func TestSOCKS5Rejections(t *testing.T) {
+	t.Parallel()
+
+	p := &SOCKS5Proxy{
+		username: []byte("user"),
+		password: []byte("pass"),
+		connect: func(ctx context.Context, request *crew.ConnectRequest, conn net.Conn) error {
+			return crew.ErrProxyDestinationNotAllowed
+		},
+	}
+	start := func() net.Conn {
+		client, server := net.Pipe()
+		go p.handleConnection(context.Background(), server)
+		return client
+	}
+	authenticate := func(client net.Conn) {
+		_, err := client.Write([]byte{socks5Version, 1, socks5AuthUserPass})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{socks5Version, socks5AuthUserPass}, readN(t, client, 2))
+		_, err = client.Write(append(append([]byte{socks5AuthVersion, 4}, "user"...), append([]byte{4}, "pass"...)...))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{socks5AuthVersion, 0x00}, readN(t, client, 2))
+	}
+
+	// Authentication is required.
+	client := start()
+	_, err := client.Write([]byte{socks5Version, 1, socks5AuthNone})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, socks5AuthNoAcceptable}, readN(t, client, 2))
+	_ = client.Close()
+
+	// Wrong credentials.
+	client = start()
+	_, err = client.Write([]byte{socks5Version, 1, socks5AuthUserPass})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, socks5AuthUserPass}, readN(t, client, 2))
+	_, err = client.Write(append(append([]byte{socks5AuthVersion, 4}, "user"...), append([]byte{4}, "nope"...)...))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{socks5AuthVersion, 0x01}, readN(t, client, 2))
+	_ = client.Close()
+
+	// BIND is not supported.
+	client = start()
+	authenticate(client)
+	_, err = client.Write(append([]byte{socks5Version, 0x02, 0}, (&socks5Addr{IP: net.IPv4(1, 1, 1, 1), Port: 80}).pack()...))
+	require.NoError(t, err)
+	assert.Equal(t, byte(socks5ReplyCmdNotSupported), readN(t, client, 10)[1])
+	_ = client.Close()
+
+	// Connect errors are reported.
+	client = start()
+	authenticate(client)
+	_, err = client.Write(append([]byte{socks5Version, socks5CmdConnect, 0}, (&socks5Addr{IP: net.IPv4(10, 0, 0, 1), Port: 80}).pack()...))
+	require.NoError(t, err)
+	assert.Equal(t, byte(socks5ReplyNotAllowed), readN(t, client, 10)[1])
+	_ = client.Close()
+}
+
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	t.Helper()
+
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	require.NoError(t, err)
+	return buf
+}
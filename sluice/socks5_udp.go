@@ -0,0 +1,270 @@
+package sluice
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/spn/crew"
+)
+
+// socks5UDPAssociation relays datagrams of a SOCKS5 UDP ASSOCIATE request.
+// Every destination gets its own tunnel.
+type socks5UDPAssociation struct {
+	proxy    *SOCKS5Proxy
+	sock     *net.UDPConn
+	clientIP net.IP
+	closed   *abool.AtomicBool
+
+	lock       sync.Mutex
+	clientAddr *net.UDPAddr
+	conns      map[string]*socks5UDPConn
+}
+
+func (p *SOCKS5Proxy) handleUDPAssociate(_ context.Context, conn net.Conn, clientDst *socks5Addr) {
+	tcpLocal, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		_ = writeSOCKS5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+	tcpRemote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		_ = writeSOCKS5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+
+	// Listen for datagrams on the IP the client connected to.
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpLocal.IP})
+	if err != nil {
+		_ = writeSOCKS5Reply(conn, socks5ReplyGeneralFailure, nil)
+		log.Warningf("spn/sluice: failed to listen for socks5 udp associate: %s", err)
+		return
+	}
+
+	assoc := &socks5UDPAssociation{
+		proxy:    p,
+		sock:     sock,
+		clientIP: tcpRemote.IP,
+		closed:   abool.New(),
+		conns:    make(map[string]*socks5UDPConn),
+	}
+	// Use the client address, if the client already knows it.
+	if clientDst.Port != 0 && clientDst.IP != nil && !clientDst.IP.IsUnspecified() {
+		assoc.clientAddr = &net.UDPAddr{IP: clientDst.IP, Port: int(clientDst.Port)}
+	}
+	defer assoc.close()
+
+	// Report the relay address.
+	if err := writeSOCKS5Reply(conn, socks5ReplySucceeded, sock.LocalAddr()); err != nil {
+		return
+	}
+	module.StartWorker("socks5 udp relay", assoc.relay)
+
+	// The association ends when the control connection is closed.
+	_ = conn.SetDeadline(time.Time{})
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+func (assoc *socks5UDPAssociation) close() {
+	if !assoc.closed.SetToIf(false, true) {
+		return
+	}
+
+	_ = assoc.sock.Close()
+
+	assoc.lock.Lock()
+	defer assoc.lock.Unlock()
+	for _, conn := range assoc.conns {
+		_ = conn.Close()
+	}
+}
+
+func (assoc *socks5UDPAssociation) relay(_ context.Context) error {
+	for {
+		buf := make([]byte, 2048)
+		n, addr, err := assoc.sock.ReadFromUDP(buf)
+		if err != nil {
+			assoc.close()
+			return nil
+		}
+
+		// Only accept datagrams from the client.
+		if !addr.IP.Equal(assoc.clientIP) {
+			continue
+		}
+		assoc.lock.Lock()
+		if assoc.clientAddr == nil {
+			assoc.clientAddr = addr
+		}
+		fromClient := assoc.clientAddr.IP.Equal(addr.IP) && assoc.clientAddr.Port == addr.Port
+		assoc.lock.Unlock()
+		if !fromClient {
+			continue
+		}
+
+		// Parse header: RSV(2), FRAG(1), ATYP, DST.ADDR, DST.PORT
+		// Fragmentation is not supported.
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		dst, err := readSOCKS5Addr(r)
+		if err != nil {
+			continue
+		}
+		data := buf[n-r.Len() : n]
+
+		// Supply data to the tunnel of the destination.
+		assoc.getConn(dst).supply(data)
+	}
+}
+
+// getConn returns the connection to the given destination and creates it, if
+// it does not yet exist.
+func (assoc *socks5UDPAssociation) getConn(dst *socks5Addr) *socks5UDPConn {
+	assoc.lock.Lock()
+	defer assoc.lock.Unlock()
+
+	key := dst.String()
+	conn, ok := assoc.conns[key]
+	if ok && conn.closed.IsNotSet() {
+		return conn
+	}
+
+	// Create a new connection and connect it in a worker.
+	conn = &socks5UDPConn{
+		assoc:   assoc,
+		header:  append([]byte{0, 0, 0}, dst.pack()...),
+		closed:  abool.New(),
+		closing: make(chan struct{}),
+		in:      make(chan []byte, 100),
+	}
+	assoc.conns[key] = conn
+	module.StartWorker("socks5 udp connect", func(ctx context.Context) error {
+		err := assoc.proxy.connect(ctx, &crew.ConnectRequest{
+			Domain:   dst.Domain,
+			IP:       dst.IP,
+			Protocol: packet.UDP,
+			Port:     dst.Port,
+		}, conn)
+		if err != nil {
+			_ = conn.Close()
+			log.Infof("spn/sluice: failed to connect socks5 udp to %s: %s", dst, err)
+		}
+		return nil
+	})
+
+	return conn
+}
+
+// socks5UDPConn simulates a connection to a single destination of a SOCKS5
+// UDP association.
+type socks5UDPConn struct {
+	assoc   *socks5UDPAssociation
+	header  []byte
+	closed  *abool.AtomicBool
+	closing chan struct{}
+
+	buf []byte
+	in  chan []byte
+}
+
+// supply supplies a datagram from the client, or drops it if the queue is full.
+func (conn *socks5UDPConn) supply(data []byte) {
+	select {
+	case conn.in <- data:
+	default:
+	}
+}
+
+// Read reads data from the connection.
+func (conn *socks5UDPConn) Read(b []byte) (n int, err error) {
+	// Check if connection is closed.
+	if conn.closed.IsSet() {
+		return 0, io.EOF
+	}
+
+	// Get new buffer.
+	if conn.buf == nil {
+		select {
+		case conn.buf = <-conn.in:
+		case <-conn.closing:
+			return 0, io.EOF
+		}
+	}
+
+	// Serve from buffer.
+	copy(b, conn.buf)
+	if len(b) >= len(conn.buf) {
+		copied := len(conn.buf)
+		conn.buf = nil
+		return copied, nil
+	}
+	copied := len(b)
+	conn.buf = conn.buf[copied:]
+	return copied, nil
+}
+
+// Write writes data to the client, with the SOCKS5 UDP header of the
+// destination.
+func (conn *socks5UDPConn) Write(b []byte) (n int, err error) {
+	// Check if connection is closed.
+	if conn.closed.IsSet() {
+		return 0, io.EOF
+	}
+
+	conn.assoc.lock.Lock()
+	clientAddr := conn.assoc.clientAddr
+	conn.assoc.lock.Unlock()
+
+	datagram := make([]byte, 0, len(conn.header)+len(b))
+	datagram = append(datagram, conn.header...)
+	datagram = append(datagram, b...)
+	if _, err := conn.assoc.sock.WriteToUDP(datagram, clientAddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the connection, but not the shared socket.
+func (conn *socks5UDPConn) Close() error {
+	if conn.closed.SetToIf(false, true) {
+		close(conn.closing)
+	}
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (conn *socks5UDPConn) LocalAddr() net.Addr {
+	return conn.assoc.sock.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (conn *socks5UDPConn) RemoteAddr() net.Addr {
+	conn.assoc.lock.Lock()
+	defer conn.assoc.lock.Unlock()
+
+	return conn.assoc.clientAddr
+}
+
+// SetDeadline is a no-op as UDP connections share a single socket.
+func (conn *socks5UDPConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is a no-op as UDP connections share a single socket.
+func (conn *socks5UDPConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is a no-op as UDP connections share a single socket.
+func (conn *socks5UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
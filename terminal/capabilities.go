@@ -0,0 +1,168 @@
+package terminal
+
+import (
+	"context"
+	"time"
+
+	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/formats/varint"
+	"github.com/safing/spn/hub"
+)
+
+/*
+
+Terminal Capabilities:
+
+With terminal version 2, the local terminal advertises all capabilities it
+supports in the terminal options. The remote terminal agrees on the
+intersection with its own supported capabilities and reports the agreed
+capabilities back to the local terminal with a control message.
+
+The remote terminal may use the agreed capabilities immediately, while the
+local terminal may only use them after receiving the control message.
+Terminals with version 1 have no capabilities.
+
+Terminal Control Message Format:
+sent as data message with the reserved operation ID 0
+
+- ControlType [varint]
+- Data [bytes; format depends on control type]
+	- ControlTypeCapabilities:
+		- Capabilities [varint]
+	- ControlTypeCompressed: see compression.go
+	- ControlTypeCover: see cover.go
+	- ControlTypeKeepalive, ControlTypeKeepaliveReply: see keepalive.go
+	- ControlTypeRekey: see rekey.go
+
+*/
+
+// Capability is a feature of a terminal that needs support from both sides.
+type Capability uint32
+
+// supportedCapabilities holds all capabilities supported by this terminal
+// implementation. New capabilities are added here when they are implemented.
+var supportedCapabilities Capability
+
+// Has returns whether all of the given capabilities are set.
+func (c Capability) Has(capabilities Capability) bool {
+	return c&capabilities == capabilities
+}
+
+const (
+	// terminalControlOpID is the reserved operation ID for terminal control
+	// messages. Operation IDs are always incremented before use and thus
+	// never zero.
+	terminalControlOpID = 0
+
+	// ControlTypeCapabilities is used to report the agreed capabilities.
+	ControlTypeCapabilities uint8 = 1
+)
+
+// UpgradeVersion sets the terminal version to the highest version that is
+// supported by both this and the given Hub, if no version is set yet.
+func (opts *TerminalOpts) UpgradeVersion(h *hub.Hub) {
+	if opts.Version == 0 && h != nil && h.HasFlag(hub.FlagTerminalV2) {
+		opts.Version = 2
+	}
+}
+
+// Capabilities returns the capabilities agreed on by both sides.
+// The local terminal has no capabilities until the remote terminal reported
+// the agreed capabilities.
+func (t *TerminalBase) Capabilities() Capability {
+	return Capability(t.capabilities.Load())
+}
+
+// HasCapability returns whether the given capabilities were agreed on by both
+// sides.
+func (t *TerminalBase) HasCapability(c Capability) bool {
+	return t.Capabilities().Has(c)
+}
+
+// acceptsCapability returns whether the terminal accepts data that requires
+// the given capability.
+// The local terminal must accept such data before it received the agreed
+// capabilities, as the remote terminal may use them immediately.
+func (t *TerminalBase) acceptsCapability(c Capability) bool {
+	return t.opts.Version >= 2 &&
+		(t.opts.Capabilities & supportedCapabilities).Has(c)
+}
+
+// agreeOnCapabilities agrees on the capabilities requested by the local
+// terminal and reports them back. Must only be called on remote terminals.
+func (t *TerminalBase) agreeOnCapabilities() {
+	if t.opts.Version < 2 {
+		return
+	}
+
+	agreed := t.opts.Capabilities & supportedCapabilities
+	t.capabilities.Store(uint32(agreed))
+	t.startCoverTraffic()
+	t.startKeepalive()
+
+	// Report agreed capabilities in a worker, as the terminal may only send
+	// after it has been fully set up.
+	module.StartWorker("report terminal capabilities", func(_ context.Context) error {
+		tErr := t.sendControlMsg(ControlTypeCapabilities, varint.Pack32(uint32(agreed)), 0)
+		if tErr != nil && !tErr.IsOK() {
+			t.Abandon(tErr.Wrap("failed to report capabilities"))
+		}
+		return nil
+	})
+}
+
+// sendControlMsg sends a terminal control message to the other side.
+// If a timeout is set, sending will fail after the given timeout passed.
+func (t *TerminalBase) sendControlMsg(controlType uint8, data []byte, timeout time.Duration) *Error {
+	msg := NewEmptyMsg()
+	msg.FlowID = terminalControlOpID
+	msg.Type = MsgTypeData
+	msg.Data = container.New(varint.Pack8(controlType), data)
+	msg.Unit.MakeHighPriority()
+	msg.weightClass = WeightClassInteractive
+
+	return t.Send(msg, timeout)
+}
+
+// handleControlMsg handles a terminal control message.
+func (t *TerminalBase) handleControlMsg(data *container.Container) *Error {
+	controlType, err := data.GetNextN8()
+	if err != nil {
+		return ErrMalformedData.With("failed to parse control type: %w", err)
+	}
+
+	switch controlType {
+	case ControlTypeCapabilities:
+		capabilities, err := data.GetNextN32()
+		if err != nil {
+			return ErrMalformedData.With("failed to parse capabilities: %w", err)
+		}
+
+		// The remote may only agree on capabilities that were offered.
+		agreed := Capability(capabilities)
+		if !t.opts.Capabilities.Has(agreed) {
+			return ErrIncorrectUsage.With("remote agreed on capabilities 0x%x that were not offered", agreed)
+		}
+		t.capabilities.Store(uint32(agreed))
+		t.startCoverTraffic()
+		t.startKeepalive()
+		t.startRekeying()
+
+	case ControlTypeCompressed:
+		return t.handleCompressedMsg(data)
+
+	case ControlTypeCover:
+		return t.handleCoverMsg()
+
+	case ControlTypeKeepalive, ControlTypeKeepaliveReply:
+		return t.handleKeepaliveMsg(controlType)
+
+	case ControlTypeRekey:
+		return t.handleRekeyMsg(data)
+
+	default:
+		return ErrUnexpectedMsgType.With("unknown control type %d", controlType)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package terminal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTerminalCapabilities(t *testing.T) { //nolint:paralleltest // Test changes supportedCapabilities.
+	// Simulate supported capabilities.
+	defer func(c Capability) {
+		supportedCapabilities = c
+	}(supportedCapabilities)
+	supportedCapabilities = 0b011
+
+	// Create terminals that offer partly supported capabilities.
+	a, b, err := NewSimpleTestTerminalPair(0, 0, &TerminalOpts{
+		Version:         2,
+		FlowControl:     FlowControlDFQ,
+		FlowControlSize: defaultTestQueueSize,
+		Capabilities:    0b101,
+	})
+	if err != nil {
+		t.Fatalf("failed to create test terminal pair: %s", err)
+	}
+	defer a.Abandon(nil)
+	defer b.Abandon(nil)
+
+	// The remote terminal agrees immediately.
+	assert.Equal(t, Capability(0b001), b.Capabilities(), "remote should agree on the intersection")
+
+	// The local terminal receives the agreed capabilities.
+	for i := 0; i < 100 && a.Capabilities() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, Capability(0b001), a.Capabilities(), "local should receive agreed capabilities")
+	assert.True(t, a.HasCapability(0b001), "local should have agreed capability")
+	assert.False(t, a.HasCapability(0b100), "local should not have unsupported capability")
+
+	// Version 1 has no capabilities.
+	v1Opts := &TerminalOpts{Version: 1, Capabilities: 0b001}
+	assert.NotNil(t, v1Opts.Check(true), "capabilities should require version 2")
+}
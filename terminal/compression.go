@@ -0,0 +1,177 @@
+package terminal
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/formats/varint"
+)
+
+/*
+
+Terminal Compression:
+
+Terminals with version 2 that agreed on CapabilityCompression may compress
+the data messages of operations that opted in via SetCompression. Every
+operation message is compressed on its own before it is added to the terminal
+message, so that data of different operations never shares a compression
+context. Otherwise, the size of a compressed terminal message could reveal
+whether the data of one operation matches data of another, as exploited by
+CRIME. Control messages, including padding, are never compressed.
+
+Compression is only applied if the message exceeds a size threshold and
+actually gets smaller. A compressed operation message is sent as a terminal
+control message, which serves as the per-message compression flag:
+
+- ControlTypeCompressed:
+	- Compressed Operation Message [bytes; deflate]
+		- must hold exactly one data message of an operation
+
+Both sides decide on their own whether to compress the data they send, as
+requested by the Compress terminal option.
+
+*/
+
+const (
+	// CapabilityCompression is the capability to receive compressed operation
+	// data messages.
+	CapabilityCompression Capability = 1 << 0
+
+	// ControlTypeCompressed is used to send a compressed operation message.
+	ControlTypeCompressed uint8 = 2
+
+	// compressionThreshold defines the minimum size of a message to be compressed.
+	compressionThreshold = 256
+
+	// maxDecompressedSize defines the maximum size of decompressed data in
+	// order to protect against decompression bombs.
+	maxDecompressedSize = 65536
+)
+
+func init() {
+	supportedCapabilities |= CapabilityCompression
+}
+
+// compressionEnabled defines whether expansion terminals request compression.
+var compressionEnabled = abool.New()
+
+// EnableCompression sets whether expansion terminals request compression.
+func EnableCompression(enabled bool) {
+	compressionEnabled.SetTo(enabled)
+}
+
+// CompressionEnabled returns whether expansion terminals request compression.
+func CompressionEnabled() bool {
+	return compressionEnabled.IsSet()
+}
+
+var (
+	compressorPool = sync.Pool{
+		New: func() any {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+	decompressorPool = sync.Pool{
+		New: func() any {
+			return flate.NewReader(nil)
+		},
+	}
+)
+
+// shouldCompress returns whether data sent by the terminal should be
+// compressed.
+func (t *TerminalBase) shouldCompress() bool {
+	return t.opts.Compress &&
+		t.opts.Version >= 2 &&
+		t.HasCapability(CapabilityCompression)
+}
+
+// compressMsg compresses the given operation message into a terminal control
+// message. The message is left unchanged if compression does not reduce its
+// size.
+func compressMsg(msg *Msg) {
+	// Pack a copy of the operation message.
+	packed := container.New(msg.Data.CompileData())
+	MakeMsg(packed, msg.FlowID, msg.Type)
+
+	// Check if data is within compression limits.
+	if packed.Length() < compressionThreshold || packed.Length() > maxDecompressedSize {
+		return
+	}
+
+	// Compress data.
+	buf := bytes.NewBuffer(make([]byte, 0, packed.Length()))
+	w := compressorPool.Get().(*flate.Writer) //nolint:forcetypeassert
+	defer compressorPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(packed.CompileData()); err != nil {
+		return
+	}
+	if err := w.Close(); err != nil {
+		return
+	}
+
+	// Only use compressed data if it is actually smaller.
+	compressed := container.New(
+		varint.Pack8(ControlTypeCompressed),
+		buf.Bytes(),
+	)
+	if compressed.Length() >= packed.Length() {
+		return
+	}
+
+	// Convert to terminal control message.
+	msg.FlowID = terminalControlOpID
+	msg.Type = MsgTypeData
+	msg.Data = compressed
+}
+
+// decompressOpMsg decompresses the given compressed operation message.
+func decompressOpMsg(data *container.Container) (*container.Container, *Error) {
+	r := decompressorPool.Get().(io.ReadCloser) //nolint:forcetypeassert
+	defer decompressorPool.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data.CompileData()), nil); err != nil { //nolint:forcetypeassert
+		return nil, ErrMalformedData.With("failed to set up decompression: %w", err)
+	}
+
+	// Read one byte more than permitted to detect oversized data.
+	decompressed, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, ErrMalformedData.With("failed to decompress: %w", err)
+	}
+	if len(decompressed) > maxDecompressedSize {
+		return nil, ErrMalformedData.With("decompressed data exceeds %d bytes", maxDecompressedSize)
+	}
+
+	return container.New(decompressed), nil
+}
+
+// handleCompressedMsg handles a control message with a compressed operation
+// message.
+func (t *TerminalBase) handleCompressedMsg(data *container.Container) *Error {
+	if !t.acceptsCapability(CapabilityCompression) {
+		return ErrIncorrectUsage.With("received compressed data without agreed compression")
+	}
+
+	decompressed, tErr := decompressOpMsg(data)
+	if tErr != nil {
+		return tErr
+	}
+
+	// Compressed data must hold exactly one operation message.
+	msgLength, err := decompressed.GetNextN32()
+	if err != nil {
+		return ErrMalformedData.With("failed to get compressed operation msg length: %w", err)
+	}
+	if msgLength == 0 || int(msgLength) != decompressed.Length() {
+		return ErrMalformedData.With("compressed data must hold exactly one operation msg")
+	}
+
+	return t.handleOpMsg(decompressed, true)
+}
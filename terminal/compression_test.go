@@ -0,0 +1,126 @@
+package terminal
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/formats/varint"
+)
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+
+	// Small messages are not compressed.
+	small := NewMsg([]byte("hello"))
+	defer small.Finish()
+	small.FlowID = 8
+	compressMsg(small)
+	assert.Equal(t, uint32(8), small.FlowID, "small message should not be compressed")
+	assert.Equal(t, []byte("hello"), small.Data.CompileData(), "small message should not be changed")
+
+	// Compressible messages are compressed into a control message.
+	data := bytes.Repeat([]byte("text-heavy traffic "), 100)
+	msg := NewMsg(data)
+	defer msg.Finish()
+	msg.FlowID = 8
+	compressMsg(msg)
+	assert.Equal(t, uint32(terminalControlOpID), msg.FlowID, "message should be a control message")
+	assert.Equal(t, MsgTypeData, msg.Type)
+	assert.Less(t, msg.Data.Length(), len(data), "data should be compressed")
+	controlType, err := msg.Data.GetNextN8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ControlTypeCompressed, controlType)
+
+	// Decompress and parse the original operation message.
+	decompressed, tErr := decompressOpMsg(msg.Data)
+	if tErr != nil {
+		t.Fatal(tErr)
+	}
+	msgLength, err := decompressed.GetNextN32()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, decompressed.Length(), int(msgLength), "operation message should span all data")
+	opID, msgType, err := ParseIDType(decompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint32(8), opID)
+	assert.Equal(t, MsgTypeData, msgType)
+	assert.Equal(t, data, decompressed.CompileData(), "decompressed data should match")
+
+	// Decompression is limited.
+	_, tErr = decompressOpMsg(container.New(deflate(t, make([]byte, maxDecompressedSize+1))))
+	assert.NotNil(t, tErr, "oversized data should be rejected")
+}
+
+func TestCompressedMsgHandling(t *testing.T) {
+	t.Parallel()
+
+	// Create terminals with compression.
+	a, b, err := NewSimpleTestTerminalPair(0, 0, &TerminalOpts{
+		Version:         2,
+		FlowControl:     FlowControlDFQ,
+		FlowControlSize: defaultTestQueueSize,
+		Compress:        true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create test terminal pair: %s", err)
+	}
+	defer a.Abandon(nil)
+	defer b.Abandon(nil)
+	assert.True(t, b.shouldCompress(), "remote should compress")
+
+	// A compressed data message is handled.
+	dataMsg := container.New(bytes.Repeat([]byte("text-heavy traffic "), 100))
+	MakeMsg(dataMsg, 8, MsgTypeData)
+	tErr := b.handleOpMsgs(compressedControlMsg(t, dataMsg.CompileData()))
+	assert.Nil(t, tErr, "compressed data message should be handled")
+
+	// Compressed control messages are rejected.
+	coverMsg := container.New(varint.Pack8(ControlTypeCover), make([]byte, 1000))
+	MakeMsg(coverMsg, terminalControlOpID, MsgTypeData)
+	tErr = b.handleOpMsgs(compressedControlMsg(t, coverMsg.CompileData()))
+	assert.NotNil(t, tErr, "compressed control message should be rejected")
+
+	// Multiple compressed messages are rejected.
+	tErr = b.handleOpMsgs(compressedControlMsg(t, bytes.Repeat(dataMsg.CompileData(), 2)))
+	assert.NotNil(t, tErr, "multiple compressed messages should be rejected")
+
+	// Compressed padding is rejected.
+	tErr = b.handleOpMsgs(compressedControlMsg(t, append([]byte{0}, make([]byte, 1000)...)))
+	assert.NotNil(t, tErr, "compressed padding should be rejected")
+}
+
+// compressedControlMsg returns a packed compression control message holding
+// the given data.
+func compressedControlMsg(t *testing.T, data []byte) *container.Container {
+	t.Helper()
+
+	c := container.New(varint.Pack8(ControlTypeCompressed), deflate(t, data))
+	MakeMsg(c, terminalControlOpID, MsgTypeData)
+	return c
+}
+
+func deflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -31,6 +31,7 @@ const (
 	FlowControlDefault FlowControlType = 0
 	FlowControlDFQ     FlowControlType = 1
 	FlowControlNone    FlowControlType = 2
+	FlowControlCFQ     FlowControlType = 3
 
 	defaultFlowControl = FlowControlDFQ
 )
@@ -42,7 +43,7 @@ func (fct FlowControlType) DefaultSize() uint32 {
 	}
 
 	switch fct {
-	case FlowControlDFQ:
+	case FlowControlDFQ, FlowControlCFQ:
 		return 50000
 	case FlowControlNone:
 		return 10000
@@ -90,6 +91,13 @@ type DuplexFlowQueue struct {
 	// forceSpaceReport forces the sender to send a space report.
 	forceSpaceReport chan struct{}
 
+	// reportThreshold defines the reported space below which a space report is
+	// forced.
+	reportThreshold int32
+
+	// congestion holds the congestion control state, if enabled.
+	congestion *congestionControl
+
 	// flush is used to send a finish function to the handler, which will write
 	// all pending messages and then call the received function.
 	flush chan func()
@@ -112,6 +120,7 @@ func NewDuplexFlowQueue(
 		recvQueue:        make(chan *Msg, queueSize),
 		reportedSpace:    new(int32),
 		forceSpaceReport: make(chan struct{}, 1),
+		reportThreshold:  int32(float32(queueSize) * forceReportBelowPercent),
 		flush:            make(chan func()),
 	}
 	atomic.StoreInt32(dfq.sendSpace, int32(queueSize))
@@ -127,13 +136,13 @@ func (dfq *DuplexFlowQueue) StartWorkers(m *modules.Module, terminalName string)
 
 // shouldReportRecvSpace returns whether the receive space should be reported.
 func (dfq *DuplexFlowQueue) shouldReportRecvSpace() bool {
-	return atomic.LoadInt32(dfq.reportedSpace) < int32(float32(cap(dfq.recvQueue))*forceReportBelowPercent)
+	return atomic.LoadInt32(dfq.reportedSpace) < dfq.reportThreshold
 }
 
 // decrementReportedRecvSpace decreases the reported recv space by 1 and
 // returns if the receive space should be reported.
 func (dfq *DuplexFlowQueue) decrementReportedRecvSpace() (shouldReportRecvSpace bool) {
-	return atomic.AddInt32(dfq.reportedSpace, -1) < int32(float32(cap(dfq.recvQueue))*forceReportBelowPercent)
+	return atomic.AddInt32(dfq.reportedSpace, -1) < dfq.reportThreshold
 }
 
 // getSendSpace returns the current send space.
@@ -146,7 +155,25 @@ func (dfq *DuplexFlowQueue) decrementSendSpace() int32 {
 	return atomic.AddInt32(dfq.sendSpace, -1)
 }
 
+// canSend returns whether there is send space available and the congestion
+// window, if enabled, permits sending.
+func (dfq *DuplexFlowQueue) canSend() bool {
+	sendSpace := dfq.getSendSpace()
+	if sendSpace <= 0 {
+		return false
+	}
+	if dfq.congestion != nil {
+		return dfq.congestion.permits(int32(cap(dfq.sendQueue)) - sendSpace)
+	}
+	return true
+}
+
 func (dfq *DuplexFlowQueue) addToSendSpace(n int32) {
+	// Update congestion control with the acknowledged messages.
+	if dfq.congestion != nil {
+		dfq.congestion.acknowledged(n)
+	}
+
 	// Add new space to send space and check if it was zero.
 	atomic.AddInt32(dfq.sendSpace, n)
 	// Wake the sender in case it is waiting.
@@ -215,7 +242,7 @@ sending:
 		if sendSpaceDepleted {
 			select {
 			case <-dfq.wakeSender:
-				if dfq.getSendSpace() > 0 {
+				if dfq.canSend() {
 					sendSpaceDepleted = false
 				} else {
 					continue sending
@@ -271,8 +298,11 @@ sending:
 
 			// Submit for sending upstream.
 			dfq.submitUpstream(msg, 0)
+			if dfq.congestion != nil {
+				dfq.congestion.sent()
+			}
 			// Decrease the send space and set flag if depleted.
-			if dfq.decrementSendSpace() <= 0 {
+			if dfq.decrementSendSpace() <= 0 || !dfq.canSend() {
 				sendSpaceDepleted = true
 			}
 
@@ -346,7 +376,7 @@ func init() {
 
 // ReadyToSend returns a channel that can be read when data can be sent.
 func (dfq *DuplexFlowQueue) ReadyToSend() <-chan struct{} {
-	if atomic.LoadInt32(dfq.sendSpace) > 0 {
+	if dfq.canSend() {
 		return ready
 	}
 	return dfq.readyToSend
@@ -434,13 +464,17 @@ func (dfq *DuplexFlowQueue) Deliver(msg *Msg) *Error {
 
 // FlowStats returns a k=v formatted string of internal stats.
 func (dfq *DuplexFlowQueue) FlowStats() string {
-	return fmt.Sprintf(
+	stats := fmt.Sprintf(
 		"sq=%d rq=%d sends=%d reps=%d",
 		len(dfq.sendQueue),
 		len(dfq.recvQueue),
 		atomic.LoadInt32(dfq.sendSpace),
 		atomic.LoadInt32(dfq.reportedSpace),
 	)
+	if dfq.congestion != nil {
+		stats += " " + dfq.congestion.stats()
+	}
+	return stats
 }
 
 // RecvQueueLen returns the current length of the receive queue.
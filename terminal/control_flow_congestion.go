@@ -0,0 +1,223 @@
+package terminal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+
+Congestion-Aware Flow Queue:
+
+The congestion-aware flow queue (CFQ) uses the same wire format as the duplex
+flow queue (DFQ), but additionally limits the messages in flight to a
+congestion window that adapts to the measured round trip time and delivery
+rate. This keeps queues along long multi-hop routes short, while still
+utilizing the available bandwidth.
+
+The round trip time is measured from sending a message until its space is
+reported back by the other side. In order to get timely measurements, the
+receiving side reports space after every few handled messages.
+
+The congestion window is adapted similarly to TCP Vegas: The number of queued
+messages is estimated from the difference between the current and the minimum
+round trip time. The window grows while few messages are queued and is
+drained to the bandwidth-delay product when too many messages are queued.
+
+The CFQ requires terminal version 2 and CapabilityCFQ, as terminals that do
+not know it would reject the terminal options. Local terminals fall back to
+the DFQ otherwise.
+
+*/
+
+const (
+	// CapabilityCFQ is the capability to use the congestion-aware flow queue.
+	CapabilityCFQ Capability = 1 << 4
+
+	// cfqAckInterval defines after how many handled messages the receiving side
+	// reports space.
+	cfqAckInterval = 8
+
+	// cfqMinWindow defines the minimum congestion window. It must be bigger than
+	// the ack interval in order to always receive space reports.
+	cfqMinWindow = 4 * cfqAckInterval
+
+	// cfqInitialWindow defines the initial congestion window.
+	cfqInitialWindow = 2 * cfqMinWindow
+
+	// cfqQueuedLow and cfqQueuedHigh define the range of estimated queued
+	// messages in which the congestion window is kept stable.
+	cfqQueuedLow  = 4
+	cfqQueuedHigh = 16
+
+	// cfqMinRTTWindow defines how long a measured minimum round trip time is
+	// valid. This allows adapting to changed routes.
+	cfqMinRTTWindow = 10 * time.Second
+)
+
+func init() {
+	supportedCapabilities |= CapabilityCFQ
+}
+
+// NewCongestionFlowQueue returns a new duplex flow queue with congestion
+// control.
+func NewCongestionFlowQueue(
+	ctx context.Context,
+	queueSize uint32,
+	submitUpstream func(msg *Msg, timeout time.Duration),
+) *DuplexFlowQueue {
+	dfq := NewDuplexFlowQueue(ctx, queueSize, submitUpstream)
+	dfq.congestion = newCongestionControl(queueSize)
+
+	// Report space more frequently in order to measure the round trip time.
+	if threshold := int32(queueSize) - cfqAckInterval; threshold > dfq.reportThreshold {
+		dfq.reportThreshold = threshold
+	}
+
+	return dfq
+}
+
+// congestionControl holds the congestion control state of a flow queue.
+type congestionControl struct {
+	lock sync.Mutex
+
+	// window is the congestion window in messages.
+	window    float64
+	maxWindow float64
+	slowStart bool
+
+	// sentAt holds the send times of all messages in flight.
+	sentAt []time.Time
+
+	// minRTT is the minimum measured round trip time, which was measured at
+	// minRTTAt. srtt is the smoothed round trip time.
+	minRTT   time.Duration
+	minRTTAt time.Time
+	srtt     time.Duration
+
+	// deliveryRate is the smoothed delivery rate in messages per second, which
+	// is measured over intervals of at least a round trip time.
+	deliveryRate   float64
+	deliveredCnt   int32
+	deliveredSince time.Time
+}
+
+func newCongestionControl(queueSize uint32) *congestionControl {
+	return &congestionControl{
+		window:    cfqInitialWindow,
+		maxWindow: float64(queueSize),
+		slowStart: true,
+		sentAt:    make([]time.Time, 0, cfqInitialWindow),
+	}
+}
+
+// permits returns whether another message may be sent with the given
+// amount of messages in flight.
+func (cc *congestionControl) permits(inFlight int32) bool {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	return float64(inFlight) < cc.window
+}
+
+// sent records that a message was sent.
+func (cc *congestionControl) sent() {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	cc.sentAt = append(cc.sentAt, time.Now())
+}
+
+// acknowledged records that the other side reported space for n messages and
+// adapts the congestion window.
+func (cc *congestionControl) acknowledged(n int32) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	// Get send time of the last acknowledged message.
+	// Messages are acknowledged in order.
+	if n <= 0 || len(cc.sentAt) == 0 {
+		return
+	}
+	if int(n) > len(cc.sentAt) {
+		n = int32(len(cc.sentAt))
+	}
+	sentAt := cc.sentAt[n-1]
+	cc.sentAt = cc.sentAt[n:]
+
+	// Update round trip times.
+	now := time.Now()
+	rtt := now.Sub(sentAt)
+	if cc.minRTT == 0 || rtt < cc.minRTT || now.Sub(cc.minRTTAt) > cfqMinRTTWindow {
+		cc.minRTT = rtt
+		cc.minRTTAt = now
+	}
+	if cc.srtt == 0 {
+		cc.srtt = rtt
+	} else {
+		cc.srtt = (7*cc.srtt + rtt) / 8
+	}
+
+	// Update delivery rate.
+	cc.deliveredCnt += n
+	if cc.deliveredSince.IsZero() {
+		cc.deliveredSince = now
+	} else if elapsed := now.Sub(cc.deliveredSince); elapsed >= cc.srtt && elapsed > 0 {
+		rate := float64(cc.deliveredCnt) / elapsed.Seconds()
+		if cc.deliveryRate == 0 {
+			cc.deliveryRate = rate
+		} else {
+			cc.deliveryRate = (3*cc.deliveryRate + rate) / 4
+		}
+		cc.deliveredCnt = 0
+		cc.deliveredSince = now
+	}
+
+	// Estimate the messages queued along the route.
+	queued := cc.window * (1 - float64(cc.minRTT)/float64(cc.srtt))
+
+	// Adapt congestion window.
+	switch {
+	case cc.slowStart && queued <= cfqQueuedLow:
+		// Grow exponentially until messages start to queue.
+		cc.window += float64(n)
+	case queued < cfqQueuedLow:
+		// Grow by one message per round trip.
+		cc.window += float64(n) / cc.window
+	case queued > cfqQueuedHigh:
+		// Drain the queue by reducing the window to the bandwidth-delay product.
+		cc.slowStart = false
+		bdp := cc.deliveryRate * cc.minRTT.Seconds()
+		if bdp > 0 && bdp+cfqQueuedLow < cc.window {
+			cc.window = bdp + cfqQueuedLow
+		} else {
+			cc.window -= float64(n) / cc.window
+		}
+	default:
+		cc.slowStart = false
+	}
+
+	// Keep window in bounds.
+	switch {
+	case cc.window < cfqMinWindow:
+		cc.window = cfqMinWindow
+	case cc.window > cc.maxWindow:
+		cc.window = cc.maxWindow
+	}
+}
+
+// stats returns a k=v formatted string of the congestion control state.
+func (cc *congestionControl) stats() string {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	return fmt.Sprintf(
+		"cwnd=%.0f minrtt=%s srtt=%s rate=%.0f/s",
+		cc.window,
+		cc.minRTT.Round(time.Millisecond),
+		cc.srtt.Round(time.Millisecond),
+		cc.deliveryRate,
+	)
+}
@@ -0,0 +1,61 @@
+package terminal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCongestionControl(t *testing.T) {
+	t.Parallel()
+
+	cc := newCongestionControl(DefaultQueueSize)
+	assert.True(t, cc.permits(0), "should permit sending")
+	assert.False(t, cc.permits(cfqInitialWindow), "should not permit more than the initial window")
+
+	// Simulate a constant round trip time: The window grows.
+	simulateRoundTrip := func(rtt time.Duration) {
+		for i := 0; i < cfqAckInterval; i++ {
+			cc.sent()
+			cc.sentAt[len(cc.sentAt)-1] = time.Now().Add(-rtt)
+		}
+		cc.acknowledged(cfqAckInterval)
+	}
+	for i := 0; i < 20; i++ {
+		simulateRoundTrip(10 * time.Millisecond)
+	}
+	grownWindow := cc.window
+	assert.Greater(t, grownWindow, float64(cfqInitialWindow), "window should grow without queuing")
+
+	// Simulate a growing round trip time: The window is drained.
+	for i := 0; i < 20; i++ {
+		simulateRoundTrip(100 * time.Millisecond)
+	}
+	assert.Less(t, cc.window, grownWindow, "window should shrink with queuing")
+	assert.GreaterOrEqual(t, cc.window, float64(cfqMinWindow), "window should not shrink below minimum")
+	assert.False(t, cc.slowStart, "slow start should end with queuing")
+}
+
+func TestCongestionFlowQueueOpts(t *testing.T) {
+	t.Parallel()
+
+	// Local terminals fall back to the DFQ without terminal version 2.
+	opts := &TerminalOpts{FlowControl: FlowControlCFQ}
+	assert.Nil(t, opts.Check(true), "options should be valid")
+	assert.Equal(t, FlowControlDFQ, opts.FlowControl, "should fall back to DFQ")
+
+	// Local terminals keep the CFQ with terminal version 2.
+	opts = &TerminalOpts{Version: 2, FlowControl: FlowControlCFQ}
+	assert.Nil(t, opts.Check(true), "options should be valid")
+	assert.Equal(t, FlowControlCFQ, opts.FlowControl, "should keep CFQ")
+
+	// Remote terminals reject the CFQ without the capability.
+	opts = &TerminalOpts{
+		Version:         2,
+		Capabilities:    CapabilityCompression,
+		FlowControl:     FlowControlCFQ,
+		FlowControlSize: DefaultQueueSize,
+	}
+	assert.NotNil(t, opts.Check(false), "options without CapabilityCFQ should be rejected")
+}
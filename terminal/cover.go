@@ -0,0 +1,161 @@
+package terminal
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/formats/varint"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portbase/rng"
+)
+
+/*
+
+Terminal Cover Traffic:
+
+Terminals with version 2 that agreed on CapabilityCoverTraffic may send cover
+traffic in order to hide the actual traffic pattern from observers. Cover
+traffic is sent as a terminal control message, which is dropped by the other
+side:
+
+- ControlTypeCover:
+	- Random Data [bytes]
+
+Cover traffic fills up the actual traffic to the configured rate. With a burst
+size set, cover traffic is sent in bursts of about the burst size at random
+intervals instead of at a constant rate.
+
+Both sides send cover traffic as requested by the cover traffic terminal
+options.
+
+*/
+
+const (
+	// CapabilityCoverTraffic is the capability to receive cover traffic.
+	CapabilityCoverTraffic Capability = 1 << 1
+
+	// ControlTypeCover is used to send cover traffic.
+	ControlTypeCover uint8 = 3
+
+	// DefaultCoverTrafficRate is the default rate of cover traffic in bytes per
+	// second.
+	DefaultCoverTrafficRate = 8192
+
+	// maxCoverTrafficRate is the maximum rate of cover traffic in bytes per
+	// second the other side may request.
+	maxCoverTrafficRate = 131072
+
+	// maxCoverTrafficBurst is the maximum burst size in bytes the other side may
+	// request.
+	maxCoverTrafficBurst = 65536
+
+	// coverTrafficInterval defines the interval in which cover traffic is
+	// generated.
+	coverTrafficInterval = 100 * time.Millisecond
+
+	// maxCoverMsgSize defines the maximum data size of a single cover message.
+	maxCoverMsgSize = 1000
+)
+
+func init() {
+	supportedCapabilities |= CapabilityCoverTraffic
+}
+
+// startCoverTraffic starts sending cover traffic, if requested and agreed on.
+func (t *TerminalBase) startCoverTraffic() {
+	if t.opts.CoverTrafficRate == 0 || !t.HasCapability(CapabilityCoverTraffic) {
+		return
+	}
+
+	module.StartWorker("terminal cover traffic", t.coverTrafficWorker)
+}
+
+func (t *TerminalBase) coverTrafficWorker(_ context.Context) error {
+	ticker := time.NewTicker(coverTrafficInterval)
+	defer ticker.Stop()
+
+	// Reset sent bytes counter to ignore traffic before cover traffic started.
+	t.sentBytes.Store(0)
+
+	// Calculate amount of bytes per interval and the threshold for sending.
+	perInterval := int(t.opts.CoverTrafficRate) * int(coverTrafficInterval) / int(time.Second)
+	nextThreshold := func() int {
+		if t.opts.CoverTrafficBurst == 0 {
+			return 1
+		}
+		// Randomize burst size between half and one and a half the burst size.
+		burst := int(t.opts.CoverTrafficBurst)
+		return burst/2 + rand.Intn(burst+1) //nolint:gosec // Does not need to be cryptographically secure.
+	}
+
+	var budget int
+	threshold := nextThreshold()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.ctx.Done():
+			return nil
+		}
+
+		// Add interval budget and subtract the operative data sent since the
+		// last tick. Cover traffic is not counted there, but subtracted when sent.
+		budget += perInterval - int(t.sentBytes.Swap(0))
+		if budget < 0 {
+			budget = 0
+		}
+		if budget < threshold {
+			continue
+		}
+
+		// Send cover traffic for the available budget.
+	sending:
+		for budget > 0 {
+			size := budget
+			if size > maxCoverMsgSize {
+				size = maxCoverMsgSize
+			}
+			tErr := t.sendCoverMsg(size)
+			switch {
+			case tErr == nil:
+				budget -= size
+			case tErr.Is(ErrTimeout):
+				// The terminal is busy, so real traffic is flowing.
+				break sending
+			case tErr.Is(ErrStopping):
+				return nil
+			default:
+				log.Warningf("spn/terminal: %s failed to send cover traffic: %s", t.FmtID(), tErr)
+				return nil
+			}
+		}
+		threshold = nextThreshold()
+	}
+}
+
+// sendCoverMsg sends a cover message with the given data size.
+func (t *TerminalBase) sendCoverMsg(size int) *Error {
+	// Use random data, so that cover traffic cannot be compressed.
+	data, err := rng.Bytes(size)
+	if err != nil {
+		data = make([]byte, size)
+	}
+
+	msg := NewEmptyMsg()
+	msg.FlowID = terminalControlOpID
+	msg.Type = MsgTypeData
+	msg.Data = container.New(varint.Pack8(ControlTypeCover), data)
+	msg.weightClass = WeightClassBackground
+
+	return t.Send(msg, coverTrafficInterval)
+}
+
+// handleCoverMsg handles a control message with cover traffic.
+func (t *TerminalBase) handleCoverMsg() *Error {
+	if !t.acceptsCapability(CapabilityCoverTraffic) {
+		return ErrIncorrectUsage.With("received cover traffic without agreed cover traffic")
+	}
+	// Drop cover traffic.
+	return nil
+}
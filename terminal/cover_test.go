@@ -0,0 +1,63 @@
+package terminal
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/safing/portbase/container"
+)
+
+func TestCoverTraffic(t *testing.T) {
+	t.Parallel()
+
+	// Create terminals that count the forwarded bytes.
+	// The upstream of a waits until b is created.
+	var a, b *TestTerminal
+	var aSent, bSent atomic.Int64
+	bCreated := make(chan struct{})
+	opts := &TerminalOpts{
+		Version:          2,
+		FlowControl:      FlowControlDFQ,
+		FlowControlSize:  defaultTestQueueSize,
+		CoverTrafficRate: 10000,
+	}
+	var initData *container.Container
+	var tErr *Error
+	a, initData, tErr = NewLocalTestTerminal(
+		module.Ctx, 127, "a", nil, opts, UpstreamSendFunc(func(msg *Msg, _ time.Duration) *Error {
+			aSent.Add(int64(msg.Data.Length()))
+			<-bCreated
+			return b.Deliver(msg)
+		}),
+	)
+	if tErr != nil {
+		t.Fatalf("failed to create local terminal: %s", tErr)
+	}
+	b, _, tErr = NewRemoteTestTerminal(
+		module.Ctx, 127, "b", nil, initData, UpstreamSendFunc(func(msg *Msg, _ time.Duration) *Error {
+			bSent.Add(int64(msg.Data.Length()))
+			return a.Deliver(msg)
+		}),
+	)
+	if tErr != nil {
+		t.Fatalf("failed to create remote terminal: %s", tErr)
+	}
+	close(bCreated)
+	defer a.Abandon(nil)
+	defer b.Abandon(nil)
+
+	// Both sides send cover traffic at about the configured rate.
+	time.Sleep(time.Second)
+	assert.Greater(t, aSent.Load(), int64(7500), "local should send cover traffic at the configured rate")
+	assert.Less(t, aSent.Load(), int64(15000), "local should not exceed cover traffic rate")
+	assert.Greater(t, bSent.Load(), int64(7500), "remote should send cover traffic at the configured rate")
+	assert.Less(t, bSent.Load(), int64(15000), "remote should not exceed cover traffic rate")
+	assert.True(t, a.Abandoning.IsNotSet(), "local should not fail")
+	assert.True(t, b.Abandoning.IsNotSet(), "remote should not fail")
+
+	// Cover traffic rate is limited.
+	assert.NotNil(t, (&TerminalOpts{CoverTrafficRate: maxCoverTrafficRate + 1}).Check(true), "cover traffic rate should be limited")
+}
@@ -1,5 +1,7 @@
 package terminal
 
+import "time"
+
 const (
 	// UsePriorityDataMsgs defines whether priority data messages should be used.
 	UsePriorityDataMsgs = true
@@ -12,6 +14,8 @@ func DefaultCraneControllerOpts() *TerminalOpts {
 		Padding:             0, // Crane already applies padding.
 		FlowControl:         FlowControlNone,
 		UsePriorityDataMsgs: UsePriorityDataMsgs,
+		RekeyInterval:       time.Duration(rekeyPolicyInterval.Load()),
+		RekeyBytes:          rekeyPolicyBytes.Load(),
 	}
 }
 
@@ -32,5 +36,9 @@ func DefaultExpansionTerminalOpts() *TerminalOpts {
 		Padding:             8,
 		FlowControl:         FlowControlDFQ,
 		UsePriorityDataMsgs: UsePriorityDataMsgs,
+		Compress:            compressionEnabled.IsSet(),
+		KeepaliveInterval:   uint16(keepaliveInterval.Load()),
+		RekeyInterval:       time.Duration(rekeyPolicyInterval.Load()),
+		RekeyBytes:          rekeyPolicyBytes.Load(),
 	}
 }
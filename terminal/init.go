@@ -2,6 +2,7 @@ package terminal
 
 import (
 	"context"
+	"time"
 
 	"github.com/safing/jess"
 	"github.com/safing/portbase/container"
@@ -19,11 +20,13 @@ Terminal Init Message Format:
 - Data Block [bytes; not blocked]
 	- TerminalOpts as DSD
 
+Version 2 adds capability negotiation. See capabilities.go.
+
 */
 
 const (
 	minSupportedTerminalVersion = 1
-	maxSupportedTerminalVersion = 1
+	maxSupportedTerminalVersion = 2
 )
 
 // TerminalOpts holds configuration for the terminal.
@@ -36,6 +39,35 @@ type TerminalOpts struct { //nolint:golint,maligned // TODO: Rename.
 	FlowControlSize uint32          `json:"qs,omitempty"` // Previously was "QueueSize".
 
 	UsePriorityDataMsgs bool `json:"pr,omitempty"`
+
+	// Capabilities holds the capabilities supported by the local terminal.
+	// Only available with version 2.
+	Capabilities Capability `json:"c,omitempty"`
+
+	// Compress requests both sides to compress the data they send.
+	// Only effective with version 2 and agreed CapabilityCompression.
+	Compress bool `json:"z,omitempty"`
+
+	// CoverTrafficRate requests both sides to send cover traffic to fill up
+	// the actual traffic to this rate in bytes per second.
+	// CoverTrafficBurst optionally sets the size in bytes of the bursts in
+	// which cover traffic is sent.
+	// Only effective with version 2 and agreed CapabilityCoverTraffic.
+	CoverTrafficRate  uint32 `json:"cr,omitempty"`
+	CoverTrafficBurst uint32 `json:"cb,omitempty"`
+
+	// KeepaliveInterval requests both sides to probe the other side for
+	// liveness after the given amount of seconds without receiving anything.
+	// Only effective with version 2 and agreed CapabilityKeepalive.
+	KeepaliveInterval uint16 `json:"ka,omitempty"`
+
+	// RekeyInterval and RekeyBytes define after which duration and after how
+	// many encrypted and decrypted bytes the local terminal switches to new
+	// encryption sessions. They are not sent to the remote terminal.
+	// Only effective with encryption, version 2 and agreed CapabilityRekey.
+	// Crane controllers apply them to the encryption session of the crane.
+	RekeyInterval time.Duration `json:"-"`
+	RekeyBytes    uint64        `json:"-"`
 }
 
 // ParseTerminalOpts parses terminal options from the container and checks if
@@ -98,6 +130,38 @@ func (opts *TerminalOpts) Check(useDefaultsForRequired bool) *Error {
 		return ErrInvalidOptions.With("unsupported terminal version %d", opts.Version)
 	}
 
+	// Capabilities are only available with version 2.
+	// Advertise all supported capabilities when permitted.
+	switch {
+	case opts.Version < 2 && opts.Capabilities != 0:
+		return ErrInvalidOptions.With("capabilities require terminal version 2")
+	case opts.Version >= 2 && opts.Capabilities == 0 && useDefaultsForRequired:
+		opts.Capabilities = supportedCapabilities
+	}
+
+	// Cover traffic is limited, as it must be sent by the other side too.
+	if opts.CoverTrafficRate > maxCoverTrafficRate {
+		return ErrInvalidOptions.With("cover traffic rate of %d exceeds maximum of %d", opts.CoverTrafficRate, maxCoverTrafficRate)
+	}
+	if opts.CoverTrafficBurst > maxCoverTrafficBurst {
+		return ErrInvalidOptions.With("cover traffic burst of %d exceeds maximum of %d", opts.CoverTrafficBurst, maxCoverTrafficBurst)
+	}
+
+	// Keepalives must not be too frequent, as they must be sent by the other
+	// side too.
+	if opts.KeepaliveInterval != 0 &&
+		(opts.KeepaliveInterval < minKeepaliveInterval || opts.KeepaliveInterval > maxKeepaliveInterval) {
+		return ErrInvalidOptions.With("keepalive interval of %ds is out of range", opts.KeepaliveInterval)
+	}
+
+	// Re-keying requires a full key exchange and must not be too frequent.
+	if opts.RekeyInterval != 0 && opts.RekeyInterval < minRekeyInterval {
+		return ErrInvalidOptions.With("rekey interval of %s is below minimum of %s", opts.RekeyInterval, minRekeyInterval)
+	}
+	if opts.RekeyBytes != 0 && opts.RekeyBytes < minRekeyBytes {
+		return ErrInvalidOptions.With("rekey bytes of %d is below minimum of %d", opts.RekeyBytes, minRekeyBytes)
+	}
+
 	// FlowControl is optional.
 	switch opts.FlowControl {
 	case FlowControlDefault:
@@ -105,6 +169,17 @@ func (opts *TerminalOpts) Check(useDefaultsForRequired bool) *Error {
 		opts.FlowControl = defaultFlowControl
 	case FlowControlNone, FlowControlDFQ:
 		// Ok.
+	case FlowControlCFQ:
+		// The CFQ must be supported by both sides.
+		// Fall back to the DFQ when permitted.
+		switch {
+		case opts.Version >= 2 && (opts.Capabilities & supportedCapabilities).Has(CapabilityCFQ):
+			// Ok.
+		case useDefaultsForRequired:
+			opts.FlowControl = FlowControlDFQ
+		default:
+			return ErrInvalidOptions.With("congestion flow queue requires terminal version 2 and CapabilityCFQ")
+		}
 	default:
 		return ErrInvalidOptions.With("unknown flow control type: %d", opts.FlowControl)
 	}
@@ -150,21 +225,14 @@ func NewLocalBaseTerminal(
 	if remoteHub != nil {
 		initMsg.Encrypt = true
 
-		// Select signet (public key) of remote Hub to use.
-		s := remoteHub.SelectSignet()
-		if s == nil {
-			return nil, nil, ErrHubNotReady.With("failed to select signet of remote hub")
-		}
-
 		// Create new session.
-		env := jess.NewUnconfiguredEnvelope()
-		env.SuiteID = jess.SuiteWireV1
-		env.Recipients = []*jess.Signet{s}
-		jession, err := env.WireCorrespondence(nil)
+		jession, err := newSession(remoteHub)
 		if err != nil {
-			return nil, nil, ErrIntegrity.With("failed to initialize encryption: %w", err)
+			return nil, nil, err
 		}
 		t.jession = jession
+		t.recvJession = jession
+		t.remoteHub = remoteHub
 
 		// Encryption is ready for sending.
 		close(t.encryptionReady)
@@ -173,6 +241,27 @@ func NewLocalBaseTerminal(
 	return t, initData, nil
 }
 
+// newSession creates a new encryption session to the given Hub, using the
+// exchange key currently selected from the Hub's status.
+func newSession(remoteHub *hub.Hub) (*jess.Session, *Error) {
+	// Select signet (public key) of remote Hub to use.
+	s := remoteHub.SelectSignet()
+	if s == nil {
+		return nil, ErrHubNotReady.With("failed to select signet of remote hub")
+	}
+
+	// Create new session.
+	env := jess.NewUnconfiguredEnvelope()
+	env.SuiteID = jess.SuiteWireV1
+	env.Recipients = []*jess.Signet{s}
+	jession, err := env.WireCorrespondence(nil)
+	if err != nil {
+		return nil, ErrIntegrity.With("failed to initialize encryption: %w", err)
+	}
+
+	return jession, nil
+}
+
 // NewRemoteBaseTerminal creates a new remote terminal base for use with inheriting terminals.
 func NewRemoteBaseTerminal(
 	ctx context.Context,
@@ -198,6 +287,9 @@ func NewRemoteBaseTerminal(
 		return nil, nil, err
 	}
 
+	// Agree on capabilities with the local terminal.
+	t.agreeOnCapabilities()
+
 	// Setup encryption if enabled.
 	if initMsg.Encrypt {
 		if identity == nil {
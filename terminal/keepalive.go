@@ -0,0 +1,173 @@
+package terminal
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/portbase/log"
+)
+
+/*
+
+Terminal Keepalive:
+
+Terminals with version 2 that agreed on CapabilityKeepalive probe the other
+side for liveness, as requested by the KeepaliveInterval terminal option.
+Keepalives are sent as terminal control messages:
+
+- ControlTypeKeepalive: requests a keepalive reply
+- ControlTypeKeepaliveReply: replies to a keepalive request
+
+Both sides check every interval whether they received anything from the other
+side. If not, they send a keepalive request. If the other side does not
+respond within keepaliveMaxMissed intervals, the peer is considered dead: The
+dead peer callback is called and the terminal is abandoned.
+
+Keepalives are only sent while the terminal has active operations, so that
+unused terminals still time out when idle.
+
+*/
+
+const (
+	// CapabilityKeepalive is the capability to reply to keepalive requests.
+	CapabilityKeepalive Capability = 1 << 2
+
+	// ControlTypeKeepalive is used to request a keepalive reply.
+	ControlTypeKeepalive uint8 = 4
+
+	// ControlTypeKeepaliveReply is used to reply to a keepalive request.
+	ControlTypeKeepaliveReply uint8 = 5
+
+	// minKeepaliveInterval and maxKeepaliveInterval define the range of
+	// permitted keepalive intervals in seconds.
+	minKeepaliveInterval = 5
+	maxKeepaliveInterval = 3600
+
+	// keepaliveMaxMissed defines after how many unanswered keepalive intervals
+	// the peer is considered dead.
+	keepaliveMaxMissed = 3
+)
+
+// keepaliveIntervalUnit is the unit of the keepalive interval option.
+// It is only changed for testing.
+var keepaliveIntervalUnit = time.Second
+
+func init() {
+	supportedCapabilities |= CapabilityKeepalive
+}
+
+// keepaliveInterval holds the keepalive interval in seconds requested by
+// expansion terminals.
+var keepaliveInterval atomic.Uint32
+
+// SetKeepaliveInterval sets the keepalive interval requested by expansion
+// terminals. Zero disables keepalives. The interval is capped to the
+// permitted range.
+func SetKeepaliveInterval(interval time.Duration) {
+	seconds := uint32(interval / time.Second)
+	switch {
+	case seconds == 0:
+	case seconds < minKeepaliveInterval:
+		seconds = minKeepaliveInterval
+	case seconds > maxKeepaliveInterval:
+		seconds = maxKeepaliveInterval
+	}
+	keepaliveInterval.Store(seconds)
+}
+
+// OnDeadPeer sets a function that is called when the other side stopped
+// responding to keepalives, before the terminal is abandoned.
+func (t *TerminalBase) OnDeadPeer(callback func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.deadPeerCallback = callback
+}
+
+// startKeepalive starts sending keepalives, if requested and agreed on.
+func (t *TerminalBase) startKeepalive() {
+	if t.opts.KeepaliveInterval == 0 || !t.HasCapability(CapabilityKeepalive) {
+		return
+	}
+
+	module.StartWorker("terminal keepalive", t.keepaliveWorker)
+}
+
+func (t *TerminalBase) keepaliveWorker(_ context.Context) error {
+	interval := time.Duration(t.opts.KeepaliveInterval) * keepaliveIntervalUnit
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastCheck := time.Now()
+	var missed int
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.ctx.Done():
+			return nil
+		}
+
+		// Check if anything was received since the last check.
+		received := t.lastReceived.Load() >= lastCheck.UnixNano()
+		lastCheck = time.Now()
+		switch {
+		case received:
+			missed = 0
+			continue
+		case t.GetActiveOpCount() == 0:
+			// Do not keep unused terminals alive.
+			missed = 0
+			continue
+		case missed >= keepaliveMaxMissed:
+			t.handleDeadPeer(time.Duration(missed) * interval)
+			return nil
+		}
+
+		// Send keepalive request.
+		missed++
+		tErr := t.sendControlMsg(ControlTypeKeepalive, nil, interval)
+		switch {
+		case tErr == nil:
+		case tErr.Is(ErrTimeout):
+			// The terminal is stuck, which is handled by missing the reply.
+		case tErr.Is(ErrStopping):
+			return nil
+		default:
+			log.Warningf("spn/terminal: %s failed to send keepalive: %s", t.FmtID(), tErr)
+			return nil
+		}
+	}
+}
+
+// handleDeadPeer calls the dead peer callback and abandons the terminal.
+func (t *TerminalBase) handleDeadPeer(silence time.Duration) {
+	t.lock.RLock()
+	callback := t.deadPeerCallback
+	t.lock.RUnlock()
+
+	if callback != nil {
+		callback()
+	}
+	t.Abandon(ErrTimeout.With("peer did not respond to keepalives for %s", silence))
+}
+
+// handleKeepaliveMsg handles a keepalive control message.
+func (t *TerminalBase) handleKeepaliveMsg(controlType uint8) *Error {
+	if !t.acceptsCapability(CapabilityKeepalive) {
+		return ErrIncorrectUsage.With("received keepalive without agreed keepalive")
+	}
+
+	// Reply to keepalive requests in a worker, as the handler must not block.
+	if controlType == ControlTypeKeepalive {
+		module.StartWorker("reply to terminal keepalive", func(_ context.Context) error {
+			tErr := t.sendControlMsg(ControlTypeKeepaliveReply, nil, minKeepaliveInterval*keepaliveIntervalUnit)
+			if tErr != nil && !tErr.IsOK() && !tErr.Is(ErrTimeout) {
+				log.Warningf("spn/terminal: %s failed to reply to keepalive: %s", t.FmtID(), tErr)
+			}
+			return nil
+		})
+	}
+
+	return nil
+}
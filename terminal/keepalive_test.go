@@ -0,0 +1,80 @@
+package terminal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/container"
+)
+
+func TestKeepalive(t *testing.T) { //nolint:paralleltest // Test changes keepaliveIntervalUnit.
+	keepaliveIntervalUnit = 10 * time.Millisecond
+	defer func() {
+		keepaliveIntervalUnit = time.Second
+	}()
+
+	// Create terminals with a link that can be broken.
+	var a, b *TestTerminal
+	broken := abool.New()
+	opts := &TerminalOpts{
+		Version:           2,
+		FlowControl:       FlowControlDFQ,
+		FlowControlSize:   defaultTestQueueSize,
+		KeepaliveInterval: minKeepaliveInterval,
+	}
+	var initData *container.Container
+	var tErr *Error
+	a, initData, tErr = NewLocalTestTerminal(
+		module.Ctx, 127, "a", nil, opts, UpstreamSendFunc(func(msg *Msg, _ time.Duration) *Error {
+			if broken.IsSet() {
+				msg.Finish()
+				return nil
+			}
+			return b.Deliver(msg)
+		}),
+	)
+	require.Nil(t, tErr)
+	b, _, tErr = NewRemoteTestTerminal(
+		module.Ctx, 127, "b", nil, initData, UpstreamSendFunc(func(msg *Msg, _ time.Duration) *Error {
+			if broken.IsSet() {
+				msg.Finish()
+				return nil
+			}
+			return a.Deliver(msg)
+		}),
+	)
+	require.Nil(t, tErr)
+	defer a.Abandon(nil)
+	defer b.Abandon(nil)
+
+	// Trace keepalives and add an active operation to keep the terminal in use.
+	tracer := NewTracer(1000)
+	a.SetTracer(tracer)
+	a.SetActiveOp(8, newUnknownOp(8, ""))
+	deadPeer := abool.New()
+	a.OnDeadPeer(deadPeer.Set)
+
+	// An idle, but working link is kept alive with keepalives.
+	time.Sleep(500 * time.Millisecond)
+	assert.True(t, a.Abandoning.IsNotSet(), "terminal with working link should not be abandoned")
+	var keepalives int
+	for _, r := range tracer.Records() {
+		if r.OpID == terminalControlOpID && r.Direction == TraceOut {
+			keepalives++
+		}
+	}
+	assert.Greater(t, keepalives, 2, "should send keepalives")
+
+	// A broken link is detected.
+	broken.Set()
+	time.Sleep(500 * time.Millisecond)
+	assert.True(t, deadPeer.IsSet(), "dead peer callback should be called")
+	assert.True(t, a.Abandoning.IsSet(), "terminal with dead peer should be abandoned")
+
+	// Keepalive intervals are limited.
+	assert.NotNil(t, (&TerminalOpts{KeepaliveInterval: 1}).Check(true), "keepalive interval should be limited")
+}
@@ -15,6 +15,15 @@ type Msg struct {
 	Type   MsgType
 	Data   *container.Container
 
+	// weightClass is the weight class of the sending operation.
+	weightClass WeightClass
+	// switchSession signifies that the sender switches to the prepared
+	// encryption session after sending this message.
+	switchSession bool
+	// compress signifies that the sending operation permits compressing the
+	// data of this message.
+	compress bool
+
 	// Unit scheduling.
 	// Note: With just 100B per packet, a uint64 (the Unit ID) is enough for
 	// over 1800 Exabyte. No need for overflow support.
@@ -61,7 +70,7 @@ func (msg *Msg) Pack() {
 // Consume adds another Message to itself.
 // The given Msg is packed before adding it to the data.
 // The data is moved - not copied!
-// High priority mark is inherited.
+// High priority and session switch marks are inherited.
 func (msg *Msg) Consume(other *Msg) {
 	// Pack message to be added.
 	other.Pack()
@@ -74,6 +83,11 @@ func (msg *Msg) Consume(other *Msg) {
 		msg.Unit.MakeHighPriority()
 	}
 
+	// Inherit session switch.
+	if other.switchSession {
+		msg.switchSession = true
+	}
+
 	// Finish other unit.
 	other.Finish()
 }
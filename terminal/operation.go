@@ -207,24 +207,8 @@ func (t *TerminalBase) Send(msg *Msg, timeout time.Duration) *Error {
 	// Wait for processing slot.
 	msg.Unit.WaitForSlot()
 
-	// Check if the send queue has available space.
-	select {
-	case t.sendQueue <- msg:
-		return nil
-	default:
-	}
-
-	// Submit message to buffer, if space is available.
-	select {
-	case t.sendQueue <- msg:
-		return nil
-	case <-TimedOut(timeout):
-		msg.Finish()
-		return ErrTimeout.With("sending via terminal")
-	case <-t.Ctx().Done():
-		msg.Finish()
-		return ErrStopping
-	}
+	// Submit message to the sender.
+	return t.sendQueue.send(msg, timeout, t.Ctx().Done())
 }
 
 // StopOperation sends the end signal with an optional error and then deletes
@@ -8,9 +8,11 @@ import (
 
 // OperationBase provides the basic operation functionality.
 type OperationBase struct {
-	terminal Terminal
-	id       uint32
-	stopped  abool.AtomicBool
+	terminal    Terminal
+	id          uint32
+	stopped     abool.AtomicBool
+	weightClass WeightClass
+	compress    bool
 }
 
 // InitOperationBase initialize the operation with the ID and attached terminal.
@@ -26,6 +28,32 @@ func (op *OperationBase) ID() uint32 {
 	return op.id
 }
 
+// WeightClass returns the weight class of the operation.
+// Should not be overridden by implementations.
+func (op *OperationBase) WeightClass() WeightClass {
+	return op.weightClass
+}
+
+// SetWeightClass sets the weight class of the operation, which defines its
+// share of the terminal's sending capacity. Unknown weight classes are ignored.
+// Must be called before the operation sends messages.
+// Should not be overridden by implementations.
+func (op *OperationBase) SetWeightClass(wc WeightClass) {
+	if wc.IsValid() {
+		op.weightClass = wc
+	}
+}
+
+// SetCompression sets whether the data messages of the operation may be
+// compressed, if the terminal compresses data. Each message is compressed on
+// its own, so only enable this for operations whose messages do not mix
+// secrets with data controlled by others.
+// Must be called before the operation sends messages.
+// Should not be overridden by implementations.
+func (op *OperationBase) SetCompression(enabled bool) {
+	op.compress = enabled
+}
+
 // Type returns the operation's type ID.
 // Should be overridden by implementations to return correct type ID.
 func (op *OperationBase) Type() string {
@@ -69,6 +97,8 @@ func (op *OperationBase) NewEmptyMsg() *Msg {
 func (op *OperationBase) Send(msg *Msg, timeout time.Duration) *Error {
 	// Add and update metadata.
 	msg.FlowID = op.id
+	msg.weightClass = op.weightClass
+	msg.compress = op.compress
 	if msg.Type == MsgTypeData && msg.Unit.IsHighPriority() && UsePriorityDataMsgs {
 		msg.Type = MsgTypePriorityData
 	}
@@ -0,0 +1,286 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/formats/dsd"
+)
+
+/*
+
+RPC Operations:
+
+An RPC operation sends a single request and receives a stream of responses.
+Requests and responses are serialized with DSD (CBOR), where an empty request
+is the zero value of the request type. The remote side stops the operation
+when the handler has returned, which ends the response stream on the local
+side.
+
+New operations define an RPC type and register it during init:
+
+	var echoRPC = &terminal.RPC[EchoRequest, EchoResponse]{
+		Type:    "echo",
+		Timeout: 10 * time.Second,
+		Handler: handleEcho,
+	}
+
+	func init() {
+		echoRPC.Register()
+	}
+
+The operation is then called with echoRPC.Call() for a single response or
+with echoRPC.Stream() for a response stream. Call finishes on the first
+response and does not wait for the remote side to stop the operation.
+
+*/
+
+const (
+	// defaultRPCTimeout is the default timeout for RPC operations.
+	defaultRPCTimeout = 30 * time.Second
+
+	// defaultRPCResponseQueueSize is the default size of the response queue.
+	defaultRPCResponseQueueSize = 100
+)
+
+// RPCHandler handles a request of an RPC operation on the remote side.
+// Responses are sent with the given send function. The operation is stopped
+// with the returned error when the handler returns. The given context is
+// canceled when the operation is stopped by the other side.
+type RPCHandler[Req, Resp any] func(ctx context.Context, t Terminal, request *Req, send func(response *Resp) *Error) *Error
+
+// RPC defines a typed request/response operation.
+type RPC[Req, Resp any] struct {
+	// Type is the type ID of the operation.
+	Type string
+	// Requires defines the required permissions to run the operation.
+	Requires Permission
+	// Timeout defines the maximum duration of the whole operation.
+	// Defaults to 30 seconds.
+	Timeout time.Duration
+	// WeightClass defines the weight class of the operation on both sides.
+	WeightClass WeightClass
+	// ResponseQueueSize defines how many responses may be queued on the local
+	// side before the operation fails. Defaults to 100.
+	ResponseQueueSize int
+	// Handler handles requests on the remote side.
+	Handler RPCHandler[Req, Resp]
+}
+
+// Register registers the RPC operation type and may only be called during
+// Go's init and a module's prep phase.
+func (rpc *RPC[Req, Resp]) Register() {
+	RegisterOpType(OperationFactory{
+		Type:     rpc.Type,
+		Requires: rpc.Requires,
+		Start:    rpc.start,
+	})
+}
+
+func (rpc *RPC[Req, Resp]) timeout() time.Duration {
+	if rpc.Timeout > 0 {
+		return rpc.Timeout
+	}
+	return defaultRPCTimeout
+}
+
+// Call sends the request and returns the first response. The operation is
+// stopped when the first response is received, so that remote sides that do
+// not stop the operation after responding are supported.
+func (rpc *RPC[Req, Resp]) Call(ctx context.Context, t Terminal, request *Req) (*Resp, *Error) {
+	var response *Resp
+	tErr := rpc.Stream(ctx, t, request, func(r *Resp) *Error {
+		response = r
+		return ErrExplicitAck
+	})
+	switch {
+	case tErr.IsError():
+		return nil, tErr
+	case response == nil:
+		return nil, ErrIncorrectUsage.With("%s operation ended without response", rpc.Type)
+	default:
+		return response, nil
+	}
+}
+
+// Stream sends the request and calls the given function for every response
+// until the operation ends. If the function returns an error, the operation
+// is stopped with it.
+func (rpc *RPC[Req, Resp]) Stream(ctx context.Context, t Terminal, request *Req, handle func(response *Resp) *Error) *Error {
+	// Create operation.
+	queueSize := rpc.ResponseQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultRPCResponseQueueSize
+	}
+	op := &rpcOp[Req, Resp]{
+		rpc:       rpc,
+		responses: make(chan *Resp, queueSize),
+		ended:     make(chan *Error, 1),
+	}
+	op.SetWeightClass(rpc.WeightClass)
+
+	// Pack request.
+	var initData *container.Container
+	if request != nil {
+		data, err := dsd.Dump(request, dsd.CBOR)
+		if err != nil {
+			return ErrInternalError.With("failed to pack %s request: %w", rpc.Type, err)
+		}
+		initData = container.New(data)
+	}
+
+	// Start operation.
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout())
+	defer cancel()
+	if tErr := t.StartOperation(op, initData, rpc.timeout()); tErr != nil {
+		return tErr
+	}
+
+	// Handle responses until the operation ends.
+	for {
+		select {
+		case response := <-op.responses:
+			if tErr := handle(response); tErr != nil {
+				op.Stop(op, tErr)
+				return tErr
+			}
+
+		case tErr := <-op.ended:
+			// Handle remaining responses, as they were delivered before the end.
+			for len(op.responses) > 0 {
+				if handleErr := handle(<-op.responses); handleErr != nil {
+					return handleErr
+				}
+			}
+			if tErr.IsOK() {
+				return nil
+			}
+			return tErr
+
+		case <-ctx.Done():
+			tErr := ErrCanceled
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				tErr = ErrTimeout.With("%s operation", rpc.Type)
+			}
+			op.Stop(op, tErr)
+			return tErr
+		}
+	}
+}
+
+// rpcOp is the local side of an RPC operation.
+type rpcOp[Req, Resp any] struct {
+	OperationBase
+
+	rpc       *RPC[Req, Resp]
+	responses chan *Resp
+	ended     chan *Error
+}
+
+// Type returns the type ID.
+func (op *rpcOp[Req, Resp]) Type() string {
+	return op.rpc.Type
+}
+
+// Deliver delivers a message to the operation.
+func (op *rpcOp[Req, Resp]) Deliver(msg *Msg) *Error {
+	defer msg.Finish()
+
+	// Parse response.
+	response := new(Resp)
+	_, err := dsd.Load(msg.Data.CompileData(), response)
+	if err != nil {
+		return ErrMalformedData.With("failed to parse %s response: %w", op.rpc.Type, err)
+	}
+
+	// Queue response.
+	select {
+	case op.responses <- response:
+		return nil
+	default:
+		return ErrQueueOverflow.With("%s responses are not handled", op.rpc.Type)
+	}
+}
+
+// HandleStop gives the operation the ability to cleanly shut down.
+// The returned error is the error to send to the other side.
+// Should never be called directly. Call Stop() instead.
+func (op *rpcOp[Req, Resp]) HandleStop(err *Error) (errorToSend *Error) {
+	select {
+	case op.ended <- err:
+	default:
+	}
+	return err
+}
+
+// rpcHandlerOp is the remote side of an RPC operation.
+type rpcHandlerOp[Req, Resp any] struct {
+	OperationBase
+
+	rpc       *RPC[Req, Resp]
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+}
+
+func (rpc *RPC[Req, Resp]) start(t Terminal, opID uint32, data *container.Container) (Operation, *Error) {
+	// Parse request. An empty request is the zero value.
+	request := new(Req)
+	if data.HoldsData() {
+		_, err := dsd.Load(data.CompileData(), request)
+		if err != nil {
+			return nil, ErrMalformedData.With("failed to parse %s request: %w", rpc.Type, err)
+		}
+	}
+
+	// Create operation.
+	op := &rpcHandlerOp[Req, Resp]{
+		rpc: rpc,
+	}
+	op.InitOperationBase(t, opID)
+	op.SetWeightClass(rpc.WeightClass)
+	op.ctx, op.cancelCtx = context.WithTimeout(t.Ctx(), rpc.timeout())
+
+	// Handle request in worker.
+	module.StartWorker(rpc.Type+" operation", func(_ context.Context) error {
+		tErr := rpc.Handler(op.ctx, t, request, op.send)
+		op.Stop(op, tErr)
+		return nil
+	})
+
+	return op, nil
+}
+
+// Type returns the type ID.
+func (op *rpcHandlerOp[Req, Resp]) Type() string {
+	return op.rpc.Type
+}
+
+// send sends a response to the local side.
+func (op *rpcHandlerOp[Req, Resp]) send(response *Resp) *Error {
+	if op.Stopped() {
+		return ErrStopping
+	}
+
+	data, err := dsd.Dump(response, dsd.CBOR)
+	if err != nil {
+		return ErrInternalError.With("failed to pack %s response: %w", op.rpc.Type, err)
+	}
+
+	return op.Send(op.NewMsg(data), op.rpc.timeout())
+}
+
+// Deliver delivers a message to the operation.
+func (op *rpcHandlerOp[Req, Resp]) Deliver(msg *Msg) *Error {
+	msg.Finish()
+	return ErrIncorrectUsage.With("%s operation does not accept data after the request", op.rpc.Type)
+}
+
+// HandleStop gives the operation the ability to cleanly shut down.
+// The returned error is the error to send to the other side.
+// Should never be called directly. Call Stop() instead.
+func (op *rpcHandlerOp[Req, Resp]) HandleStop(err *Error) (errorToSend *Error) {
+	op.cancelCtx()
+	return err
+}
@@ -0,0 +1,102 @@
+package terminal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testRPCRequest struct {
+	Count int
+	Fail  bool
+	Block bool
+}
+
+type testRPCResponse struct {
+	Num int
+}
+
+var testRPC = &RPC[testRPCRequest, testRPCResponse]{
+	Type:    "test/rpc",
+	Timeout: 3 * time.Second,
+	Handler: func(ctx context.Context, _ Terminal, request *testRPCRequest, send func(*testRPCResponse) *Error) *Error {
+		for i := 1; i <= request.Count; i++ {
+			if tErr := send(&testRPCResponse{Num: i}); tErr != nil {
+				return tErr
+			}
+		}
+		switch {
+		case request.Fail:
+			return ErrPermissionDenied.With("test failure")
+		case request.Block:
+			<-ctx.Done()
+			return ErrCanceled
+		}
+		return nil
+	},
+}
+
+var testRPCRestricted = &RPC[testRPCRequest, testRPCResponse]{
+	Type:     "test/rpc/restricted",
+	Requires: IsHubOwner,
+	Handler: func(_ context.Context, _ Terminal, _ *testRPCRequest, send func(*testRPCResponse) *Error) *Error {
+		return send(&testRPCResponse{})
+	},
+}
+
+func init() {
+	testRPC.Register()
+	testRPCRestricted.Register()
+}
+
+func TestRPCOperation(t *testing.T) {
+	t.Parallel()
+
+	a, _, err := NewSimpleTestTerminalPair(0, 0, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// Call returns the first response.
+	resp, tErr := testRPC.Call(ctx, a, &testRPCRequest{Count: 1})
+	require.Nil(t, tErr)
+	assert.Equal(t, 1, resp.Num)
+
+	// Stream receives all responses in order.
+	var received []int
+	tErr = testRPC.Stream(ctx, a, &testRPCRequest{Count: 50}, func(r *testRPCResponse) *Error {
+		received = append(received, r.Num)
+		return nil
+	})
+	require.Nil(t, tErr)
+	require.Len(t, received, 50)
+	assert.Equal(t, 50, received[49])
+
+	// Call finishes on the first response, even if the remote side does not
+	// stop the operation.
+	started := time.Now()
+	resp, tErr = testRPC.Call(ctx, a, &testRPCRequest{Count: 1, Block: true})
+	require.Nil(t, tErr)
+	assert.Equal(t, 1, resp.Num)
+	assert.Less(t, time.Since(started), time.Second, "call should not wait for the operation to end")
+
+	// Handler errors are returned.
+	_, tErr = testRPC.Call(ctx, a, &testRPCRequest{Fail: true})
+	assert.ErrorIs(t, tErr, ErrPermissionDenied)
+
+	// A call without response fails.
+	_, tErr = testRPC.Call(ctx, a, nil)
+	assert.ErrorIs(t, tErr, ErrIncorrectUsage)
+
+	// Canceling the context stops the operation.
+	cancelCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, tErr = testRPC.Call(cancelCtx, a, &testRPCRequest{Block: true})
+	assert.ErrorIs(t, tErr, ErrTimeout)
+
+	// Required permissions are enforced.
+	_, tErr = testRPCRestricted.Call(ctx, a, nil)
+	assert.ErrorIs(t, tErr, ErrPermissionDenied)
+}
@@ -0,0 +1,307 @@
+package terminal
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/jess"
+	"github.com/safing/portbase/container"
+	"github.com/safing/portbase/formats/varint"
+	"github.com/safing/portbase/log"
+)
+
+/*
+
+Terminal Re-Keying:
+
+Encrypted terminals with version 2 that agreed on CapabilityRekey periodically
+switch to new jess wire sessions, as requested by the re-key options of the
+local terminal. Every new session exchanges a new ephemeral key of the local
+terminal with the exchange key currently announced by the remote Hub, so that
+a compromised session key only exposes the traffic of one session.
+
+Re-keying does not provide forward secrecy beyond the lifetime of the Hub's
+exchange keys: The remote side of the key exchange is not ephemeral, so a
+compromised exchange key of the Hub exposes all sessions established with it.
+Hubs replace their exchange keys regularly and burn them after they expired,
+which limits this exposure to a couple of days (see cabin/keys.go).
+
+Re-keying is always initiated by the local terminal, as only it can create new
+sessions to the remote Hub. Every direction switches sessions independently
+with a terminal control message that marks the last terminal message sent with
+the previous session:
+
+- ControlTypeRekey:
+	- Handshake [bytes; only when initiating]: first letter of the new session
+
+1. The local terminal creates a new session, sends the rekey control message
+   with the first letter of the new session and then switches to the new
+   session for sending.
+2. The remote terminal creates its new session from the received letter and
+   switches to it for receiving after the terminal message with the rekey
+   control message was handled. It then sends an empty rekey control message
+   and switches to the new session for sending.
+3. The local terminal switches to the new session for receiving after the
+   terminal message with the empty rekey control message was handled.
+
+As the handshake of the new session is sent within the previous session, an
+observer additionally needs the keys of the previous session in order to
+follow the switch to the new session.
+
+*/
+
+const (
+	// CapabilityRekey is the capability to switch to new encryption sessions.
+	CapabilityRekey Capability = 1 << 3
+
+	// ControlTypeRekey is used to switch to new encryption sessions.
+	ControlTypeRekey uint8 = 6
+
+	// DefaultRekeyInterval is the default interval after which cranes and
+	// expansion terminals switch to new encryption sessions.
+	DefaultRekeyInterval = 10 * time.Minute
+
+	// DefaultRekeyBytes is the default amount of encrypted and decrypted bytes
+	// after which cranes and expansion terminals switch to new encryption
+	// sessions.
+	DefaultRekeyBytes = 1 << 30 // 1GiB
+
+	// minRekeyInterval and minRekeyBytes define the minimum re-key options, as
+	// every re-key requires a full key exchange.
+	minRekeyInterval = time.Minute
+	minRekeyBytes    = 1 << 20 // 1MiB
+)
+
+// rekeyCheckInterval defines how often the re-key options are checked.
+// It is only changed for testing.
+var rekeyCheckInterval = 10 * time.Second
+
+func init() {
+	supportedCapabilities |= CapabilityRekey
+}
+
+var (
+	// rekeyPolicyInterval and rekeyPolicyBytes hold the re-key options used
+	// by crane controllers and expansion terminals.
+	rekeyPolicyInterval atomic.Int64
+	rekeyPolicyBytes    atomic.Uint64
+)
+
+func init() {
+	SetRekeyPolicy(DefaultRekeyInterval, DefaultRekeyBytes)
+}
+
+// SetRekeyPolicy sets after which duration and after how many encrypted and
+// decrypted bytes cranes and expansion terminals switch to new encryption
+// sessions.
+// Zero disables the respective trigger. Values are raised to the permitted
+// minimum.
+func SetRekeyPolicy(interval time.Duration, bytes uint64) {
+	if interval != 0 && interval < minRekeyInterval {
+		interval = minRekeyInterval
+	}
+	if bytes != 0 && bytes < minRekeyBytes {
+		bytes = minRekeyBytes
+	}
+	rekeyPolicyInterval.Store(int64(interval))
+	rekeyPolicyBytes.Store(bytes)
+}
+
+// Rekeys returns how often the terminal switched to new encryption sessions.
+func (t *TerminalBase) Rekeys() uint32 {
+	return t.rekeys.Load()
+}
+
+// startRekeying starts re-keying, if requested and agreed on.
+// Must only be called on local terminals.
+func (t *TerminalBase) startRekeying() {
+	if t.remoteHub == nil ||
+		(t.opts.RekeyInterval == 0 && t.opts.RekeyBytes == 0) ||
+		!t.HasCapability(CapabilityRekey) {
+		return
+	}
+
+	module.StartWorker("terminal re-keying", t.rekeyWorker)
+}
+
+func (t *TerminalBase) rekeyWorker(_ context.Context) error {
+	ticker := time.NewTicker(rekeyCheckInterval)
+	defer ticker.Stop()
+
+	lastRekey := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.ctx.Done():
+			return nil
+		}
+
+		// Check if a re-key is due.
+		switch {
+		case t.opts.RekeyInterval > 0 && time.Since(lastRekey) >= t.opts.RekeyInterval:
+		case t.opts.RekeyBytes > 0 && t.rekeyBytes.Load() >= t.opts.RekeyBytes:
+		default:
+			continue
+		}
+
+		tErr := t.rekey()
+		switch {
+		case tErr == nil:
+			lastRekey = time.Now()
+		case tErr.Is(ErrStopping):
+			return nil
+		case tErr.Is(ErrHubNotReady):
+			// Retry with the next check, as the Hub might announce new
+			// exchange keys with its next status update.
+			log.Warningf("spn/terminal: %s failed to re-key: %s", t.FmtID(), tErr)
+		default:
+			t.Abandon(tErr.Wrap("failed to re-key"))
+			return nil
+		}
+	}
+}
+
+// rekey starts switching to a new encryption session, which uses the exchange
+// key currently announced by the remote Hub.
+// It is a no-op if the previous re-key has not yet finished.
+// Must only be called on local terminals.
+func (t *TerminalBase) rekey() *Error {
+	// Create the new session and its first letter.
+	next, tErr := newSession(t.remoteHub)
+	if tErr != nil {
+		return tErr
+	}
+	handshake, err := next.Close(nil)
+	if err != nil {
+		return ErrIntegrity.With("failed to create handshake: %w", err)
+	}
+	handshakeData, err := handshake.ToWire()
+	if err != nil {
+		return ErrInternalError.With("failed to pack handshake: %w", err)
+	}
+
+	// Prepare switching sessions.
+	t.jessionLock.Lock()
+	if t.rekeySendNext != nil || t.rekeyRecvNext != nil {
+		t.jessionLock.Unlock()
+		return nil
+	}
+	t.rekeySendNext = next
+	t.rekeyRecvNext = next
+	t.jessionLock.Unlock()
+
+	t.rekeyBytes.Store(0)
+	return t.sendRekeyMsg(handshakeData.CompileData())
+}
+
+// sendRekeyMsg sends a rekey control message, after which the sender
+// switches to the prepared session.
+func (t *TerminalBase) sendRekeyMsg(handshake []byte) *Error {
+	msg := NewEmptyMsg()
+	msg.FlowID = terminalControlOpID
+	msg.Type = MsgTypeData
+	msg.Data = container.New(varint.Pack8(ControlTypeRekey), handshake)
+	msg.Unit.MakeHighPriority()
+	msg.weightClass = WeightClassInteractive
+	msg.switchSession = true
+
+	return t.Send(msg, 0)
+}
+
+// handleRekeyMsg handles a rekey control message.
+func (t *TerminalBase) handleRekeyMsg(data *container.Container) *Error {
+	if !t.opts.Encrypt || !t.acceptsCapability(CapabilityRekey) {
+		return ErrIncorrectUsage.With("received rekey without agreed re-keying")
+	}
+
+	t.jessionLock.Lock()
+	defer t.jessionLock.Unlock()
+
+	if t.rekeyRecvSwitch {
+		return ErrIncorrectUsage.With("received duplicate rekey")
+	}
+
+	// Handle the reply of the remote terminal.
+	if !data.HoldsData() {
+		if t.rekeyRecvNext == nil {
+			return ErrIncorrectUsage.With("received unexpected rekey reply")
+		}
+		t.rekeyRecvSwitch = true
+		return nil
+	}
+
+	// Otherwise, the local terminal initiated a re-key.
+	if t.identity == nil {
+		return ErrIncorrectUsage.With("received rekey on local terminal")
+	}
+	if t.rekeySendNext != nil || t.rekeyRecvNext != nil {
+		return ErrIncorrectUsage.With("received rekey while re-keying")
+	}
+
+	// Create new session from the handshake.
+	handshake, err := jess.LetterFromWire(data)
+	if err != nil {
+		return ErrMalformedData.With("failed to parse rekey handshake: %w", err)
+	}
+	next, err := handshake.WireCorrespondence(t.identity)
+	if err != nil {
+		return ErrIntegrity.With("failed to initialize new session: %w", err)
+	}
+	if _, err := next.Open(handshake); err != nil {
+		return ErrIntegrity.With("failed to open rekey handshake: %w", err)
+	}
+	t.rekeySendNext = next
+	t.rekeyRecvNext = next
+	t.rekeyRecvSwitch = true
+
+	// Reply in a worker, as the handler must not block.
+	module.StartWorker("reply to terminal rekey", func(_ context.Context) error {
+		tErr := t.sendRekeyMsg(nil)
+		if tErr != nil && !tErr.IsOK() && !tErr.Is(ErrStopping) {
+			t.Abandon(tErr.Wrap("failed to reply to rekey"))
+		}
+		return nil
+	})
+
+	return nil
+}
+
+// switchSendSession switches to the prepared session for sending.
+// Must only be called by the sender after a rekey control message was sent.
+func (t *TerminalBase) switchSendSession() {
+	t.jessionLock.Lock()
+	defer t.jessionLock.Unlock()
+
+	if t.rekeySendNext == nil {
+		log.Warningf("spn/terminal: %s sent rekey without prepared session", t.FmtID())
+		return
+	}
+	t.jession = t.rekeySendNext
+	t.rekeySendNext = nil
+	t.finishRekey()
+}
+
+// switchRecvSession switches to the prepared session for receiving, if a
+// rekey control message was received.
+// Must only be called by the handler after a terminal message was handled.
+func (t *TerminalBase) switchRecvSession() {
+	t.jessionLock.Lock()
+	defer t.jessionLock.Unlock()
+
+	if !t.rekeyRecvSwitch {
+		return
+	}
+	t.recvJession = t.rekeyRecvNext
+	t.rekeyRecvNext = nil
+	t.rekeyRecvSwitch = false
+	t.finishRekey()
+}
+
+// finishRekey counts the re-key when both directions switched sessions.
+// Must be called with jessionLock held.
+func (t *TerminalBase) finishRekey() {
+	if t.rekeySendNext == nil && t.rekeyRecvNext == nil {
+		t.rekeys.Add(1)
+	}
+}
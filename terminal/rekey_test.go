@@ -0,0 +1,140 @@
+package terminal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/safing/portbase/container"
+	"github.com/safing/spn/cabin"
+)
+
+func TestRekey(t *testing.T) {
+	t.Parallel()
+
+	identity, erro := cabin.CreateIdentity(module.Ctx, "test")
+	require.NoError(t, erro)
+
+	// Create encrypted terminals.
+	a, b := createRekeyTestTerminals(t, identity)
+	defer a.Abandon(nil)
+	defer b.Abandon(nil)
+
+	// Re-key continuously while traffic is flowing in both directions.
+	// The capabilities are reported with the first encrypted reply.
+	ctx, cancel := context.WithCancel(module.Ctx)
+	rekeyDone := make(chan struct{})
+	go func() {
+		defer close(rekeyDone)
+		for {
+			select {
+			case <-time.After(5 * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
+			if !a.HasCapability(CapabilityRekey) {
+				continue
+			}
+			if tErr := a.rekey(); tErr != nil {
+				t.Errorf("failed to re-key: %s", tErr)
+				return
+			}
+		}
+	}()
+	testTerminalWithCounters(t, a, b, &testWithCounterOpts{
+		testName:        "rekey",
+		clientCountTo:   defaultTestQueueSize * 10,
+		serverCountTo:   defaultTestQueueSize * 10,
+		waitBetweenMsgs: time.Millisecond,
+	})
+	cancel()
+	<-rekeyDone
+
+	// Both sides must have switched sessions.
+	assert.Greater(t, a.Rekeys(), uint32(1), "local should have re-keyed")
+	assert.Greater(t, b.Rekeys(), uint32(1), "remote should have re-keyed")
+	assert.True(t, a.Abandoning.IsNotSet(), "local should not be abandoned")
+	assert.True(t, b.Abandoning.IsNotSet(), "remote should not be abandoned")
+
+	// Re-key options are limited.
+	assert.NotNil(t, (&TerminalOpts{RekeyInterval: time.Second}).Check(true), "rekey interval should be limited")
+	assert.NotNil(t, (&TerminalOpts{RekeyBytes: 1024}).Check(true), "rekey bytes should be limited")
+}
+
+func TestRekeyWithNewExchangeKey(t *testing.T) {
+	t.Parallel()
+
+	identity, erro := cabin.CreateIdentity(module.Ctx, "test")
+	require.NoError(t, erro)
+
+	a, b := createRekeyTestTerminals(t, identity)
+	defer a.Abandon(nil)
+	defer b.Abandon(nil)
+
+	// Wait for the capabilities, which are reported with the first encrypted reply.
+	testTerminalWithCounters(t, a, b, &testWithCounterOpts{
+		testName:      "rekey-before-key-change",
+		clientCountTo: 10,
+		serverCountTo: 10,
+	})
+	require.True(t, a.HasCapability(CapabilityRekey), "rekey should be agreed on")
+
+	// Replace the exchange keys of the Hub and burn the previous ones.
+	identity.Lock()
+	newStatus := identity.Hub.Status.Copy()
+	changed, erro := identity.MaintainExchKeys(newStatus, time.Now().Add(7*24*time.Hour))
+	identity.Unlock()
+	require.NoError(t, erro)
+	require.True(t, changed, "exchange keys should have changed")
+	identity.Hub.Lock()
+	identity.Hub.Status = newStatus
+	identity.Hub.Unlock()
+
+	// Re-key with the new exchange key.
+	require.Nil(t, a.rekey())
+	testTerminalWithCounters(t, a, b, &testWithCounterOpts{
+		testName:      "rekey-after-key-change",
+		clientCountTo: 10,
+		serverCountTo: 10,
+	})
+	assert.Equal(t, uint32(1), a.Rekeys(), "local should have re-keyed")
+	assert.Equal(t, uint32(1), b.Rekeys(), "remote should have re-keyed")
+	assert.True(t, a.Abandoning.IsNotSet(), "local should not be abandoned")
+	assert.True(t, b.Abandoning.IsNotSet(), "remote should not be abandoned")
+}
+
+func createRekeyTestTerminals(t *testing.T, identity *cabin.Identity) (a, b *TestTerminal) {
+	t.Helper()
+
+	opts := &TerminalOpts{
+		Version:         2,
+		Encrypt:         true,
+		Padding:         defaultTestPadding,
+		FlowControl:     FlowControlDFQ,
+		FlowControlSize: defaultTestQueueSize,
+		Compress:        true,
+	}
+	var initData *container.Container
+	var tErr *Error
+	a, initData, tErr = NewLocalTestTerminal(
+		module.Ctx, 127, "a", identity.Hub, opts, createForwardingUpstream(
+			t, "a", "b", func(msg *Msg) *Error {
+				return b.Deliver(msg)
+			},
+		),
+	)
+	require.Nil(t, tErr)
+	b, _, tErr = NewRemoteTestTerminal(
+		module.Ctx, 127, "b", identity, initData, createForwardingUpstream(
+			t, "b", "a", func(msg *Msg) *Error {
+				return a.Deliver(msg)
+			},
+		),
+	)
+	require.Nil(t, tErr)
+
+	return a, b
+}
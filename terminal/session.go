@@ -11,6 +11,7 @@ import (
 )
 
 const (
+	// Default rate limits. See RateLimitPolicy.
 	rateLimitMinOps          = 250
 	rateLimitMaxOpsPerSecond = 5
 
@@ -40,6 +41,10 @@ type Session struct {
 	// Rate limited operations because of suspicion are also counted as 1.
 	suspicionScore atomic.Int64
 
+	// permission holds the permissions granted to the session, which select
+	// the rate limit policy.
+	permission atomic.Uint32
+
 	concurrencyPool chan struct{}
 }
 
@@ -69,6 +74,14 @@ func (t *SessionAddOn) GetSession() *Session {
 	return t.session
 }
 
+// CurrentSession returns the terminal's session, if it exists.
+func (t *SessionAddOn) CurrentSession() *Session {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.session
+}
+
 // NewSession returns a new session.
 func NewSession() *Session {
 	return &Session{
@@ -89,15 +102,37 @@ func (s *Session) RateLimitInfo() string {
 	)
 }
 
+// GrantPermission adds the given permissions to the session.
+func (s *Session) GrantPermission(grant Permission) {
+	for {
+		current := s.permission.Load()
+		if s.permission.CompareAndSwap(current, current|uint32(grant)) {
+			return
+		}
+	}
+}
+
+// Permission returns the permissions granted to the session.
+func (s *Session) Permission() Permission {
+	return Permission(s.permission.Load())
+}
+
+// RateLimitPolicy returns the rate limit policy that currently applies to the
+// session.
+func (s *Session) RateLimitPolicy() *RateLimitPolicy {
+	return GetRateLimitPolicy(s.Permission())
+}
+
 // RateLimit enforces a rate and suspicion limit.
 func (s *Session) RateLimit() *Error {
 	secondsActive := time.Now().Unix() - s.started
+	policy := s.RateLimitPolicy()
 
 	// Check the suspicion limit.
 	score := s.suspicionScore.Load()
-	if score > rateLimitMinSuspicion {
+	if score > policy.MinSuspicion {
 		scorePerSecond := score / secondsActive
-		if scorePerSecond >= rateLimitMaxSuspicionPerSecond {
+		if scorePerSecond >= policy.MaxSuspicionPerSecond {
 			// Add current try to suspicion score.
 			s.suspicionScore.Add(1)
 
@@ -106,7 +141,7 @@ func (s *Session) RateLimit() *Error {
 
 		// Permanently rate limit if suspicion goes over the perma min limit and
 		// the suspicion score is greater than 80% of the operation count.
-		if score > rateLimitMinPermaSuspicion &&
+		if score > policy.MinPermaSuspicion &&
 			score*5 > s.opCount.Load()*4 { // Think: 80*5 == 100*4
 			return ErrRateLimited
 		}
@@ -114,9 +149,9 @@ func (s *Session) RateLimit() *Error {
 
 	// Check the rate limit.
 	count := s.opCount.Add(1)
-	if count > rateLimitMinOps {
+	if count > policy.MinOps {
 		opsPerSecond := count / secondsActive
-		if opsPerSecond >= rateLimitMaxOpsPerSecond {
+		if opsPerSecond >= policy.MaxOpsPerSecond {
 			return ErrRateLimited
 		}
 	}
@@ -124,6 +159,34 @@ func (s *Session) RateLimit() *Error {
 	return nil
 }
 
+// SessionStats holds the rate limiting counters of a session.
+type SessionStats struct {
+	Started            time.Time
+	Permission         Permission
+	OpCount            int64
+	OpsPerSecond       int64
+	SuspicionScore     int64
+	SuspicionPerSecond int64
+	Policy             *RateLimitPolicy
+}
+
+// Stats returns the current rate limiting counters of the session.
+func (s *Session) Stats() *SessionStats {
+	secondsActive := time.Now().Unix() - s.started
+	opCount := s.opCount.Load()
+	suspicionScore := s.suspicionScore.Load()
+
+	return &SessionStats{
+		Started:            time.Unix(s.started, 0),
+		Permission:         s.Permission(),
+		OpCount:            opCount,
+		OpsPerSecond:       opCount / secondsActive,
+		SuspicionScore:     suspicionScore,
+		SuspicionPerSecond: suspicionScore / secondsActive,
+		Policy:             s.RateLimitPolicy(),
+	}
+}
+
 // Suspicion Factors.
 const (
 	SusFactorCommon          = 1
@@ -0,0 +1,164 @@
+package terminal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"strings"
+	"sync"
+)
+
+// RateLimitPolicy defines the operation rate and suspicion limits of a
+// session. Zero values are replaced by the default policy values.
+type RateLimitPolicy struct {
+	// MinOps is the amount of operations that are always permitted.
+	MinOps int64 `json:"minOps,omitempty"`
+	// MaxOpsPerSecond is the average rate of operations at which operations
+	// are rate limited.
+	MaxOpsPerSecond int64 `json:"maxOpsPerSecond,omitempty"`
+
+	// MinSuspicion is the suspicion score that is always tolerated.
+	MinSuspicion int64 `json:"minSuspicion,omitempty"`
+	// MinPermaSuspicion is the suspicion score at which the session is
+	// permanently rate limited, if most operations were suspicious.
+	MinPermaSuspicion int64 `json:"minPermaSuspicion,omitempty"`
+	// MaxSuspicionPerSecond is the average suspicion score rate at which
+	// operations are rate limited.
+	MaxSuspicionPerSecond int64 `json:"maxSuspicionPerSecond,omitempty"`
+}
+
+// DefaultRateLimitPolicy returns the default rate limit policy.
+func DefaultRateLimitPolicy() *RateLimitPolicy {
+	return &RateLimitPolicy{
+		MinOps:                rateLimitMinOps,
+		MaxOpsPerSecond:       rateLimitMaxOpsPerSecond,
+		MinSuspicion:          rateLimitMinSuspicion,
+		MinPermaSuspicion:     rateLimitMinPermaSuspicion,
+		MaxSuspicionPerSecond: rateLimitMaxSuspicionPerSecond,
+	}
+}
+
+// withDefaults returns a copy of the policy with all unset values set to the
+// default values.
+func (p *RateLimitPolicy) withDefaults() *RateLimitPolicy {
+	policy := DefaultRateLimitPolicy()
+	if p.MinOps > 0 {
+		policy.MinOps = p.MinOps
+	}
+	if p.MaxOpsPerSecond > 0 {
+		policy.MaxOpsPerSecond = p.MaxOpsPerSecond
+	}
+	if p.MinSuspicion > 0 {
+		policy.MinSuspicion = p.MinSuspicion
+	}
+	if p.MinPermaSuspicion > 0 {
+		policy.MinPermaSuspicion = p.MinPermaSuspicion
+	}
+	if p.MaxSuspicionPerSecond > 0 {
+		policy.MaxSuspicionPerSecond = p.MaxSuspicionPerSecond
+	}
+	return policy
+}
+
+var (
+	rateLimitPolicies     = make(map[Permission]*RateLimitPolicy)
+	rateLimitPoliciesLock sync.RWMutex
+
+	defaultRateLimitPolicy = DefaultRateLimitPolicy()
+)
+
+// SetRateLimitPolicies replaces all rate limit policies. The policies are
+// selected by the permissions granted to a session. The policy for
+// NoPermission applies to sessions without any granted permissions.
+func SetRateLimitPolicies(policies map[Permission]*RateLimitPolicy) {
+	rateLimitPoliciesLock.Lock()
+	defer rateLimitPoliciesLock.Unlock()
+
+	rateLimitPolicies = make(map[Permission]*RateLimitPolicy, len(policies))
+	for permission, policy := range policies {
+		if policy != nil {
+			rateLimitPolicies[permission] = policy.withDefaults()
+		}
+	}
+}
+
+// GetRateLimitPolicies returns a copy of all rate limit policies.
+func GetRateLimitPolicies() map[Permission]*RateLimitPolicy {
+	rateLimitPoliciesLock.RLock()
+	defer rateLimitPoliciesLock.RUnlock()
+
+	policies := make(map[Permission]*RateLimitPolicy, len(rateLimitPolicies))
+	for permission, policy := range rateLimitPolicies {
+		copied := *policy
+		policies[permission] = &copied
+	}
+	return policies
+}
+
+// GetRateLimitPolicy returns the rate limit policy for the given granted
+// permissions. If multiple policies match, the policy requiring the most
+// permissions is used. If none match, the default policy is returned.
+// The returned policy must not be modified.
+func GetRateLimitPolicy(granted Permission) *RateLimitPolicy {
+	rateLimitPoliciesLock.RLock()
+	defer rateLimitPoliciesLock.RUnlock()
+
+	var (
+		selected     *RateLimitPolicy
+		selectedBits int
+	)
+	for permission, policy := range rateLimitPolicies {
+		if !granted.Has(permission) {
+			continue
+		}
+		setBits := bits.OnesCount16(uint16(permission))
+		if selected == nil || setBits > selectedBits {
+			selected = policy
+			selectedBits = setBits
+		}
+	}
+
+	if selected == nil {
+		return defaultRateLimitPolicy
+	}
+	return selected
+}
+
+// permissionNames maps permission names, as used in rate limit policy
+// configuration, to permissions.
+var permissionNames = map[string]Permission{
+	"none":              NoPermission,
+	"mayExpand":         MayExpand,
+	"mayConnect":        MayConnect,
+	"isHubOwner":        IsHubOwner,
+	"isHubAdvisor":      IsHubAdvisor,
+	"isCraneController": IsCraneController,
+}
+
+// ParseRateLimitPolicies parses rate limit policies from JSON. The policies
+// are keyed by permission names, which may be combined with "+", eg.
+// {"mayConnect+mayExpand": {"maxOpsPerSecond": 10}}.
+func ParseRateLimitPolicies(data []byte) (map[Permission]*RateLimitPolicy, error) {
+	var raw map[string]*RateLimitPolicy
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse rate limit policies: %w", err)
+	}
+
+	policies := make(map[Permission]*RateLimitPolicy, len(raw))
+	for key, policy := range raw {
+		var permission Permission
+		for _, name := range strings.Split(key, "+") {
+			p, ok := permissionNames[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown permission %q in rate limit policies", name)
+			}
+			permission |= p
+		}
+		if policy == nil {
+			return nil, fmt.Errorf("missing rate limit policy for %q", key)
+		}
+		policies[permission] = policy
+	}
+
+	return policies, nil
+}
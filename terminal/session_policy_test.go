@@ -0,0 +1,48 @@
+package terminal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitPolicies(t *testing.T) { //nolint:paralleltest // Changes global policies.
+	defer SetRateLimitPolicies(nil)
+
+	policies, err := ParseRateLimitPolicies([]byte(`{
+		"none": {"maxOpsPerSecond": 2},
+		"mayConnect": {"minOps": 1000},
+		"mayConnect+mayExpand": {"minOps": 2000, "maxOpsPerSecond": 20}
+	}`))
+	require.NoError(t, err)
+	SetRateLimitPolicies(policies)
+
+	// Without matching permissions, the "none" policy is used.
+	policy := GetRateLimitPolicy(IsHubOwner)
+	assert.Equal(t, int64(2), policy.MaxOpsPerSecond)
+	assert.Equal(t, int64(rateLimitMinOps), policy.MinOps, "unset values should use defaults")
+
+	// The most specific matching policy is used.
+	assert.Equal(t, int64(1000), GetRateLimitPolicy(MayConnect).MinOps)
+	assert.Equal(t, int64(2000), GetRateLimitPolicy(MayConnect|MayExpand|IsHubOwner).MinOps)
+
+	// Sessions use the policy of their granted permissions.
+	s := NewSession()
+	for i := 0; i < 1000; i++ {
+		s.GrantPermission(MayConnect)
+		if tErr := s.RateLimit(); tErr != nil {
+			t.Fatalf("should not rate limit within min limit: %s", tErr)
+		}
+	}
+	assert.Equal(t, MayConnect, s.Permission())
+	assert.Equal(t, int64(1000), s.Stats().OpCount)
+
+	// Unknown permissions are rejected.
+	_, err = ParseRateLimitPolicies([]byte(`{"mayFly": {"minOps": 1}}`))
+	assert.Error(t, err)
+
+	// Without policies, the default policy is used.
+	SetRateLimitPolicies(nil)
+	assert.Equal(t, DefaultRateLimitPolicy(), GetRateLimitPolicy(MayConnect))
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/safing/portbase/rng"
 	"github.com/safing/spn/cabin"
 	"github.com/safing/spn/conf"
+	"github.com/safing/spn/hub"
 )
 
 const (
@@ -82,8 +83,8 @@ type TerminalBase struct { //nolint:golint,maligned // Being explicit is helpful
 
 	// ext holds the extended terminal so that the base terminal can access custom functions.
 	ext Terminal
-	// sendQueue holds message to be sent.
-	sendQueue chan *Msg
+	// sendQueue schedules messages to be sent.
+	sendQueue *weightedSendQueue
 	// flowControl holds the flow control system.
 	flowControl FlowControl
 	// upstream represents the upstream (parent) terminal.
@@ -112,12 +113,29 @@ type TerminalBase struct { //nolint:golint,maligned // Being explicit is helpful
 
 	// jession is the jess session used for encryption.
 	jession *jess.Session
-	// jessionLock locks jession.
+	// recvJession is the jess session used for decryption.
+	// It only differs from jession while re-keying.
+	recvJession *jess.Session
+	// jessionLock locks jession, recvJession and the re-keying state.
 	jessionLock sync.Mutex
 	// encryptionReady is set when the encryption is ready for sending messages.
 	encryptionReady chan struct{}
 	// identity is the identity used by a remote Terminal.
 	identity *cabin.Identity
+	// remoteHub is used by a local Terminal to create new sessions for re-keying.
+	remoteHub *hub.Hub
+
+	// rekeySendNext and rekeyRecvNext hold the sessions to switch to when
+	// re-keying.
+	rekeySendNext *jess.Session
+	rekeyRecvNext *jess.Session
+	// rekeyRecvSwitch signifies that the other side switched sessions after
+	// the terminal message that is currently handled.
+	rekeyRecvSwitch bool
+	// rekeyBytes counts the bytes encrypted and decrypted since the last re-key.
+	rekeyBytes atomic.Uint64
+	// rekeys counts the finished re-keys.
+	rekeys atomic.Uint32
 
 	// operations holds references to all active operations that require persistence.
 	operations map[uint32]Operation
@@ -129,6 +147,18 @@ type TerminalBase struct { //nolint:golint,maligned // Being explicit is helpful
 	// opts holds the terminal options. It must not be modified after the terminal
 	// has started.
 	opts *TerminalOpts
+	// capabilities holds the capabilities agreed on by both sides.
+	capabilities atomic.Uint32
+	// sentBytes counts the operative bytes sent for shaping cover traffic.
+	sentBytes atomic.Uint64
+	// tracer records message headers, if tracing is enabled.
+	tracer atomic.Pointer[Tracer]
+	// lastReceived holds the time of the last received message in unix
+	// nanoseconds for detecting dead peers.
+	lastReceived atomic.Int64
+	// deadPeerCallback is called when the other side stopped responding to
+	// keepalives.
+	deadPeerCallback func()
 
 	// lastUnknownOpID holds the operation ID of the last data message received
 	// for an unknown operation ID.
@@ -156,7 +186,7 @@ func createTerminalBase(
 	t := &TerminalBase{
 		id:              id,
 		parentID:        parentID,
-		sendQueue:       make(chan *Msg),
+		sendQueue:       newWeightedSendQueue(),
 		upstream:        upstream,
 		waitForFlush:    abool.New(),
 		flush:           make(chan func()),
@@ -183,6 +213,10 @@ func createTerminalBase(
 		t.flowControl = NewDuplexFlowQueue(t.Ctx(), initMsg.FlowControlSize, t.submitToUpstream)
 		t.deliverProxy = t.flowControl.Deliver
 		t.recvProxy = t.flowControl.Receive
+	case FlowControlCFQ:
+		t.flowControl = NewCongestionFlowQueue(t.Ctx(), initMsg.FlowControlSize, t.submitToUpstream)
+		t.deliverProxy = t.flowControl.Deliver
+		t.recvProxy = t.flowControl.Receive
 	case FlowControlNone:
 		deliver := make(chan *Msg, initMsg.FlowControlSize)
 		t.deliverProxy = MakeDirectDeliveryDeliverFunc(ctx, deliver)
@@ -273,6 +307,7 @@ func (t *TerminalBase) Handler(_ context.Context) error {
 			}
 
 		case msg = <-t.recvProxy():
+			t.lastReceived.Store(time.Now().UnixNano())
 			err := t.handleReceive(msg)
 			if err != nil {
 				t.Abandon(err.Wrap("failed to handle"))
@@ -351,12 +386,12 @@ func (t *TerminalBase) Sender(_ context.Context) error {
 	defer msgBufferMsg.Finish()
 
 	// Only receive message when not sending the current msg buffer.
-	sendQueueOpMsgs := func() <-chan *Msg {
+	sendQueueOpMsgs := func() <-chan struct{} {
 		// Don't handle more messages, if the buffer is full.
 		if msgBufferLimitReached {
 			return nil
 		}
-		return t.sendQueue
+		return t.sendQueue.ready()
 	}
 
 	// Only wait for sending slot when the current msg buffer is ready to be sent.
@@ -399,11 +434,31 @@ handling:
 				atomic.StoreUint32(t.idleCounter, 0)
 			}
 
-		case msg := <-sendQueueOpMsgs():
+		case <-sendQueueOpMsgs():
+			msg := t.sendQueue.next()
 			if msg == nil {
 				continue handling
 			}
 
+			// Count operative data for cover traffic.
+			// Terminal control messages, including cover traffic, are not counted.
+			if msg.FlowID != terminalControlOpID {
+				t.sentBytes.Add(uint64(msg.Data.Length()))
+			}
+
+			// Record message header if tracing.
+			if tracer := t.tracer.Load(); tracer != nil {
+				tracer.record(TraceOut, t.id, msg.FlowID, msg.Type, msg.Data.Length())
+			}
+
+			// Compress data of operations that permit it.
+			// Every message is compressed on its own, never the whole batch.
+			if msg.compress &&
+				(msg.Type == MsgTypeData || msg.Type == MsgTypePriorityData) &&
+				t.shouldCompress() {
+				compressMsg(msg)
+			}
+
 			// Add unit to buffer unit, or use it as new buffer.
 			if msgBufferMsg != nil {
 				// Pack, append and finish additional message.
@@ -553,7 +608,10 @@ func (t *TerminalBase) encrypt(c *container.Container) (*container.Container, *E
 	t.jessionLock.Lock()
 	defer t.jessionLock.Unlock()
 
-	letter, err := t.jession.Close(c.CompileData())
+	data := c.CompileData()
+	t.rekeyBytes.Add(uint64(len(data)))
+
+	letter, err := t.jession.Close(data)
 	if err != nil {
 		return nil, ErrIntegrity.With("failed to encrypt: %w", err)
 	}
@@ -590,18 +648,22 @@ func (t *TerminalBase) decrypt(c *container.Container) (*container.Container, *E
 		if err != nil {
 			return nil, ErrIntegrity.With("failed to initialize incoming encryption: %w", err)
 		}
+		t.recvJession = t.jession
 
-		// Don't need that anymore.
-		t.identity = nil
+		// Don't need that anymore, unless needed for re-keying.
+		if !t.acceptsCapability(CapabilityRekey) {
+			t.identity = nil
+		}
 
 		// Encryption is ready for sending.
 		close(t.encryptionReady)
 	}
 
-	decryptedData, err := t.jession.Open(letter)
+	decryptedData, err := t.recvJession.Open(letter)
 	if err != nil {
 		return nil, ErrIntegrity.With("failed to decrypt: %w", err)
 	}
+	t.rekeyBytes.Add(uint64(len(decryptedData)))
 
 	return container.New(decryptedData), nil
 }
@@ -627,27 +689,41 @@ func (t *TerminalBase) handleReceive(msg *Msg) *Error {
 	}
 
 	// Handle operation messages.
-	for msg.Data.HoldsData() {
+	tErr = t.handleOpMsgs(msg.Data)
+	if tErr != nil {
+		return tErr
+	}
+
+	// Switch to the next session if the other side re-keyed.
+	if t.opts.Encrypt {
+		t.switchRecvSession()
+	}
+	return nil
+}
+
+// handleOpMsgs handles all operation messages in the given container.
+func (t *TerminalBase) handleOpMsgs(c *container.Container) *Error {
+	for c.HoldsData() {
 		// Get next message length.
-		msgLength, err := msg.Data.GetNextN32()
+		msgLength, err := c.GetNextN32()
 		if err != nil {
 			return ErrMalformedData.With("failed to get operation msg length: %w", err)
 		}
 		if msgLength == 0 {
 			// Remainder is padding.
 			// Padding can only be at the end of the segment.
-			t.handlePaddingMsg(msg.Data)
+			t.handlePaddingMsg(c)
 			return nil
 		}
 
 		// Get op msg data.
-		msgData, err := msg.Data.GetAsContainer(int(msgLength))
+		msgData, err := c.GetAsContainer(int(msgLength))
 		if err != nil {
-			return ErrMalformedData.With("failed to get operation msg data (%d/%d bytes): %w", msg.Data.Length(), msgLength, err)
+			return ErrMalformedData.With("failed to get operation msg data (%d/%d bytes): %w", c.Length(), msgLength, err)
 		}
 
 		// Handle op msg.
-		if handleErr := t.handleOpMsg(msgData); handleErr != nil {
+		if handleErr := t.handleOpMsg(msgData, false); handleErr != nil {
 			return handleErr
 		}
 	}
@@ -655,7 +731,9 @@ func (t *TerminalBase) handleReceive(msg *Msg) *Error {
 	return nil
 }
 
-func (t *TerminalBase) handleOpMsg(data *container.Container) *Error {
+// handleOpMsg handles a single operation message.
+// Decompressed operation messages may only be data messages of operations.
+func (t *TerminalBase) handleOpMsg(data *container.Container, decompressed bool) *Error {
 	// Debugging:
 	// log.Errorf("spn/terminal %s handling opmsg: %s", t.FmtID(), spew.Sdump(data.CompileData()))
 
@@ -664,6 +742,18 @@ func (t *TerminalBase) handleOpMsg(data *container.Container) *Error {
 	if err != nil {
 		return ErrMalformedData.With("failed to parse operation msg id/type: %w", err)
 	}
+	if decompressed &&
+		(opID == terminalControlOpID || (msgType != MsgTypeData && msgType != MsgTypePriorityData)) {
+		return ErrMalformedData.With("compressed data may only hold operation data")
+	}
+	if tracer := t.tracer.Load(); tracer != nil {
+		tracer.record(TraceIn, t.id, opID, msgType, data.Length())
+	}
+
+	// Handle terminal control messages.
+	if opID == terminalControlOpID && msgType == MsgTypeData && t.opts.Version >= 2 {
+		return t.handleControlMsg(data)
+	}
 
 	switch msgType {
 	case MsgTypeInit:
@@ -773,6 +863,11 @@ func (t *TerminalBase) sendOpMsgs(msg *Msg) *Error {
 		return tErr
 	}
 
+	// Switch to the next session, if a rekey control message was sent.
+	if msg.switchSession && t.opts.Encrypt {
+		t.switchSendSession()
+	}
+
 	// Send data.
 	t.submit(msg, 0)
 	return nil
@@ -25,6 +25,7 @@ func TestTerminals(t *testing.T) {
 	for _, encrypt := range []bool{false, true} {
 		// Test with different flow controls.
 		for _, fc := range []struct {
+			version         uint8
 			flowControl     FlowControlType
 			flowControlSize uint32
 		}{
@@ -36,9 +37,15 @@ func TestTerminals(t *testing.T) {
 				flowControl:     FlowControlDFQ,
 				flowControlSize: defaultTestQueueSize,
 			},
+			{
+				version:         2,
+				flowControl:     FlowControlCFQ,
+				flowControlSize: defaultTestQueueSize,
+			},
 		} {
 			// Run tests with combined options.
 			testTerminals(t, identity, &TerminalOpts{
+				Version:         fc.version,
 				Encrypt:         encrypt,
 				Padding:         defaultTestPadding,
 				FlowControl:     fc.flowControl,
@@ -46,6 +53,16 @@ func TestTerminals(t *testing.T) {
 			})
 		}
 	}
+
+	// Test with compression.
+	testTerminals(t, identity, &TerminalOpts{
+		Version:         2,
+		Encrypt:         true,
+		Padding:         defaultTestPadding,
+		FlowControl:     FlowControlDFQ,
+		FlowControlSize: defaultTestQueueSize,
+		Compress:        true,
+	})
 }
 
 func testTerminals(t *testing.T, identity *cabin.Identity, terminalOpts *TerminalOpts) {
@@ -88,9 +105,10 @@ func testTerminals(t *testing.T, identity *cabin.Identity, terminalOpts *Termina
 	// Start testing with counters.
 	countToQueueSize := uint64(terminalOpts.FlowControlSize)
 	optionsSuffix := fmt.Sprintf(
-		"encrypt=%v,flowType=%d",
+		"encrypt=%v,flowType=%d,compress=%v",
 		terminalOpts.Encrypt,
 		terminalOpts.FlowControl,
+		terminalOpts.Compress,
 	)
 
 	testTerminalWithCounters(t, term1, term2, &testWithCounterOpts{
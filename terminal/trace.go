@@ -0,0 +1,278 @@
+package terminal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tevino/abool"
+)
+
+/*
+
+Terminal Message Tracing:
+
+A Tracer records the headers of the decrypted operation messages of the
+terminals it is assigned to into a ring buffer. Tracing is opt-in and is
+assigned per crane, so that all terminals of a crane share a tracer.
+
+Outgoing messages are recorded before compression, padding and encryption.
+Incoming messages are recorded after decryption and decompression. Padding is
+not recorded.
+
+The records can be exported as JSON lines or as pcapng. The pcapng export
+uses the link type LINKTYPE_USER0 (147) and the following packet format:
+
+- Direction [uint8; 1 = in, 2 = out]
+- MsgType [uint8]
+- Reserved [uint16]
+- Terminal ID [uint32; big endian]
+- Operation ID [uint32; big endian]
+- Length [uint32; big endian]
+
+*/
+
+const (
+	// DefaultTraceSize is the default amount of records a tracer keeps.
+	DefaultTraceSize = 10000
+
+	// MaxTraceSize is the maximum amount of records a tracer may keep.
+	MaxTraceSize = 1000000
+)
+
+// TraceDirection is the direction of a traced message.
+type TraceDirection uint8
+
+// Trace Directions.
+const (
+	TraceIn  TraceDirection = 1
+	TraceOut TraceDirection = 2
+)
+
+func (d TraceDirection) String() string {
+	switch d {
+	case TraceIn:
+		return "in"
+	case TraceOut:
+		return "out"
+	default:
+		return "unknown"
+	}
+}
+
+// TraceRecord holds the header of a traced operation message.
+type TraceRecord struct {
+	Time       time.Time
+	Direction  TraceDirection
+	TerminalID uint32
+	OpID       uint32
+	MsgType    MsgType
+	// Length is the length of the message data, excluding the header.
+	Length uint32
+}
+
+// Tracer records terminal message headers into a ring buffer.
+type Tracer struct {
+	lock    sync.Mutex
+	records []TraceRecord
+	next    int
+	full    bool
+
+	started time.Time
+	active  *abool.AtomicBool
+}
+
+// NewTracer returns a new active tracer that keeps the given amount of
+// records.
+func NewTracer(size int) *Tracer {
+	switch {
+	case size <= 0:
+		size = DefaultTraceSize
+	case size > MaxTraceSize:
+		size = MaxTraceSize
+	}
+
+	return &Tracer{
+		records: make([]TraceRecord, size),
+		started: time.Now(),
+		active:  abool.NewBool(true),
+	}
+}
+
+// Stop stops recording. Existing records are kept.
+func (tr *Tracer) Stop() {
+	tr.active.UnSet()
+}
+
+// Active returns whether the tracer is recording.
+func (tr *Tracer) Active() bool {
+	return tr.active.IsSet()
+}
+
+// Started returns when the tracer was created.
+func (tr *Tracer) Started() time.Time {
+	return tr.started
+}
+
+// Size returns the amount of records the tracer keeps.
+func (tr *Tracer) Size() int {
+	return len(tr.records)
+}
+
+func (tr *Tracer) record(dir TraceDirection, terminalID, opID uint32, msgType MsgType, length int) {
+	if !tr.active.IsSet() {
+		return
+	}
+
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	tr.records[tr.next] = TraceRecord{
+		Time:       time.Now(),
+		Direction:  dir,
+		TerminalID: terminalID,
+		OpID:       opID,
+		MsgType:    msgType,
+		Length:     uint32(length),
+	}
+	tr.next++
+	if tr.next >= len(tr.records) {
+		tr.next = 0
+		tr.full = true
+	}
+}
+
+// Records returns a copy of all records, ordered from oldest to newest.
+func (tr *Tracer) Records() []TraceRecord {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	if !tr.full {
+		return append([]TraceRecord(nil), tr.records[:tr.next]...)
+	}
+
+	records := make([]TraceRecord, 0, len(tr.records))
+	records = append(records, tr.records[tr.next:]...)
+	return append(records, tr.records[:tr.next]...)
+}
+
+// SetTracer sets the tracer to record the terminal's messages with.
+// Pass nil to disable tracing.
+func (t *TerminalBase) SetTracer(tracer *Tracer) {
+	t.tracer.Store(tracer)
+}
+
+// traceRecordJSON is the JSON export format of a trace record.
+type traceRecordJSON struct {
+	Time       time.Time `json:"time"`
+	Direction  string    `json:"dir"`
+	TerminalID uint32    `json:"terminal"`
+	OpID       uint32    `json:"op"`
+	MsgType    string    `json:"type"`
+	Length     uint32    `json:"len"`
+}
+
+func fmtTraceMsgType(msgType MsgType) string {
+	switch msgType {
+	case MsgTypeInit:
+		return "init"
+	case MsgTypeData:
+		return "data"
+	case MsgTypePriorityData:
+		return "prio"
+	case MsgTypeStop:
+		return "stop"
+	default:
+		return "unknown"
+	}
+}
+
+// WriteJSONL writes all records as JSON lines.
+func (tr *Tracer) WriteJSONL(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, r := range tr.Records() {
+		if err := enc.Encode(traceRecordJSON{
+			Time:       r.Time,
+			Direction:  r.Direction.String(),
+			TerminalID: r.TerminalID,
+			OpID:       r.OpID,
+			MsgType:    fmtTraceMsgType(r.MsgType),
+			Length:     r.Length,
+		}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+const (
+	pcapngBlockTypeSHB = 0x0A0D0D0A
+	pcapngBlockTypeIDB = 0x00000001
+	pcapngBlockTypeEPB = 0x00000006
+	pcapngByteOrder    = 0x1A2B3C4D
+	pcapngLinkTypeUser = 147
+
+	tracePacketSize = 16
+)
+
+// WritePcapng writes all records as a pcapng file.
+func (tr *Tracer) WritePcapng(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	le := binary.LittleEndian
+
+	// Section Header Block.
+	shb := make([]byte, 28)
+	le.PutUint32(shb[0:], pcapngBlockTypeSHB)
+	le.PutUint32(shb[4:], 28)
+	le.PutUint32(shb[8:], pcapngByteOrder)
+	le.PutUint16(shb[12:], 1)                  // Major version.
+	le.PutUint16(shb[14:], 0)                  // Minor version.
+	le.PutUint64(shb[16:], 0xFFFFFFFFFFFFFFFF) // Section length unknown.
+	le.PutUint32(shb[24:], 28)
+	if _, err := bw.Write(shb); err != nil {
+		return err
+	}
+
+	// Interface Description Block.
+	idb := make([]byte, 20)
+	le.PutUint32(idb[0:], pcapngBlockTypeIDB)
+	le.PutUint32(idb[4:], 20)
+	le.PutUint16(idb[8:], pcapngLinkTypeUser)
+	le.PutUint32(idb[12:], 0) // No snap length limit.
+	le.PutUint32(idb[16:], 20)
+	if _, err := bw.Write(idb); err != nil {
+		return err
+	}
+
+	// Enhanced Packet Blocks.
+	epb := make([]byte, 32+tracePacketSize)
+	for _, r := range tr.Records() {
+		ts := uint64(r.Time.UnixMicro())
+		le.PutUint32(epb[0:], pcapngBlockTypeEPB)
+		le.PutUint32(epb[4:], uint32(len(epb)))
+		le.PutUint32(epb[8:], 0) // Interface ID.
+		le.PutUint32(epb[12:], uint32(ts>>32))
+		le.PutUint32(epb[16:], uint32(ts))
+		le.PutUint32(epb[20:], tracePacketSize)
+		le.PutUint32(epb[24:], tracePacketSize)
+
+		packet := epb[28 : 28+tracePacketSize]
+		packet[0] = byte(r.Direction)
+		packet[1] = byte(r.MsgType)
+		packet[2], packet[3] = 0, 0
+		binary.BigEndian.PutUint32(packet[4:], r.TerminalID)
+		binary.BigEndian.PutUint32(packet[8:], r.OpID)
+		binary.BigEndian.PutUint32(packet[12:], r.Length)
+
+		le.PutUint32(epb[28+tracePacketSize:], uint32(len(epb)))
+		if _, err := bw.Write(epb); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
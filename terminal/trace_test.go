@@ -0,0 +1,94 @@
+package terminal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/safing/portbase/container"
+)
+
+func TestTracer(t *testing.T) {
+	t.Parallel()
+
+	// Create traced terminals.
+	var a, b *TestTerminal
+	aTracer := NewTracer(10)
+	bTracer := NewTracer(10)
+	opts := &TerminalOpts{
+		Version:         2,
+		FlowControl:     FlowControlDFQ,
+		FlowControlSize: defaultTestQueueSize,
+	}
+	var initData *container.Container
+	var tErr *Error
+	a, initData, tErr = NewLocalTestTerminal(
+		module.Ctx, 127, "a", nil, opts, UpstreamSendFunc(func(msg *Msg, _ time.Duration) *Error {
+			return b.Deliver(msg)
+		}),
+	)
+	require.Nil(t, tErr)
+	a.SetTracer(aTracer)
+	b, _, tErr = NewRemoteTestTerminal(
+		module.Ctx, 127, "b", nil, initData, UpstreamSendFunc(func(msg *Msg, _ time.Duration) *Error {
+			return a.Deliver(msg)
+		}),
+	)
+	require.Nil(t, tErr)
+	b.SetTracer(bTracer)
+	defer a.Abandon(nil)
+	defer b.Abandon(nil)
+
+	// The remote reports the agreed capabilities with a control message.
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, bTracer.Records(), 1)
+	sent := bTracer.Records()[0]
+	assert.Equal(t, TraceOut, sent.Direction)
+	assert.Equal(t, uint32(terminalControlOpID), sent.OpID)
+	assert.Equal(t, MsgTypeData, sent.MsgType)
+	require.Len(t, aTracer.Records(), 1)
+	received := aTracer.Records()[0]
+	assert.Equal(t, TraceIn, received.Direction)
+	assert.Equal(t, sent.Length, received.Length)
+
+	// The ring buffer keeps the newest records in order.
+	tr := NewTracer(3)
+	for i := 1; i <= 5; i++ {
+		tr.record(TraceOut, 1, uint32(i*4), MsgTypeData, i)
+	}
+	records := tr.Records()
+	require.Len(t, records, 3)
+	assert.Equal(t, uint32(12), records[0].OpID)
+	assert.Equal(t, uint32(20), records[2].OpID)
+
+	// Stopped tracers do not record.
+	tr.Stop()
+	tr.record(TraceOut, 1, 24, MsgTypeData, 6)
+	assert.Equal(t, uint32(20), tr.Records()[2].OpID)
+
+	// Export as JSON lines.
+	buf := &bytes.Buffer{}
+	require.NoError(t, tr.WriteJSONL(buf))
+	scanner := bufio.NewScanner(buf)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+	}
+	assert.Equal(t, 3, lines)
+	assert.Equal(t, "out", tr.Records()[0].Direction.String())
+
+	// Export as pcapng.
+	buf.Reset()
+	require.NoError(t, tr.WritePcapng(buf))
+	pcap := buf.Bytes()
+	assert.Equal(t, 28+20+3*(32+tracePacketSize), len(pcap))
+	assert.Equal(t, uint32(pcapngBlockTypeSHB), binary.LittleEndian.Uint32(pcap))
+	firstPacket := pcap[28+20+28:]
+	assert.Equal(t, byte(TraceOut), firstPacket[0])
+	assert.Equal(t, uint32(12), binary.BigEndian.Uint32(firstPacket[8:]))
+}
@@ -0,0 +1,150 @@
+package terminal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WeightClass is the weight class of an operation, which defines its share of
+// the terminal's sending capacity.
+type WeightClass uint8
+
+// Weight Classes.
+const (
+	// WeightClassBulk is the default weight class for operations.
+	WeightClassBulk WeightClass = 0
+	// WeightClassInteractive is for latency sensitive operations, like DNS or
+	// remote shells.
+	WeightClassInteractive WeightClass = 1
+	// WeightClassBackground is for operations that may be delayed in favor of
+	// all other operations.
+	WeightClassBackground WeightClass = 2
+
+	weightClassCount = 3
+)
+
+// weightClassWeights holds the weights of the weight classes.
+var weightClassWeights = [weightClassCount]uint64{
+	WeightClassBulk:        4,
+	WeightClassInteractive: 16,
+	WeightClassBackground:  1,
+}
+
+// IsValid returns whether the weight class is known.
+func (wc WeightClass) IsValid() bool {
+	return wc < weightClassCount
+}
+
+func (wc WeightClass) String() string {
+	switch wc {
+	case WeightClassBulk:
+		return "bulk"
+	case WeightClassInteractive:
+		return "interactive"
+	case WeightClassBackground:
+		return "background"
+	default:
+		return "unknown"
+	}
+}
+
+// weightedStrideBase is divided by the weight to get the stride of a class.
+const weightedStrideBase = 1 << 16
+
+// weightedSendQueue schedules the messages of a terminal by the weight class
+// of their operation with weighted fair queuing.
+// Messages are not buffered, but are handed over directly from the sending
+// operations to the terminal's sender, which keeps sending blocking.
+//
+// Every weight class has a pass value, which is increased by the size of each
+// sent message divided by the weight of the class. The waiting class with the
+// lowest pass value is served first.
+type weightedSendQueue struct {
+	queues [weightClassCount]chan *Msg
+	// pass and vtime are only accessed by the sender.
+	pass  [weightClassCount]uint64
+	vtime uint64
+
+	// waiting holds the number of messages waiting to be sent.
+	waiting atomic.Int32
+	// wake is used to wake the sender when a message is waiting.
+	wake chan struct{}
+}
+
+func newWeightedSendQueue() *weightedSendQueue {
+	q := &weightedSendQueue{
+		wake: make(chan struct{}, 1),
+	}
+	for i := range q.queues {
+		q.queues[i] = make(chan *Msg)
+	}
+	return q
+}
+
+// send hands the message over to the sender.
+func (q *weightedSendQueue) send(msg *Msg, timeout time.Duration, done <-chan struct{}) *Error {
+	queue := q.queues[msg.weightClass]
+
+	// Announce waiting message and wake the sender.
+	// The sender decreases the waiting counter when taking the message.
+	q.waiting.Add(1)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	// Wait for the sender to take the message.
+	select {
+	case queue <- msg:
+		return nil
+	case <-TimedOut(timeout):
+		q.waiting.Add(-1)
+		msg.Finish()
+		return ErrTimeout.With("sending via terminal")
+	case <-done:
+		q.waiting.Add(-1)
+		msg.Finish()
+		return ErrStopping
+	}
+}
+
+// ready returns a channel that can be read when a message might be waiting.
+func (q *weightedSendQueue) ready() <-chan struct{} {
+	if q.waiting.Load() > 0 {
+		return ready
+	}
+	return q.wake
+}
+
+// next returns the next message to send, if one is waiting.
+// Must only be called by the sender.
+func (q *weightedSendQueue) next() *Msg {
+	// Order weight classes by their pass.
+	var order [weightClassCount]WeightClass
+	for i := range order {
+		order[i] = WeightClass(i)
+		for j := i; j > 0 && q.pass[order[j]] < q.pass[order[j-1]]; j-- {
+			order[j], order[j-1] = order[j-1], order[j]
+		}
+	}
+
+	// Take the message from the waiting class with the lowest pass.
+	for _, wc := range order {
+		select {
+		case msg := <-q.queues[wc]:
+			q.waiting.Add(-1)
+			q.vtime = q.pass[wc]
+			if msg.Data != nil {
+				q.pass[wc] += uint64(msg.Data.Length()) * (weightedStrideBase / weightClassWeights[wc])
+			}
+			return msg
+		default:
+			// Idle classes must not save up their share.
+			if q.pass[wc] < q.vtime {
+				q.pass[wc] = q.vtime
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package terminal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedSendQueue(t *testing.T) {
+	t.Parallel()
+
+	q := newWeightedSendQueue()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Continuously send messages of all weight classes.
+	for wc := WeightClass(0); wc < weightClassCount; wc++ {
+		go func(wc WeightClass) {
+			for ctx.Err() == nil {
+				msg := NewMsg(make([]byte, 100))
+				msg.weightClass = wc
+				_ = q.send(msg, 0, ctx.Done())
+			}
+		}(wc)
+	}
+
+	// Receive messages and count them by weight class.
+	// Give the senders time to wait again, so that no class is idle.
+	var received [weightClassCount]int
+	for i := 0; i < 210; i++ {
+		time.Sleep(time.Millisecond)
+		select {
+		case <-q.ready():
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+		msg := q.next()
+		if msg == nil {
+			i--
+			continue
+		}
+		received[msg.weightClass]++
+		msg.Finish()
+	}
+
+	// Check that the classes were served by their weight.
+	assert.InDelta(t, 160, received[WeightClassInteractive], 10, "interactive should get 16/21")
+	assert.InDelta(t, 40, received[WeightClassBulk], 10, "bulk should get 4/21")
+	assert.InDelta(t, 10, received[WeightClassBackground], 10, "background should get 1/21")
+}